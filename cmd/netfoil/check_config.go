@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/tinfoil-factory/netfoil/internal/dns"
+)
+
+const checkConfigUsage = `SYNOPSIS
+    netfoil check-config [OPTIONS]
+
+    Validate a config directory without binding any sockets. Every problem found is
+    reported as <file>:<line>: <message>. Exits 1 if the config is invalid.
+
+OPTIONS
+        --config-directory
+			Config directory (default: /etc/netfoil).
+
+        --json
+			Print the result as JSON (default: false).
+
+        --help, -h
+			Print the help message.
+
+Example
+    $ netfoil check-config --config-directory packaging/config`
+
+type checkConfigResult struct {
+	Valid    bool                `json:"valid"`
+	Errors   []checkConfigError  `json:"errors"`
+	Warnings []checkConfigError  `json:"warnings"`
+	Imports  []checkConfigImport `json:"imports"`
+}
+
+type checkConfigImport struct {
+	File     string `json:"file"`
+	Format   string `json:"format"`
+	Exact    int    `json:"exact"`
+	Suffixes int    `json:"suffixes"`
+	Skipped  int    `json:"skipped"`
+}
+
+type checkConfigError struct {
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+func checkConfig(args []string) int {
+	flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+	var help, h, jsonOutput bool
+	var configPath string
+	flags.BoolVar(&help, "help", false, "")
+	flags.BoolVar(&h, "h", false, "")
+	flags.BoolVar(&jsonOutput, "json", false, "")
+	flags.StringVar(&configPath, "config-directory", "/etc/netfoil", "")
+
+	err := flags.Parse(args)
+	if err != nil || help || h {
+		fmt.Println(checkConfigUsage)
+		return 1
+	}
+
+	config, err := dns.ReadConfigFile(configPath)
+	configErrors := dns.ConfigErrors(err)
+
+	// Validate the rule files even if the config file is broken, so that all problems are reported at once
+	denyPunycode := false
+	pinResponseDomain := false
+	if config != nil {
+		denyPunycode = config.DenyPunycode
+		pinResponseDomain = config.PinResponseDomain
+	}
+
+	policy, err := dns.NewPolicy(configPath, denyPunycode, pinResponseDomain)
+	configErrors = append(configErrors, dns.ConfigErrors(err)...)
+
+	result := checkConfigResult{
+		Valid:    len(configErrors) == 0,
+		Errors:   make([]checkConfigError, 0),
+		Warnings: make([]checkConfigError, 0),
+		Imports:  make([]checkConfigImport, 0),
+	}
+
+	for _, configError := range configErrors {
+		result.Errors = append(result.Errors, newCheckConfigError(configError))
+	}
+
+	summaries := make([]dns.ImportSummary, 0)
+	if policy != nil {
+		summaries = policy.ImportSummaries()
+	}
+
+	for _, summary := range summaries {
+		for _, warning := range summary.Warnings {
+			result.Warnings = append(result.Warnings, newCheckConfigError(warning))
+		}
+
+		result.Imports = append(result.Imports, checkConfigImport{
+			File:     summary.Filename,
+			Format:   string(summary.Format),
+			Exact:    summary.Exact,
+			Suffixes: summary.Suffixes,
+			Skipped:  summary.Skipped,
+		})
+	}
+
+	if jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(result)
+		if err != nil {
+			println(err.Error())
+			return 1
+		}
+	} else {
+		for _, configError := range configErrors {
+			fmt.Println(configError.Error())
+		}
+
+		for _, summary := range summaries {
+			for _, warning := range summary.Warnings {
+				fmt.Printf("warning: %s\n", warning.Error())
+			}
+
+			fmt.Printf("%s: %s, %d exact, %d suffixes, %d skipped\n", summary.Filename, summary.Format, summary.Exact, summary.Suffixes, summary.Skipped)
+		}
+
+		if result.Valid {
+			fmt.Printf("%s: OK\n", configPath)
+		}
+	}
+
+	if !result.Valid {
+		return 1
+	}
+
+	return 0
+}
+
+func newCheckConfigError(configError *dns.ConfigError) checkConfigError {
+	return checkConfigError{
+		File:    configError.Filename,
+		Line:    configError.Line,
+		Message: configError.Err.Error(),
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/tinfoil-factory/netfoil/internal/dns"
+)
+
+const ctlUsage = `SYNOPSIS
+    netfoil ctl [OPTIONS] <command> [<argument>...]
+
+    Send a command to a running netfoil over its control socket. Only root and the user netfoil runs as are allowed.
+
+COMMANDS
+        stats
+			Print query and cache counters.
+
+        flush [<domain>]
+			Remove all cached responses, or only those for a domain.
+
+        reload
+			Read the rule files in the config directory again. The config file needs a restart.
+
+        config
+			Print the effective config.
+
+        tail
+			Print a line per query until interrupted, in the same format as the query log.
+
+        recent [client=<ip or prefix>] [name=<domain>] [verdict=<verdict>]
+			Print the recent queries kept in memory with their events, filter reasons and answers, the oldest
+			first. A name also matches the names below it, and the verdict is allow, deny, audit-deny, break-glass
+			or error.
+
+OPTIONS
+        --control-socket
+			Path of the control socket (default: /run/netfoil.control).
+
+        --help, -h
+			Print the help message.
+
+Example
+    $ netfoil ctl flush example.com`
+
+func ctl(args []string) int {
+	flags := flag.NewFlagSet("ctl", flag.ExitOnError)
+	var help, h bool
+	var controlSocket string
+	flags.BoolVar(&help, "help", false, "")
+	flags.BoolVar(&h, "h", false, "")
+	flags.StringVar(&controlSocket, "control-socket", "/run/netfoil.control", "")
+	err := flags.Parse(args)
+	maxArgs := 2
+	if flags.Arg(0) == dns.ControlCommandRecent {
+		maxArgs = 4
+	}
+
+	if err != nil || help || h || flags.NArg() < 1 || flags.NArg() > maxArgs {
+		fmt.Println(ctlUsage)
+		return 1
+	}
+
+	command := flags.Arg(0)
+	switch command {
+	case dns.ControlCommandStats, dns.ControlCommandFlush, dns.ControlCommandReload, dns.ControlCommandConfig, dns.ControlCommandTail, dns.ControlCommandRecent:
+	default:
+		fmt.Println(ctlUsage)
+		return 1
+	}
+
+	conn, err := net.Dial("unix", controlSocket)
+	if err != nil {
+		println(err.Error())
+		return 1
+	}
+	defer conn.Close()
+
+	_, err = fmt.Fprintf(conn, "%s\n", strings.Join(flags.Args(), " "))
+	if err != nil {
+		println(err.Error())
+		return 1
+	}
+
+	streaming := false
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if streaming {
+			fmt.Println(line)
+			continue
+		}
+
+		if line == "ok" {
+			if command != dns.ControlCommandTail {
+				return 0
+			}
+
+			streaming = true
+			continue
+		}
+
+		message, found := strings.CutPrefix(line, "error ")
+		if found {
+			println(message)
+			return 1
+		}
+
+		fmt.Println(line)
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		println(err.Error())
+		return 1
+	}
+
+	if !streaming {
+		println("connection closed without a status")
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tinfoil-factory/netfoil/internal/dns"
+)
+
+const explainUsage = `SYNOPSIS
+    netfoil explain [OPTIONS] <domain> [<type>]
+
+    Evaluate a question against the policy in a config directory without any network access, and print
+    every filter step, including the rule, file and line that matched. The type defaults to A.
+
+OPTIONS
+        --config-directory
+			Config directory (default: /etc/netfoil).
+
+        --response
+			File with a fake response to evaluate, one answer per line (default: empty), e.g.
+			    RCODE NoError
+			    example.com. CNAME cdn.example.com.
+			    cdn.example.com. A 192.0.2.1
+			    example.com. HTTPS 1 . alpn=h2 ipv4hint=192.0.2.1 ech=public.example.com
+
+        --response-wire
+			File with a recorded response in DNS wire format to evaluate (default: empty).
+
+        --client
+			Client address used to select a policy from policies.d (default: empty, the default policy).
+
+        --listen
+			Local address the query is received on, used to select a policy from policies.d (default: empty).
+
+        --time
+			Local time to evaluate schedules at, as YYYY-MM-DDTHH:MM (default: now).
+
+        --help, -h
+			Print the help message.
+
+Example
+    $ netfoil explain --config-directory /etc/netfoil example.com AAAA`
+
+func explain(args []string) int {
+	flags := flag.NewFlagSet("explain", flag.ExitOnError)
+	var help, h bool
+	var configPath, responsePath, responseWirePath, clientString, listenString, timeString string
+	flags.BoolVar(&help, "help", false, "")
+	flags.BoolVar(&h, "h", false, "")
+	flags.StringVar(&configPath, "config-directory", "/etc/netfoil", "")
+	flags.StringVar(&responsePath, "response", "", "")
+	flags.StringVar(&responseWirePath, "response-wire", "", "")
+	flags.StringVar(&clientString, "client", "", "")
+	flags.StringVar(&listenString, "listen", "", "")
+	flags.StringVar(&timeString, "time", "", "")
+
+	// allow options both before and after the positional arguments
+	positional := make([]string, 0)
+	for {
+		err := flags.Parse(args)
+		if err != nil || help || h {
+			fmt.Println(explainUsage)
+			return 1
+		}
+
+		if flags.NArg() == 0 {
+			break
+		}
+
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+
+	if len(positional) < 1 || len(positional) > 2 || (responsePath != "" && responseWirePath != "") {
+		fmt.Println(explainUsage)
+		return 1
+	}
+
+	name := positional[0]
+	if !strings.HasSuffix(name, ".") {
+		name = name + "."
+	}
+
+	recordType := dns.RecordTypeA
+	if len(positional) == 2 {
+		var err error
+		recordType, err = dns.ParseRecordType(positional[1])
+		if err != nil {
+			println(err.Error())
+			return 1
+		}
+	}
+
+	config, err := dns.ReadConfigFile(configPath)
+	if err != nil {
+		println(err.Error())
+		return 1
+	}
+
+	policy, err := dns.NewPolicy(configPath, config.DenyPunycode, config.PinResponseDomain)
+	if err != nil {
+		println(err.Error())
+		return 1
+	}
+
+	client, err := parseOptionalAddr(clientString)
+	if err != nil {
+		println(err.Error())
+		return 1
+	}
+
+	listen, err := parseOptionalAddr(listenString)
+	if err != nil {
+		println(err.Error())
+		return 1
+	}
+
+	if timeString != "" {
+		now, err := time.ParseInLocation("2006-01-02T15:04", timeString, time.Local)
+		if err != nil {
+			println("invalid time: " + timeString)
+			return 1
+		}
+
+		policy.SetClock(func() time.Time {
+			return now
+		})
+	}
+
+	policy = policy.ForClient(client, listen)
+
+	response, err := readExplainResponse(responsePath, responseWirePath)
+	if err != nil {
+		println(err.Error())
+		return 1
+	}
+
+	question := dns.Question{
+		Name:  name,
+		Type:  recordType,
+		Class: dns.ClassTypeIN,
+	}
+
+	explanation := policy.Explain(question, response)
+
+	if policy.Name() != "default" {
+		fmt.Printf("policy %s\n", policy.Name())
+	}
+	fmt.Printf("query %s %s\n", strings.TrimSuffix(name, "."), recordType.Name())
+	printReasons(explanation.QueryReasons)
+	if !explanation.QueryAllowed {
+		printDenyVerdict(explanation)
+		return 0
+	}
+
+	if explanation.Response == nil {
+		fmt.Printf("verdict: allow query, no response given\n")
+		return 0
+	}
+
+	source := "given"
+	if explanation.Pinned {
+		source = "pinned"
+	}
+
+	fmt.Printf("response (%s) [%s]\n", source, explanation.Response.Flags.RCODE.Name())
+	printReasons(explanation.ResponseReasons)
+	if !explanation.ResponseAllowed {
+		printDenyVerdict(explanation)
+		return 0
+	}
+
+	fmt.Printf("verdict: allow\n")
+	return 0
+}
+
+func readExplainResponse(responsePath string, responseWirePath string) (*dns.Response, error) {
+	if responsePath != "" {
+		file, err := os.Open(responsePath)
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := dns.ParseResponseText(file)
+		closeErr := file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", responsePath, err)
+		}
+
+		return response, closeErr
+	}
+
+	if responseWirePath != "" {
+		data, err := os.ReadFile(responseWirePath)
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := dns.UnmarshalResponse(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", responseWirePath, err)
+		}
+
+		return response, nil
+	}
+
+	return nil, nil
+}
+
+func printDenyVerdict(explanation *dns.Explanation) {
+	if explanation.Dropped {
+		fmt.Printf("verdict: deny, no response is sent\n")
+	} else if explanation.Response != nil && !explanation.QueryAllowed {
+		fmt.Printf("verdict: deny, rewritten to %s\n", explanation.Response.Flags.RCODE.Name())
+	} else {
+		fmt.Printf("verdict: deny\n")
+	}
+}
+
+func printReasons(reasons []dns.FilterReason) {
+	for i, reason := range reasons {
+		fmt.Printf("  %d. %s\n", i+1, reason)
+	}
+}
+
+func parseOptionalAddr(s string) (netip.Addr, error) {
+	if s == "" {
+		return netip.Addr{}, nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid IP address: %s", s)
+	}
+
+	return addr, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/tinfoil-factory/netfoil/internal/dns"
+)
+
+const learnUsage = `SYNOPSIS
+    netfoil learn [OPTIONS] [<log file>...]
+
+    Read query logs and propose allow.exact, allow.suffix and pin.response-domain entries for the names that were
+    denied because no allow rule matched. Names are grouped by registrable domain, and a group with enough distinct
+    names is proposed as a suffix. The proposals are printed as a diff against the config directory, to review and
+    apply with patch -p1 -d <config directory>. Logs are read from stdin when no log file is given.
+
+OPTIONS
+        --config-directory
+			Config directory (default: /etc/netfoil).
+
+        --min-count
+			Times a name or CNAME pair must be seen to be proposed (default: 1).
+
+        --suffix-threshold
+			Distinct names below a registrable domain to propose a suffix instead of exact names (default: 3).
+
+        --public-suffix-list
+			Path to the public suffix list (default: empty, the last label is the public suffix).
+
+        --help, -h
+			Print the help message.
+
+Example
+    $ journalctl -u netfoil --since yesterday | netfoil learn --config-directory /etc/netfoil > learn.diff`
+
+func learn(args []string) int {
+	defaults := dns.DefaultLearnOptions()
+
+	flags := flag.NewFlagSet("learn", flag.ExitOnError)
+	var help, h bool
+	var configPath, publicSuffixListPath string
+	var minCount, suffixThreshold int
+	flags.BoolVar(&help, "help", false, "")
+	flags.BoolVar(&h, "h", false, "")
+	flags.StringVar(&configPath, "config-directory", "/etc/netfoil", "")
+	flags.IntVar(&minCount, "min-count", defaults.MinCount, "")
+	flags.IntVar(&suffixThreshold, "suffix-threshold", defaults.SuffixMinNames, "")
+	flags.StringVar(&publicSuffixListPath, "public-suffix-list", "", "")
+	err := flags.Parse(args)
+	if err != nil || help || h || minCount < 1 || suffixThreshold < 1 {
+		fmt.Println(learnUsage)
+		return 1
+	}
+
+	config, err := dns.ReadConfigFile(configPath)
+	if err != nil {
+		println(err.Error())
+		return 1
+	}
+
+	policy, err := dns.NewPolicy(configPath, config.DenyPunycode, config.PinResponseDomain)
+	if err != nil {
+		println(err.Error())
+		return 1
+	}
+
+	options := dns.LearnOptions{
+		MinCount:       minCount,
+		SuffixMinNames: suffixThreshold,
+	}
+
+	if publicSuffixListPath != "" {
+		options.PublicSuffixes, err = dns.ReadPublicSuffixList(publicSuffixListPath)
+		if err != nil {
+			println(err.Error())
+			return 1
+		}
+	}
+
+	queryLog := dns.NewQueryLog()
+	if flags.NArg() == 0 {
+		err = queryLog.Read(os.Stdin)
+		if err != nil {
+			println(err.Error())
+			return 1
+		}
+	}
+
+	for _, path := range flags.Args() {
+		err = readQueryLog(queryLog, path)
+		if err != nil {
+			println(err.Error())
+			return 1
+		}
+	}
+
+	proposals := policy.Propose(queryLog, options)
+	if proposals.Empty() {
+		return 0
+	}
+
+	diff, err := proposals.Diff(configPath)
+	if err != nil {
+		println(err.Error())
+		return 1
+	}
+
+	fmt.Print(diff)
+	return 0
+}
+
+func readQueryLog(queryLog *dns.QueryLog, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	err = queryLog.Read(file)
+	closeErr := file.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return closeErr
+}
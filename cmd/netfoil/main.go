@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"crypto/x509"
 	"flag"
 	"fmt"
 	"log/slog"
 	"net"
 	"os"
+	"os/signal"
 	"syscall"
 	"unsafe"
 
@@ -17,6 +19,11 @@ import (
 
 const usage = `SYNOPSIS
     netfoil [OPTIONS]
+    netfoil check-config [OPTIONS]
+    netfoil explain [OPTIONS] <domain> [<type>]
+    netfoil learn [OPTIONS] [<log file>...]
+    netfoil ctl [OPTIONS] <command> [<argument>...]
+    netfoil verify-log [OPTIONS] <audit log>...
 
 OPTIONS
         --ip
@@ -37,6 +44,18 @@ OPTIONS
         --filter-system-calls
             Apply seccomp filter for system calls (default: false, only supported on x86_64).
 
+        --control-socket
+            Path of the control socket for netfoil ctl (default: empty, no control socket unless passed by systemd).
+
+        --metrics-listen
+            Loopback <ip>:<port> or Unix socket path to serve Prometheus metrics on (default: empty, no metrics).
+
+        --dnstap-socket
+            Path of the Unix socket of a dnstap collector (default: empty, no dnstap).
+
+        --dnstap-file
+            Path of a file to write dnstap to, truncated on start (default: empty, no dnstap).
+
         --help, -h
 			Print the help message.
 
@@ -44,6 +63,21 @@ Example
     $ netfoil --ip 127.0.0.1 --port 53 --config-directory /etc/netfoil`
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check-config":
+			os.Exit(checkConfig(os.Args[2:]))
+		case "explain":
+			os.Exit(explain(os.Args[2:]))
+		case "learn":
+			os.Exit(learn(os.Args[2:]))
+		case "ctl":
+			os.Exit(ctl(os.Args[2:]))
+		case "verify-log":
+			os.Exit(verifyLog(os.Args[2:]))
+		}
+	}
+
 	options, err := processInput()
 	if err != nil {
 		println(err.Error())
@@ -68,7 +102,21 @@ func main() {
 		os.Exit(1)
 	}
 
-	configureLogger(config)
+	redactor, err := dns.NewRedactor(config)
+	if err != nil {
+		println(err.Error())
+		os.Exit(1)
+	}
+
+	err = configureLogger(config, redactor)
+	if err != nil {
+		println(err.Error())
+		os.Exit(1)
+	}
+
+	if !config.Enforce {
+		slog.Warn("audit mode: denials are logged as audit-deny but not enforced")
+	}
 
 	conn, tcpListener, err := systemdSocketListener()
 	if err != nil {
@@ -90,18 +138,125 @@ func main() {
 		os.Exit(1)
 	}
 
+	logImportSummaries(policy)
+
+	// break-glass is off without BreakGlassDuration=, and SIGUSR2 is ignored
+	if config.BreakGlassDuration > 0 {
+		breakGlass := dns.NewBreakGlass(config.BreakGlassDuration, config.BreakGlassFile)
+		policy.SetBreakGlass(breakGlass)
+		watchBreakGlassSignal(breakGlass)
+		breakGlass.WatchFile()
+	} else {
+		signal.Ignore(syscall.SIGUSR2)
+	}
+
+	recent := dns.NewRecentQueries(config.RecentQueries)
+	watchRecentQueriesSignal(recent)
+
+	controlListener, err := controlSocketListener(options.ControlSocket)
+	if err != nil {
+		println(err.Error())
+		os.Exit(1)
+	}
+
+	var control *dns.Control = nil
+	if controlListener != nil {
+		defer controlListener.Close()
+		control = dns.NewControl(controlListener, options.ConfigDirectory, redactor)
+	}
+
+	var metricsListener net.Listener = nil
+	if options.MetricsListen != "" {
+		metricsListener, err = dns.ListenMetrics(options.MetricsListen)
+		if err != nil {
+			println(err.Error())
+			os.Exit(1)
+		}
+		defer metricsListener.Close()
+	}
+
+	var dnstap *dns.Dnstap = nil
+	if options.DnstapSocket != "" {
+		dnstap = dns.NewDnstapSocket(options.DnstapSocket)
+	} else if options.DnstapFile != "" {
+		dnstap, err = dns.NewDnstapFile(options.DnstapFile)
+		if err != nil {
+			println(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	auditLog, err := dns.NewAuditLog(config, redactor)
+	if err != nil {
+		println(err.Error())
+		os.Exit(1)
+	}
+
+	notifier := dns.NewNotifier(config, redactor)
+	if options.FilterSystemCalls && config.NotifyCommand != "" {
+		println("NotifyCommand= cannot run a command with --filter-system-calls, use NotifyURL= instead")
+		os.Exit(1)
+	}
+
+	systemd, err := dns.NewSystemdNotify()
+	if err != nil {
+		println(err.Error())
+		os.Exit(1)
+	}
+
 	// Apply late for a shorter allowlist
-	err = applySystemCallFilter(options.FilterSystemCalls, caCertPool)
+	err = applySystemCallFilter(options.FilterSystemCalls, caCertPool, control != nil || config.BreakGlassFile != "", auditLog != nil)
 	if err != nil {
 		println(err.Error())
 		os.Exit(1)
 	}
 
-	err = dns.Server(conn, tcpListener, config, policy, caCertPool)
+	if dnstap != nil {
+		dnstap.Start()
+	}
+	auditLog.Start()
+	notifier.Start()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	err = dns.Server(ctx, conn, tcpListener, config, policy, caCertPool, dns.ServerOptions{
+		Control:         control,
+		MetricsListener: metricsListener,
+		Dnstap:          dnstap,
+		AuditLog:        auditLog,
+		Recent:          recent,
+		Notifier:        notifier,
+		Systemd:         systemd,
+	})
 	if err != nil {
 		println(err.Error())
 		os.Exit(1)
 	}
+
+	shutdown(config, recent, dnstap, auditLog)
+}
+
+// shutdown writes what is held back once the server stopped. Queued notifications are dropped.
+func shutdown(config *dns.Config, recent *dns.RecentQueries, dnstap *dns.Dnstap, auditLog *dns.AuditLog) {
+	if config.ShutdownDumpRecentQueries {
+		err := recent.Dump(slog.Default().Handler())
+		if err != nil {
+			slog.Warn("failed to write recent queries", "error", err.Error())
+		}
+	}
+
+	dnstap.Stop()
+
+	err := auditLog.Close()
+	if err != nil {
+		slog.Error("failed to close audit log", "error", err.Error())
+	}
+
+	err = dns.FlushLogHandler(slog.Default().Handler())
+	if err != nil {
+		println(err.Error())
+	}
 }
 
 func loadCACertPool(path string) (*x509.CertPool, error) {
@@ -145,7 +300,7 @@ func disableSpeculation(disable bool) error {
 	return nil
 }
 
-func applySystemCallFilter(filter bool, caCertPool *x509.CertPool) error {
+func applySystemCallFilter(filter bool, caCertPool *x509.CertPool, readFiles bool, syncFiles bool) error {
 	if filter {
 		// NoNewPrivs must be applied before the seccomp filter
 		_, _, errInt := syscall.AllThreadsSyscall6(syscall.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, uintptr(1), 0, 0, 0, 0)
@@ -185,6 +340,8 @@ func applySystemCallFilter(filter bool, caCertPool *x509.CertPool) error {
 			unix.SYS_GETSOCKNAME,
 			unix.SYS_GETSOCKOPT,
 			unix.SYS_RECVFROM,
+			unix.SYS_RECVMSG,
+			unix.SYS_SENDMSG,
 			unix.SYS_SENDTO,
 			unix.SYS_SETSOCKOPT,
 			unix.SYS_SOCKET,
@@ -216,12 +373,15 @@ func applySystemCallFilter(filter bool, caCertPool *x509.CertPool) error {
 			unix.SYS_CLOCK_GETTIME,
 		}
 
-		if caCertPool == nil {
+		// the system certificate pool is loaded on first use, and a reload from the control socket and the
+		// break-glass flag file read files later on
+		if caCertPool == nil || readFiles {
 			additionalAllowedSyscalls := []uint32{
 				// @file-system
 				unix.SYS_FCNTL,
 				unix.SYS_FSTAT,
 				unix.SYS_GETDENTS64,
+				unix.SYS_NEWFSTATAT,
 				unix.SYS_OPENAT,
 				unix.SYS_READLINKAT,
 			}
@@ -229,6 +389,11 @@ func applySystemCallFilter(filter bool, caCertPool *x509.CertPool) error {
 			allowedSyscalls = append(allowedSyscalls, additionalAllowedSyscalls...)
 		}
 
+		// the audit log is synced at each checkpoint
+		if syncFiles {
+			allowedSyscalls = append(allowedSyscalls, unix.SYS_FSYNC)
+		}
+
 		instructions := make([]bpf.Instruction, 0)
 
 		syscallOffset := uint32(0)
@@ -285,13 +450,24 @@ func createSeccompProgram(instructions []bpf.Instruction) (*syscall.SockFprog, e
 	return program, nil
 }
 
-func configureLogger(config *dns.Config) {
-	opts := &slog.HandlerOptions{
-		Level: config.LogLevel,
+func configureLogger(config *dns.Config, redactor *dns.Redactor) error {
+	handler, err := dns.NewConfiguredLogHandler(config, os.Stdout, redactor)
+	if err != nil {
+		return err
 	}
 
-	logger := slog.New(slog.NewTextHandler(os.Stdout, opts))
-	slog.SetDefault(logger)
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+func logImportSummaries(policy *dns.Policy) {
+	for _, summary := range policy.ImportSummaries() {
+		for _, warning := range summary.Warnings {
+			slog.Warn("skipped imported entry", "error", warning.Error())
+		}
+
+		slog.Info("imported list", "file", summary.Filename, "format", summary.Format, "exact", summary.Exact, "suffixes", summary.Suffixes, "skipped", summary.Skipped)
+	}
 }
 
 func systemdSocketListener() (*net.UDPConn, *net.TCPListener, error) {
@@ -317,6 +493,56 @@ func systemdSocketListener() (*net.UDPConn, *net.TCPListener, error) {
 	return nil, nil, fmt.Errorf("systemd socket listener not configured")
 }
 
+func watchBreakGlassSignal(breakGlass *dns.BreakGlass) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+
+	go func() {
+		for range signals {
+			breakGlass.Signal()
+		}
+	}()
+}
+
+// watchRecentQueriesSignal writes the recent queries to the log on SIGUSR1.
+func watchRecentQueriesSignal(recent *dns.RecentQueries) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+
+	go func() {
+		for range signals {
+			err := recent.Dump(slog.Default().Handler())
+			if err != nil {
+				slog.Warn("failed to write recent queries", "error", err.Error())
+			}
+		}
+	}()
+}
+
+// controlSocketListener returns the control socket passed by systemd as the third socket, or creates one at path.
+func controlSocketListener(path string) (*net.UnixListener, error) {
+	if os.Getenv("LISTEN_FDS") == "3" {
+		f := os.NewFile(uintptr(5), "netfoil.socket.control")
+		listener, err := net.FileListener(f)
+		if err != nil {
+			return nil, err
+		}
+
+		unixListener, ok := listener.(*net.UnixListener)
+		if !ok {
+			return nil, fmt.Errorf("systemd socket 3 is not a Unix socket")
+		}
+
+		return unixListener, nil
+	}
+
+	if path == "" {
+		return nil, nil
+	}
+
+	return dns.ListenControl(path)
+}
+
 type Options struct {
 	IP                 net.IP
 	Port               int
@@ -324,12 +550,16 @@ type Options struct {
 	DisableSpeculation bool
 	PinCA              string
 	FilterSystemCalls  bool
+	ControlSocket      string
+	MetricsListen      string
+	DnstapSocket       string
+	DnstapFile         string
 }
 
 func processInput() (*Options, error) {
 	flags := flag.NewFlagSet("all", flag.ExitOnError)
 	var help, h, disableSpeculation, filterSystemCalls bool
-	var configPath, ipString, pinCA string
+	var configPath, ipString, pinCA, controlSocket, metricsListen, dnstapSocket, dnstapFile string
 	var portInt int
 	flags.BoolVar(&help, "help", false, "")
 	flags.BoolVar(&h, "h", false, "")
@@ -339,6 +569,10 @@ func processInput() (*Options, error) {
 	flags.StringVar(&ipString, "ip", "127.0.0.1", "")
 	flags.StringVar(&configPath, "config-directory", "/etc/netfoil", "")
 	flags.StringVar(&pinCA, "pin-certificate-authority", "", "")
+	flags.StringVar(&controlSocket, "control-socket", "", "")
+	flags.StringVar(&metricsListen, "metrics-listen", "", "")
+	flags.StringVar(&dnstapSocket, "dnstap-socket", "", "")
+	flags.StringVar(&dnstapFile, "dnstap-file", "", "")
 
 	err := flags.Parse(os.Args[1:])
 	if err != nil || help || h {
@@ -346,6 +580,10 @@ func processInput() (*Options, error) {
 		os.Exit(1)
 	}
 
+	if dnstapSocket != "" && dnstapFile != "" {
+		return nil, fmt.Errorf("--dnstap-socket and --dnstap-file are mutually exclusive")
+	}
+
 	if portInt < 0 || portInt > dns.UINT16_MAX {
 		return nil, fmt.Errorf("invalid port %d", portInt)
 	}
@@ -364,6 +602,10 @@ func processInput() (*Options, error) {
 		DisableSpeculation: disableSpeculation,
 		PinCA:              pinCA,
 		FilterSystemCalls:  filterSystemCalls,
+		ControlSocket:      controlSocket,
+		MetricsListen:      metricsListen,
+		DnstapSocket:       dnstapSocket,
+		DnstapFile:         dnstapFile,
 	}, nil
 }
 
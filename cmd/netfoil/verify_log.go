@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/tinfoil-factory/netfoil/internal/dns"
+)
+
+const verifyLogUsage = `SYNOPSIS
+    netfoil verify-log [OPTIONS] <audit log>...
+
+    Verify the hash chain and the signed checkpoints of audit logs written with AuditLogFile=. Every record that was
+    edited, removed or reordered is reported as <file>: line <line>: <message>. Each file is verified as a chain of
+    its own. Exits 1 if a problem is found.
+
+OPTIONS
+        --public-key
+			Path to the PEM encoded Ed25519 public key of AuditLogKeyFile= (required).
+
+        --help, -h
+			Print the help message.
+
+Example
+    $ netfoil verify-log --public-key audit.pub /var/log/netfoil/audit.log`
+
+func verifyLog(args []string) int {
+	flags := flag.NewFlagSet("verify-log", flag.ExitOnError)
+	var help, h bool
+	var publicKeyPath string
+	flags.BoolVar(&help, "help", false, "")
+	flags.BoolVar(&h, "h", false, "")
+	flags.StringVar(&publicKeyPath, "public-key", "", "")
+
+	err := flags.Parse(args)
+	if err != nil || help || h || publicKeyPath == "" || flags.NArg() == 0 {
+		fmt.Println(verifyLogUsage)
+		return 1
+	}
+
+	publicKey, err := dns.ReadEd25519PublicKey(publicKeyPath)
+	if err != nil {
+		println(err.Error())
+		return 1
+	}
+
+	exitCode := 0
+	for _, path := range flags.Args() {
+		verification, err := verifyLogFile(path, publicKey)
+		if err != nil {
+			println(err.Error())
+			return 1
+		}
+
+		for _, problem := range verification.Problems {
+			fmt.Printf("%s: %s\n", path, problem.Error())
+		}
+
+		fmt.Printf("%s: %d records, %d checkpoints, %d problems\n", path, verification.Records, verification.Checkpoints, len(verification.Problems))
+		if verification.Unverified > 0 {
+			fmt.Printf("%s: %d records were not signed by the run that wrote them\n", path, verification.Unverified)
+		}
+		if verification.Unsigned > 0 {
+			fmt.Printf("%s: %d records after the last checkpoint are not signed yet\n", path, verification.Unsigned)
+		}
+
+		if len(verification.Problems) > 0 {
+			exitCode = 1
+		}
+	}
+
+	return exitCode
+}
+
+func verifyLogFile(path string, publicKey ed25519.PublicKey) (*dns.AuditLogVerification, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return dns.VerifyAuditLog(file, publicKey)
+}
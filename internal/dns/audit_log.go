@@ -0,0 +1,445 @@
+package dns
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The audit log is a file of JSON lines, one per denial, audit denial and break-glass answer. Each record holds the
+// SHA-256 of the line before it, and a checkpoint record signs the sequence number and hash of the line before it with
+// Ed25519. A line that is edited, removed or moved breaks the chain, and a chain that is rewritten as a whole lacks
+// valid signatures. Records after the last checkpoint are only protected by the chain, so removing them at the end of
+// the file cannot be detected.
+//
+// On start, the last checkpoint and the chain of the records after it are verified. Records left unsigned by the
+// previous run, e.g. after a crash, are followed by an unverified record before they are signed, since anyone can edit
+// them and recompute the chain while netfoil is stopped.
+
+const (
+	auditRecordVerdict    = "verdict"
+	auditRecordCheckpoint = "checkpoint"
+	auditRecordUnverified = "unverified"
+
+	auditMaxLineLength = 64 * 1024
+)
+
+// auditGenesisHash is the previous hash of the first record.
+var auditGenesisHash = strings.Repeat("0", 2*sha256.Size)
+
+type auditRecord struct {
+	Seq     uint64   `json:"seq"`
+	Time    string   `json:"time"`
+	Kind    string   `json:"kind"`
+	Client  string   `json:"client,omitempty"`
+	Name    string   `json:"name,omitempty"`
+	Type    string   `json:"type,omitempty"`
+	Verdict string   `json:"verdict,omitempty"`
+	Reasons []string `json:"reasons,omitempty"`
+	// stable, unlike the text of the reasons
+	ReasonCodes []string `json:"reason_codes,omitempty"`
+	// records before an unverified record that were not signed by the run that wrote them
+	Unverified int    `json:"unverified,omitempty"`
+	Prev       string `json:"prev"`
+	Signature  string `json:"signature,omitempty"`
+}
+
+type AuditLog struct {
+	path     string
+	key      ed25519.PrivateKey
+	interval time.Duration
+	redactor *Redactor
+
+	// closed by Close, and by the checkpoint writer of Start once it returned
+	stop    chan struct{}
+	stopped chan struct{}
+
+	mutex    sync.Mutex
+	file     *os.File
+	seq      uint64
+	prev     string
+	unsigned int
+	closed   bool
+}
+
+// NewAuditLog opens the AuditLogFile= of config and continues the chain of the records already in it, so it must be
+// called before system calls are filtered. Records are redacted by redactor.
+func NewAuditLog(config *Config, redactor *Redactor) (*AuditLog, error) {
+	if config.AuditLogFile == "" {
+		return nil, nil
+	}
+
+	key, err := readEd25519PrivateKey(config.AuditLogKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", keyAuditLogKeyFile, err)
+	}
+
+	file, err := os.OpenFile(config.AuditLogFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", keyAuditLogFile, err)
+	}
+
+	auditLog := &AuditLog{
+		path:     config.AuditLogFile,
+		key:      key,
+		interval: config.AuditLogCheckpointInterval,
+		redactor: redactor,
+		file:     file,
+		prev:     auditGenesisHash,
+		stop:     make(chan struct{}),
+	}
+
+	err = auditLog.readTail()
+	if err == nil && auditLog.unsigned > 0 {
+		err = auditLog.append(auditRecord{Kind: auditRecordUnverified, Unverified: auditLog.unsigned})
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("%s: %s: %w", keyAuditLogFile, config.AuditLogFile, err)
+	}
+
+	return auditLog, nil
+}
+
+// readTail finds the sequence number and hash of the last record, and the records after the last checkpoint, which
+// must be signed by the key and followed by an unbroken chain.
+func (a *AuditLog) readTail() error {
+	publicKey := a.key.Public().(ed25519.PublicKey)
+	reader := bufio.NewReaderSize(a.file, auditMaxLineLength)
+
+	var broken error
+	for {
+		line, err := reader.ReadSlice('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				return fmt.Errorf("ends with an incomplete record, move it away to start a new chain")
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("record %d: %w", a.seq+1, err)
+		}
+
+		text := string(line[:len(line)-1])
+		record := auditRecord{}
+		err = json.Unmarshal([]byte(text), &record)
+		if err != nil {
+			return fmt.Errorf("invalid record %d: %w", a.seq+1, err)
+		}
+
+		if broken == nil && (record.Seq != a.seq+1 || record.Prev != a.prev) {
+			broken = fmt.Errorf("record %d does not follow record %d, the records after the last checkpoint are edited, missing or reordered, move it away to start a new chain", record.Seq, a.seq)
+		}
+
+		if record.Kind == auditRecordCheckpoint {
+			signature, err := base64.StdEncoding.DecodeString(record.Signature)
+			if err != nil || !ed25519.Verify(publicKey, auditCheckpointMessage(record.Seq, record.Prev), signature) {
+				broken = fmt.Errorf("invalid signature of checkpoint %d, move it away to start a new chain", record.Seq)
+			} else {
+				// the records before are verified by netfoil verify-log
+				broken = nil
+			}
+			a.unsigned = 0
+		} else {
+			a.unsigned++
+		}
+		a.seq = record.Seq
+		a.prev = auditHash(text)
+	}
+
+	return broken
+}
+
+// Start writes a checkpoint for the unverified record of the previous run, and then one every
+// AuditLogCheckpointInterval= when there are new records.
+func (a *AuditLog) Start() {
+	if a == nil {
+		return
+	}
+
+	a.stopped = make(chan struct{})
+	go func() {
+		defer close(a.stopped)
+
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+
+		for {
+			err := a.checkpoint()
+			if err != nil {
+				slog.Error("failed to write audit log checkpoint", "file", a.path, "error", err.Error())
+			}
+
+			select {
+			case <-a.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Close stops the checkpoints of Start, writes a checkpoint for the records since the last one, so none are left
+// unsigned, and closes the file. Records after Close are dropped.
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+
+	close(a.stop)
+	if a.stopped != nil {
+		<-a.stopped
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	err := a.sign()
+	closeErr := a.file.Close()
+	a.closed = true
+	if err != nil || closeErr != nil {
+		return fmt.Errorf("%s: %w", a.path, errors.Join(err, closeErr))
+	}
+
+	return nil
+}
+
+// record appends the verdict of result, allowed queries are not recorded.
+func (a *AuditLog) record(result workerResult) error {
+	if a == nil || result.question == nil {
+		return nil
+	}
+
+	verdict := result.verdict()
+	reasons := result.filterReasons
+	switch verdict {
+	case verdictAllow:
+		return nil
+	case verdictAuditDeny:
+		reasons = result.auditReasons
+	}
+
+	return a.append(auditRecord{
+		Kind:        auditRecordVerdict,
+		Client:      a.redactor.client(result.client),
+		Name:        a.redactor.name(strings.TrimSuffix(result.question.Name, ".")),
+		Type:        result.question.Type.Name(),
+		Verdict:     verdict,
+		Reasons:     a.redactor.reasons(reasonStrings(reasons)),
+		ReasonCodes: reasonCodes(reasons),
+	})
+}
+
+func (a *AuditLog) checkpoint() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.sign()
+}
+
+// sign writes a checkpoint when there are unsigned records, with a.mutex held.
+func (a *AuditLog) sign() error {
+	if a.closed || a.unsigned == 0 {
+		return nil
+	}
+
+	err := a.write(auditRecord{Kind: auditRecordCheckpoint})
+	if err != nil {
+		return err
+	}
+
+	return a.file.Sync()
+}
+
+func (a *AuditLog) append(record auditRecord) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.closed {
+		return nil
+	}
+
+	return a.write(record)
+}
+
+// write writes record after the last one, with a.mutex held.
+func (a *AuditLog) write(record auditRecord) error {
+	record.Seq = a.seq + 1
+	record.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	record.Prev = a.prev
+	if record.Kind == auditRecordCheckpoint {
+		record.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(a.key, auditCheckpointMessage(record.Seq, record.Prev)))
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = a.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+
+	a.seq = record.Seq
+	a.prev = auditHash(string(line))
+	if record.Kind == auditRecordCheckpoint {
+		a.unsigned = 0
+	} else {
+		a.unsigned++
+	}
+
+	return nil
+}
+
+func auditHash(line string) string {
+	hash := sha256.Sum256([]byte(line))
+	return hex.EncodeToString(hash[:])
+}
+
+func auditCheckpointMessage(seq uint64, prev string) []byte {
+	return []byte(fmt.Sprintf("netfoil audit checkpoint %d %s", seq, prev))
+}
+
+// AuditLogVerification is the result of verifying an audit log.
+type AuditLogVerification struct {
+	Records     int
+	Checkpoints int
+	// records after the last checkpoint, only protected by the chain
+	Unsigned int
+	// records not signed by the run that wrote them, e.g. after a crash
+	Unverified int
+	Problems   []error
+}
+
+// VerifyAuditLog checks the chain and checkpoint signatures of an audit log, and reports every line where records
+// were edited, removed or reordered.
+func VerifyAuditLog(r io.Reader, publicKey ed25519.PublicKey) (*AuditLogVerification, error) {
+	verification := &AuditLogVerification{
+		Problems: make([]error, 0),
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), auditMaxLineLength)
+
+	expectedSeq := uint64(1)
+	expectedPrev := auditGenesisHash
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+
+		record := auditRecord{}
+		err := json.Unmarshal([]byte(line), &record)
+		if err != nil {
+			verification.Problems = append(verification.Problems, fmt.Errorf("line %d: invalid record: %w", lineNumber, err))
+			expectedSeq++
+			expectedPrev = auditHash(line)
+			continue
+		}
+
+		if record.Seq != expectedSeq {
+			verification.Problems = append(verification.Problems, fmt.Errorf("line %d: sequence number %d, expected %d: records are missing or reordered", lineNumber, record.Seq, expectedSeq))
+		}
+
+		if record.Prev != expectedPrev {
+			verification.Problems = append(verification.Problems, fmt.Errorf("line %d: previous hash does not match the line before: records are edited, missing or reordered", lineNumber))
+		}
+
+		switch record.Kind {
+		case auditRecordCheckpoint:
+			verification.Checkpoints++
+			verification.Unsigned = 0
+
+			signature, err := base64.StdEncoding.DecodeString(record.Signature)
+			if err != nil || !ed25519.Verify(publicKey, auditCheckpointMessage(record.Seq, record.Prev), signature) {
+				verification.Problems = append(verification.Problems, fmt.Errorf("line %d: invalid checkpoint signature", lineNumber))
+			}
+		case auditRecordVerdict:
+			verification.Records++
+			verification.Unsigned++
+		case auditRecordUnverified:
+			verification.Unverified += record.Unverified
+			verification.Unsigned++
+		default:
+			verification.Problems = append(verification.Problems, fmt.Errorf("line %d: unknown record kind '%s'", lineNumber, record.Kind))
+		}
+
+		// continue from this line, so each problem is reported once
+		expectedSeq = record.Seq + 1
+		expectedPrev = auditHash(line)
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return verification, nil
+}
+
+func readEd25519PrivateKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEMBlock(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an Ed25519 private key")
+	}
+
+	return privateKey, nil
+}
+
+// ReadEd25519PublicKey reads a PEM encoded Ed25519 public key, e.g. from openssl pkey -pubout.
+func ReadEd25519PublicKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEMBlock(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an Ed25519 public key")
+	}
+
+	return publicKey, nil
+}
+
+func readPEMBlock(path string, blockType string) (*pem.Block, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%s: no PEM %s", path, blockType)
+	}
+
+	return block, nil
+}
@@ -0,0 +1,258 @@
+package dns
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newAuditLogTestConfig(t *testing.T) (*Config, ed25519.PublicKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	directory := t.TempDir()
+	keyFile := filepath.Join(directory, "audit.key")
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{
+		AuditLogFile:               filepath.Join(directory, "audit.log"),
+		AuditLogKeyFile:            keyFile,
+		AuditLogCheckpointInterval: defaultAuditLogCheckpointInterval,
+	}
+
+	return config, publicKey
+}
+
+func writeAuditTestLog(t *testing.T, config *Config, names ...string) {
+	auditLog, err := NewAuditLog(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := newTestResult("allowed.example.com")
+	allowed.allowed = true
+	err = auditLog.record(allowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range names {
+		err = auditLog.record(newTestResult(name, FilterReason{Code: FilterCodeDenyExact, Value: name, Rule: name}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// signs the records of this run
+	err = auditLog.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func verifyAuditTestLog(t *testing.T, content string, publicKey ed25519.PublicKey) *AuditLogVerification {
+	verification, err := VerifyAuditLog(strings.NewReader(content), publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return verification
+}
+
+func TestAuditLog(t *testing.T) {
+	config, publicKey := newAuditLogTestConfig(t)
+
+	writeAuditTestLog(t, config, "a.example.com", "b.example.com")
+	// a restart continues the chain
+	writeAuditTestLog(t, config, "c.example.com")
+
+	content, err := os.ReadFile(config.AuditLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) != 5 || strings.Contains(string(content), "allowed.example.com") {
+		t.Fatalf("expected 3 denials and 2 checkpoints, got\n%s", content)
+	}
+
+	if !strings.Contains(lines[0], `"seq":1,`) || !strings.Contains(lines[0], `"verdict":"deny"`) || !strings.Contains(lines[0], `"reason_codes":["DENY_EXACT"]`) || !strings.Contains(lines[0], `"prev":"`+auditGenesisHash+`"`) {
+		t.Errorf("unexpected first record %s", lines[0])
+	}
+
+	verification := verifyAuditTestLog(t, string(content), publicKey)
+	if len(verification.Problems) != 0 || verification.Records != 3 || verification.Checkpoints != 2 || verification.Unsigned != 0 {
+		t.Errorf("unexpected verification %+v", verification)
+	}
+
+	otherKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verification = verifyAuditTestLog(t, string(content), otherKey)
+	if len(verification.Problems) != 2 {
+		t.Errorf("expected invalid signatures, got %v", verification.Problems)
+	}
+
+	tests := []struct {
+		name     string
+		lines    []string
+		expected []string
+	}{
+		{"edited", []string{strings.Replace(lines[0], "a.example.com", "x.example.com", 2), lines[1], lines[2], lines[3], lines[4]}, []string{"line 2: previous hash"}},
+		{"removed", []string{lines[0], lines[2], lines[3], lines[4]}, []string{"line 2: sequence number 3, expected 2", "line 2: previous hash"}},
+		{"reordered", []string{lines[1], lines[0], lines[2], lines[3], lines[4]}, []string{"line 1: sequence number 2, expected 1", "line 2: sequence number 1, expected 3", "line 3: sequence number 3, expected 2"}},
+		{"truncated head", lines[3:], []string{"line 1: sequence number 4, expected 1"}},
+		{"replayed record", append(append([]string{}, lines...), lines[0]), []string{"line 6: sequence number 1, expected 6"}},
+	}
+
+	for _, test := range tests {
+		verification = verifyAuditTestLog(t, strings.Join(test.lines, "\n")+"\n", publicKey)
+
+		problems := make([]string, 0)
+		for _, problem := range verification.Problems {
+			problems = append(problems, problem.Error())
+		}
+
+		for _, expected := range test.expected {
+			found := false
+			for _, problem := range problems {
+				if strings.HasPrefix(problem, expected) {
+					found = true
+				}
+			}
+
+			if !found {
+				t.Errorf("%s: expected '%s', got %v", test.name, expected, problems)
+			}
+		}
+	}
+}
+
+func TestAuditLogIncompleteRecord(t *testing.T) {
+	config, _ := newAuditLogTestConfig(t)
+
+	err := os.WriteFile(config.AuditLogFile, []byte(`{"seq":1,`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewAuditLog(config, nil)
+	if err == nil || !strings.Contains(err.Error(), "incomplete record") {
+		t.Errorf("expected an error for an incomplete record, got %v", err)
+	}
+}
+
+func TestAuditLogClose(t *testing.T) {
+	config, publicKey := newAuditLogTestConfig(t)
+
+	auditLog, err := NewAuditLog(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLog.Start()
+
+	err = auditLog.record(newTestResult("a.example.com", FilterReason{Code: FilterCodeDenyExact}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = auditLog.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// e.g. a query still in flight after ShutdownTimeout=
+	err = auditLog.record(newTestResult("b.example.com", FilterReason{Code: FilterCodeDenyExact}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(config.AuditLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verification := verifyAuditTestLog(t, string(content), publicKey)
+	if len(verification.Problems) != 0 || verification.Records != 1 || verification.Unsigned != 0 || strings.Contains(string(content), "b.example.com") {
+		t.Errorf("expected the record before Close to be signed and the one after it dropped, got %+v\n%s", verification, content)
+	}
+}
+
+func TestAuditLogUnsignedTail(t *testing.T) {
+	config, publicKey := newAuditLogTestConfig(t)
+	writeAuditTestLog(t, config, "a.example.com")
+
+	// e.g. a crash before the checkpoint of Close
+	auditLog, err := NewAuditLog(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"b.example.com", "c.example.com"} {
+		err = auditLog.record(newTestResult(name, FilterReason{Code: FilterCodeDenyExact}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = auditLog.file.Close()
+
+	content, err := os.ReadFile(config.AuditLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// edited without recomputing the chain
+	edited := strings.Replace(string(content), "b.example.com", "x.example.com", 1)
+	err = os.WriteFile(config.AuditLogFile, []byte(edited), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewAuditLog(config, nil)
+	if err == nil || !strings.Contains(err.Error(), "record 4 does not follow record 3") {
+		t.Errorf("expected an error for an edited tail, got %v", err)
+	}
+
+	// a forged checkpoint
+	forged := strings.Replace(string(content), `"signature":"`, `"signature":"AAAA`, 1)
+	err = os.WriteFile(config.AuditLogFile, []byte(forged), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewAuditLog(config, nil)
+	if err == nil || !strings.Contains(err.Error(), "invalid signature of checkpoint 2") {
+		t.Errorf("expected an error for an invalid checkpoint, got %v", err)
+	}
+
+	err = os.WriteFile(config.AuditLogFile, content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAuditTestLog(t, config)
+
+	content, err = os.ReadFile(config.AuditLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verification := verifyAuditTestLog(t, string(content), publicKey)
+	if len(verification.Problems) != 0 || verification.Unverified != 2 || !strings.Contains(string(content), `"kind":"unverified","unverified":2,`) {
+		t.Errorf("expected the tail of the previous run to be marked as unverified, got %+v\n%s", verification, content)
+	}
+}
@@ -0,0 +1,203 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Break-glass suspends the domain allow rules for a limited time, so every domain that is not denied is allowed. Deny
+// rules, the format checks and the IP rules stay in place.
+
+const (
+	breakGlassReason       = "allow due to break-glass"
+	breakGlassPollInterval = 5 * time.Second
+	BreakGlassSignal       = "SIGUSR2"
+)
+
+type BreakGlass struct {
+	duration time.Duration
+	file     string
+
+	mutex   sync.Mutex
+	until   time.Time
+	trigger string
+	timer   *time.Timer
+
+	// the last expiry read from the flag file, so an unchanged file does not start break-glass again
+	fileExpiry time.Time
+	fileErr    string
+}
+
+// NewBreakGlass returns an inactive break-glass, where duration is both the length of a break-glass started by a
+// signal and the longest a flag file can keep it active. file is empty when there is no flag file.
+func NewBreakGlass(duration time.Duration, file string) *BreakGlass {
+	return &BreakGlass{
+		duration: duration,
+		file:     file,
+	}
+}
+
+// Signal starts break-glass for its full duration, or restarts it if already active.
+func (b *BreakGlass) Signal() {
+	b.start(BreakGlassSignal, time.Now().Add(b.duration))
+}
+
+func (b *BreakGlass) start(trigger string, until time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+
+	b.until = until
+	b.trigger = trigger
+	b.timer = time.AfterFunc(time.Until(until), func() {
+		b.stop(until, "expired")
+	})
+
+	slog.Warn("BREAK-GLASS STARTED: domain allow rules are suspended", "trigger", trigger, "until", until.Format(time.RFC3339))
+}
+
+// stop ends the break-glass that lasts until, unless it was restarted since.
+func (b *BreakGlass) stop(until time.Time, reason string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.until.Equal(until) || b.until.IsZero() {
+		return
+	}
+
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+
+	slog.Warn("BREAK-GLASS ENDED: domain allow rules are enforced again", "trigger", b.trigger, "reason", reason)
+	b.until = time.Time{}
+	b.trigger = ""
+	b.timer = nil
+}
+
+func (b *BreakGlass) active(now time.Time) (time.Time, bool) {
+	if b == nil {
+		return time.Time{}, false
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.until, now.Before(b.until)
+}
+
+// WatchFile polls the flag file. The file contains a single RFC 3339 expiry timestamp, e.g. 2026-10-19T15:30:00+02:00.
+// Writing a new expiry starts break-glass, capped at the break-glass duration, and removing the file ends it.
+func (b *BreakGlass) WatchFile() {
+	if b.file == "" {
+		return
+	}
+
+	go func() {
+		for {
+			b.checkFile(time.Now())
+			time.Sleep(breakGlassPollInterval)
+		}
+	}()
+}
+
+func (b *BreakGlass) checkFile(now time.Time) {
+	expiry, err := readBreakGlassFile(b.file)
+	fileErr := ""
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fileErr = err.Error()
+	}
+
+	b.mutex.Lock()
+	fileActive := b.trigger == b.file
+	until := b.until
+	previousExpiry := b.fileExpiry
+	previousErr := b.fileErr
+	b.fileExpiry = expiry
+	b.fileErr = fileErr
+	b.mutex.Unlock()
+
+	if errors.Is(err, fs.ErrNotExist) {
+		if fileActive {
+			b.stop(until, "flag file removed")
+		}
+		return
+	}
+
+	if err != nil {
+		// only report a broken file once
+		if fileErr != previousErr {
+			slog.Error("break-glass flag file", "error", fileErr)
+		}
+		return
+	}
+
+	if expiry.Equal(previousExpiry) || !now.Before(expiry) {
+		return
+	}
+
+	until = expiry
+	if expiry.Sub(now) > b.duration {
+		until = now.Add(b.duration)
+		slog.Warn("break-glass flag file expiry is capped", "expiry", expiry.Format(time.RFC3339), "until", until.Format(time.RFC3339))
+	}
+
+	b.start(b.file, until)
+}
+
+func readBreakGlassFile(path string) (time.Time, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	text := strings.TrimSpace(string(content))
+	expiry, err := time.Parse(time.RFC3339, text)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s: expected an RFC 3339 timestamp, got '%s'", path, text)
+	}
+
+	return expiry, nil
+}
+
+// SetBreakGlass shares break-glass with the policy and all client policies.
+func (p *Policy) SetBreakGlass(breakGlass *BreakGlass) {
+	p.breakGlass = breakGlass
+	for _, clientPolicy := range p.clientPolicies {
+		clientPolicy.policy.breakGlass = breakGlass
+	}
+}
+
+// breakGlassAllows returns the reason a domain that no allow rule matched is allowed, when break-glass is active.
+func (p *Policy) breakGlassAllows(domain string) (FilterReason, bool) {
+	until, active := p.breakGlass.active(p.now())
+	if !active {
+		return FilterReason{}, false
+	}
+
+	return FilterReason{Code: FilterCodeBreakGlass, Value: domain, Detail: until.Format(time.RFC3339)}, true
+}
+
+// breakGlassTTL returns the seconds left of break-glass, to keep clients from caching an answer past it.
+func (p *Policy) breakGlassTTL() uint32 {
+	now := p.now()
+	until, active := p.breakGlass.active(now)
+	if !active {
+		return 0
+	}
+
+	return uint32(until.Sub(now).Seconds())
+}
+
+func isBreakGlassReason(reason FilterReason) bool {
+	return reason.Code == FilterCodeBreakGlass
+}
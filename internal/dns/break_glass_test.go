@@ -0,0 +1,176 @@
+package dns
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBreakGlass(t *testing.T) {
+	policy := newExplainTestPolicy(t)
+	breakGlass := NewBreakGlass(time.Minute, "")
+	policy.SetBreakGlass(breakGlass)
+
+	allowed, _ := policy.domainIsAllowed("other.net.")
+	if allowed {
+		t.Fatalf("should be denied without break-glass")
+	}
+
+	breakGlass.Signal()
+	until, active := breakGlass.active(time.Now())
+	if !active {
+		t.Fatalf("break-glass should be active")
+	}
+
+	allowed, reason := policy.domainIsAllowed("other.net.")
+	if !allowed || !isBreakGlassReason(reason) {
+		t.Errorf("should be allowed by break-glass, got '%s'", reason)
+	}
+
+	expected := "allow due to break-glass until " + until.Format(time.RFC3339) + ": other.net"
+	if reason.String() != expected {
+		t.Errorf("expected '%s', got '%s'", expected, reason)
+	}
+
+	allowed, reason = policy.domainIsAllowed("bad.example.com.")
+	if allowed {
+		t.Errorf("deny rules should stay in place, got '%s'", reason)
+	}
+
+	policy.pinResponseDomain = true
+	response := &Response{
+		Answers: []Answer{
+			{Name: "www.example.com.", Type: RecordTypeCNAME, CNAME: "cdn.example.com."},
+			{Name: "cdn.example.com.", Type: RecordTypeA, IPv4: net.IPv4(10, 0, 0, 1)},
+		},
+	}
+
+	allowed, reasons := policy.responseIsAllowed("www.example.com.", RecordTypeA, response)
+	if allowed {
+		t.Errorf("IP rules should stay in place, got %v", reasons)
+	}
+
+	response.Answers[1].IPv4 = net.IPv4(192, 0, 2, 1)
+	allowed, reasons = policy.responseIsAllowed("www.example.com.", RecordTypeA, response)
+	if !allowed {
+		t.Errorf("response domain should be allowed by break-glass, got %v", reasons)
+	}
+
+	breakGlass.stop(until, "test")
+	_, active = breakGlass.active(time.Now())
+	if active {
+		t.Errorf("break-glass should have ended")
+	}
+
+	allowed, _ = policy.domainIsAllowed("other.net.")
+	if allowed {
+		t.Errorf("should be denied after break-glass")
+	}
+}
+
+func TestBreakGlassFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "break-glass")
+	breakGlass := NewBreakGlass(15*time.Minute, path)
+	now := time.Now()
+
+	breakGlass.checkFile(now)
+	_, active := breakGlass.active(now)
+	if active {
+		t.Fatalf("break-glass should not be active without a flag file")
+	}
+
+	err := os.WriteFile(path, []byte(now.Add(time.Hour).Format(time.RFC3339)+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	breakGlass.checkFile(now)
+	until, active := breakGlass.active(now)
+	if !active {
+		t.Fatalf("break-glass should be active")
+	}
+
+	if !until.Equal(now.Add(15 * time.Minute)) {
+		t.Errorf("expected the expiry to be capped at %s, got %s", now.Add(15*time.Minute), until)
+	}
+
+	// an unchanged file does not start it again once it has ended
+	breakGlass.stop(until, "test")
+	breakGlass.checkFile(now)
+	_, active = breakGlass.active(now)
+	if active {
+		t.Errorf("an unchanged flag file should not restart break-glass")
+	}
+
+	err = os.WriteFile(path, []byte(now.Add(5*time.Minute).Format(time.RFC3339)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	breakGlass.checkFile(now)
+	_, active = breakGlass.active(now)
+	if !active {
+		t.Fatalf("a new expiry should start break-glass")
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	breakGlass.checkFile(now)
+	_, active = breakGlass.active(now)
+	if active {
+		t.Errorf("removing the flag file should end break-glass")
+	}
+
+	err = os.WriteFile(path, []byte("15 minutes"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	breakGlass.checkFile(now)
+	_, active = breakGlass.active(now)
+	if active {
+		t.Errorf("an invalid flag file should not start break-glass")
+	}
+}
+
+func TestProcessBreakGlass(t *testing.T) {
+	policy := newExplainTestPolicy(t)
+	policy.pinA = map[string]net.IP{
+		"other.net": net.IPv4(192, 0, 2, 1),
+	}
+
+	breakGlass := NewBreakGlass(time.Minute, "")
+	policy.SetBreakGlass(breakGlass)
+	breakGlass.Signal()
+
+	w := newAuditTestWorker(t, true)
+	w.policy.Store(policy)
+
+	question := Question{Name: "other.net.", Type: RecordTypeA, Class: ClassTypeIN}
+	request, err := MarshalRequest(1, Flags{RD: true}, question)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := w.process(&workerTask{
+		rawRequest:     request,
+		responseLength: len(request),
+		connectionType: ConnectionTypeUDP,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !result.allowed || !result.breakGlass {
+		t.Fatalf("expected an allow by break-glass")
+	}
+
+	if len(result.response.Answers) != 1 || result.response.Answers[0].TTL > 60 {
+		t.Errorf("expected the TTL to be capped at the end of break-glass, got %v", result.response.Answers)
+	}
+}
@@ -0,0 +1,242 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	configDirectoryPolicies = "policies.d"
+	configFilenameClients   = "clients"
+
+	defaultPolicyName = "default"
+)
+
+var policyNameRegex = regexp.MustCompile("^[a-z0-9][a-z0-9_-]*$")
+
+// clientPolicy is a named policy from policies.d, used for the clients it is bound to instead of the default policy.
+type clientPolicy struct {
+	name    string
+	policy  *Policy
+	clients []netip.Prefix
+	listen  []netip.Addr
+}
+
+func readClientPolicies(configDirectory string, knownTLDs map[string]struct{}, schedules *scheduleSet, blockPunycode bool, pinResponseDomain bool) ([]*clientPolicy, error) {
+	entries, err := os.ReadDir(filepath.Join(configDirectory, configDirectoryPolicies))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, &ConfigError{Filename: configDirectoryPolicies, Err: err}
+	}
+
+	errs := make([]error, 0)
+	clientPolicies := make([]*clientPolicy, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		directory := filepath.Join(configDirectoryPolicies, name)
+		if !entry.IsDir() {
+			errs = append(errs, newConfigError(directory, 0, "expected a directory"))
+			continue
+		}
+
+		if !policyNameRegex.MatchString(name) || name == defaultPolicyName {
+			errs = append(errs, newConfigError(directory, 0, "invalid policy name '%s'", name))
+			continue
+		}
+
+		policy, policyErr := newPolicy(configDirectory, directory, knownTLDs, schedules, blockPunycode, pinResponseDomain)
+		clients, listen, clientsErr := readClients(configDirectory, filepath.Join(directory, configFilenameClients))
+
+		err := errors.Join(policyErr, clientsErr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		policy.name = name
+		clientPolicies = append(clientPolicies, &clientPolicy{
+			name:    name,
+			policy:  policy,
+			clients: clients,
+			listen:  listen,
+		})
+	}
+
+	err = checkClientPolicyBindings(clientPolicies)
+	errs = append(errs, err)
+
+	return clientPolicies, errors.Join(errs...)
+}
+
+// readClients reads the bindings of a client policy: one client address or prefix per line, or 'listen <address>' for
+// queries received on that local address.
+func readClients(configDirectory string, filename string) ([]netip.Prefix, []netip.Addr, error) {
+	lines, err := readConfig(configDirectory, filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	errs := make([]error, 0)
+	clients := make([]netip.Prefix, 0)
+	listen := make([]netip.Addr, 0)
+	for _, line := range lines {
+		text := line.text
+		if strings.TrimSpace(text) != text {
+			errs = append(errs, newConfigError(filename, line.number, "'%s' has leading or trailing whitespace", text))
+			continue
+		}
+
+		address, found := strings.CutPrefix(text, "listen ")
+		if found {
+			addr, err := netip.ParseAddr(address)
+			if err != nil || addr.Zone() != "" {
+				errs = append(errs, newConfigError(filename, line.number, "invalid listen address '%s'", address))
+				continue
+			}
+
+			listen = append(listen, addr.Unmap())
+			continue
+		}
+
+		prefix, err := parseClientPrefix(text)
+		if err != nil {
+			errs = append(errs, newConfigError(filename, line.number, "invalid client '%s': %s", text, err.Error()))
+			continue
+		}
+
+		clients = append(clients, prefix)
+	}
+
+	return clients, listen, errors.Join(errs...)
+}
+
+func parseClientPrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+
+		if addr.Zone() != "" {
+			return netip.Prefix{}, fmt.Errorf("zones are not supported")
+		}
+
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	if prefix.Masked() != prefix {
+		return netip.Prefix{}, fmt.Errorf("host bits are set, expected '%s'", prefix.Masked().String())
+	}
+
+	return prefix, nil
+}
+
+// checkClientPolicyBindings rejects bindings that would make the selected policy depend on the order of policies.d.
+func checkClientPolicyBindings(clientPolicies []*clientPolicy) error {
+	errs := make([]error, 0)
+	clients := make(map[netip.Prefix]string)
+	listen := make(map[netip.Addr]string)
+	for _, clientPolicy := range clientPolicies {
+		filename := filepath.Join(configDirectoryPolicies, clientPolicy.name, configFilenameClients)
+
+		for _, prefix := range clientPolicy.clients {
+			other, found := clients[prefix]
+			if found {
+				errs = append(errs, newConfigError(filename, 0, "client '%s' is already bound to policy '%s'", prefix.String(), other))
+				continue
+			}
+			clients[prefix] = clientPolicy.name
+		}
+
+		for _, addr := range clientPolicy.listen {
+			other, found := listen[addr]
+			if found {
+				errs = append(errs, newConfigError(filename, 0, "listen address '%s' is already bound to policy '%s'", addr.String(), other))
+				continue
+			}
+			listen[addr] = clientPolicy.name
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ForClient selects the policy for a query from remote received on local. The client policy with the longest prefix
+// containing remote wins, then a client policy bound to local, then the default policy. Invalid addresses are not
+// bound to any client policy.
+func (p *Policy) ForClient(remote netip.Addr, local netip.Addr) *Policy {
+	remote = remote.Unmap()
+	local = local.Unmap()
+
+	var selected *Policy = nil
+	bits := -1
+	for _, clientPolicy := range p.clientPolicies {
+		for _, prefix := range clientPolicy.clients {
+			if prefix.Bits() > bits && prefix.Contains(remote) {
+				selected = clientPolicy.policy
+				bits = prefix.Bits()
+			}
+		}
+	}
+
+	if selected != nil {
+		return selected
+	}
+
+	for _, clientPolicy := range p.clientPolicies {
+		if local.IsValid() && slices.Contains(clientPolicy.listen, local) {
+			return clientPolicy.policy
+		}
+	}
+
+	return p
+}
+
+// Name is the directory name of a client policy, or 'default'.
+func (p *Policy) Name() string {
+	return p.name
+}
+
+// HasClientPolicies is true when policies.d contains at least one policy.
+func (p *Policy) HasClientPolicies() bool {
+	return len(p.clientPolicies) > 0
+}
+
+// PolicyNames lists the default policy followed by the client policies.
+func (p *Policy) PolicyNames() []string {
+	names := []string{p.name}
+	for _, clientPolicy := range p.clientPolicies {
+		names = append(names, clientPolicy.name)
+	}
+
+	return names
+}
+
+func (p *Policy) bindsListenAddresses() bool {
+	for _, clientPolicy := range p.clientPolicies {
+		if len(clientPolicy.listen) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,189 @@
+package dns
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeRuleFiles(t *testing.T, directory string, files map[string]string) {
+	ruleFiles := []string{
+		configFilenameAllowExact, configFilenameDenyExact, configFilenameAllowTLDs, configFilenameDenyTLDs,
+		configFilenameAllowSuffixes, configFilenameDenySuffixes, configFilenameAllowWildcards, configFilenameDenyWildcards,
+		configFilenameAllowRegexes, configFilenameDenyRegexes, configFilenameIPv4Allow, configFilenameIPv4Deny,
+		configFilenameIPv6Allow, configFilenameIPv6Deny, configFilenamePinResponseDomain, configFilenamePinA,
+	}
+
+	err := os.MkdirAll(directory, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filename := range ruleFiles {
+		err := os.WriteFile(filepath.Join(directory, filename), []byte(files[filename]), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for filename, content := range files {
+		err := os.WriteFile(filepath.Join(directory, filename), []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestClientPolicies(t *testing.T) {
+	configDirectory := t.TempDir()
+	writeRuleFiles(t, configDirectory, map[string]string{
+		configFilenameKnownTLDs:     ".com\n",
+		configFilenameSchedules:     "",
+		configFilenameAllowExact:    "example.com\n",
+		configFilenameAllowSuffixes: ".example.com\n",
+		configFilenameDenyExact:     "bad.example.com\n",
+	})
+	writeRuleFiles(t, filepath.Join(configDirectory, configDirectoryPolicies, "lab"), map[string]string{
+		configFilenameAllowTLDs: ".com\n",
+		configFilenameClients:   "10.1.0.0/16\n2001:db8::/32\nlisten 127.0.0.2\n",
+	})
+	writeRuleFiles(t, filepath.Join(configDirectory, configDirectoryPolicies, "build"), map[string]string{
+		configFilenameAllowExact: "build.example.com\n",
+		configFilenameClients:    "10.1.2.0/24\n192.0.2.7\n",
+	})
+
+	policy, err := NewPolicy(configDirectory, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remote   string
+		local    string
+		expected string
+	}{
+		{"10.1.1.1", "127.0.0.1", "lab"},
+		{"10.1.2.1", "127.0.0.1", "build"},
+		{"::ffff:10.1.2.1", "127.0.0.1", "build"},
+		{"192.0.2.7", "127.0.0.2", "build"},
+		{"192.0.2.8", "127.0.0.2", "lab"},
+		{"2001:db8::1", "::1", "lab"},
+		{"192.0.2.8", "127.0.0.1", defaultPolicyName},
+	}
+
+	for _, test := range tests {
+		selected := policy.ForClient(netip.MustParseAddr(test.remote), netip.MustParseAddr(test.local))
+		if selected.Name() != test.expected {
+			t.Errorf("%s on %s: expected '%s', got '%s'", test.remote, test.local, test.expected, selected.Name())
+		}
+	}
+
+	selected := policy.ForClient(netip.Addr{}, netip.Addr{})
+	if selected != policy {
+		t.Errorf("expected the default policy for invalid addresses, got '%s'", selected.Name())
+	}
+
+	lab := policy.ForClient(netip.MustParseAddr("10.1.1.1"), netip.Addr{})
+	build := policy.ForClient(netip.MustParseAddr("10.1.2.1"), netip.Addr{})
+
+	verdicts := []struct {
+		policy   *Policy
+		domain   string
+		expected bool
+	}{
+		{policy, "www.example.com.", true},
+		{policy, "bad.example.com.", false},
+		{lab, "bad.example.com.", true},
+		{lab, "example.org.", false},
+		{build, "build.example.com.", true},
+		{build, "www.example.com.", false},
+	}
+
+	for _, verdict := range verdicts {
+		allowed, _ := verdict.policy.domainIsAllowed(verdict.domain)
+		if allowed != verdict.expected {
+			t.Errorf("%s %s: expected %t, got %t", verdict.policy.Name(), verdict.domain, verdict.expected, allowed)
+		}
+	}
+
+	_, reason := build.domainIsAllowed("build.example.com.")
+	expectedReason := "allow due to exact allowlist: build.example.com, rule 'build.example.com' policies.d/build/allow.exact:1"
+	if reason.String() != expectedReason {
+		t.Errorf("expected '%s', got '%s'", expectedReason, reason)
+	}
+}
+
+func TestClientPolicyErrors(t *testing.T) {
+	configDirectory := t.TempDir()
+	writeRuleFiles(t, configDirectory, map[string]string{
+		configFilenameKnownTLDs: ".com\n",
+		configFilenameSchedules: "",
+	})
+	writeRuleFiles(t, filepath.Join(configDirectory, configDirectoryPolicies, "lab"), map[string]string{
+		configFilenameAllowExact: "example.org\n",
+		configFilenameClients:    "10.1.0.0/16\n10.1.0.1/16\nlisten 127.0.0.2\n",
+	})
+	writeRuleFiles(t, filepath.Join(configDirectory, configDirectoryPolicies, "guest"), map[string]string{
+		configFilenameClients: "10.1.0.0/16\nlisten 127.0.0.2\nfoo\n",
+	})
+	writeRuleFiles(t, filepath.Join(configDirectory, configDirectoryPolicies, "Guest"), map[string]string{})
+
+	_, err := NewPolicy(configDirectory, false, false)
+	if err == nil {
+		t.Fatalf("should fail")
+	}
+
+	expected := []string{
+		"policies.d/Guest: invalid policy name 'Guest'",
+		"policies.d/guest/clients:3: invalid client 'foo': ParseAddr(\"foo\"): unable to parse IP",
+		"policies.d/lab/allow.exact:1: 'example.org': not a valid TLD",
+		"policies.d/lab/clients:2: invalid client '10.1.0.1/16': host bits are set, expected '10.1.0.0/16'",
+	}
+
+	configErrors := ConfigErrors(err)
+	if len(configErrors) != len(expected) {
+		t.Fatalf("expected %d errors, got %d: %v", len(expected), len(configErrors), err)
+	}
+
+	for i, e := range expected {
+		if configErrors[i].Error() != e {
+			t.Errorf("expected '%s', got '%s'", e, configErrors[i].Error())
+		}
+	}
+}
+
+func TestClientPolicyDuplicateBindings(t *testing.T) {
+	configDirectory := t.TempDir()
+	writeRuleFiles(t, configDirectory, map[string]string{
+		configFilenameKnownTLDs: ".com\n",
+		configFilenameSchedules: "",
+	})
+	writeRuleFiles(t, filepath.Join(configDirectory, configDirectoryPolicies, "guest"), map[string]string{
+		configFilenameClients: "10.1.0.0/16\nlisten 127.0.0.2\n",
+	})
+	writeRuleFiles(t, filepath.Join(configDirectory, configDirectoryPolicies, "lab"), map[string]string{
+		configFilenameClients: "10.1.0.0/16\nlisten 127.0.0.2\n",
+	})
+
+	_, err := NewPolicy(configDirectory, false, false)
+	if err == nil {
+		t.Fatalf("should fail")
+	}
+
+	expected := []string{
+		"policies.d/lab/clients: client '10.1.0.0/16' is already bound to policy 'guest'",
+		"policies.d/lab/clients: listen address '127.0.0.2' is already bound to policy 'guest'",
+	}
+
+	configErrors := ConfigErrors(err)
+	if len(configErrors) != len(expected) {
+		t.Fatalf("expected %d errors, got %d: %v", len(expected), len(configErrors), err)
+	}
+
+	for i, e := range expected {
+		if configErrors[i].Error() != e {
+			t.Errorf("expected '%s', got '%s'", e, configErrors[i].Error())
+		}
+	}
+}
@@ -2,6 +2,7 @@ package dns
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math"
@@ -9,8 +10,10 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -20,6 +23,10 @@ const (
 	configFilenameDenyTLDs          = "deny.tld"
 	configFilenameAllowSuffixes     = "allow.suffix"
 	configFilenameDenySuffixes      = "deny.suffix"
+	configFilenameAllowWildcards    = "allow.wildcard"
+	configFilenameDenyWildcards     = "deny.wildcard"
+	configFilenameAllowRegexes      = "allow.regex"
+	configFilenameDenyRegexes       = "deny.regex"
 	configFilenameIPv4Allow         = "allow.ipv4"
 	configFilenameIPv4Deny          = "deny.ipv4"
 	configFilenameIPv6Allow         = "allow.ipv6"
@@ -30,6 +37,27 @@ const (
 
 	defaultMinTTL uint32 = 0
 	defaultMaxTTL uint32 = math.MaxUint32
+
+	defaultLogRepeatWindow        = 10 * time.Second
+	defaultLogRateLimit    uint32 = 200
+
+	defaultAuditLogCheckpointInterval = time.Minute
+
+	defaultRecentQueries uint32 = 1000
+
+	defaultNotifyRateLimit uint32 = 10
+	defaultNotifyTimeout          = 5 * time.Second
+
+	defaultClientRatePrefixV4 uint32 = 32
+	defaultClientRatePrefixV6 uint32 = 64
+	defaultResponseRateSlip   uint32 = 2
+
+	defaultWorkers      uint32 = 20
+	defaultQueueSize    uint32 = 50
+	defaultTCPWorkers   uint32 = 10
+	defaultTCPQueueSize uint32 = 50
+
+	defaultShutdownTimeout = 5 * time.Second
 )
 
 type Config struct {
@@ -43,19 +71,66 @@ type Config struct {
 	LogAllowed        bool
 	LogDenied         bool
 	LogLevel          slog.Level
+	LogFormat         LogFormat
+	LogSink           LogSink
+	SyslogSocket      string
+
+	LogPrivacy          LogPrivacy
+	LogNames            LogNames
+	LogNameKeyFile      string
+	LogClientPrefixIPv4 uint32
+	LogClientPrefixIPv6 uint32
+	LogAllowedLimit     uint32
+	PublicSuffixList    string
+	LogRepeatWindow     time.Duration
+	LogRateLimit        uint32
+	Enforce             bool
+
+	BreakGlassDuration time.Duration
+	BreakGlassFile     string
+
+	AuditLogFile               string
+	AuditLogKeyFile            string
+	AuditLogCheckpointInterval time.Duration
+
+	RecentQueries uint32
+
+	NotifyOn        []string
+	NotifyNames     []string
+	NotifyCommand   string
+	NotifyURL       *url.URL
+	NotifyRateLimit uint32
+	NotifyTimeout   time.Duration
+
+	ClientRateLimit      uint32
+	ClientRateBurst      uint32
+	ClientRatePrefixIPv4 uint32
+	ClientRatePrefixIPv6 uint32
+	ResponseRateLimit    uint32
+	ResponseRateSlip     uint32
+
+	Workers          uint32
+	QueueSize        uint32
+	TCPWorkers       uint32
+	TCPQueueSize     uint32
+	OverloadResponse OverloadResponse
+
+	ShutdownTimeout           time.Duration
+	ShutdownDumpRecentQueries bool
 }
 
 func ReadConfigFile(configDirectory string) (*Config, error) {
 	path := filepath.Join(configDirectory, "config")
 	file, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return nil, &ConfigError{Filename: "config", Err: err}
 	}
 
 	scanner := bufio.NewScanner(file)
 	result, err := parseConfig(scanner)
 	closeErr := file.Close()
 	if err != nil || closeErr != nil {
+		setConfigErrorFilename(err, "config")
 		if closeErr == nil {
 			return nil, err
 		} else if err == nil {
@@ -68,6 +143,140 @@ func ReadConfigFile(configDirectory string) (*Config, error) {
 	return result, nil
 }
 
+// Lines returns the effective config in the format of the config file, including defaults.
+func (c *Config) Lines() []string {
+	dohIPs := make([]string, 0)
+	for _, ip := range c.DoHIPs {
+		dohIPs = append(dohIPs, ip.String())
+	}
+
+	logLevel := "info"
+	if c.LogLevel == slog.LevelDebug {
+		logLevel = "debug"
+	}
+
+	notifyURL := ""
+	if c.NotifyURL != nil {
+		notifyURL = c.NotifyURL.String()
+	}
+
+	return []string{
+		fmt.Sprintf("%s=%s", keyDohURL, c.DoHURL.String()),
+		fmt.Sprintf("%s=%s", keyDohIPs, strings.Join(dohIPs, ",")),
+		fmt.Sprintf("%s=%d", keyMinTTL, c.MinTTL),
+		fmt.Sprintf("%s=%d", keyMaxTTL, c.MaxTTL),
+		fmt.Sprintf("%s=%t", keyDenyPunycode, c.DenyPunycode),
+		fmt.Sprintf("%s=%t", keyRemoveECH, c.RemoveECH),
+		fmt.Sprintf("%s=%t", keyPinResponseDomain, c.PinResponseDomain),
+		fmt.Sprintf("%s=%t", keyLogAllowed, c.LogAllowed),
+		fmt.Sprintf("%s=%t", keyLogDenied, c.LogDenied),
+		fmt.Sprintf("%s=%s", keyLogLevel, logLevel),
+		fmt.Sprintf("%s=%s", keyLogFormat, c.LogFormat),
+		fmt.Sprintf("%s=%s", keyLogSink, c.LogSink),
+		fmt.Sprintf("%s=%s", keySyslogSocket, c.SyslogSocket),
+		fmt.Sprintf("%s=%s", keyLogPrivacy, c.LogPrivacy),
+		fmt.Sprintf("%s=%s", keyLogNames, c.LogNames),
+		fmt.Sprintf("%s=%s", keyLogNameKeyFile, c.LogNameKeyFile),
+		fmt.Sprintf("%s=%d", keyLogClientPrefixV4, c.LogClientPrefixIPv4),
+		fmt.Sprintf("%s=%d", keyLogClientPrefixV6, c.LogClientPrefixIPv6),
+		fmt.Sprintf("%s=%d", keyLogAllowedLimit, c.LogAllowedLimit),
+		fmt.Sprintf("%s=%s", keyPublicSuffixList, c.PublicSuffixList),
+		fmt.Sprintf("%s=%s", keyLogRepeatWindow, c.LogRepeatWindow),
+		fmt.Sprintf("%s=%d", keyLogRateLimit, c.LogRateLimit),
+		fmt.Sprintf("%s=%t", keyEnforce, c.Enforce),
+		fmt.Sprintf("%s=%s", keyBreakGlassDuration, c.BreakGlassDuration),
+		fmt.Sprintf("%s=%s", keyBreakGlassFile, c.BreakGlassFile),
+		fmt.Sprintf("%s=%s", keyAuditLogFile, c.AuditLogFile),
+		fmt.Sprintf("%s=%s", keyAuditLogKeyFile, c.AuditLogKeyFile),
+		fmt.Sprintf("%s=%s", keyAuditLogCheckpointInterval, c.AuditLogCheckpointInterval),
+		fmt.Sprintf("%s=%d", keyRecentQueries, c.RecentQueries),
+		fmt.Sprintf("%s=%s", keyNotifyOn, strings.Join(c.NotifyOn, ",")),
+		fmt.Sprintf("%s=%s", keyNotifyNames, strings.Join(c.NotifyNames, ",")),
+		fmt.Sprintf("%s=%s", keyNotifyCommand, c.NotifyCommand),
+		fmt.Sprintf("%s=%s", keyNotifyURL, notifyURL),
+		fmt.Sprintf("%s=%d", keyNotifyRateLimit, c.NotifyRateLimit),
+		fmt.Sprintf("%s=%s", keyNotifyTimeout, c.NotifyTimeout),
+		fmt.Sprintf("%s=%d", keyClientRateLimit, c.ClientRateLimit),
+		fmt.Sprintf("%s=%d", keyClientRateBurst, c.ClientRateBurst),
+		fmt.Sprintf("%s=%d", keyClientRatePrefixV4, c.ClientRatePrefixIPv4),
+		fmt.Sprintf("%s=%d", keyClientRatePrefixV6, c.ClientRatePrefixIPv6),
+		fmt.Sprintf("%s=%d", keyResponseRateLimit, c.ResponseRateLimit),
+		fmt.Sprintf("%s=%d", keyResponseRateSlip, c.ResponseRateSlip),
+		fmt.Sprintf("%s=%d", keyWorkers, c.Workers),
+		fmt.Sprintf("%s=%d", keyQueueSize, c.QueueSize),
+		fmt.Sprintf("%s=%d", keyTCPWorkers, c.TCPWorkers),
+		fmt.Sprintf("%s=%d", keyTCPQueueSize, c.TCPQueueSize),
+		fmt.Sprintf("%s=%s", keyOverloadResponse, c.OverloadResponse),
+		fmt.Sprintf("%s=%s", keyShutdownTimeout, c.ShutdownTimeout),
+		fmt.Sprintf("%s=%t", keyShutdownDumpRecentQueries, c.ShutdownDumpRecentQueries),
+	}
+}
+
+// ConfigError is a problem found in a file in the config directory. Line is 0
+// when the problem is not tied to a single line, e.g. a missing file.
+type ConfigError struct {
+	Filename string
+	Line     int
+	Err      error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Filename == "" {
+		return e.Err.Error()
+	}
+
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.Filename, e.Err.Error())
+	}
+
+	return fmt.Sprintf("%s:%d: %s", e.Filename, e.Line, e.Err.Error())
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+func newConfigError(filename string, line int, format string, a ...any) *ConfigError {
+	return &ConfigError{
+		Filename: filename,
+		Line:     line,
+		Err:      fmt.Errorf(format, a...),
+	}
+}
+
+// ConfigErrors flattens an error returned by ReadConfigFile or NewPolicy into
+// the individual problems it is made of.
+func ConfigErrors(err error) []*ConfigError {
+	if err == nil {
+		return nil
+	}
+
+	configError, ok := err.(*ConfigError)
+	if ok {
+		return []*ConfigError{configError}
+	}
+
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return []*ConfigError{{Err: err}}
+	}
+
+	result := make([]*ConfigError, 0)
+	for _, e := range joined.Unwrap() {
+		result = append(result, ConfigErrors(e)...)
+	}
+
+	return result
+}
+
+func setConfigErrorFilename(err error, filename string) {
+	for _, configError := range ConfigErrors(err) {
+		if configError.Filename == "" {
+			configError.Filename = filename
+		}
+	}
+}
+
 type ConfigKey string
 
 const (
@@ -81,10 +290,57 @@ const (
 	keyLogAllowed        ConfigKey = "LogAllowed"
 	keyLogDenied         ConfigKey = "LogDenied"
 	keyLogLevel          ConfigKey = "LogLevel"
+	keyLogFormat         ConfigKey = "LogFormat"
+	keyLogSink           ConfigKey = "LogSink"
+	keySyslogSocket      ConfigKey = "SyslogSocket"
+
+	keyLogPrivacy        ConfigKey = "LogPrivacy"
+	keyLogNames          ConfigKey = "LogNames"
+	keyLogNameKeyFile    ConfigKey = "LogNameKeyFile"
+	keyLogClientPrefixV4 ConfigKey = "LogClientPrefixIPv4"
+	keyLogClientPrefixV6 ConfigKey = "LogClientPrefixIPv6"
+	keyLogAllowedLimit   ConfigKey = "LogAllowedLimit"
+	keyPublicSuffixList  ConfigKey = "PublicSuffixList"
+	keyLogRepeatWindow   ConfigKey = "LogRepeatWindow"
+	keyLogRateLimit      ConfigKey = "LogRateLimit"
+	keyEnforce           ConfigKey = "Enforce"
+
+	keyBreakGlassDuration ConfigKey = "BreakGlassDuration"
+	keyBreakGlassFile     ConfigKey = "BreakGlassFile"
+
+	keyAuditLogFile               ConfigKey = "AuditLogFile"
+	keyAuditLogKeyFile            ConfigKey = "AuditLogKeyFile"
+	keyAuditLogCheckpointInterval ConfigKey = "AuditLogCheckpointInterval"
+
+	keyRecentQueries ConfigKey = "RecentQueries"
+
+	keyNotifyOn        ConfigKey = "NotifyOn"
+	keyNotifyNames     ConfigKey = "NotifyNames"
+	keyNotifyCommand   ConfigKey = "NotifyCommand"
+	keyNotifyURL       ConfigKey = "NotifyURL"
+	keyNotifyRateLimit ConfigKey = "NotifyRateLimit"
+	keyNotifyTimeout   ConfigKey = "NotifyTimeout"
+
+	keyClientRateLimit    ConfigKey = "ClientRateLimit"
+	keyClientRateBurst    ConfigKey = "ClientRateBurst"
+	keyClientRatePrefixV4 ConfigKey = "ClientRatePrefixIPv4"
+	keyClientRatePrefixV6 ConfigKey = "ClientRatePrefixIPv6"
+	keyResponseRateLimit  ConfigKey = "ResponseRateLimit"
+	keyResponseRateSlip   ConfigKey = "ResponseRateSlip"
+
+	keyWorkers          ConfigKey = "Workers"
+	keyQueueSize        ConfigKey = "QueueSize"
+	keyTCPWorkers       ConfigKey = "TCPWorkers"
+	keyTCPQueueSize     ConfigKey = "TCPQueueSize"
+	keyOverloadResponse ConfigKey = "OverloadResponse"
+
+	keyShutdownTimeout           ConfigKey = "ShutdownTimeout"
+	keyShutdownDumpRecentQueries ConfigKey = "ShutdownDumpRecentQueries"
 )
 
 type ConfigMap struct {
-	m map[ConfigKey]string
+	m     map[ConfigKey]string
+	lines map[ConfigKey]int
 }
 
 func NewConfigMap(keys ...ConfigKey) *ConfigMap {
@@ -94,13 +350,26 @@ func NewConfigMap(keys ...ConfigKey) *ConfigMap {
 		m[key] = ""
 	}
 
-	return &ConfigMap{m: m}
+	return &ConfigMap{m: m, lines: make(map[ConfigKey]int)}
 }
 
 func (c *ConfigMap) Set(key ConfigKey, value string) {
 	c.m[key] = value
 }
 
+func (c *ConfigMap) setLine(key ConfigKey, line int) {
+	c.lines[key] = line
+}
+
+// wrap attaches the line the key was set on to an error from one of the getters.
+func (c *ConfigMap) wrap(key ConfigKey, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &ConfigError{Line: c.lines[key], Err: err}
+}
+
 func (c *ConfigMap) Get(key ConfigKey) (string, bool) {
 	a, b := c.m[key]
 	return a, b
@@ -139,6 +408,34 @@ func (c *ConfigMap) GetLogLevel(key ConfigKey, defaultValue slog.Level) (slog.Le
 	return result, nil
 }
 
+// getChoice returns the value of key, which must be one of choices.
+func getChoice[T ~string](c *ConfigMap, key ConfigKey, defaultValue T, choices ...T) (T, error) {
+	result := defaultValue
+
+	stringValue := c.m[key]
+	if stringValue != "" {
+		if !slices.Contains(choices, T(stringValue)) {
+			return "", fmt.Errorf("config %s= unsupported value '%s'", key, stringValue)
+		}
+		result = T(stringValue)
+	}
+
+	return result, nil
+}
+
+func (c *ConfigMap) GetPrefixLength(key ConfigKey, defaultValue uint32, maxLength uint32) (uint32, error) {
+	result, err := c.GetUint32(key, defaultValue)
+	if err != nil {
+		return 0, err
+	}
+
+	if result > maxLength {
+		return 0, fmt.Errorf("config %s= invalid prefix length %d, at most %d", key, result, maxLength)
+	}
+
+	return result, nil
+}
+
 func (c *ConfigMap) GetUint32(key ConfigKey, defaultValue uint32) (uint32, error) {
 	result := defaultValue
 
@@ -154,6 +451,106 @@ func (c *ConfigMap) GetUint32(key ConfigKey, defaultValue uint32) (uint32, error
 	return result, nil
 }
 
+func (c *ConfigMap) GetDuration(key ConfigKey, defaultValue time.Duration) (time.Duration, error) {
+	result := defaultValue
+
+	stringValue := c.m[key]
+	if stringValue != "" {
+		v, err := time.ParseDuration(stringValue)
+		if err != nil || v <= 0 {
+			return 0, fmt.Errorf("config %s= invalid duration '%s'", key, stringValue)
+		}
+		result = v
+	}
+
+	return result, nil
+}
+
+// GetDurationOrZero is GetDuration where 0 turns a feature off.
+func (c *ConfigMap) GetDurationOrZero(key ConfigKey, defaultValue time.Duration) (time.Duration, error) {
+	if c.m[key] == "0" {
+		return 0, nil
+	}
+
+	return c.GetDuration(key, defaultValue)
+}
+
+func (c *ConfigMap) GetAbsolutePath(key ConfigKey) (string, error) {
+	stringValue := c.m[key]
+	if stringValue == "" {
+		return "", nil
+	}
+
+	if !filepath.IsAbs(stringValue) {
+		return "", fmt.Errorf("config %s= must be an absolute path '%s'", key, stringValue)
+	}
+
+	return filepath.Clean(stringValue), nil
+}
+
+// GetList returns the comma separated values of key.
+func (c *ConfigMap) GetList(key ConfigKey) ([]string, error) {
+	stringValue := c.m[key]
+	if stringValue == "" {
+		return nil, nil
+	}
+
+	result := strings.Split(stringValue, ",")
+	for _, value := range result {
+		if value == "" || strings.TrimSpace(value) != value {
+			return nil, fmt.Errorf("config %s= invalid value '%s'", key, value)
+		}
+	}
+
+	return result, nil
+}
+
+// GetNotifyOn returns the verdicts and reason codes of NotifyOn=.
+func (c *ConfigMap) GetNotifyOn() ([]string, error) {
+	key := keyNotifyOn
+	result, err := c.GetList(key)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, class := range result {
+		switch {
+		case class == verdictDeny || class == verdictAuditDeny || class == verdictBreakGlass:
+		case FilterCode(class).known():
+		default:
+			return nil, fmt.Errorf("config %s= unknown verdict or reason code '%s'", key, class)
+		}
+	}
+
+	return result, nil
+}
+
+// GetNotifyURL returns the http URL of NotifyURL=, which must be on a loopback IP, as a name would be resolved
+// through netfoil itself.
+func (c *ConfigMap) GetNotifyURL() (*url.URL, error) {
+	key := keyNotifyURL
+	stringValue := c.m[key]
+	if stringValue == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(stringValue)
+	if err != nil {
+		return nil, fmt.Errorf("config '%s=%s' malformed URL: %w", key, stringValue, err)
+	}
+
+	if u.Scheme != "http" {
+		return nil, fmt.Errorf("config '%s=%s' must use scheme 'http'", key, stringValue)
+	}
+
+	addr, err := netip.ParseAddr(u.Hostname())
+	if err != nil || !addr.IsLoopback() {
+		return nil, fmt.Errorf("config '%s=%s' must be on a loopback IP", key, stringValue)
+	}
+
+	return u, nil
+}
+
 func (c *ConfigMap) GetRequiredDoHURL() (*url.URL, error) {
 	key := keyDohURL
 	stringValue := c.m[key]
@@ -225,16 +622,58 @@ func parseConfig(scanner *bufio.Scanner) (*Config, error) {
 		keyLogAllowed,
 		keyLogDenied,
 		keyLogLevel,
+		keyLogFormat,
+		keyLogSink,
+		keySyslogSocket,
+		keyLogPrivacy,
+		keyLogNames,
+		keyLogNameKeyFile,
+		keyLogClientPrefixV4,
+		keyLogClientPrefixV6,
+		keyLogAllowedLimit,
+		keyPublicSuffixList,
+		keyLogRepeatWindow,
+		keyLogRateLimit,
+		keyEnforce,
+		keyBreakGlassDuration,
+		keyBreakGlassFile,
+		keyAuditLogFile,
+		keyAuditLogKeyFile,
+		keyAuditLogCheckpointInterval,
+		keyRecentQueries,
+		keyNotifyOn,
+		keyNotifyNames,
+		keyNotifyCommand,
+		keyNotifyURL,
+		keyNotifyRateLimit,
+		keyNotifyTimeout,
+		keyClientRateLimit,
+		keyClientRateBurst,
+		keyClientRatePrefixV4,
+		keyClientRatePrefixV6,
+		keyResponseRateLimit,
+		keyResponseRateSlip,
+		keyWorkers,
+		keyQueueSize,
+		keyTCPWorkers,
+		keyTCPQueueSize,
+		keyOverloadResponse,
+		keyShutdownTimeout,
+		keyShutdownDumpRecentQueries,
 	)
 
+	errs := make([]error, 0)
+	lineNumber := 0
 	for scanner.Scan() {
 		line := scanner.Text()
+		lineNumber++
 
 		if len(line) > 0 && !strings.HasPrefix(line, "#") {
 			parts := strings.SplitN(line, "=", 2)
 
 			if len(parts) != 2 {
-				return nil, fmt.Errorf("config malformed line: '%s'", line)
+				errs = append(errs, newConfigError("", lineNumber, "config malformed line: '%s'", line))
+				continue
 			}
 
 			key := ConfigKey(parts[0])
@@ -242,72 +681,210 @@ func parseConfig(scanner *bufio.Scanner) (*Config, error) {
 
 			s, found := configMap.Get(key)
 			if !found {
-				return nil, fmt.Errorf("config unknown key '%s': '%s'", key, line)
+				errs = append(errs, newConfigError("", lineNumber, "config unknown key '%s': '%s'", key, line))
+				continue
 			}
 
 			if s != "" {
-				return nil, fmt.Errorf("config duplicate key '%s'", line)
+				errs = append(errs, newConfigError("", lineNumber, "config duplicate key '%s'", line))
+				continue
 			}
 
 			if value == "" {
-				return nil, fmt.Errorf("config %s= is empty", key)
+				errs = append(errs, newConfigError("", lineNumber, "config %s= is empty", key))
+				continue
 			}
 
 			configMap.Set(key, value)
+			configMap.setLine(key, lineNumber)
 		}
 	}
 
 	err := scanner.Err()
 	if err != nil {
-		return nil, err
+		return nil, &ConfigError{Err: err}
 	}
 
 	dohURL, err := configMap.GetRequiredDoHURL()
-	if err != nil {
-		return nil, err
-	}
+	errs = append(errs, configMap.wrap(keyDohURL, err))
 
 	dohIPs, err := configMap.GetRequiredDoHIPs()
-	if err != nil {
-		return nil, err
-	}
+	errs = append(errs, configMap.wrap(keyDohIPs, err))
 
 	minTTL, err := configMap.GetUint32(keyMinTTL, defaultMinTTL)
-	if err != nil {
-		return nil, err
-	}
+	errs = append(errs, configMap.wrap(keyMinTTL, err))
 
 	maxTTL, err := configMap.GetUint32(keyMaxTTL, defaultMaxTTL)
-	if err != nil {
-		return nil, err
-	}
+	errs = append(errs, configMap.wrap(keyMaxTTL, err))
 
 	denyPunycode, err := configMap.GetBool(keyDenyPunycode, false)
-	if err != nil {
-		return nil, err
-	}
+	errs = append(errs, configMap.wrap(keyDenyPunycode, err))
 
 	removeECH, err := configMap.GetBool(keyRemoveECH, false)
-	if err != nil {
-		return nil, err
-	}
+	errs = append(errs, configMap.wrap(keyRemoveECH, err))
 
 	pinResponseDomains, err := configMap.GetBool(keyPinResponseDomain, false)
-	if err != nil {
-		return nil, err
-	}
+	errs = append(errs, configMap.wrap(keyPinResponseDomain, err))
 
 	logAllowed, err := configMap.GetBool(keyLogAllowed, true)
-	if err != nil {
-		return nil, err
-	}
+	errs = append(errs, configMap.wrap(keyLogAllowed, err))
 
 	logDenied, err := configMap.GetBool(keyLogDenied, true)
-	if err != nil {
-		return nil, err
-	}
+	errs = append(errs, configMap.wrap(keyLogDenied, err))
 
 	logLevel, err := configMap.GetLogLevel(keyLogLevel, slog.LevelInfo)
+	errs = append(errs, configMap.wrap(keyLogLevel, err))
+
+	logFormat, err := getChoice(configMap, keyLogFormat, LogFormatText, LogFormatText, LogFormatJSON)
+	errs = append(errs, configMap.wrap(keyLogFormat, err))
+
+	logSink, err := getChoice(configMap, keyLogSink, LogSinkStdout, LogSinkStdout, LogSinkJournald, LogSinkSyslog)
+	errs = append(errs, configMap.wrap(keyLogSink, err))
+
+	syslogSocket, err := configMap.GetAbsolutePath(keySyslogSocket)
+	errs = append(errs, configMap.wrap(keySyslogSocket, err))
+
+	logPrivacy, err := getChoice(configMap, keyLogPrivacy, LogPrivacyFull, LogPrivacyFull, LogPrivacyPseudonymous, LogPrivacyMinimal)
+	errs = append(errs, configMap.wrap(keyLogPrivacy, err))
+	defaults := logPrivacyDefaults[logPrivacy]
+
+	logNames, err := getChoice(configMap, keyLogNames, defaults.names, LogNamesFull, LogNamesRegistrable, LogNamesHMAC)
+	errs = append(errs, configMap.wrap(keyLogNames, err))
+
+	logNameKeyFile, err := configMap.GetAbsolutePath(keyLogNameKeyFile)
+	if err == nil && logNames == LogNamesHMAC && logNameKeyFile == "" {
+		err = fmt.Errorf("config %s= missing, required by %s=%s", keyLogNameKeyFile, keyLogNames, LogNamesHMAC)
+	}
+	errs = append(errs, configMap.wrap(keyLogNameKeyFile, err))
+
+	logClientPrefixV4, err := configMap.GetPrefixLength(keyLogClientPrefixV4, defaults.ipv4Prefix, 32)
+	errs = append(errs, configMap.wrap(keyLogClientPrefixV4, err))
+
+	logClientPrefixV6, err := configMap.GetPrefixLength(keyLogClientPrefixV6, defaults.ipv6Prefix, 128)
+	errs = append(errs, configMap.wrap(keyLogClientPrefixV6, err))
+
+	logAllowedLimit, err := configMap.GetUint32(keyLogAllowedLimit, 0)
+	errs = append(errs, configMap.wrap(keyLogAllowedLimit, err))
+
+	publicSuffixList, err := configMap.GetAbsolutePath(keyPublicSuffixList)
+	errs = append(errs, configMap.wrap(keyPublicSuffixList, err))
+
+	logRepeatWindow, err := configMap.GetDurationOrZero(keyLogRepeatWindow, defaultLogRepeatWindow)
+	errs = append(errs, configMap.wrap(keyLogRepeatWindow, err))
+
+	logRateLimit, err := configMap.GetUint32(keyLogRateLimit, defaultLogRateLimit)
+	errs = append(errs, configMap.wrap(keyLogRateLimit, err))
+
+	enforce, err := configMap.GetBool(keyEnforce, true)
+	errs = append(errs, configMap.wrap(keyEnforce, err))
+
+	// off unless set, so a signal cannot suspend the allow rules of a netfoil that never meant to allow it
+	breakGlassDuration, err := configMap.GetDurationOrZero(keyBreakGlassDuration, 0)
+	errs = append(errs, configMap.wrap(keyBreakGlassDuration, err))
+
+	breakGlassFile, err := configMap.GetAbsolutePath(keyBreakGlassFile)
+	if err == nil && breakGlassFile != "" && breakGlassDuration == 0 {
+		err = fmt.Errorf("config %s= missing, required by %s=", keyBreakGlassDuration, keyBreakGlassFile)
+	}
+	errs = append(errs, configMap.wrap(keyBreakGlassFile, err))
+
+	auditLogFile, err := configMap.GetAbsolutePath(keyAuditLogFile)
+	errs = append(errs, configMap.wrap(keyAuditLogFile, err))
+
+	auditLogKeyFile, err := configMap.GetAbsolutePath(keyAuditLogKeyFile)
+	if err == nil && auditLogFile != "" && auditLogKeyFile == "" {
+		err = fmt.Errorf("config %s= missing, required by %s=", keyAuditLogKeyFile, keyAuditLogFile)
+	}
+	errs = append(errs, configMap.wrap(keyAuditLogKeyFile, err))
+
+	auditLogCheckpointInterval, err := configMap.GetDuration(keyAuditLogCheckpointInterval, defaultAuditLogCheckpointInterval)
+	errs = append(errs, configMap.wrap(keyAuditLogCheckpointInterval, err))
+
+	recentQueries, err := configMap.GetUint32(keyRecentQueries, defaultRecentQueries)
+	errs = append(errs, configMap.wrap(keyRecentQueries, err))
+
+	notifyOn, err := configMap.GetNotifyOn()
+	errs = append(errs, configMap.wrap(keyNotifyOn, err))
+
+	notifyNames, err := configMap.GetList(keyNotifyNames)
+	for i := range notifyNames {
+		notifyNames[i] = strings.ToLower(strings.TrimSuffix(notifyNames[i], "."))
+	}
+	errs = append(errs, configMap.wrap(keyNotifyNames, err))
+
+	notifyCommand, err := configMap.GetAbsolutePath(keyNotifyCommand)
+	errs = append(errs, configMap.wrap(keyNotifyCommand, err))
+
+	notifyURL, err := configMap.GetNotifyURL()
+	errs = append(errs, configMap.wrap(keyNotifyURL, err))
+
+	notifies := len(notifyOn) > 0 || len(notifyNames) > 0
+	if notifies && notifyCommand == "" && notifyURL == nil {
+		err = fmt.Errorf("config %s= or %s= missing, required by %s= and %s=", keyNotifyCommand, keyNotifyURL, keyNotifyOn, keyNotifyNames)
+		errs = append(errs, configMap.wrap(keyNotifyOn, err))
+	} else if !notifies && (notifyCommand != "" || notifyURL != nil) {
+		err = fmt.Errorf("config %s= or %s= missing, nothing to notify", keyNotifyOn, keyNotifyNames)
+		errs = append(errs, configMap.wrap(keyNotifyCommand, err))
+	}
+
+	notifyRateLimit, err := configMap.GetUint32(keyNotifyRateLimit, defaultNotifyRateLimit)
+	errs = append(errs, configMap.wrap(keyNotifyRateLimit, err))
+
+	notifyTimeout, err := configMap.GetDuration(keyNotifyTimeout, defaultNotifyTimeout)
+	errs = append(errs, configMap.wrap(keyNotifyTimeout, err))
+
+	clientRateLimit, err := configMap.GetUint32(keyClientRateLimit, 0)
+	errs = append(errs, configMap.wrap(keyClientRateLimit, err))
+
+	// one second of queries unless set
+	clientRateBurst, err := configMap.GetUint32(keyClientRateBurst, clientRateLimit)
+	if err == nil && clientRateBurst == 0 && clientRateLimit > 0 {
+		err = fmt.Errorf("config %s= must be at least 1 with %s=", keyClientRateBurst, keyClientRateLimit)
+	} else if err == nil && clientRateBurst > 0 && clientRateLimit == 0 {
+		err = fmt.Errorf("config %s= missing, required by %s=", keyClientRateLimit, keyClientRateBurst)
+	}
+	errs = append(errs, configMap.wrap(keyClientRateBurst, err))
+
+	clientRatePrefixV4, err := configMap.GetPrefixLength(keyClientRatePrefixV4, defaultClientRatePrefixV4, 32)
+	errs = append(errs, configMap.wrap(keyClientRatePrefixV4, err))
+
+	clientRatePrefixV6, err := configMap.GetPrefixLength(keyClientRatePrefixV6, defaultClientRatePrefixV6, 128)
+	errs = append(errs, configMap.wrap(keyClientRatePrefixV6, err))
+
+	responseRateLimit, err := configMap.GetUint32(keyResponseRateLimit, 0)
+	errs = append(errs, configMap.wrap(keyResponseRateLimit, err))
+
+	responseRateSlip, err := configMap.GetUint32(keyResponseRateSlip, defaultResponseRateSlip)
+	errs = append(errs, configMap.wrap(keyResponseRateSlip, err))
+
+	workers, err := configMap.GetUint32(keyWorkers, defaultWorkers)
+	if err == nil && workers == 0 {
+		err = fmt.Errorf("config %s= must be at least 1", keyWorkers)
+	}
+	errs = append(errs, configMap.wrap(keyWorkers, err))
+
+	queueSize, err := configMap.GetUint32(keyQueueSize, defaultQueueSize)
+	errs = append(errs, configMap.wrap(keyQueueSize, err))
+
+	tcpWorkers, err := configMap.GetUint32(keyTCPWorkers, defaultTCPWorkers)
+	if err == nil && tcpWorkers == 0 {
+		err = fmt.Errorf("config %s= must be at least 1", keyTCPWorkers)
+	}
+	errs = append(errs, configMap.wrap(keyTCPWorkers, err))
+
+	tcpQueueSize, err := configMap.GetUint32(keyTCPQueueSize, defaultTCPQueueSize)
+	errs = append(errs, configMap.wrap(keyTCPQueueSize, err))
+
+	overloadResponse, err := getChoice(configMap, keyOverloadResponse, OverloadResponseServFail, OverloadResponseServFail, OverloadResponseRefused, OverloadResponseDrop)
+	errs = append(errs, configMap.wrap(keyOverloadResponse, err))
+
+	shutdownTimeout, err := configMap.GetDuration(keyShutdownTimeout, defaultShutdownTimeout)
+	errs = append(errs, configMap.wrap(keyShutdownTimeout, err))
+
+	shutdownDumpRecentQueries, err := configMap.GetBool(keyShutdownDumpRecentQueries, false)
+	errs = append(errs, configMap.wrap(keyShutdownDumpRecentQueries, err))
+
+	err = errors.Join(errs...)
 	if err != nil {
 		return nil, err
 	}
@@ -323,24 +900,87 @@ func parseConfig(scanner *bufio.Scanner) (*Config, error) {
 		LogAllowed:        logAllowed,
 		LogDenied:         logDenied,
 		LogLevel:          logLevel,
+		LogFormat:         logFormat,
+		LogSink:           logSink,
+		SyslogSocket:      syslogSocket,
+
+		LogPrivacy:          logPrivacy,
+		LogNames:            logNames,
+		LogNameKeyFile:      logNameKeyFile,
+		LogClientPrefixIPv4: logClientPrefixV4,
+		LogClientPrefixIPv6: logClientPrefixV6,
+		LogAllowedLimit:     logAllowedLimit,
+		PublicSuffixList:    publicSuffixList,
+		LogRepeatWindow:     logRepeatWindow,
+		LogRateLimit:        logRateLimit,
+		Enforce:             enforce,
+
+		BreakGlassDuration: breakGlassDuration,
+		BreakGlassFile:     breakGlassFile,
+
+		AuditLogFile:               auditLogFile,
+		AuditLogKeyFile:            auditLogKeyFile,
+		AuditLogCheckpointInterval: auditLogCheckpointInterval,
+
+		RecentQueries: recentQueries,
+
+		NotifyOn:        notifyOn,
+		NotifyNames:     notifyNames,
+		NotifyCommand:   notifyCommand,
+		NotifyURL:       notifyURL,
+		NotifyRateLimit: notifyRateLimit,
+		NotifyTimeout:   notifyTimeout,
+
+		ClientRateLimit:      clientRateLimit,
+		ClientRateBurst:      clientRateBurst,
+		ClientRatePrefixIPv4: clientRatePrefixV4,
+		ClientRatePrefixIPv6: clientRatePrefixV6,
+		ResponseRateLimit:    responseRateLimit,
+		ResponseRateSlip:     responseRateSlip,
+
+		Workers:          workers,
+		QueueSize:        queueSize,
+		TCPWorkers:       tcpWorkers,
+		TCPQueueSize:     tcpQueueSize,
+		OverloadResponse: overloadResponse,
+
+		ShutdownTimeout:           shutdownTimeout,
+		ShutdownDumpRecentQueries: shutdownDumpRecentQueries,
 	}, nil
 }
 
-func readConfig(configDirectory string, filename string) (res []string, err error) {
+type configLine struct {
+	number int
+	text   string
+}
+
+// readOptionalConfig is readConfig where a missing file has no lines, for files added after the first release.
+func readOptionalConfig(configDirectory string, filename string) ([]configLine, error) {
+	lines, err := readConfig(configDirectory, filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	return lines, err
+}
+
+func readConfig(configDirectory string, filename string) (res []configLine, err error) {
 	path := filepath.Join(configDirectory, filename)
 
 	file, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return nil, &ConfigError{Filename: filename, Err: err}
 	}
 
-	var result []string
+	var result []configLine
+	lineNumber := 0
 	sc := bufio.NewScanner(file)
 	for sc.Scan() {
 		line := sc.Text()
+		lineNumber++
 
 		if len(line) > 0 && !strings.HasPrefix(line, "#") {
-			result = append(result, line)
+			result = append(result, configLine{number: lineNumber, text: line})
 		}
 	}
 
@@ -348,12 +988,12 @@ func readConfig(configDirectory string, filename string) (res []string, err erro
 	closeErr := file.Close()
 	if err != nil || closeErr != nil {
 		if closeErr == nil {
-			return nil, err
+			return nil, &ConfigError{Filename: filename, Err: err}
 		} else if err == nil {
-			return nil, closeErr
+			return nil, &ConfigError{Filename: filename, Err: closeErr}
 		}
 
-		return nil, fmt.Errorf("both scanning and close failed %w %w", err, closeErr)
+		return nil, &ConfigError{Filename: filename, Err: fmt.Errorf("both scanning and close failed %w %w", err, closeErr)}
 	}
 
 	return result, err
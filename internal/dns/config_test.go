@@ -3,8 +3,11 @@ package dns
 import (
 	"bufio"
 	"log/slog"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseConfig(t *testing.T) {
@@ -18,7 +21,21 @@ DenyPunycode=true
 RemoveECH=false
 LogAllowed=false
 LogDenied=true
-LogLevel=debug`
+LogLevel=debug
+LogFormat=json
+LogSink=syslog
+SyslogSocket=/run/syslog.sock
+LogPrivacy=pseudonymous
+LogClientPrefixIPv4=16
+LogAllowedLimit=10
+LogRepeatWindow=0
+LogRateLimit=50
+Enforce=false
+BreakGlassDuration=30m
+BreakGlassFile=/etc/netfoil/break-glass
+AuditLogFile=/var/log/netfoil/audit.log
+AuditLogKeyFile=/etc/netfoil/audit.key
+AuditLogCheckpointInterval=5m`
 
 	reader := strings.NewReader(s)
 	scanner := bufio.NewScanner(reader)
@@ -63,6 +80,42 @@ LogLevel=debug`
 	if config.LogLevel != slog.LevelDebug {
 		t.Errorf("LogLevel should be debug")
 	}
+
+	if config.LogFormat != LogFormatJSON {
+		t.Errorf("LogFormat should be json")
+	}
+
+	if config.LogSink != LogSinkSyslog || config.SyslogSocket != "/run/syslog.sock" {
+		t.Errorf("wrong LogSink or SyslogSocket")
+	}
+
+	if config.LogPrivacy != LogPrivacyPseudonymous || config.LogNames != LogNamesRegistrable {
+		t.Errorf("wrong LogPrivacy or LogNames")
+	}
+
+	if config.LogClientPrefixIPv4 != 16 || config.LogClientPrefixIPv6 != 48 || config.LogAllowedLimit != 10 {
+		t.Errorf("wrong LogClientPrefixIPv4, LogClientPrefixIPv6 or LogAllowedLimit")
+	}
+
+	if config.LogRepeatWindow != 0 || config.LogRateLimit != 50 {
+		t.Errorf("wrong LogRepeatWindow or LogRateLimit")
+	}
+
+	if config.Enforce != false {
+		t.Errorf("Enforce should be false")
+	}
+
+	if config.BreakGlassDuration != 30*time.Minute {
+		t.Errorf("wrong BreakGlassDuration")
+	}
+
+	if config.BreakGlassFile != "/etc/netfoil/break-glass" {
+		t.Errorf("wrong BreakGlassFile")
+	}
+
+	if config.AuditLogFile != "/var/log/netfoil/audit.log" || config.AuditLogKeyFile != "/etc/netfoil/audit.key" || config.AuditLogCheckpointInterval != 5*time.Minute {
+		t.Errorf("wrong AuditLogFile, AuditLogKeyFile or AuditLogCheckpointInterval")
+	}
 }
 
 func TestGetBool(t *testing.T) {
@@ -99,6 +152,18 @@ LogAllowed=false`
 	if config.LogDenied != true {
 		t.Errorf("LogDenied should be true")
 	}
+
+	if config.Enforce != true {
+		t.Errorf("Enforce should be true")
+	}
+
+	if config.BreakGlassDuration != 0 {
+		t.Errorf("BreakGlassDuration should be 0")
+	}
+
+	if config.BreakGlassFile != "" {
+		t.Errorf("BreakGlassFile should be empty")
+	}
 }
 
 func TestGetLogLevelDefault(t *testing.T) {
@@ -116,6 +181,195 @@ DoHIPs=0.0.0.0`
 	if config.LogLevel != slog.LevelInfo {
 		t.Errorf("LogLevel should be info")
 	}
+
+	if config.LogFormat != LogFormatText {
+		t.Errorf("LogFormat should be text")
+	}
+
+	if config.LogSink != LogSinkStdout {
+		t.Errorf("LogSink should be stdout")
+	}
+
+	if config.LogPrivacy != LogPrivacyFull || config.LogNames != LogNamesFull || config.LogClientPrefixIPv4 != 32 || config.LogClientPrefixIPv6 != 128 {
+		t.Errorf("logs should not be redacted")
+	}
+
+	if config.LogRepeatWindow != 10*time.Second || config.LogRateLimit != 200 {
+		t.Errorf("logs should be limited")
+	}
+}
+
+func TestKeyFilesRequired(t *testing.T) {
+	s := `DoHURL=https://example.com/dns-query
+DoHIPs=0.0.0.0
+LogNames=hmac
+LogClientPrefixIPv6=129
+AuditLogFile=/var/log/netfoil/audit.log`
+
+	_, err := parseConfig(bufio.NewScanner(strings.NewReader(s)))
+	if err == nil || !strings.Contains(err.Error(), "LogNameKeyFile= missing") || !strings.Contains(err.Error(), "invalid prefix length 129") || !strings.Contains(err.Error(), "AuditLogKeyFile= missing") {
+		t.Errorf("expected errors for the key files and the prefix length, got %v", err)
+	}
+
+	s = `DoHURL=https://example.com/dns-query
+DoHIPs=0.0.0.0
+LogNames=hmac
+LogNameKeyFile=log-name.key`
+
+	_, err = parseConfig(bufio.NewScanner(strings.NewReader(s)))
+	configErrors := ConfigErrors(err)
+	if len(configErrors) != 1 || configErrors[0].Line != 4 || !strings.Contains(err.Error(), "LogNameKeyFile= must be an absolute path") {
+		t.Errorf("expected an error on the line of LogNameKeyFile=, got %v", err)
+	}
+}
+
+func TestNotifyConfig(t *testing.T) {
+	s := `DoHURL=https://example.com/dns-query
+DoHIPs=0.0.0.0
+NotifyOn=deny,DENY_EXACT
+NotifyNames=Canary.Example.com.,.honeypot.example.net
+NotifyURL=http://127.0.0.1:8080/hook`
+
+	config, err := parseConfig(bufio.NewScanner(strings.NewReader(s)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.NotifyOn) != 2 || config.NotifyNames[0] != "canary.example.com" || config.NotifyURL.Port() != "8080" || config.NotifyRateLimit != defaultNotifyRateLimit {
+		t.Errorf("unexpected notify config %+v", config)
+	}
+
+	s = `DoHURL=https://example.com/dns-query
+DoHIPs=0.0.0.0
+NotifyOn=allow,DENY_SOMETHING
+NotifyURL=http://hooks.example.com/hook`
+
+	_, err = parseConfig(bufio.NewScanner(strings.NewReader(s)))
+	if err == nil || !strings.Contains(err.Error(), "unknown verdict or reason code 'allow'") || !strings.Contains(err.Error(), "must be on a loopback IP") {
+		t.Errorf("expected errors for NotifyOn= and NotifyURL=, got %v", err)
+	}
+
+	s = `DoHURL=https://example.com/dns-query
+DoHIPs=0.0.0.0
+NotifyNames=canary.example.com`
+
+	_, err = parseConfig(bufio.NewScanner(strings.NewReader(s)))
+	if err == nil || !strings.Contains(err.Error(), "NotifyCommand= or NotifyURL= missing") {
+		t.Errorf("expected an error for the missing hook, got %v", err)
+	}
+}
+
+func TestRateLimitConfig(t *testing.T) {
+	s := `DoHURL=https://example.com/dns-query
+DoHIPs=0.0.0.0
+ClientRateLimit=50
+ResponseRateLimit=5`
+
+	config, err := parseConfig(bufio.NewScanner(strings.NewReader(s)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.ClientRateBurst != 50 || config.ClientRatePrefixIPv4 != 32 || config.ClientRatePrefixIPv6 != 64 || config.ResponseRateSlip != defaultResponseRateSlip {
+		t.Errorf("unexpected rate limit config %+v", config)
+	}
+
+	s = `DoHURL=https://example.com/dns-query
+DoHIPs=0.0.0.0
+ClientRateBurst=10
+ClientRatePrefixIPv4=33`
+
+	_, err = parseConfig(bufio.NewScanner(strings.NewReader(s)))
+	if err == nil || !strings.Contains(err.Error(), "ClientRateLimit= missing") || !strings.Contains(err.Error(), "invalid prefix length 33") {
+		t.Errorf("expected errors for ClientRateBurst= and ClientRatePrefixIPv4=, got %v", err)
+	}
+}
+
+func TestOverloadConfig(t *testing.T) {
+	s := `DoHURL=https://example.com/dns-query
+DoHIPs=0.0.0.0
+Workers=64
+OverloadResponse=refused`
+
+	config, err := parseConfig(bufio.NewScanner(strings.NewReader(s)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Workers != 64 || config.QueueSize != defaultQueueSize || config.TCPWorkers != defaultTCPWorkers || config.OverloadResponse != OverloadResponseRefused {
+		t.Errorf("unexpected overload config %+v", config)
+	}
+
+	s = `DoHURL=https://example.com/dns-query
+DoHIPs=0.0.0.0
+TCPWorkers=0
+OverloadResponse=nxdomain`
+
+	_, err = parseConfig(bufio.NewScanner(strings.NewReader(s)))
+	if err == nil || !strings.Contains(err.Error(), "TCPWorkers= must be at least 1") || !strings.Contains(err.Error(), "OverloadResponse=") {
+		t.Errorf("expected errors for TCPWorkers= and OverloadResponse=, got %v", err)
+	}
+}
+
+func TestBreakGlassConfig(t *testing.T) {
+	s := `DoHURL=https://example.com/dns-query
+DoHIPs=0.0.0.0
+BreakGlassFile=/etc/netfoil/break-glass`
+
+	_, err := parseConfig(bufio.NewScanner(strings.NewReader(s)))
+	if err == nil || !strings.Contains(err.Error(), "BreakGlassDuration= missing, required by BreakGlassFile=") {
+		t.Errorf("expected an error for BreakGlassFile= without BreakGlassDuration=, got %v", err)
+	}
+
+	s = `DoHURL=https://example.com/dns-query
+DoHIPs=0.0.0.0
+BreakGlassDuration=0`
+
+	config, err := parseConfig(bufio.NewScanner(strings.NewReader(s)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.BreakGlassDuration != 0 {
+		t.Errorf("expected break-glass to be off, got %s", config.BreakGlassDuration)
+	}
+}
+
+func TestShutdownConfig(t *testing.T) {
+	s := `DoHURL=https://example.com/dns-query
+DoHIPs=0.0.0.0`
+
+	config, err := parseConfig(bufio.NewScanner(strings.NewReader(s)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.ShutdownTimeout != defaultShutdownTimeout || config.ShutdownDumpRecentQueries {
+		t.Errorf("unexpected shutdown config %+v", config)
+	}
+
+	s = `DoHURL=https://example.com/dns-query
+DoHIPs=0.0.0.0
+ShutdownTimeout=30s
+ShutdownDumpRecentQueries=true`
+
+	config, err = parseConfig(bufio.NewScanner(strings.NewReader(s)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.ShutdownTimeout != 30*time.Second || !config.ShutdownDumpRecentQueries {
+		t.Errorf("unexpected shutdown config %+v", config)
+	}
+
+	s = `DoHURL=https://example.com/dns-query
+DoHIPs=0.0.0.0
+ShutdownTimeout=0`
+
+	_, err = parseConfig(bufio.NewScanner(strings.NewReader(s)))
+	if err == nil || !strings.Contains(err.Error(), "ShutdownTimeout=") {
+		t.Errorf("expected an error for ShutdownTimeout=0, got %v", err)
+	}
 }
 
 func TestIPv6(t *testing.T) {
@@ -152,3 +406,94 @@ DoHIPs=a.0.0.0`
 		t.Fatalf("expected '%s', got '%s'", expectedError, err.Error())
 	}
 }
+
+func TestParseConfigReportsAllErrors(t *testing.T) {
+	s := `DoHURL=https://example.com/dns-query
+DoHIPs=0.0.0.0
+Unknown=1
+MinTTL=x
+LogLevel=trace
+BreakGlassFile=break-glass`
+
+	reader := strings.NewReader(s)
+	scanner := bufio.NewScanner(reader)
+
+	_, err := parseConfig(scanner)
+	if err == nil {
+		t.Fatalf("parsing should fail")
+	}
+
+	configErrors := ConfigErrors(err)
+	if len(configErrors) != 4 {
+		t.Fatalf("expected 4 errors, got %d: %v", len(configErrors), err)
+	}
+
+	expectedLines := []int{3, 4, 5, 6}
+	for i, configError := range configErrors {
+		if configError.Line != expectedLines[i] {
+			t.Errorf("expected line %d, got %d", expectedLines[i], configError.Line)
+		}
+	}
+}
+
+func TestNewPolicyReportsAllErrors(t *testing.T) {
+	configDirectory := t.TempDir()
+	files := map[string]string{
+		configFilenameKnownTLDs:         ".com\n",
+		configFilenameAllowExact:        "# comment\nexample.com\nexample.org\n",
+		configFilenameDenyExact:         "",
+		configFilenameAllowTLDs:         "",
+		configFilenameDenyTLDs:          ".org\n",
+		configFilenameAllowSuffixes:     "example.com\n",
+		configFilenameDenySuffixes:      "",
+		configFilenameIPv4Allow:         "0.0.0.0/0\n",
+		configFilenameIPv4Deny:          "",
+		configFilenameIPv6Allow:         "::/0\n",
+		configFilenameIPv6Deny:          "0.0.0.0/0\n",
+		configFilenamePinResponseDomain: "",
+		configFilenameAllowWildcards:    "",
+		configFilenameDenyWildcards:     "*.example.com\n",
+		configFilenameAllowRegexes:      "",
+		configFilenameDenyRegexes:       "^ad[0-9]+\\.\n(\n",
+		configFilenameSchedules:         "",
+	}
+
+	for filename, content := range files {
+		err := os.WriteFile(filepath.Join(configDirectory, filename), []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := NewPolicy(configDirectory, false, false)
+	if err == nil {
+		t.Fatalf("should fail")
+	}
+
+	expected := []string{
+		"allow.exact:3: 'example.org': not a valid TLD",
+		"deny.tld:1: '.org' not present in known.tld",
+		"allow.suffix:1: 'example.com' must start with a '.'",
+		"deny.ipv6:1: '0.0.0.0/0': need to be IPv6",
+		"deny.regex:2: '(': error parsing regexp: missing closing ): `(`",
+		"pin.a: open " + filepath.Join(configDirectory, configFilenamePinA) + ": no such file or directory",
+	}
+
+	configErrors := ConfigErrors(err)
+	if len(configErrors) != len(expected) {
+		t.Fatalf("expected %d errors, got %d: %v", len(expected), len(configErrors), err)
+	}
+
+	for _, e := range expected {
+		found := false
+		for _, configError := range configErrors {
+			if configError.Error() == e {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Errorf("expected error '%s' in %v", e, err)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package dns
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinfoil-factory/netfoil/internal/lru"
+	"golang.org/x/sys/unix"
+)
+
+// The control protocol is line based text over a Unix socket, one command per connection:
+//
+//	client: <command> [<argument>]\n
+//	server: zero or more data lines, then "ok\n" or "error <message>\n"
+//
+// For tail the server answers "ok" first and then writes a line per query until the client disconnects.
+
+const (
+	ControlCommandStats  = "stats"
+	ControlCommandFlush  = "flush"
+	ControlCommandReload = "reload"
+	ControlCommandConfig = "config"
+	ControlCommandTail   = "tail"
+	ControlCommandRecent = "recent"
+
+	controlMaxRequestLength = 256
+	controlMaxConnections   = 4
+	controlMaxTails         = 4
+	controlTailBuffer       = 256
+	controlTimeout          = 5 * time.Second
+)
+
+// Control serves the control socket. Only root and the user netfoil runs as are allowed, checked with SO_PEERCRED on
+// top of the file permissions of the socket.
+type Control struct {
+	listener        *net.UnixListener
+	configDirectory string
+	connections     chan struct{}
+	tailConnections chan struct{}
+	reloadMutex     sync.Mutex
+	tailMutex       sync.Mutex
+	tails           map[chan string]struct{}
+	redactor        *Redactor
+
+	// set by Server
+	config  *Config
+	cache   *lru.Cache[timedResponse]
+	policy  *atomic.Pointer[Policy]
+	metrics *metrics
+	recent  *RecentQueries
+}
+
+// NewControl returns the control socket server, where tailed queries are redacted by redactor.
+func NewControl(listener *net.UnixListener, configDirectory string, redactor *Redactor) *Control {
+	return &Control{
+		listener:        listener,
+		configDirectory: configDirectory,
+		redactor:        redactor,
+		connections:     make(chan struct{}, controlMaxConnections),
+		tailConnections: make(chan struct{}, controlMaxTails),
+		tails:           make(map[chan string]struct{}),
+	}
+}
+
+// ListenControl creates the control socket at path, only accessible by the current user.
+func ListenControl(path string) (*net.UnixListener, error) {
+	return listenUnixSocket(path, 0177)
+}
+
+func listenUnixSocket(path string, umask int) (*net.UnixListener, error) {
+	// a socket left behind by an earlier run
+	info, err := os.Lstat(path)
+	if err == nil {
+		if info.Mode().Type() != os.ModeSocket {
+			return nil, fmt.Errorf("socket %s: exists and is not a socket", path)
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	oldUmask := unix.Umask(umask)
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	unix.Umask(oldUmask)
+	if err != nil {
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+func (c *Control) start() {
+	go func() {
+		for {
+			conn, err := c.listener.AcceptUnix()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+
+				slog.Error("control: failed to accept connection", "error", err.Error())
+				continue
+			}
+
+			select {
+			case c.connections <- struct{}{}:
+				go func() {
+					release := sync.OnceFunc(func() {
+						<-c.connections
+					})
+					defer release()
+
+					c.handle(conn, release)
+				}()
+			default:
+				_, _ = conn.Write([]byte("error busy\n"))
+				_ = conn.Close()
+			}
+		}
+	}()
+}
+
+// handle serves a connection, where release frees its slot of the connections for commands.
+func (c *Control) handle(conn *net.UnixConn, release func()) {
+	defer conn.Close()
+
+	ucred, err := peerCredentials(conn)
+	if err != nil {
+		slog.Warn("control: failed to read peer credentials", "error", err.Error())
+		return
+	}
+
+	if ucred.Uid != 0 && int(ucred.Uid) != os.Getuid() {
+		slog.Warn("control: denied", "uid", ucred.Uid, "pid", ucred.Pid)
+		_, _ = conn.Write([]byte("error permission denied\n"))
+		return
+	}
+
+	err = conn.SetDeadline(time.Now().Add(controlTimeout))
+	if err != nil {
+		return
+	}
+
+	reader := bufio.NewReaderSize(io.LimitReader(conn, controlMaxRequestLength), controlMaxRequestLength)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		_, _ = conn.Write([]byte("error invalid request\n"))
+		return
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		_, _ = conn.Write([]byte("error invalid request\n"))
+		return
+	}
+
+	slog.Info("control", "command", strings.Join(fields, " "), "uid", ucred.Uid, "pid", ucred.Pid)
+
+	command := fields[0]
+	arguments := fields[1:]
+	if command == ControlCommandTail && len(arguments) == 0 {
+		c.tail(conn, release)
+		return
+	}
+
+	lines, err := c.run(command, arguments)
+	for _, l := range lines {
+		_, writeErr := fmt.Fprintf(conn, "%s\n", l)
+		if writeErr != nil {
+			return
+		}
+	}
+
+	if err != nil {
+		slog.Warn("control: failed", "command", command, "error", err.Error())
+		_, _ = fmt.Fprintf(conn, "error %s\n", err.Error())
+	} else {
+		_, _ = fmt.Fprintf(conn, "ok\n")
+	}
+}
+
+func (c *Control) run(command string, arguments []string) ([]string, error) {
+	switch {
+	case command == ControlCommandStats && len(arguments) == 0:
+		return c.statsLines(), nil
+	case command == ControlCommandFlush && len(arguments) == 0:
+		flushed := c.cache.DeleteFunc(func(string) bool { return true })
+		return []string{fmt.Sprintf("flushed %d", flushed)}, nil
+	case command == ControlCommandFlush && len(arguments) == 1:
+		name := strings.ToLower(strings.TrimSuffix(arguments[0], ".")) + "."
+		flushed := c.cache.DeleteFunc(func(key string) bool {
+			keyName, _, _ := strings.Cut(key, ":")
+			return strings.EqualFold(keyName, name)
+		})
+		return []string{fmt.Sprintf("flushed %d", flushed)}, nil
+	case command == ControlCommandReload && len(arguments) == 0:
+		return c.reload()
+	case command == ControlCommandConfig && len(arguments) == 0:
+		lines := c.config.Lines()
+		lines = append(lines, "# policies: "+strings.Join(c.policy.Load().PolicyNames(), ","))
+		return lines, nil
+	case command == ControlCommandRecent:
+		filter, err := parseRecentQueryFilter(arguments)
+		if err != nil {
+			return nil, err
+		}
+
+		return c.recent.recentQueryLines(filter, c.redactor)
+	}
+
+	return nil, fmt.Errorf("unknown command")
+}
+
+// parseRecentQueryFilter parses arguments like client=192.0.2.0/24, name=example.com and verdict=deny.
+func parseRecentQueryFilter(arguments []string) (RecentQueryFilter, error) {
+	filter := RecentQueryFilter{}
+	for _, argument := range arguments {
+		key, value, found := strings.Cut(argument, "=")
+		if !found || value == "" {
+			return filter, fmt.Errorf("invalid filter '%s'", argument)
+		}
+
+		switch key {
+		case "client":
+			filter.Client = value
+		case "name":
+			filter.Name = value
+		case "verdict":
+			filter.Verdict = value
+		default:
+			return filter, fmt.Errorf("invalid filter '%s'", argument)
+		}
+	}
+
+	return filter, nil
+}
+
+func (c *Control) statsLines() []string {
+	return []string{
+		fmt.Sprintf("queries %d", c.metrics.queries.Load()),
+		fmt.Sprintf("allowed %d", c.metrics.allowed.Load()),
+		fmt.Sprintf("denied %d", c.metrics.denied.Load()),
+		fmt.Sprintf("audited %d", c.metrics.audited.Load()),
+		fmt.Sprintf("errors %d", c.metrics.errors.Load()),
+		fmt.Sprintf("cache-hits %d", c.metrics.cacheHits.Load()),
+		fmt.Sprintf("external-requests %d", c.metrics.externalRequests.Load()),
+		fmt.Sprintf("cache-size %d", c.cache.Size()),
+		fmt.Sprintf("cache-capacity %d", c.cache.Capacity()),
+	}
+}
+
+// reload reads the rule files again. Settings in the config file need a restart.
+func (c *Control) reload() ([]string, error) {
+	c.reloadMutex.Lock()
+	defer c.reloadMutex.Unlock()
+
+	policy, err := NewPolicy(c.configDirectory, c.config.DenyPunycode, c.config.PinResponseDomain)
+	if err != nil {
+		lines := make([]string, 0)
+		for _, configError := range ConfigErrors(err) {
+			lines = append(lines, configError.Error())
+		}
+
+		return lines, fmt.Errorf("reload failed, keeping the current policy")
+	}
+
+	if policy.bindsListenAddresses() != c.policy.Load().bindsListenAddresses() {
+		return nil, fmt.Errorf("reload failed, adding or removing listen bindings in policies.d needs a restart")
+	}
+
+	policy.SetBreakGlass(c.policy.Load().breakGlass)
+	c.policy.Store(policy)
+	slog.Info("control: policy reloaded")
+
+	return nil, nil
+}
+
+// tail streams queries until the client disconnects, in a slot of its own so tails never keep other commands out.
+func (c *Control) tail(conn *net.UnixConn, release func()) {
+	select {
+	case c.tailConnections <- struct{}{}:
+		defer func() {
+			<-c.tailConnections
+		}()
+	default:
+		_, _ = conn.Write([]byte("error busy\n"))
+		return
+	}
+	release()
+
+	err := conn.SetDeadline(time.Time{})
+	if err != nil {
+		return
+	}
+
+	lines := make(chan string, controlTailBuffer)
+	c.tailMutex.Lock()
+	c.tails[lines] = struct{}{}
+	c.tailMutex.Unlock()
+
+	defer func() {
+		c.tailMutex.Lock()
+		delete(c.tails, lines)
+		c.tailMutex.Unlock()
+	}()
+
+	// the client does not send anything after the command, so a read returns when it disconnects
+	closed := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+
+	_, err = conn.Write([]byte("ok\n"))
+	if err != nil {
+		return
+	}
+
+	for {
+		select {
+		case line := <-lines:
+			err = conn.SetWriteDeadline(time.Now().Add(controlTimeout))
+			if err != nil {
+				return
+			}
+
+			_, err = conn.Write([]byte(line + "\n"))
+			if err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// publish sends a result to all tail connections, dropping it for a connection that is not keeping up rather than
+// blocking the caller.
+func (c *Control) publish(result workerResult) {
+	if result.question == nil {
+		return
+	}
+
+	c.tailMutex.Lock()
+	defer c.tailMutex.Unlock()
+
+	if len(c.tails) == 0 {
+		return
+	}
+
+	line := c.tailLine(result)
+	for lines := range c.tails {
+		select {
+		case lines <- line:
+		default:
+		}
+	}
+}
+
+func (c *Control) tailLine(result workerResult) string {
+	name := c.redactor.name(strings.TrimSuffix(result.question.Name, "."))
+	reasons := c.redactor.reasons(reasonStrings(result.auditReasons))
+	return queryLogLine(result.verdict(), name, result.question.Type.Name(), reasons)
+}
+
+func peerCredentials(conn *net.UnixConn) (*unix.Ucred, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var ucred *unix.Ucred
+	var ucredErr error
+	err = rawConn.Control(func(fd uintptr) {
+		ucred, ucredErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ucred, ucredErr
+}
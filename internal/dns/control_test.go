@@ -0,0 +1,185 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tinfoil-factory/netfoil/internal/lru"
+)
+
+func newTestControl(t *testing.T) (*Control, string) {
+	path := filepath.Join(t.TempDir(), "control")
+	listener, err := ListenControl(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	dohURL, err := url.Parse("https://example.com/dns-query")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	currentPolicy := &atomic.Pointer[Policy]{}
+	currentPolicy.Store(newExplainTestPolicy(t))
+
+	control := NewControl(listener, t.TempDir(), nil)
+	control.config = &Config{DoHURL: dohURL, Enforce: true}
+	control.cache = lru.NewCache[timedResponse](16)
+	control.policy = currentPolicy
+	control.metrics = newMetrics()
+	control.recent = NewRecentQueries(16)
+	control.start()
+
+	return control, path
+}
+
+func controlRequest(t *testing.T, path string, request string) []string {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = fmt.Fprintf(conn, "%s\n", request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	return lines
+}
+
+func TestControl(t *testing.T) {
+	control, path := newTestControl(t)
+
+	for _, key := range []string{"example.com.:1", "Example.com.:28", "www.example.com.:1"} {
+		control.cache.Set(key, &timedResponse{})
+	}
+
+	control.metrics.add(workerResult{question: &Question{Name: "example.com.", Type: RecordTypeA}, allowed: true, cacheHit: true})
+
+	lines := controlRequest(t, path, "stats")
+	if len(lines) == 0 || lines[len(lines)-1] != "ok" || !slices.Contains(lines, "queries 1") || !slices.Contains(lines, "cache-size 3") {
+		t.Errorf("unexpected stats %v", lines)
+	}
+
+	lines = controlRequest(t, path, "flush example.com")
+	if !slices.Equal(lines, []string{"flushed 2", "ok"}) {
+		t.Errorf("unexpected flush %v", lines)
+	}
+
+	lines = controlRequest(t, path, "flush")
+	if !slices.Equal(lines, []string{"flushed 1", "ok"}) {
+		t.Errorf("unexpected flush %v", lines)
+	}
+
+	lines = controlRequest(t, path, "config")
+	if !slices.Contains(lines, "DoHURL=https://example.com/dns-query") || !slices.Contains(lines, "Enforce=true") {
+		t.Errorf("unexpected config %v", lines)
+	}
+
+	lines = controlRequest(t, path, "reload")
+	if len(lines) == 0 || lines[len(lines)-1] != "error reload failed, keeping the current policy" {
+		t.Errorf("unexpected reload %v", lines)
+	}
+
+	control.recent.add(time.Now(), workerResult{question: &Question{Name: "example.com.", Type: RecordTypeA}, allowed: true})
+	lines = controlRequest(t, path, "recent name=example.com verdict=allow")
+	if len(lines) < 2 || !strings.HasSuffix(lines[0], "allow|example.com|A") || lines[len(lines)-1] != "ok" {
+		t.Errorf("unexpected recent %v", lines)
+	}
+
+	lines = controlRequest(t, path, "recent verdict=deny")
+	if !slices.Equal(lines, []string{"ok"}) {
+		t.Errorf("unexpected recent %v", lines)
+	}
+
+	lines = controlRequest(t, path, "recent since=1h")
+	if !slices.Equal(lines, []string{"error invalid filter 'since=1h'"}) {
+		t.Errorf("unexpected recent %v", lines)
+	}
+
+	lines = controlRequest(t, path, "shutdown now")
+	if !slices.Equal(lines, []string{"error unknown command"}) {
+		t.Errorf("unexpected response %v", lines)
+	}
+}
+
+func TestControlTail(t *testing.T) {
+	control, path := newTestControl(t)
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = fmt.Fprintf(conn, "tail\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scanner := bufio.NewScanner(conn)
+	if !scanner.Scan() || scanner.Text() != "ok" {
+		t.Fatalf("expected ok, got '%s'", scanner.Text())
+	}
+
+	control.publish(workerResult{question: &Question{Name: "example.com.", Type: RecordTypeA}, allowed: true})
+	control.publish(workerResult{question: &Question{Name: "bad.example.com.", Type: RecordTypeAAAA}})
+
+	expected := []string{"allow|example.com|A", "deny|bad.example.com|AAAA"}
+	for _, e := range expected {
+		if !scanner.Scan() || scanner.Text() != e {
+			t.Errorf("expected '%s', got '%s'", e, scanner.Text())
+		}
+	}
+}
+
+func TestControlTails(t *testing.T) {
+	_, path := newTestControl(t)
+
+	for range controlMaxTails {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		_, err = fmt.Fprintf(conn, "tail\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		scanner := bufio.NewScanner(conn)
+		if !scanner.Scan() || scanner.Text() != "ok" {
+			t.Fatalf("expected ok, got '%s'", scanner.Text())
+		}
+	}
+
+	lines := controlRequest(t, path, "tail")
+	if len(lines) != 1 || lines[0] != "error busy" {
+		t.Errorf("expected another tail to be busy, got %v", lines)
+	}
+
+	// the tails do not hold the slots of the commands
+	lines = controlRequest(t, path, "stats")
+	if len(lines) == 0 || lines[len(lines)-1] != "ok" {
+		t.Errorf("expected stats while tailing, got %v", lines)
+	}
+}
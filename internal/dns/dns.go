@@ -101,6 +101,26 @@ func (r RecordType) Name() string {
 	}
 }
 
+func ParseRecordType(s string) (RecordType, error) {
+	switch strings.ToUpper(s) {
+	case "A":
+		return RecordTypeA, nil
+	case "CNAME":
+		return RecordTypeCNAME, nil
+	case "AAAA":
+		return RecordTypeAAAA, nil
+	case "HTTPS":
+		return RecordTypeHTTPS, nil
+	default:
+		v, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("unknown record type '%s'", s)
+		}
+
+		return RecordType(v), nil
+	}
+}
+
 type Header struct {
 	TransactionID         uint16
 	Flags                 uint16
@@ -2,6 +2,7 @@ package dns
 
 import (
 	"bytes"
+	"context"
 	"crypto/x509"
 	"encoding/binary"
 	"errors"
@@ -9,9 +10,12 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	"net/netip"
 	"os"
 	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tinfoil-factory/netfoil/internal/lru"
@@ -24,16 +28,41 @@ const (
 	ConnectionTypeTCP = "TCP"
 )
 
+// OverloadResponse is the answer to a UDP query that is shed because all workers are busy and the queue is full.
+type OverloadResponse string
+
+const (
+	OverloadResponseServFail OverloadResponse = "servfail"
+	OverloadResponseRefused  OverloadResponse = "refused"
+	OverloadResponseDrop     OverloadResponse = "drop"
+)
+
+const (
+	logMessageShed   = "queries shed"
+	overloadLogEvery = 10 * time.Second
+
+	logMessageShuttingDown = "shutting down"
+	logMessageStopped      = "stopped"
+)
+
 type workerTask struct {
 	rawRequest     []byte
 	responseLength int
 	udpRemote      *net.UDPAddr
 	connectionType ConnectionType
 	remote         string
+	remoteAddr     netip.Addr
+	localAddr      netip.Addr
+	localPort      uint16
+	// answered from the cache or the policy only, and shed when it needs the upstream
+	cacheOnly bool
 }
 
 type workerResult struct {
 	remote             *net.UDPAddr
+	local              netip.Addr
+	connectionType     ConnectionType
+	client             string
 	question           *Question
 	response           *Response
 	marshalledResponse []byte
@@ -41,8 +70,12 @@ type workerResult struct {
 	cacheHit           bool
 	externalRequest    bool
 	pinned             bool
+	audited            bool
+	auditReasons       []FilterReason
+	breakGlass         bool
 	logEvents          []LogEvent
 	filterReasons      []FilterReason
+	shed               bool
 	time               time.Duration
 	err                error
 }
@@ -53,8 +86,14 @@ type worker struct {
 	dohClient      *DoHClient
 	taskQueue      <-chan workerTask
 	resultsChannel chan<- workerResult
-	policy         *Policy
+	policy         *atomic.Pointer[Policy]
 	tcpConnQueue   <-chan *net.TCPConn
+	dnstap         *Dnstap
+	clientLimiter  *rateLimiter
+	// nil for the overflow worker, whose queries are no progress of the workers
+	systemd *SystemdNotify
+	// done when shutting down, so open TCP connections are closed between queries
+	ctx context.Context
 }
 
 type timedResponse struct {
@@ -88,69 +127,227 @@ func (t *timedResponse) rewriteTTLs() (result *Response, stillValid bool) {
 	return result, ok
 }
 
-func Server(conn *net.UDPConn, tcpListener *net.TCPListener, config *Config, policy *Policy, caCertPool *x509.CertPool) error {
+// ServerOptions are the optional parts of Server, each nil when not used.
+type ServerOptions struct {
+	// nil when there is no control socket
+	Control *Control
+	// nil when metrics are not served
+	MetricsListener net.Listener
+	// nil when no dnstap messages are written
+	Dnstap *Dnstap
+	// nil without AuditLogFile=
+	AuditLog *AuditLog
+	// nil with RecentQueries=0
+	Recent *RecentQueries
+	// nil when notifications are off
+	Notifier *Notifier
+	// nil when not started by systemd with Type=notify
+	Systemd *SystemdNotify
+}
+
+// Server serves DNS on conn and tcpListener until ctx is done, then stops reading and accepting, and returns once the
+// queries in flight are answered or ShutdownTimeout= passed.
+func Server(ctx context.Context, conn *net.UDPConn, tcpListener *net.TCPListener, config *Config, policy *Policy, caCertPool *x509.CertPool, options ServerOptions) error {
+	control := options.Control
+	dnstap := options.Dnstap
+	auditLog := options.AuditLog
+	recent := options.Recent
+	notifier := options.Notifier
+	systemd := options.Systemd
+
 	dohClient, err := NewDoHClient(config.DoHURL, config.DoHIPs, caCertPool)
 	if err != nil {
 		return err
 	}
 
 	cache := lru.NewCache[timedResponse](4096)
+	m := newMetrics()
+	m.cache = cache
+	dohClient.metrics = m
+	dohClient.dnstap = dnstap
+	m.dnstap = dnstap
+	m.notifier = notifier
+
+	clientLimiter := newClientRateLimiter(config)
+	responseLimiter := newResponseRateLimiter(config)
+	m.clientLimiter = clientLimiter
+	m.responseLimiter = responseLimiter
+	clientLimiter.start()
+	responseLimiter.start()
+
+	// replaced by a reload from the control socket
+	currentPolicy := &atomic.Pointer[Policy]{}
+	currentPolicy.Store(policy)
+
+	if control != nil {
+		control.config = config
+		control.cache = cache
+		control.policy = currentPolicy
+		control.metrics = m
+		control.recent = recent
+		control.start()
+	}
+
+	tasksChannel := make(chan workerTask, config.QueueSize)
+	resultsChannel := make(chan workerResult, config.QueueSize)
 
-	numWorkers := 20
-	channelSize := 50
-	tasksChannel := make(chan workerTask, channelSize)
-	resultsChannel := make(chan workerResult, channelSize)
+	// the workers and the accept loop, which send to resultsChannel
+	senders := sync.WaitGroup{}
 
-	for i := 0; i < numWorkers; i++ {
+	for i := 0; i < int(config.Workers); i++ {
 		worker := &worker{
 			cache:          cache,
 			config:         config,
 			dohClient:      dohClient,
 			taskQueue:      tasksChannel,
 			resultsChannel: resultsChannel,
-			policy:         policy,
+			policy:         currentPolicy,
+			dnstap:         dnstap,
+			systemd:        systemd,
+		}
+		worker.start(&senders)
+	}
+
+	// serves queries from the cache on the reader when the queue is full
+	overflowWorker := &worker{
+		cache:     cache,
+		config:    config,
+		dohClient: dohClient,
+		policy:    currentPolicy,
+		dnstap:    dnstap,
+	}
+
+	packetInfo := false
+	if policy.bindsListenAddresses() {
+		err = enablePacketInfo(conn)
+		if err != nil {
+			return err
 		}
-		worker.start()
+		packetInfo = true
 	}
+	listenAddr := addrFromNetAddr(conn.LocalAddr())
+	listenPort := portFromNetAddr(conn.LocalAddr())
+
+	// held while a result is handled, so none is handled after Server gave up waiting and returned
+	handling := sync.Mutex{}
+	abandoned := false
 
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
+
+		shed := 0
+		shedLogged := time.Time{}
 		for result := range resultsChannel {
-			if result.err != nil {
-				fmt.Printf("error: %s\n", result.err.Error())
+			handling.Lock()
+			if abandoned {
+				handling.Unlock()
+				return
+			}
+
+			m.add(result)
+
+			if result.shed {
+				shed++
+				now := time.Now()
+				if now.Sub(shedLogged) >= overloadLogEvery {
+					slog.Warn(logMessageShed, "count", shed, "response", string(config.OverloadResponse))
+					shed = 0
+					shedLogged = now
+				}
 			} else {
-				logResult(config, result)
+				recent.add(time.Now(), result)
+				if control != nil {
+					control.publish(result)
+				}
+
+				if result.err != nil {
+					logError(result)
+				} else {
+					logResult(config, result)
+
+					auditErr := auditLog.record(result)
+					if auditErr != nil {
+						slog.Error("failed to write audit log", "error", auditErr.Error())
+					}
+
+					notifier.notify(time.Now(), result)
+				}
 			}
 
-			if result.marshalledResponse != nil {
-				_, err = conn.WriteToUDP(result.marshalledResponse, result.remote)
+			response := responseLimiter.limitResponse(time.Now(), result)
+			if response != nil {
+				var err error
+				if packetInfo && result.local.IsValid() {
+					_, _, err = conn.WriteMsgUDP(response, packetInfoSource(result.local), result.remote)
+				} else {
+					_, err = conn.WriteToUDP(response, result.remote)
+				}
 				if err != nil {
-					fmt.Printf("error: failed to write UDP response: %s\n", err.Error())
+					slog.Error("failed to write UDP response", "error", err.Error())
 				}
 			}
+
+			handling.Unlock()
 		}
 	}()
 
-	maxTCPWorkers := 10
-	tcpConnQueue := make(chan *net.TCPConn, 50)
+	tcpConnQueue := make(chan *net.TCPConn, config.TCPQueueSize)
 
-	for i := 0; i < maxTCPWorkers; i++ {
+	for i := 0; i < int(config.TCPWorkers); i++ {
 		tcpWorker := &worker{
 			cache:          cache,
 			config:         config,
 			dohClient:      dohClient,
 			taskQueue:      tasksChannel,
 			resultsChannel: resultsChannel,
-			policy:         policy,
+			policy:         currentPolicy,
 			tcpConnQueue:   tcpConnQueue,
+			dnstap:         dnstap,
+			clientLimiter:  clientLimiter,
+			systemd:        systemd,
+			ctx:            ctx,
+		}
+		tcpWorker.startTCP(&senders)
+	}
+
+	if options.MetricsListener != nil {
+		m.queues = []queueGauge{
+			{name: "tasks", length: func() int { return len(tasksChannel) }, capacity: cap(tasksChannel)},
+			{name: "results", length: func() int { return len(resultsChannel) }, capacity: cap(resultsChannel)},
+			{name: "tcp", length: func() int { return len(tcpConnQueue) }, capacity: cap(tcpConnQueue)},
 		}
-		tcpWorker.startTCP()
+		m.serve(options.MetricsListener)
 	}
 
+	// unblocks the reads and accepts below
+	context.AfterFunc(ctx, func() {
+		slog.Info(logMessageShuttingDown)
+
+		err := conn.SetReadDeadline(time.Now())
+		if err != nil {
+			slog.Error("failed to stop reading from UDP", "error", err.Error())
+		}
+
+		err = tcpListener.Close()
+		if err != nil {
+			slog.Error("failed to close TCP listener", "error", err.Error())
+		}
+	})
+
+	senders.Add(1)
 	go func() {
+		defer senders.Done()
+		defer close(tcpConnQueue)
+
 		for {
 			conn, err := tcpListener.Accept()
 			if err != nil {
-				err = fmt.Errorf("error: failed to accept connection: %w\n", err)
+				if ctx.Err() != nil {
+					return
+				}
+
+				err = fmt.Errorf("failed to accept connection: %w", err)
 				resultsChannel <- workerResult{
 					err: err,
 				}
@@ -161,9 +358,10 @@ func Server(conn *net.UDPConn, tcpListener *net.TCPListener, config *Config, pol
 			select {
 			case tcpConnQueue <- tcpConn:
 			default:
+				m.shedTCP.Add(1)
 				err = conn.Close()
 				if err != nil {
-					err = fmt.Errorf("error: %w\n", err)
+					err = fmt.Errorf("failed to close queued TCP connection: %w", err)
 					resultsChannel <- workerResult{
 						err: err,
 					}
@@ -173,11 +371,28 @@ func Server(conn *net.UDPConn, tcpListener *net.TCPListener, config *Config, pol
 		}
 	}()
 
+	// the policy is loaded, the DoH client built and the listeners set up
+	systemd.start(ctx, m, func() int {
+		return len(tasksChannel) + len(resultsChannel) + len(tcpConnQueue)
+	})
+
+	oob := make([]byte, 128)
 	for {
 		buf := make([]byte, 1024)
-		responseLength, remote, err := conn.ReadFromUDP(buf[:])
+		var responseLength, oobLength int
+		var remote *net.UDPAddr
+		var err error
+		if packetInfo {
+			responseLength, oobLength, _, remote, err = conn.ReadMsgUDP(buf[:], oob)
+		} else {
+			responseLength, remote, err = conn.ReadFromUDP(buf[:])
+		}
 		if err != nil {
-			err = fmt.Errorf("error: reading from UDP: %w\n", err)
+			if ctx.Err() != nil {
+				break
+			}
+
+			err = fmt.Errorf("reading from UDP: %w", err)
 
 			resultsChannel <- workerResult{
 				err: err,
@@ -186,32 +401,99 @@ func Server(conn *net.UDPConn, tcpListener *net.TCPListener, config *Config, pol
 			continue
 		}
 
+		// dropped before a worker is busy with it
+		if responseLength > 0 && !clientLimiter.allowClient(time.Now(), addrFromNetAddr(remote)) {
+			continue
+		}
+
 		if responseLength > 0 {
+			localAddr := listenAddr
+			if packetInfo {
+				addr, found := packetInfoDestination(oob[:oobLength])
+				if found {
+					localAddr = addr
+				}
+			}
+
 			workerTask := workerTask{
 				rawRequest:     buf,
 				responseLength: responseLength,
 				udpRemote:      remote,
 				remote:         remote.String(),
+				remoteAddr:     addrFromNetAddr(remote),
+				localAddr:      localAddr,
+				localPort:      listenPort,
 				connectionType: ConnectionTypeUDP,
 			}
 
-			tasksChannel <- workerTask
+			select {
+			case tasksChannel <- workerTask:
+			default:
+				// all workers are busy, so only what needs no upstream request is answered
+				workerTask.cacheOnly = true
+				result := overflowWorker.run(&workerTask)
+
+				// nor does the reader wait for a full results queue, the query is dropped and the client retries
+				select {
+				case resultsChannel <- result:
+				default:
+					m.shedUDP.Add(1)
+				}
+			}
 		}
 	}
+
+	systemd.stopping()
+
+	close(tasksChannel)
+	go func() {
+		senders.Wait()
+		close(resultsChannel)
+	}()
+
+	select {
+	case <-done:
+		slog.Info(logMessageStopped)
+	case <-time.After(config.ShutdownTimeout):
+		// the results still to come are dropped, as the audit log and dnstap are closed next
+		handling.Lock()
+		abandoned = true
+		handling.Unlock()
+
+		slog.Warn(logMessageStopped, "error", "queries still in flight after "+config.ShutdownTimeout.String())
+	}
+
+	return nil
 }
 
 func (w *worker) handleTCPConnection(conn *net.TCPConn) {
 	request := bytes.Buffer{}
 	buf := make([]byte, 1024)
 
+	// a read waiting for the next query returns when shutting down
+	stop := context.AfterFunc(w.ctx, func() {
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
 	var length *int = nil
 	for {
 		err := conn.SetReadDeadline(time.Now().Add(tcpServerReadWriteTimeout))
+		if err == nil && w.ctx.Err() != nil {
+			err = conn.Close()
+			if err != nil {
+				w.resultsChannel <- workerResult{
+					err: fmt.Errorf("failed to close TCP connection on shutdown: %w", err),
+				}
+			}
+
+			return
+		}
 		if err != nil {
-			err := fmt.Errorf("error: failed to set read deadline: %s\n", err.Error())
+			err := fmt.Errorf("failed to set read deadline: %s", err.Error())
 			closeErr := conn.Close()
 			if closeErr != nil {
-				err = fmt.Errorf("error: %w %w\n", err, closeErr)
+				err = fmt.Errorf("%w %w", err, closeErr)
 			}
 
 			w.resultsChannel <- workerResult{
@@ -240,14 +522,14 @@ func (w *worker) handleTCPConnection(conn *net.TCPConn) {
 					// ignore
 					err = nil
 				} else {
-					err = fmt.Errorf("error: reading from TCP: %w\n", err)
+					err = fmt.Errorf("reading from TCP: %w", err)
 				}
 				closeErr := conn.Close()
 				if closeErr != nil {
 					if err != nil {
-						err = fmt.Errorf("error: %w %w\n", err, closeErr)
+						err = fmt.Errorf("%w %w", err, closeErr)
 					} else {
-						err = fmt.Errorf("error: failed to close TCP: %w\n", closeErr)
+						err = fmt.Errorf("failed to close TCP: %w", closeErr)
 					}
 				}
 
@@ -277,32 +559,54 @@ func (w *worker) handleTCPConnection(conn *net.TCPConn) {
 			goto continueRead
 		}
 
+		if !w.clientLimiter.allowClient(time.Now(), addrFromNetAddr(conn.RemoteAddr())) {
+			err = conn.Close()
+			if err != nil {
+				w.resultsChannel <- workerResult{
+					err: fmt.Errorf("failed to close rate limited TCP connection: %w", err),
+				}
+			}
+
+			return
+		}
+
 		workerTask := workerTask{
 			rawRequest:     request.Bytes()[2:requestTotalLength],
 			responseLength: *length,
 			udpRemote:      nil,
 			connectionType: ConnectionTypeTCP,
 			remote:         conn.RemoteAddr().String(),
+			remoteAddr:     addrFromNetAddr(conn.RemoteAddr()),
+			localAddr:      addrFromNetAddr(conn.LocalAddr()),
+			localPort:      portFromNetAddr(conn.LocalAddr()),
 		}
 
 		start := time.Now()
 		result, err := w.process(&workerTask)
 		elapsed := time.Since(start)
 
-		w.resultsChannel <- workerResult{
+		tcpResult := workerResult{
 			remote:          nil,
+			connectionType:  ConnectionTypeTCP,
+			client:          workerTask.remote,
 			question:        result.question,
 			response:        result.response,
 			allowed:         result.allowed,
 			cacheHit:        result.cacheHit,
 			externalRequest: result.externalRequest,
 			pinned:          result.pinned,
+			audited:         result.audited,
+			auditReasons:    result.auditReasons,
+			breakGlass:      result.breakGlass,
 			logEvents:       result.logEvents,
 			filterReasons:   result.filterReasons,
 			time:            elapsed,
 			err:             err,
 		}
 
+		w.dnstap.client(&workerTask, start, tcpResult, result.marshalledResponse)
+		w.resultsChannel <- tcpResult
+
 		if request.Len() > requestTotalLength {
 			residual := slices.Clone(request.Bytes()[requestTotalLength:])
 			request.Reset()
@@ -319,7 +623,7 @@ func (w *worker) handleTCPConnection(conn *net.TCPConn) {
 				err = fmt.Errorf("error marshalling TCP length: %w", err)
 				closeErr := conn.Close()
 				if closeErr != nil {
-					err = fmt.Errorf("error: %w %w\n", err, closeErr)
+					err = fmt.Errorf("%w %w", err, closeErr)
 				}
 
 				w.resultsChannel <- workerResult{
@@ -331,10 +635,10 @@ func (w *worker) handleTCPConnection(conn *net.TCPConn) {
 
 			err = conn.SetWriteDeadline(time.Now().Add(tcpServerReadWriteTimeout))
 			if err != nil {
-				err = fmt.Errorf("error: failed to set write deadline: %w", err)
+				err = fmt.Errorf("failed to set write deadline: %w", err)
 				closeErr := conn.Close()
 				if closeErr != nil {
-					err = fmt.Errorf("error: %w %w\n", err, closeErr)
+					err = fmt.Errorf("%w %w", err, closeErr)
 				}
 
 				w.resultsChannel <- workerResult{
@@ -346,10 +650,10 @@ func (w *worker) handleTCPConnection(conn *net.TCPConn) {
 
 			_, err = conn.Write(bf.Bytes())
 			if err != nil {
-				err = fmt.Errorf("error: failed to write TCP length: %w", err)
+				err = fmt.Errorf("failed to write TCP length: %w", err)
 				closeErr := conn.Close()
 				if closeErr != nil {
-					err = fmt.Errorf("error: %w %w\n", err, closeErr)
+					err = fmt.Errorf("%w %w", err, closeErr)
 				}
 
 				w.resultsChannel <- workerResult{
@@ -361,10 +665,10 @@ func (w *worker) handleTCPConnection(conn *net.TCPConn) {
 
 			_, err = conn.Write(result.marshalledResponse)
 			if err != nil {
-				err = fmt.Errorf("error: failed to write TCP response: %w", err)
+				err = fmt.Errorf("failed to write TCP response: %w", err)
 				closeErr := conn.Close()
 				if closeErr != nil {
-					err = fmt.Errorf("error: %w %w\n", err, closeErr)
+					err = fmt.Errorf("%w %w", err, closeErr)
 				}
 
 				w.resultsChannel <- workerResult{
@@ -377,129 +681,54 @@ func (w *worker) handleTCPConnection(conn *net.TCPConn) {
 	}
 }
 
-func logResult(config *Config, result workerResult) {
-	nameWithoutTrailingDot := strings.TrimSuffix(result.question.Name, ".")
-	if result.allowed && config.LogAllowed {
-		fmt.Printf("allow|%s|%s\n", nameWithoutTrailingDot, result.question.Type.Name())
-	}
-
-	if !result.allowed && config.LogDenied {
-		fmt.Printf("deny|%s|%s\n", nameWithoutTrailingDot, result.question.Type.Name())
-	}
-
-	if config.LogLevel == slog.LevelDebug {
-		fmt.Printf("result\n")
-		for _, logEvent := range result.logEvents {
-			fmt.Printf("  %s\n", logEvent)
-		}
-
-		if len(result.filterReasons) > 0 {
-			fmt.Printf("  filter\n")
-		}
-		for _, reason := range result.filterReasons {
-			fmt.Printf("    %s\n", reason)
-		}
-
-		fmt.Printf("  cache hit: %t, external request: %t, pinned: %t\n", result.cacheHit, result.externalRequest, result.pinned)
-		if result.response != nil {
-			fmt.Printf("  response [%s]\n", result.response.Flags.RCODE.Name())
-			for _, answer := range result.response.Answers {
-				fmt.Printf("    name: %s\n", answer.Name)
-				fmt.Printf("      type: %d\n", answer.Type)
-				fmt.Printf("      TTL: %d\n", answer.TTL)
-
-				switch answer.Type {
-				case RecordTypeA:
-					fmt.Printf("      IPv4: %s\n", answer.IPv4.String())
-				case RecordTypeCNAME:
-					fmt.Printf("      CNAME: %s\n", answer.CNAME)
-				case RecordTypeAAAA:
-					fmt.Printf("      IPv6: %s\n", answer.IPv6.String())
-				case RecordTypeHTTPS:
-					name := "."
-					if answer.HTTPSRecord.TargetName != "" {
-						name = answer.HTTPSRecord.TargetName
-					}
-
-					alpn := ""
-					if len(answer.HTTPSRecord.ALPN) > 0 {
-						alpn = fmt.Sprintf(" alpn=\"%s\"", strings.Join(answer.HTTPSRecord.ALPN, ","))
-					}
-
-					ipv4Hints := ""
-					if len(answer.HTTPSRecord.IPv4Hint) > 0 {
-						sb := strings.Builder{}
-						for i, h := range answer.HTTPSRecord.IPv4Hint {
-							sb.WriteString(h.String())
-							if i < len(answer.HTTPSRecord.IPv4Hint)-1 {
-								sb.WriteString(",")
-							}
-						}
-
-						ipv4Hints = fmt.Sprintf(" ipv4hint=%s", sb.String())
-					}
-
-					ipv6Hints := ""
-					if len(answer.HTTPSRecord.IPv6Hint) > 0 {
-						sb := strings.Builder{}
-						for i, h := range answer.HTTPSRecord.IPv6Hint {
-							sb.WriteString(h.String())
-							if i < len(answer.HTTPSRecord.IPv6Hint)-1 {
-								sb.WriteString(",")
-							}
-						}
-
-						ipv6Hints = fmt.Sprintf(" ipv6hint=%s", sb.String())
-					}
-
-					ech := ""
-					if answer.HTTPSRecord.ECH != nil {
-						sb := strings.Builder{}
-						for i, e := range answer.HTTPSRecord.ECH {
-							sb.WriteString(e.PublicName)
-							if i < len(answer.HTTPSRecord.ECH)-1 {
-								sb.WriteString(",")
-							}
-						}
-
-						ech = fmt.Sprintf(" ech=%s", sb.String())
-					}
+func (w *worker) start(senders *sync.WaitGroup) {
+	senders.Add(1)
+	go func() {
+		defer senders.Done()
 
-					fmt.Printf("      HTTPS: %d %s%s%s%s%s\n", answer.HTTPSRecord.Priority, name, alpn, ipv4Hints, ipv6Hints, ech)
-				}
-			}
+		for task := range w.taskQueue {
+			w.resultsChannel <- w.run(&task)
 		}
-		fmt.Printf("  time: %f\n", result.time.Seconds())
-	}
+	}()
 }
 
-func (w *worker) start() {
-	go func() {
-		for task := range w.taskQueue {
-			start := time.Now()
-			result, err := w.process(&task)
-			elapsed := time.Since(start)
+// run processes a UDP query.
+func (w *worker) run(task *workerTask) workerResult {
+	start := time.Now()
+	result, err := w.process(task)
+	elapsed := time.Since(start)
+
+	workerResult := workerResult{
+		remote:             task.udpRemote,
+		local:              task.localAddr,
+		connectionType:     task.connectionType,
+		client:             task.remote,
+		question:           result.question,
+		response:           result.response,
+		marshalledResponse: result.marshalledResponse,
+		allowed:            result.allowed,
+		cacheHit:           result.cacheHit,
+		externalRequest:    result.externalRequest,
+		pinned:             result.pinned,
+		audited:            result.audited,
+		auditReasons:       result.auditReasons,
+		breakGlass:         result.breakGlass,
+		logEvents:          result.logEvents,
+		filterReasons:      result.filterReasons,
+		shed:               result.shed,
+		time:               elapsed,
+		err:                err,
+	}
 
-			w.resultsChannel <- workerResult{
-				remote:             task.udpRemote,
-				question:           result.question,
-				response:           result.response,
-				marshalledResponse: result.marshalledResponse,
-				allowed:            result.allowed,
-				cacheHit:           result.cacheHit,
-				externalRequest:    result.externalRequest,
-				pinned:             result.pinned,
-				logEvents:          result.logEvents,
-				filterReasons:      result.filterReasons,
-				time:               elapsed,
-				err:                err,
-			}
-		}
-	}()
+	w.dnstap.client(task, start, workerResult, result.marshalledResponse)
+	return workerResult
 }
 
-func (w *worker) startTCP() {
+func (w *worker) startTCP(senders *sync.WaitGroup) {
+	senders.Add(1)
 	go func() {
+		defer senders.Done()
+
 		for conn := range w.tcpConnQueue {
 			w.handleTCPConnection(conn)
 		}
@@ -514,8 +743,18 @@ type processResponse struct {
 	cacheHit           bool
 	externalRequest    bool
 	pinned             bool
+	audited            bool
+	auditReasons       []FilterReason
+	breakGlass         bool
 	logEvents          []LogEvent
 	filterReasons      []FilterReason
+	shed               bool
+}
+
+// audit records a denial that is not enforced, since Enforce=false.
+func (p *processResponse) audit(filterReason ...FilterReason) {
+	p.audited = true
+	p.auditReasons = append(p.auditReasons, filterReason...)
 }
 
 func (p *processResponse) appendLogEvent(logEvent LogEvent) {
@@ -527,6 +766,9 @@ func (p *processResponse) appendFilterReason(filterReason ...FilterReason) {
 }
 
 func (w *worker) process(workerTask *workerTask) (processResponse, error) {
+	w.systemd.begin()
+	defer w.systemd.finish()
+
 	result := processResponse{
 		question:           nil,
 		response:           nil,
@@ -542,7 +784,8 @@ func (w *worker) process(workerTask *workerTask) (processResponse, error) {
 	// FIXME check for too large requests
 	responseLength := workerTask.responseLength
 	buf := workerTask.rawRequest
-	policy := w.policy
+	defaultPolicy := w.policy.Load()
+	policy := defaultPolicy.ForClient(workerTask.remoteAddr, workerTask.localAddr)
 
 	isTCP := false
 	if workerTask.connectionType == ConnectionTypeTCP {
@@ -552,6 +795,10 @@ func (w *worker) process(workerTask *workerTask) (processResponse, error) {
 		result.appendLogEvent(LogEvent(fmt.Sprintf("query from: %s [UDP]", workerTask.remote)))
 	}
 
+	if defaultPolicy.HasClientPolicies() {
+		result.appendLogEvent(LogEvent(fmt.Sprintf("policy: %s", policy.Name())))
+	}
+
 	request, err := UnmarshalRequest(buf[:responseLength])
 	if err != nil {
 		formatError, marshalErr := MarshalEmptyFormatError(buf[:responseLength])
@@ -572,12 +819,44 @@ func (w *worker) process(workerTask *workerTask) (processResponse, error) {
 	if supportedRequest(request) {
 		queryAllowed, filterReason := policy.queryIsAllowed(*question)
 		result.appendFilterReason(filterReason...)
+		if !queryAllowed && !w.config.Enforce {
+			result.audit(filterReason...)
+			queryAllowed = true
+		}
+
+		var rpzVerdict *rpzVerdict = nil
+		rpzTriggered := false
 		if queryAllowed {
+			rpzVerdict, rpzTriggered = policy.rpzQuery(question)
+			if rpzTriggered {
+				result.appendFilterReason(rpzVerdict.reason)
+
+				if !w.config.Enforce && rpzVerdict.action != rpzActionPassthru {
+					result.audit(rpzVerdict.reason)
+					rpzTriggered = false
+				} else if rpzVerdict.action == rpzActionDrop {
+					result.appendLogEvent("dropped by rpz")
+					return result, nil
+				}
+			}
+		}
+
+		if queryAllowed && rpzTriggered && (rpzVerdict.action == rpzActionNXDomain || rpzVerdict.action == rpzActionNoData) {
+			result.response = rpzVerdict.response
+		} else if queryAllowed {
+			// The cache holds unfiltered upstream answers that are filtered again on every hit, so it is shared by
+			// all client policies: a verdict never depends on which policy populated the cache.
 			key := fmt.Sprintf("%s:%d", question.Name, question.Type)
 
 			found := false
 			var candidateResponse *Response = nil
-			if len(policy.pinA) > 0 && question.Type == RecordTypeA {
+			if rpzTriggered && rpzVerdict.action == rpzActionLocalData {
+				found = true
+				candidateResponse = rpzVerdict.response
+				result.pinned = true
+			}
+
+			if !found && len(policy.pinA) > 0 && question.Type == RecordTypeA {
 				var ip net.IP = nil
 				questionName := strings.TrimSuffix(question.Name, ".")
 				ip, found = policy.pinA[questionName]
@@ -601,6 +880,10 @@ func (w *worker) process(workerTask *workerTask) (processResponse, error) {
 				}
 			}
 
+			if !found && workerTask.cacheOnly {
+				return w.shed(result, request)
+			}
+
 			if !found {
 				result.externalRequest = true
 				candidateResponse, err = w.dohClient.DoH(request)
@@ -639,11 +922,37 @@ func (w *worker) process(workerTask *workerTask) (processResponse, error) {
 
 			responseAllowed, filterReason := policy.responseIsAllowed(question.Name, question.Type, candidateResponse)
 			result.appendFilterReason(filterReason...)
+			if !responseAllowed && !w.config.Enforce {
+				result.audit(filterReason...)
+				responseAllowed = true
+			}
+
+			blockResponse := generateBlockResponse()
+			passthru := rpzTriggered && rpzVerdict.action == rpzActionPassthru
+			if responseAllowed && !passthru {
+				rpzVerdict, rpzTriggered = policy.rpzResponse(question, candidateResponse)
+				if rpzTriggered && !w.config.Enforce {
+					result.appendFilterReason(rpzVerdict.reason)
+					result.audit(rpzVerdict.reason)
+				} else if rpzTriggered {
+					result.appendFilterReason(rpzVerdict.reason)
+
+					switch rpzVerdict.action {
+					case rpzActionDrop:
+						result.appendLogEvent("dropped by rpz")
+						return result, nil
+					case rpzActionNXDomain, rpzActionNoData:
+						responseAllowed = false
+						blockResponse = rpzVerdict.response
+					}
+				}
+			}
+
 			if responseAllowed {
 				result.allowed = true
 				result.response = candidateResponse
 			} else {
-				result.response = generateBlockResponse()
+				result.response = blockResponse
 			}
 		} else {
 			result.response = generateBlockResponse()
@@ -661,6 +970,10 @@ func (w *worker) process(workerTask *workerTask) (processResponse, error) {
 		return result, nil
 	}
 
+	result.breakGlass = result.allowed && slices.ContainsFunc(result.filterReasons, isBreakGlassReason)
+	breakGlassTTL := policy.breakGlassTTL()
+
+	scheduleTTL, scheduled := policy.scheduleTTL(question, result.response)
 	for i, answer := range result.response.Answers {
 		if answer.TTL < w.config.MinTTL {
 			answer.TTL = w.config.MinTTL
@@ -670,6 +983,16 @@ func (w *worker) process(workerTask *workerTask) (processResponse, error) {
 			answer.TTL = w.config.MaxTTL
 		}
 
+		// a verdict that depends on a schedule must not be cached by the client past the next schedule change
+		if scheduled && answer.TTL > scheduleTTL {
+			answer.TTL = scheduleTTL
+		}
+
+		// the same for an answer only allowed because of break-glass
+		if result.breakGlass && answer.TTL > breakGlassTTL {
+			answer.TTL = breakGlassTTL
+		}
+
 		if answer.Type == RecordTypeHTTPS {
 			if w.config.RemoveECH {
 				answer.HTTPSRecord.ECH = make([]ECHConfig, 0)
@@ -687,3 +1010,22 @@ func (w *worker) process(workerTask *workerTask) (processResponse, error) {
 	result.marshalledResponse = marshalledResponse
 	return result, nil
 }
+
+// shed answers a query that needs an upstream request while all workers are busy with OverloadResponse=.
+func (w *worker) shed(result processResponse, request *Request) (processResponse, error) {
+	result.shed = true
+	result.appendLogEvent("shed due to overload")
+
+	var err error
+	switch w.config.OverloadResponse {
+	case OverloadResponseServFail:
+		result.marshalledResponse, err = MarshalServerFailure(request)
+	case OverloadResponseRefused:
+		result.marshalledResponse, err = MarshalRefusedResponse(request)
+	}
+	if err != nil {
+		return result, fmt.Errorf("failed to marshal overload response '%w'", err)
+	}
+
+	return result, nil
+}
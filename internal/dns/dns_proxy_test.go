@@ -0,0 +1,243 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/netip"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tinfoil-factory/netfoil/internal/lru"
+)
+
+func newAuditTestWorker(t *testing.T, enforce bool) *worker {
+	policy := newExplainTestPolicy(t)
+	policy.pinA = map[string]net.IP{
+		"bad.example.com": net.IPv4(10, 0, 0, 1),
+	}
+
+	currentPolicy := &atomic.Pointer[Policy]{}
+	currentPolicy.Store(policy)
+
+	return &worker{
+		cache: lru.NewCache[timedResponse](16),
+		config: &Config{
+			MaxTTL:  math.MaxUint32,
+			Enforce: enforce,
+		},
+		policy: currentPolicy,
+	}
+}
+
+func TestProcessAudit(t *testing.T) {
+	question := Question{Name: "bad.example.com.", Type: RecordTypeA, Class: ClassTypeIN}
+	request, err := MarshalRequest(1, Flags{RD: true}, question)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task := &workerTask{
+		rawRequest:     request,
+		responseLength: len(request),
+		connectionType: ConnectionTypeUDP,
+	}
+
+	w := newAuditTestWorker(t, true)
+	result, err := w.process(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.allowed || result.audited {
+		t.Errorf("expected an enforced deny")
+	}
+
+	if result.response.Flags.RCODE != ResponseCodeNXDomain {
+		t.Errorf("expected '%s', got '%s'", ResponseCodeNXDomain.Name(), result.response.Flags.RCODE.Name())
+	}
+
+	w = newAuditTestWorker(t, false)
+	result, err = w.process(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !result.allowed || !result.audited {
+		t.Errorf("expected an audited allow")
+	}
+
+	if len(result.response.Answers) != 1 || !result.response.Answers[0].IPv4.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("expected the pinned answer, got %v", result.response.Answers)
+	}
+
+	expected := []string{
+		"deny due to exact denylist: bad.example.com, rule 'bad.example.com' deny.exact:7",
+		"deny query",
+		"deny due to IPv4 denylist: 10.0.0.1, rule '10.0.0.0/8' deny.ipv4:2",
+		"deny due to response IPv4: 10.0.0.1",
+	}
+
+	if len(result.auditReasons) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, result.auditReasons)
+	}
+
+	for i := range expected {
+		if result.auditReasons[i].String() != expected[i] {
+			t.Errorf("expected '%s', got '%s'", expected[i], result.auditReasons[i])
+		}
+	}
+}
+
+func TestProcessCacheOnly(t *testing.T) {
+	question := Question{Name: "good.example.com.", Type: RecordTypeA, Class: ClassTypeIN}
+	request, err := MarshalRequest(1, Flags{RD: true}, question)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task := &workerTask{
+		rawRequest:     request,
+		responseLength: len(request),
+		connectionType: ConnectionTypeUDP,
+		cacheOnly:      true,
+	}
+
+	w := newAuditTestWorker(t, true)
+	w.config.OverloadResponse = OverloadResponseRefused
+	result, err := w.process(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !result.shed || result.externalRequest {
+		t.Fatalf("expected the query to be shed without an upstream request")
+	}
+
+	flags := UnmarshalFlags(binary.BigEndian.Uint16(result.marshalledResponse[2:4]))
+	if flags.RCODE != ResponseCodeRefused {
+		t.Errorf("expected '%s', got '%s'", ResponseCodeRefused.Name(), flags.RCODE.Name())
+	}
+
+	w.config.OverloadResponse = OverloadResponseDrop
+	result, err = w.process(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !result.shed || result.marshalledResponse != nil {
+		t.Errorf("expected the query to be shed without a response")
+	}
+
+	w.cache.Set(fmt.Sprintf("%s:%d", question.Name, question.Type), &timedResponse{
+		time:     time.Now(),
+		response: generateAResponse(&question, net.IPv4(93, 184, 216, 34)),
+	})
+
+	result, err = w.process(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.shed || !result.cacheHit || !result.allowed {
+		t.Errorf("expected an allowed answer from the cache")
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{
+		DoHURL:          &url.URL{Scheme: "https", Host: "dns.example.com", Path: "/dns-query"},
+		DoHIPs:          []netip.Addr{netip.MustParseAddr("192.0.2.1")},
+		MaxTTL:          math.MaxUint32,
+		Enforce:         true,
+		Workers:         2,
+		QueueSize:       4,
+		TCPWorkers:      2,
+		TCPQueueSize:    4,
+		ShutdownTimeout: 5 * time.Second,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- Server(ctx, conn, tcpListener, config, newExplainTestPolicy(t), nil, ServerOptions{})
+	}()
+
+	// denied without an upstream request
+	question := Question{Name: "bad.example.com.", Type: RecordTypeA, Class: ClassTypeIN}
+	request, err := MarshalRequest(1, Flags{RD: true}, question)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcpConn, err := net.Dial("tcp", tcpListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpConn.Close()
+
+	err = binary.Write(tcpConn, binary.BigEndian, uint16(len(request)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tcpConn.Write(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tcpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	length := uint16(0)
+	err = binary.Read(tcpConn, binary.BigEndian, &length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadFull(tcpConn, make([]byte, length))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the connection waits for another query
+	cancel()
+
+	select {
+	case err = <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the server to stop")
+	}
+
+	_, err = tcpConn.Read(make([]byte, 1))
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("expected the TCP connection to be closed, got %v", err)
+	}
+
+	_, err = net.Dial("tcp", tcpListener.Addr().String())
+	if err == nil {
+		t.Errorf("expected no more TCP connections to be accepted")
+	}
+}
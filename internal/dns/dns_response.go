@@ -180,6 +180,69 @@ func MarshalServerFailure(request *Request) ([]byte, error) {
 	return rp.Bytes(), nil
 }
 
+// marshalTruncated returns response without its records and with TC set, so the client retries over TCP.
+func marshalTruncated(response []byte, question Question) ([]byte, error) {
+	if len(response) < headerLength {
+		return nil, fmt.Errorf("response too short, expected at least %d, got %d", headerLength, len(response))
+	}
+
+	flags := UnmarshalFlags(binary.BigEndian.Uint16(response[2:4]))
+	flags.TC = true
+
+	header := &Header{
+		TransactionID:         binary.BigEndian.Uint16(response[0:2]),
+		Flags:                 MarshalFlags(flags),
+		NumberOfQuestions:     1,
+		NumberOfAnswers:       0,
+		NumberOfAuthorityRRs:  0,
+		NumberOfAdditionalRRs: 0,
+	}
+
+	rp := &bytes.Buffer{}
+	err := writeHeader(rp, header)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeQuestion(rp, question)
+	if err != nil {
+		return nil, err
+	}
+
+	return rp.Bytes(), nil
+}
+
+func MarshalRefusedResponse(request *Request) ([]byte, error) {
+	flags := Flags{
+		QR:     true, // this is a response
+		OPCODE: 0,
+		RCODE:  ResponseCodeRefused,
+		RA:     true,
+	}
+
+	header := &Header{
+		TransactionID:         request.TransactionID,
+		Flags:                 MarshalFlags(flags),
+		NumberOfQuestions:     1,
+		NumberOfAnswers:       0,
+		NumberOfAuthorityRRs:  0,
+		NumberOfAdditionalRRs: 0,
+	}
+
+	rp := &bytes.Buffer{}
+	err := writeHeader(rp, header)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeQuestion(rp, request.Question)
+	if err != nil {
+		return nil, err
+	}
+
+	return rp.Bytes(), nil
+}
+
 func MarshalNotImplementedResponse(request *Request) ([]byte, error) {
 	flags := Flags{
 		QR:     true, // this is a response
@@ -228,6 +291,20 @@ func generateBlockResponse() *Response {
 	return response
 }
 
+func generateNoDataResponse() *Response {
+	flags := Flags{
+		QR:     true, // this is a response
+		OPCODE: 0,
+		RCODE:  ResponseCodeNoError,
+		RA:     true,
+	}
+
+	return &Response{
+		Flags:   flags,
+		Answers: make([]Answer, 0),
+	}
+}
+
 func UnmarshalResponse(data []byte) (*Response, error) {
 	p := bytes.NewBuffer(data)
 
@@ -0,0 +1,552 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// https://dnstap.info, messages are encoded by hand following dnstap.proto and written as Frame Streams
+// (https://github.com/farsightsec/fstrm).
+
+const (
+	dnstapContentType   = "protobuf:dnstap.Dnstap"
+	dnstapQueueSize     = 1024
+	dnstapRetryInterval = 5 * time.Second
+	dnstapWriteTimeout  = 5 * time.Second
+
+	// Frame Streams control frames
+	fstrmControlAccept  = 0x01
+	fstrmControlStart   = 0x02
+	fstrmControlStop    = 0x03
+	fstrmControlReady   = 0x04
+	fstrmControlFinish  = 0x05
+	fstrmFieldType      = 0x01
+	fstrmMaxControlSize = 512
+
+	// Dnstap.Type
+	dnstapTypeMessage = 1
+
+	// Message.Type
+	dnstapClientQuery       = 5
+	dnstapClientResponse    = 6
+	dnstapForwarderQuery    = 7
+	dnstapForwarderResponse = 8
+
+	// SocketFamily
+	dnstapFamilyINET  = 1
+	dnstapFamilyINET6 = 2
+
+	// SocketProtocol
+	dnstapProtocolUDP = 1
+	dnstapProtocolTCP = 2
+	dnstapProtocolDoH = 4
+)
+
+// errDnstapStopped is returned by connect when the stream was stopped by Stop.
+var errDnstapStopped = errors.New("dnstap stopped")
+
+// Dnstap writes dnstap messages to a Unix socket or a file. Messages are queued and dropped when the queue is full, so
+// a slow or missing collector never blocks a worker.
+type Dnstap struct {
+	path     string
+	file     *os.File
+	identity []byte
+	frames   chan []byte
+	dropped  atomic.Uint64
+
+	// closed by Stop, and by the writer once the stream is stopped
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// NewDnstapSocket returns a writer for a collector listening on the Unix socket at path. The connection is made, and
+// remade, in the background.
+func NewDnstapSocket(path string) *Dnstap {
+	return newDnstap(path, nil)
+}
+
+// NewDnstapFile truncates the file at path and writes a single Frame Streams stream to it.
+func NewDnstapFile(path string) (*Dnstap, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDnstap(path, file), nil
+}
+
+func newDnstap(path string, file *os.File) *Dnstap {
+	identity, err := os.Hostname()
+	if err != nil {
+		identity = ""
+	}
+
+	return &Dnstap{
+		path:     path,
+		file:     file,
+		identity: []byte(identity),
+		frames:   make(chan []byte, dnstapQueueSize),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+func (d *Dnstap) Start() {
+	if d.file != nil {
+		go d.writeFile()
+	} else {
+		go d.writeSocket()
+	}
+}
+
+// Stop writes the queued messages and a STOP frame, and waits for a collector to finish the stream, for up to
+// dnstapWriteTimeout. Messages sent after Stop are dropped.
+func (d *Dnstap) Stop() {
+	if d == nil {
+		return
+	}
+
+	close(d.stop)
+	select {
+	case <-d.stopped:
+	case <-time.After(dnstapWriteTimeout):
+	}
+}
+
+func (d *Dnstap) writeFile() {
+	w := bufio.NewWriter(d.file)
+	err := writeControlFrame(w, fstrmControlStart)
+	if err == nil {
+		err = d.writeFrames(w, nil)
+	}
+	if err == nil {
+		err = d.file.Close()
+		if err == nil {
+			close(d.stopped)
+			return
+		}
+	}
+
+	// nothing more is written, and queued messages are dropped from here on
+	slog.Error("dnstap: failed to write file, stopped writing", "file", d.path, "error", err.Error())
+	_ = d.file.Close()
+	close(d.stopped)
+	for range d.frames {
+		d.dropped.Add(1)
+	}
+}
+
+func (d *Dnstap) writeSocket() {
+	defer close(d.stopped)
+
+	lastErr := ""
+	for {
+		err := d.connect()
+		if errors.Is(err, errDnstapStopped) {
+			return
+		}
+
+		// only report a new problem, a collector that is down is retried quietly
+		if err.Error() != lastErr {
+			slog.Warn("dnstap: collector unavailable, dropping messages", "socket", d.path, "error", err.Error())
+			lastErr = err.Error()
+		}
+
+		select {
+		case <-d.stop:
+			return
+		case <-time.After(dnstapRetryInterval):
+		}
+	}
+}
+
+// connect writes to the collector until the connection fails, or until Stop and the collector finished the stream.
+func (d *Dnstap) connect() error {
+	conn, err := net.DialTimeout("unix", d.path, dnstapWriteTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// bidirectional handshake: READY, ACCEPT, START
+	err = conn.SetDeadline(time.Now().Add(dnstapWriteTimeout))
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(conn)
+	err = writeControlFrame(w, fstrmControlReady)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	controlType, err := readControlFrame(conn)
+	if err != nil {
+		return err
+	}
+	if controlType != fstrmControlAccept {
+		return fmt.Errorf("expected ACCEPT, got control frame %d", controlType)
+	}
+
+	err = writeControlFrame(w, fstrmControlStart)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	slog.Info("dnstap: connected to collector", "socket", d.path)
+	err = d.writeFrames(w, conn)
+	if err != nil {
+		return err
+	}
+
+	// the collector acknowledges STOP with FINISH
+	err = conn.SetReadDeadline(time.Now().Add(dnstapWriteTimeout))
+	if err != nil {
+		return err
+	}
+
+	controlType, err = readControlFrame(conn)
+	if err == nil && controlType != fstrmControlFinish {
+		err = fmt.Errorf("expected FINISH, got control frame %d", controlType)
+	}
+	if err != nil {
+		slog.Warn("dnstap: collector did not finish the stream", "socket", d.path, "error", err.Error())
+	}
+
+	return errDnstapStopped
+}
+
+// writeFrames writes queued messages until Stop, and then the messages still queued and a STOP frame.
+func (d *Dnstap) writeFrames(w *bufio.Writer, conn net.Conn) error {
+	for {
+		var frame []byte
+		select {
+		case frame = <-d.frames:
+		case <-d.stop:
+			return d.writeStop(w, conn)
+		}
+
+		err := d.writeFrame(w, conn, frame)
+		if err != nil {
+			return err
+		}
+
+		// write in batches while busy
+		if len(d.frames) == 0 {
+			err = w.Flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (d *Dnstap) writeStop(w *bufio.Writer, conn net.Conn) error {
+	for len(d.frames) > 0 {
+		err := d.writeFrame(w, conn, <-d.frames)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := writeControlFrame(w, fstrmControlStop)
+	if err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+func (d *Dnstap) writeFrame(w *bufio.Writer, conn net.Conn, frame []byte) error {
+	if conn != nil {
+		err := conn.SetWriteDeadline(time.Now().Add(dnstapWriteTimeout))
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeDataFrame(w, frame)
+}
+
+// Dropped returns the number of messages dropped because the queue was full or nothing could be written.
+func (d *Dnstap) Dropped() uint64 {
+	return d.dropped.Load()
+}
+
+type dnstapMessage struct {
+	messageType     uint64
+	protocol        uint64
+	queryAddress    netip.AddrPort
+	responseAddress netip.AddrPort
+	queryTime       time.Time
+	queryMessage    []byte
+	responseTime    time.Time
+	responseMessage []byte
+	extra           []byte
+}
+
+// send queues a message without blocking, and is a no-op when d is nil.
+func (d *Dnstap) send(m dnstapMessage) {
+	if d == nil {
+		return
+	}
+
+	select {
+	case d.frames <- d.marshal(m):
+	default:
+		d.dropped.Add(1)
+	}
+}
+
+// client sends the CLIENT_QUERY and CLIENT_RESPONSE of a request. response is nil when no response was sent.
+func (d *Dnstap) client(task *workerTask, queryTime time.Time, result workerResult, response []byte) {
+	if d == nil {
+		return
+	}
+
+	protocol := uint64(dnstapProtocolUDP)
+	if task.connectionType == ConnectionTypeTCP {
+		protocol = dnstapProtocolTCP
+	}
+
+	queryAddress, _ := netip.ParseAddrPort(task.remote)
+	responseAddress := netip.AddrPortFrom(task.localAddr, task.localPort)
+
+	d.send(dnstapMessage{
+		messageType:     dnstapClientQuery,
+		protocol:        protocol,
+		queryAddress:    queryAddress,
+		responseAddress: responseAddress,
+		queryTime:       queryTime,
+		queryMessage:    task.rawRequest[:task.responseLength],
+	})
+
+	if response == nil {
+		return
+	}
+
+	d.send(dnstapMessage{
+		messageType:     dnstapClientResponse,
+		protocol:        protocol,
+		queryAddress:    queryAddress,
+		responseAddress: responseAddress,
+		queryTime:       queryTime,
+		responseTime:    time.Now(),
+		responseMessage: response,
+		extra:           dnstapExtra(result),
+	})
+}
+
+// forwarder sends the FORWARDER_QUERY and FORWARDER_RESPONSE of a DoH request. response is nil when the request
+// failed.
+func (d *Dnstap) forwarder(local netip.AddrPort, upstream netip.AddrPort, queryTime time.Time, query []byte, response []byte) {
+	if d == nil {
+		return
+	}
+
+	d.send(dnstapMessage{
+		messageType:     dnstapForwarderQuery,
+		protocol:        dnstapProtocolDoH,
+		queryAddress:    local,
+		responseAddress: upstream,
+		queryTime:       queryTime,
+		queryMessage:    query,
+	})
+
+	if response == nil {
+		return
+	}
+
+	d.send(dnstapMessage{
+		messageType:     dnstapForwarderResponse,
+		protocol:        dnstapProtocolDoH,
+		queryAddress:    local,
+		responseAddress: upstream,
+		queryTime:       queryTime,
+		responseTime:    time.Now(),
+		responseMessage: response,
+	})
+}
+
+// dnstapExtra returns the verdict and filter reasons of a request as JSON, for the extra field of CLIENT_RESPONSE.
+func dnstapExtra(result workerResult) []byte {
+	if result.question == nil {
+		return nil
+	}
+
+	extra := struct {
+		Verdict          string   `json:"verdict"`
+		Reasons          []string `json:"reasons"`
+		ReasonCodes      []string `json:"reason_codes"`
+		AuditReasons     []string `json:"audit_reasons,omitempty"`
+		AuditReasonCodes []string `json:"audit_reason_codes,omitempty"`
+	}{
+		Verdict:          result.verdict(),
+		Reasons:          reasonStrings(result.filterReasons),
+		ReasonCodes:      reasonCodes(result.filterReasons),
+		AuditReasons:     reasonStrings(result.auditReasons),
+		AuditReasonCodes: reasonCodes(result.auditReasons),
+	}
+
+	b, err := json.Marshal(extra)
+	if err != nil {
+		return nil
+	}
+
+	return b
+}
+
+func (d *Dnstap) marshal(m dnstapMessage) []byte {
+	message := make([]byte, 0, 64+len(m.queryMessage)+len(m.responseMessage))
+	message = appendVarintField(message, 1, m.messageType)
+
+	address := m.queryAddress
+	if !address.IsValid() {
+		address = m.responseAddress
+	}
+	if address.IsValid() {
+		family := uint64(dnstapFamilyINET6)
+		if address.Addr().Unmap().Is4() {
+			family = dnstapFamilyINET
+		}
+		message = appendVarintField(message, 2, family)
+	}
+
+	message = appendVarintField(message, 3, m.protocol)
+	if m.queryAddress.IsValid() {
+		message = appendBytesField(message, 4, m.queryAddress.Addr().Unmap().AsSlice())
+	}
+	if m.responseAddress.IsValid() {
+		message = appendBytesField(message, 5, m.responseAddress.Addr().Unmap().AsSlice())
+	}
+	if m.queryAddress.IsValid() {
+		message = appendVarintField(message, 6, uint64(m.queryAddress.Port()))
+	}
+	if m.responseAddress.IsValid() {
+		message = appendVarintField(message, 7, uint64(m.responseAddress.Port()))
+	}
+
+	if !m.queryTime.IsZero() {
+		message = appendVarintField(message, 8, uint64(m.queryTime.Unix()))
+		message = appendFixed32Field(message, 9, uint32(m.queryTime.Nanosecond()))
+	}
+	if m.queryMessage != nil {
+		message = appendBytesField(message, 10, m.queryMessage)
+	}
+
+	if !m.responseTime.IsZero() {
+		message = appendVarintField(message, 12, uint64(m.responseTime.Unix()))
+		message = appendFixed32Field(message, 13, uint32(m.responseTime.Nanosecond()))
+	}
+	if m.responseMessage != nil {
+		message = appendBytesField(message, 14, m.responseMessage)
+	}
+
+	frame := make([]byte, 0, 32+len(d.identity)+len(m.extra)+len(message))
+	if len(d.identity) > 0 {
+		frame = appendBytesField(frame, 1, d.identity)
+	}
+	frame = appendBytesField(frame, 2, []byte("netfoil"))
+	if m.extra != nil {
+		frame = appendBytesField(frame, 3, m.extra)
+	}
+	frame = appendBytesField(frame, 14, message)
+	frame = appendVarintField(frame, 15, dnstapTypeMessage)
+
+	return frame
+}
+
+// protobuf wire format
+
+const (
+	protobufVarint  = 0
+	protobufBytes   = 2
+	protobufFixed32 = 5
+)
+
+func appendVarintField(b []byte, field uint64, value uint64) []byte {
+	b = binary.AppendUvarint(b, field<<3|protobufVarint)
+	return binary.AppendUvarint(b, value)
+}
+
+func appendBytesField(b []byte, field uint64, value []byte) []byte {
+	b = binary.AppendUvarint(b, field<<3|protobufBytes)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func appendFixed32Field(b []byte, field uint64, value uint32) []byte {
+	b = binary.AppendUvarint(b, field<<3|protobufFixed32)
+	return binary.LittleEndian.AppendUint32(b, value)
+}
+
+// Frame Streams
+
+func writeDataFrame(w io.Writer, frame []byte) error {
+	header := binary.BigEndian.AppendUint32(nil, uint32(len(frame)))
+	_, err := w.Write(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(frame)
+	return err
+}
+
+// writeControlFrame writes a control frame, where READY and START carry the dnstap content type.
+func writeControlFrame(w io.Writer, controlType uint32) error {
+	payload := binary.BigEndian.AppendUint32(nil, controlType)
+	if controlType == fstrmControlReady || controlType == fstrmControlStart {
+		payload = binary.BigEndian.AppendUint32(payload, fstrmFieldType)
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(dnstapContentType)))
+		payload = append(payload, dnstapContentType...)
+	}
+
+	// an escape, a data frame length of 0, followed by the length of the control frame
+	header := binary.BigEndian.AppendUint32(nil, 0)
+	header = binary.BigEndian.AppendUint32(header, uint32(len(payload)))
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+// readControlFrame reads a control frame and returns its type, ignoring its fields.
+func readControlFrame(r io.Reader) (uint32, error) {
+	header := make([]byte, 8)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, err
+	}
+
+	if binary.BigEndian.Uint32(header[0:4]) != 0 {
+		return 0, fmt.Errorf("expected a control frame")
+	}
+
+	length := binary.BigEndian.Uint32(header[4:8])
+	if length < 4 || length > fstrmMaxControlSize {
+		return 0, fmt.Errorf("invalid control frame length %d", length)
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint32(payload[0:4]), nil
+}
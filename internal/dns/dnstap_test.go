@@ -0,0 +1,256 @@
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// protobufFields returns the varint and bytes fields of a protobuf message, the last value wins.
+func protobufFields(t *testing.T, b []byte) (map[uint64]uint64, map[uint64][]byte) {
+	varints := make(map[uint64]uint64)
+	bytesFields := make(map[uint64][]byte)
+
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("invalid tag")
+		}
+		b = b[n:]
+
+		field := tag >> 3
+		switch tag & 7 {
+		case protobufVarint:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatalf("invalid varint")
+			}
+			varints[field] = v
+			b = b[n:]
+		case protobufBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				t.Fatalf("invalid length")
+			}
+			bytesFields[field] = b[n : n+int(length)]
+			b = b[n+int(length):]
+		case protobufFixed32:
+			b = b[4:]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+	}
+
+	return varints, bytesFields
+}
+
+func readDataFrame(t *testing.T, r io.Reader) []byte {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := make([]byte, binary.BigEndian.Uint32(header))
+	_, err = io.ReadFull(r, frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return frame
+}
+
+func TestDnstapSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnstap")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	dnstap := NewDnstapSocket(path)
+	dnstap.Start()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	controlType, err := readControlFrame(reader)
+	if err != nil || controlType != fstrmControlReady {
+		t.Fatalf("expected READY, got %d %v", controlType, err)
+	}
+
+	err = writeControlFrame(conn, fstrmControlAccept)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	controlType, err = readControlFrame(reader)
+	if err != nil || controlType != fstrmControlStart {
+		t.Fatalf("expected START, got %d %v", controlType, err)
+	}
+
+	question := Question{Name: "example.com.", Type: RecordTypeA, Class: ClassTypeIN}
+	request, err := MarshalRequest(1, Flags{RD: true}, question)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task := &workerTask{
+		rawRequest:     request,
+		responseLength: len(request),
+		connectionType: ConnectionTypeUDP,
+		remote:         "192.0.2.10:5300",
+		localAddr:      netip.MustParseAddr("127.0.0.1"),
+		localPort:      53,
+	}
+	result := workerResult{
+		question:      &question,
+		filterReasons: []FilterReason{FilterReason{Code: FilterCodeDenyExact, Value: "example.com", Rule: "example.com"}},
+	}
+	dnstap.client(task, time.Now(), result, []byte("response"))
+
+	frame := readDataFrame(t, reader)
+	varints, fields := protobufFields(t, frame)
+	if varints[15] != dnstapTypeMessage || string(fields[2]) != "netfoil" {
+		t.Errorf("unexpected dnstap frame %v %v", varints, fields)
+	}
+
+	varints, fields = protobufFields(t, fields[14])
+	if varints[1] != dnstapClientQuery || varints[2] != dnstapFamilyINET || varints[3] != dnstapProtocolUDP || varints[6] != 5300 || varints[7] != 53 {
+		t.Errorf("unexpected message %v", varints)
+	}
+
+	if !bytes.Equal(fields[4], []byte{192, 0, 2, 10}) || !bytes.Equal(fields[10], request) {
+		t.Errorf("unexpected message %v", fields)
+	}
+
+	frame = readDataFrame(t, reader)
+	_, fields = protobufFields(t, frame)
+	if string(fields[3]) != `{"verdict":"deny","reasons":["deny due to exact denylist: example.com, rule 'example.com'"],"reason_codes":["DENY_EXACT"]}` {
+		t.Errorf("unexpected extra '%s'", fields[3])
+	}
+
+	varints, fields = protobufFields(t, fields[14])
+	if varints[1] != dnstapClientResponse || string(fields[14]) != "response" {
+		t.Errorf("unexpected message %v %v", varints, fields)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		dnstap.Stop()
+		close(stopped)
+	}()
+
+	controlType, err = readControlFrame(reader)
+	if err != nil || controlType != fstrmControlStop {
+		t.Fatalf("expected STOP, got %d %v", controlType, err)
+	}
+
+	err = writeControlFrame(conn, fstrmControlFinish)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-stopped
+}
+
+func TestDnstapFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	dnstap, err := NewDnstapFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := netip.MustParseAddrPort("[2001:db8::1]:443")
+	dnstap.forwarder(netip.MustParseAddrPort("[2001:db8::2]:40000"), upstream, time.Now(), []byte("query"), nil)
+	dnstap.Start()
+
+	var content []byte
+	for range 50 {
+		content, err = os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(content) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	reader := bytes.NewReader(content)
+	controlType, err := readControlFrame(reader)
+	if err != nil || controlType != fstrmControlStart {
+		t.Fatalf("expected START, got %d %v", controlType, err)
+	}
+
+	_, fields := protobufFields(t, readDataFrame(t, reader))
+	varints, fields := protobufFields(t, fields[14])
+	if varints[1] != dnstapForwarderQuery || varints[2] != dnstapFamilyINET6 || varints[3] != dnstapProtocolDoH || varints[7] != 443 {
+		t.Errorf("unexpected message %v", varints)
+	}
+
+	if !bytes.Equal(fields[5], upstream.Addr().AsSlice()) || string(fields[10]) != "query" {
+		t.Errorf("unexpected message %v", fields)
+	}
+}
+
+func TestDnstapDoesNotBlock(t *testing.T) {
+	// never started, as if the collector is not keeping up
+	dnstap := NewDnstapSocket(filepath.Join(t.TempDir(), "missing"))
+
+	for range dnstapQueueSize + 10 {
+		dnstap.forwarder(netip.AddrPort{}, netip.AddrPort{}, time.Now(), []byte("query"), nil)
+	}
+
+	if dnstap.Dropped() != 10 {
+		t.Errorf("expected 10 dropped messages, got %d", dnstap.Dropped())
+	}
+
+	var nilDnstap *Dnstap
+	nilDnstap.client(&workerTask{}, time.Now(), workerResult{}, nil)
+}
+
+func TestDnstapFileStop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	dnstap, err := NewDnstapFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dnstap.Start()
+	dnstap.forwarder(netip.MustParseAddrPort("192.0.2.2:40000"), netip.MustParseAddrPort("192.0.2.1:443"), time.Now(), []byte("query"), nil)
+	dnstap.Stop()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bytes.NewReader(content)
+	controlType, err := readControlFrame(reader)
+	if err != nil || controlType != fstrmControlStart {
+		t.Fatalf("expected START, got %d %v", controlType, err)
+	}
+
+	readDataFrame(t, reader)
+
+	controlType, err = readControlFrame(reader)
+	if err != nil || controlType != fstrmControlStop {
+		t.Fatalf("expected STOP, got %d %v", controlType, err)
+	}
+
+	if reader.Len() != 0 {
+		t.Errorf("expected nothing after STOP, got %d bytes", reader.Len())
+	}
+}
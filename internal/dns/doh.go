@@ -10,6 +10,7 @@ import (
 	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/netip"
 	"net/url"
 	"strings"
@@ -31,6 +32,11 @@ const (
 type DoHClient struct {
 	httpClient *http.Client
 	dohURL     *url.URL
+
+	// nil when metrics are not collected
+	metrics *metrics
+	// nil when no dnstap messages are written
+	dnstap *Dnstap
 }
 
 func (c *DoHClient) DoH(request *Request) (*Response, error) {
@@ -54,6 +60,35 @@ func (c *DoHClient) DoH(request *Request) (*Response, error) {
 
 	req.Header.Set("Accept", "application/dns-message")
 
+	// the upstream address for metrics and dnstap, as the DoH URL can resolve to several
+	var local, upstream netip.AddrPort
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			local, _ = netip.ParseAddrPort(info.Conn.LocalAddr().String())
+			upstream, _ = netip.ParseAddrPort(info.Conn.RemoteAddr().String())
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	start := time.Now()
+	body, err := c.do(req)
+
+	upstreamIP := ""
+	if upstream.IsValid() {
+		upstreamIP = upstream.Addr().Unmap().String()
+	}
+	c.metrics.observeUpstream(upstreamIP, time.Since(start), err)
+	c.dnstap.forwarder(local, upstream, start, marshalledRequest, body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return UnmarshalResponse(body)
+}
+
+// do returns the body of a successful DoH response.
+func (c *DoHClient) do(req *http.Request) ([]byte, error) {
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, err
@@ -87,13 +122,7 @@ func (c *DoHClient) DoH(request *Request) (*Response, error) {
 		return nil, fmt.Errorf("failed to read and close %w %w", err, closeErr)
 	}
 
-	response, err := UnmarshalResponse(body)
-	if err != nil {
-		return nil, err
-	}
-
-	return response, nil
-
+	return body, nil
 }
 
 func NewDoHClient(dohURL *url.URL, DoHIP []netip.Addr, caCertPool *x509.CertPool) (*DoHClient, error) {
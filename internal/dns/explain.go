@@ -0,0 +1,264 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Explanation is the verdict of a Policy for a question, and for a response to it when one is given.
+type Explanation struct {
+	QueryAllowed    bool
+	QueryReasons    []FilterReason
+	Pinned          bool
+	Dropped         bool
+	Response        *Response
+	ResponseAllowed bool
+	ResponseReasons []FilterReason
+}
+
+// Explain evaluates a question, and optionally a response, the same way a worker would, without any network access.
+func (p *Policy) Explain(question Question, response *Response) *Explanation {
+	explanation := &Explanation{}
+
+	explanation.QueryAllowed, explanation.QueryReasons = p.queryIsAllowed(question)
+	if !explanation.QueryAllowed {
+		return explanation
+	}
+
+	rpzVerdict, rpzTriggered := p.rpzQuery(&question)
+	if rpzTriggered {
+		explanation.QueryReasons = append(explanation.QueryReasons, rpzVerdict.reason)
+
+		switch rpzVerdict.action {
+		case rpzActionDrop:
+			explanation.QueryAllowed = false
+			explanation.Dropped = true
+			return explanation
+		case rpzActionNXDomain, rpzActionNoData:
+			explanation.QueryAllowed = false
+			explanation.Response = rpzVerdict.response
+			return explanation
+		case rpzActionLocalData:
+			response = rpzVerdict.response
+			explanation.Pinned = true
+		}
+	}
+
+	if !explanation.Pinned && question.Type == RecordTypeA {
+		ip, found := p.pinA[strings.TrimSuffix(question.Name, ".")]
+		if found {
+			response = generateAResponse(&question, ip)
+			explanation.Pinned = true
+		}
+	}
+
+	if response == nil {
+		return explanation
+	}
+
+	explanation.Response = response
+	explanation.ResponseAllowed, explanation.ResponseReasons = p.responseIsAllowed(question.Name, question.Type, response)
+
+	passthru := rpzTriggered && rpzVerdict.action == rpzActionPassthru
+	if explanation.ResponseAllowed && !passthru {
+		rpzVerdict, rpzTriggered = p.rpzResponse(&question, response)
+		if rpzTriggered {
+			explanation.ResponseReasons = append(explanation.ResponseReasons, rpzVerdict.reason)
+
+			switch rpzVerdict.action {
+			case rpzActionDrop:
+				explanation.ResponseAllowed = false
+				explanation.Dropped = true
+			case rpzActionNXDomain, rpzActionNoData:
+				explanation.ResponseAllowed = false
+			}
+		}
+	}
+
+	return explanation
+}
+
+// ParseResponseText reads a response written one answer per line, e.g.
+//
+//	RCODE NoError
+//	example.com. CNAME cdn.example.com.
+//	cdn.example.com. A 192.0.2.1
+//	cdn.example.com. AAAA 2001:db8::1
+//	example.com. HTTPS 1 . alpn=h2,h3 ipv4hint=192.0.2.1 ipv6hint=2001:db8::1 ech=public.example.com
+//
+// The RCODE line is optional and defaults to NoError.
+func ParseResponseText(reader io.Reader) (*Response, error) {
+	response := &Response{
+		Flags: Flags{
+			QR:    true,
+			RA:    true,
+			RCODE: ResponseCodeNoError,
+		},
+		Answers: make([]Answer, 0),
+	}
+
+	lineNumber := 0
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		lineNumber++
+
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if fields[0] == "RCODE" {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: expected 'RCODE <code>'", lineNumber)
+			}
+
+			rcode, err := parseResponseCode(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+
+			response.Flags.RCODE = rcode
+			continue
+		}
+
+		answer, err := parseAnswerText(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+
+		response.Answers = append(response.Answers, *answer)
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+func parseResponseCode(s string) (ResponseCode, error) {
+	for rcode := ResponseCodeNoError; rcode <= ResponseCodeRefused; rcode++ {
+		if strings.EqualFold(rcode.Name(), s) {
+			return rcode, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown response code '%s'", s)
+}
+
+func parseAnswerText(fields []string) (*Answer, error) {
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("expected '<name> <type> <data>'")
+	}
+
+	name := fields[0]
+	if !strings.HasSuffix(name, ".") {
+		name = name + "."
+	}
+
+	recordType, err := ParseRecordType(fields[1])
+	if err != nil {
+		return nil, err
+	}
+
+	answer := &Answer{
+		Name:  name,
+		Type:  recordType,
+		Class: ClassTypeIN,
+		TTL:   defaultTTL,
+	}
+
+	switch recordType {
+	case RecordTypeA:
+		ip := net.ParseIP(fields[2]).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 '%s'", fields[2])
+		}
+		answer.IPv4 = ip
+	case RecordTypeAAAA:
+		ip := net.ParseIP(fields[2])
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 '%s'", fields[2])
+		}
+		answer.IPv6 = ip
+	case RecordTypeCNAME:
+		cname := fields[2]
+		if !strings.HasSuffix(cname, ".") {
+			cname = cname + "."
+		}
+		answer.CNAME = cname
+	case RecordTypeHTTPS:
+		record, err := parseHTTPSRecordText(fields[2:])
+		if err != nil {
+			return nil, err
+		}
+		answer.HTTPSRecord = *record
+	}
+
+	return answer, nil
+}
+
+func parseHTTPSRecordText(fields []string) (*HTTPSRecord, error) {
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("expected HTTPS '<priority> <target> [key=value ...]'")
+	}
+
+	priority, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTPS priority '%s'", fields[0])
+	}
+
+	targetName := fields[1]
+	if targetName != "." && !strings.HasSuffix(targetName, ".") {
+		targetName = targetName + "."
+	}
+
+	record := &HTTPSRecord{
+		Priority:   uint16(priority),
+		TargetName: targetName,
+	}
+
+	for _, field := range fields[2:] {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected HTTPS parameter 'key=value', got '%s'", field)
+		}
+
+		values := strings.Split(strings.Trim(parts[1], "\""), ",")
+		switch parts[0] {
+		case "alpn":
+			record.ALPN = values
+		case "ipv4hint":
+			for _, value := range values {
+				ip := net.ParseIP(value).To4()
+				if ip == nil {
+					return nil, fmt.Errorf("invalid ipv4hint '%s'", value)
+				}
+				record.IPv4Hint = append(record.IPv4Hint, ip)
+			}
+		case "ipv6hint":
+			for _, value := range values {
+				ip := net.ParseIP(value)
+				if ip == nil || ip.To4() != nil {
+					return nil, fmt.Errorf("invalid ipv6hint '%s'", value)
+				}
+				record.IPv6Hint = append(record.IPv6Hint, ip)
+			}
+		case "ech":
+			// only the public name is relevant to the policy
+			for _, value := range values {
+				record.ECH = append(record.ECH, ECHConfig{PublicName: value})
+			}
+		default:
+			return nil, fmt.Errorf("unsupported HTTPS parameter '%s'", parts[0])
+		}
+	}
+
+	return record, nil
+}
@@ -0,0 +1,140 @@
+package dns
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func newExplainTestPolicy(t *testing.T) *Policy {
+	suffixSearchAllow, err := buildSuffixesSearch([]string{".com"}, []string{".example.net"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exactSearchBlock, err := buildDomainSearch([]string{"bad.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	empty, err := buildDomainSearch([]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sources := make(ruleSources)
+	sources.add(configFilenameAllowTLDs, ".com", 3)
+	sources.add(configFilenameDenyExact, "bad.example.com", 7)
+	sources.add(configFilenameIPv4Deny, "10.0.0.0/8", 2)
+
+	return &Policy{
+		exactSearchAllow:  empty,
+		suffixSearchAllow: suffixSearchAllow,
+		exactSearchBlock:  exactSearchBlock,
+		suffixSearchBlock: empty,
+		knownTLDs:         map[string]struct{}{"com": {}, "net": {}},
+		allowIPv4:         []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")},
+		denyIPv4:          []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		sources:           sources,
+	}
+}
+
+func TestExplainQuery(t *testing.T) {
+	policy := newExplainTestPolicy(t)
+
+	explanation := policy.Explain(Question{Name: "bad.example.com.", Type: RecordTypeA}, nil)
+	if explanation.QueryAllowed {
+		t.Fatalf("should be denied")
+	}
+
+	expected := "deny due to exact denylist: bad.example.com, rule 'bad.example.com' deny.exact:7"
+	if explanation.QueryReasons[0].String() != expected {
+		t.Errorf("expected '%s', got '%s'", expected, explanation.QueryReasons[0])
+	}
+
+	explanation = policy.Explain(Question{Name: "www.example.com.", Type: RecordTypeA}, nil)
+	if !explanation.QueryAllowed {
+		t.Fatalf("should be allowed")
+	}
+
+	expected = "allow due to suffix allowlist: www.example.com, rule '.com' allow.tld:3"
+	if explanation.QueryReasons[0].String() != expected {
+		t.Errorf("expected '%s', got '%s'", expected, explanation.QueryReasons[0])
+	}
+
+	if explanation.Response != nil {
+		t.Errorf("expected no response")
+	}
+}
+
+func TestExplainResponse(t *testing.T) {
+	policy := newExplainTestPolicy(t)
+
+	s := `# fake response
+RCODE NoError
+www.example.com. CNAME cdn.example.net.
+cdn.example.net A 10.1.2.3`
+
+	response, err := ParseResponseText(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(response.Answers) != 2 {
+		t.Fatalf("expected 2 answers, got %d", len(response.Answers))
+	}
+
+	if response.Answers[1].Name != "cdn.example.net." {
+		t.Errorf("expected trailing '.' to be added, got '%s'", response.Answers[1].Name)
+	}
+
+	explanation := policy.Explain(Question{Name: "www.example.com.", Type: RecordTypeA}, response)
+	if explanation.ResponseAllowed {
+		t.Fatalf("should be denied")
+	}
+
+	expected := "deny due to IPv4 denylist: 10.1.2.3, rule '10.0.0.0/8' deny.ipv4:2"
+	if explanation.ResponseReasons[0].String() != expected {
+		t.Errorf("expected '%s', got '%s'", expected, explanation.ResponseReasons[0])
+	}
+}
+
+func TestParseResponseTextHTTPS(t *testing.T) {
+	s := `example.com. HTTPS 1 . alpn=h2,h3 ipv4hint=192.0.2.1 ipv6hint=2001:db8::1 ech=public.example.com`
+
+	response, err := ParseResponseText(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := response.Answers[0].HTTPSRecord
+	if record.Priority != 1 || record.TargetName != "." {
+		t.Errorf("wrong priority or target name")
+	}
+
+	if len(record.ALPN) != 2 || record.ALPN[1] != "h3" {
+		t.Errorf("wrong alpn")
+	}
+
+	if len(record.IPv4Hint) != 1 || record.IPv4Hint[0].String() != "192.0.2.1" {
+		t.Errorf("wrong ipv4hint")
+	}
+
+	if len(record.IPv6Hint) != 1 || record.IPv6Hint[0].String() != "2001:db8::1" {
+		t.Errorf("wrong ipv6hint")
+	}
+
+	if len(record.ECH) != 1 || record.ECH[0].PublicName != "public.example.com" {
+		t.Errorf("wrong ech")
+	}
+
+	_, err = ParseResponseText(strings.NewReader("example.com. A ::1"))
+	if err == nil {
+		t.Fatalf("should fail")
+	}
+
+	expectedErr := "line 1: invalid IPv4 '::1'"
+	if err.Error() != expectedErr {
+		t.Fatalf("expected '%s', got '%s'", expectedErr, err.Error())
+	}
+}
@@ -1,11 +1,15 @@
 package dns
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"net/netip"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/tinfoil-factory/netfoil/internal/suffixtrie"
 )
@@ -32,6 +36,12 @@ type Policy struct {
 	suffixSearchAllow    *suffixtrie.Node
 	exactSearchBlock     *suffixtrie.Node
 	suffixSearchBlock    *suffixtrie.Node
+	wildcardParentsAllow *suffixtrie.Node
+	wildcardParentsBlock *suffixtrie.Node
+	wildcardsAllow       []domainPattern
+	wildcardsBlock       []domainPattern
+	regexesAllow         []domainPattern
+	regexesBlock         []domainPattern
 	knownTLDs            map[string]struct{}
 	denyIPv4             []netip.Prefix
 	denyIPv6             []netip.Prefix
@@ -41,96 +51,253 @@ type Policy struct {
 	pinResponseDomain    bool
 	pinResponseDomainMap map[string]map[string]struct{}
 	pinA                 map[string]net.IP
+	sources              ruleSources
+	importSummaries      []ImportSummary
+	rpzZones             []*rpzZone
+	name                 string
+	clientPolicies       []*clientPolicy
+	scheduledAllow       []scheduledRule
+	scheduledBlock       []scheduledRule
+	clock                func() time.Time
+	breakGlass           *BreakGlass
 }
 
-func NewPolicy(configDirectory string, blockPunycode bool, pinResponseDomain bool) (*Policy, error) {
-	knownTLDs, err := readKnownTLDs(configDirectory, Policy{})
-	if err != nil {
-		return nil, err
-	}
+type ruleSource struct {
+	filename string
+	line     int
+	schedule string
+}
 
-	partialPolicy := Policy{
-		knownTLDs:     knownTLDs,
-		blockPunycode: blockPunycode,
-	}
+// ruleSources maps rule file -> rule -> where the rule was read from, so that a filter reason can point to the
+// rule that matched. The source is a different file than the rule file for imported rules.
+type ruleSources map[string]map[string]ruleSource
 
-	allowTLDs, err := readAndValidateTLDs(configDirectory, configFilenameAllowTLDs, knownTLDs, partialPolicy)
-	if err != nil {
-		return nil, err
+// add records a rule read from filename, which is inside a client policy directory for client policies. Rules are
+// keyed by the base name of the rule file so that the same lookup works for every policy.
+func (r ruleSources) add(filename string, rule string, line int) {
+	r.insert(filepath.Base(filename), rule, ruleSource{filename: filename, line: line})
+}
+
+// addScheduled records a rule that is only active during the named schedule, or always when the name is empty.
+func (r ruleSources) addScheduled(filename string, rule string, line int, schedule string) {
+	r.insert(filepath.Base(filename), rule, ruleSource{filename: filename, line: line, schedule: schedule})
+}
+
+func (r ruleSources) addFrom(ruleFilename string, sourceFilename string, rule string, line int) {
+	r.insert(ruleFilename, rule, ruleSource{filename: sourceFilename, line: line})
+}
+
+func (r ruleSources) insert(ruleFilename string, rule string, source ruleSource) {
+	if r == nil {
+		return
 	}
 
-	allowSuffixes, err := readAndValidateSuffixes(configDirectory, configFilenameAllowSuffixes, partialPolicy)
-	if err != nil {
-		return nil, err
+	rules, found := r[ruleFilename]
+	if !found {
+		rules = make(map[string]ruleSource)
+		r[ruleFilename] = rules
 	}
 
-	allowExact, err := readAndValidateExact(configDirectory, configFilenameAllowExact, partialPolicy)
-	if err != nil {
-		return nil, err
+	_, found = rules[rule]
+	if !found {
+		rules[rule] = source
 	}
+}
 
-	blockTLDs, err := readAndValidateTLDs(configDirectory, configFilenameDenyTLDs, knownTLDs, partialPolicy)
-	if err != nil {
-		return nil, err
+// source returns <file>:<line> for the first of the rule files containing the rule, or "" when it is not known.
+func (r ruleSources) source(rule string, ruleFilenames ...string) string {
+	for _, ruleFilename := range ruleFilenames {
+		source, found := r[ruleFilename][rule]
+		if found {
+			return fmt.Sprintf("%s:%d", source.filename, source.line)
+		}
 	}
 
-	blockSuffixes, err := readAndValidateSuffixes(configDirectory, configFilenameDenySuffixes, partialPolicy)
+	return ""
+}
+
+func NewPolicy(configDirectory string, blockPunycode bool, pinResponseDomain bool) (*Policy, error) {
+	knownTLDs, err := readKnownTLDs(configDirectory, Policy{})
 	if err != nil {
+		// every other rule is validated against the known TLDs
 		return nil, err
 	}
 
-	blockExact, err := readAndValidateExact(configDirectory, configFilenameDenyExact, partialPolicy)
-	if err != nil {
-		return nil, err
+	schedules, schedulesErr := readSchedules(configDirectory)
+	if schedules == nil {
+		schedules = &scheduleSet{}
 	}
 
-	// TODO these could be combined into one suffix trie
-	suffixSearchAllow, err := buildSuffixesSearch(allowTLDs, allowSuffixes)
+	policy, policyErr := newPolicy(configDirectory, "", knownTLDs, schedules, blockPunycode, pinResponseDomain)
+	clientPolicies, clientPoliciesErr := readClientPolicies(configDirectory, knownTLDs, schedules, blockPunycode, pinResponseDomain)
+
+	err = errors.Join(schedulesErr, policyErr, clientPoliciesErr)
 	if err != nil {
 		return nil, err
 	}
 
-	exactSearchAllow, err := buildDomainSearch(allowExact)
-	if err != nil {
-		return nil, err
+	policy.name = defaultPolicyName
+	policy.clientPolicies = clientPolicies
+	return policy, nil
+}
+
+// newPolicy reads the rule files in directory, which is relative to configDirectory and empty for the default policy.
+func newPolicy(configDirectory string, directory string, knownTLDs map[string]struct{}, schedules *scheduleSet, blockPunycode bool, pinResponseDomain bool) (*Policy, error) {
+	partialPolicy := Policy{
+		knownTLDs:     knownTLDs,
+		blockPunycode: blockPunycode,
 	}
 
-	suffixSearchBlock, err := buildSuffixesSearch(blockTLDs, blockSuffixes)
+	errs := make([]error, 0)
+	sources := make(ruleSources)
+
+	allowTLDs, err := readAndValidateTLDs(configDirectory, filepath.Join(directory, configFilenameAllowTLDs), knownTLDs, partialPolicy, sources)
+	errs = append(errs, err)
+
+	allowSuffixes, err := readAndValidateSuffixes(configDirectory, filepath.Join(directory, configFilenameAllowSuffixes), partialPolicy, sources)
+	errs = append(errs, err)
+
+	allowExact, err := readAndValidateExact(configDirectory, filepath.Join(directory, configFilenameAllowExact), partialPolicy, sources)
+	errs = append(errs, err)
+
+	blockTLDs, err := readAndValidateTLDs(configDirectory, filepath.Join(directory, configFilenameDenyTLDs), knownTLDs, partialPolicy, sources)
+	errs = append(errs, err)
+
+	blockSuffixes, err := readAndValidateSuffixes(configDirectory, filepath.Join(directory, configFilenameDenySuffixes), partialPolicy, sources)
+	errs = append(errs, err)
+
+	blockExact, err := readAndValidateExact(configDirectory, filepath.Join(directory, configFilenameDenyExact), partialPolicy, sources)
+	errs = append(errs, err)
+
+	wildcardsAllow, err := readAndValidateWildcards(configDirectory, filepath.Join(directory, configFilenameAllowWildcards), partialPolicy, sources)
+	errs = append(errs, err)
+
+	wildcardsBlock, err := readAndValidateWildcards(configDirectory, filepath.Join(directory, configFilenameDenyWildcards), partialPolicy, sources)
+	errs = append(errs, err)
+
+	regexesAllow, err := readAndValidateRegexes(configDirectory, filepath.Join(directory, configFilenameAllowRegexes), sources)
+	errs = append(errs, err)
+
+	regexesBlock, err := readAndValidateRegexes(configDirectory, filepath.Join(directory, configFilenameDenyRegexes), sources)
+	errs = append(errs, err)
+
+	allowImports, err := readImports(configDirectory, filepath.Join(directory, configDirectoryAllowImports), configFilenameAllowExact, configFilenameAllowSuffixes, partialPolicy, sources)
+	errs = append(errs, err)
+
+	blockImports, err := readImports(configDirectory, filepath.Join(directory, configDirectoryDenyImports), configFilenameDenyExact, configFilenameDenySuffixes, partialPolicy, sources)
+	errs = append(errs, err)
+
+	rpzZones, err := readRPZZones(configDirectory, filepath.Join(directory, configDirectoryRPZ), partialPolicy)
+	errs = append(errs, err)
+
+	denyIPv4, err := readAndValidateIP(configDirectory, filepath.Join(directory, configFilenameIPv4Deny), IPv4, sources)
+	errs = append(errs, err)
+
+	allowIPv4, err := readAndValidateIP(configDirectory, filepath.Join(directory, configFilenameIPv4Allow), IPv4, sources)
+	errs = append(errs, err)
+
+	denyIPv6, err := readAndValidateIP(configDirectory, filepath.Join(directory, configFilenameIPv6Deny), IPv6, sources)
+	errs = append(errs, err)
+
+	allowIPv6, err := readAndValidateIP(configDirectory, filepath.Join(directory, configFilenameIPv6Allow), IPv6, sources)
+	errs = append(errs, err)
+
+	pinResponseDomainMap, err := readAndValidatePinResponseDomain(configDirectory, filepath.Join(directory, configFilenamePinResponseDomain), partialPolicy, sources)
+	errs = append(errs, err)
+
+	pinA, err := readAndValidatePinA(configDirectory, filepath.Join(directory, configFilenamePinA), partialPolicy, sources)
+	errs = append(errs, err)
+
+	err = errors.Join(errs...)
 	if err != nil {
 		return nil, err
 	}
 
-	exactSearchBlock, err := buildDomainSearch(blockExact)
+	allowSuffixes = append(allowSuffixes, allowImports.suffixes...)
+	allowExact = append(allowExact, allowImports.exact...)
+	blockSuffixes = append(blockSuffixes, blockImports.suffixes...)
+	blockExact = append(blockExact, blockImports.exact...)
+
+	schedules.applyFileSchedules(sources)
+
+	scheduledAllow := make([]scheduledRule, 0)
+	scheduledBlock := make([]scheduledRule, 0)
+	var scheduled []scheduledRule
+
+	blockExact, scheduled, err = schedules.partitionDomains(blockExact, "exact", configFilenameDenyExact, sources)
+	errs = append(errs, err)
+	scheduledBlock = append(scheduledBlock, scheduled...)
+
+	blockTLDs, scheduled, err = schedules.partitionDomains(blockTLDs, "suffix", configFilenameDenyTLDs, sources)
+	errs = append(errs, err)
+	scheduledBlock = append(scheduledBlock, scheduled...)
+
+	blockSuffixes, scheduled, err = schedules.partitionDomains(blockSuffixes, "suffix", configFilenameDenySuffixes, sources)
+	errs = append(errs, err)
+	scheduledBlock = append(scheduledBlock, scheduled...)
+
+	wildcardsBlock, scheduled, err = schedules.partitionPatterns(wildcardsBlock, "wildcard", configFilenameDenyWildcards, sources)
+	errs = append(errs, err)
+	scheduledBlock = append(scheduledBlock, scheduled...)
+
+	regexesBlock, scheduled, err = schedules.partitionPatterns(regexesBlock, "regex", configFilenameDenyRegexes, sources)
+	errs = append(errs, err)
+	scheduledBlock = append(scheduledBlock, scheduled...)
+
+	allowExact, scheduled, err = schedules.partitionDomains(allowExact, "exact", configFilenameAllowExact, sources)
+	errs = append(errs, err)
+	scheduledAllow = append(scheduledAllow, scheduled...)
+
+	allowTLDs, scheduled, err = schedules.partitionDomains(allowTLDs, "suffix", configFilenameAllowTLDs, sources)
+	errs = append(errs, err)
+	scheduledAllow = append(scheduledAllow, scheduled...)
+
+	allowSuffixes, scheduled, err = schedules.partitionDomains(allowSuffixes, "suffix", configFilenameAllowSuffixes, sources)
+	errs = append(errs, err)
+	scheduledAllow = append(scheduledAllow, scheduled...)
+
+	wildcardsAllow, scheduled, err = schedules.partitionPatterns(wildcardsAllow, "wildcard", configFilenameAllowWildcards, sources)
+	errs = append(errs, err)
+	scheduledAllow = append(scheduledAllow, scheduled...)
+
+	regexesAllow, scheduled, err = schedules.partitionPatterns(regexesAllow, "regex", configFilenameAllowRegexes, sources)
+	errs = append(errs, err)
+	scheduledAllow = append(scheduledAllow, scheduled...)
+
+	err = errors.Join(errs...)
 	if err != nil {
 		return nil, err
 	}
 
-	denyIPv4, err := readAndValidateIP(configDirectory, configFilenameIPv4Deny, IPv4)
+	// TODO these could be combined into one suffix trie
+	suffixSearchAllow, err := buildSuffixesSearch(allowTLDs, allowSuffixes)
 	if err != nil {
 		return nil, err
 	}
 
-	allowIPv4, err := readAndValidateIP(configDirectory, configFilenameIPv4Allow, IPv4)
+	exactSearchAllow, err := buildDomainSearch(allowExact)
 	if err != nil {
 		return nil, err
 	}
 
-	denyIPv6, err := readAndValidateIP(configDirectory, configFilenameIPv6Deny, IPv6)
+	suffixSearchBlock, err := buildSuffixesSearch(blockTLDs, blockSuffixes)
 	if err != nil {
 		return nil, err
 	}
 
-	allowIPv6, err := readAndValidateIP(configDirectory, configFilenameIPv6Allow, IPv6)
+	exactSearchBlock, err := buildDomainSearch(blockExact)
 	if err != nil {
 		return nil, err
 	}
 
-	pinResponseDomainMap, err := readAndValidatePinResponseDomain(configDirectory, partialPolicy)
+	wildcardParents, wildcardsAllow := splitWildcards(wildcardsAllow)
+	wildcardParentsAllow, err := buildDomainSearch(wildcardParents)
 	if err != nil {
 		return nil, err
 	}
 
-	pinA, err := readAndValidatePinA(configDirectory, partialPolicy)
+	wildcardParents, wildcardsBlock = splitWildcards(wildcardsBlock)
+	wildcardParentsBlock, err := buildDomainSearch(wildcardParents)
 	if err != nil {
 		return nil, err
 	}
@@ -140,6 +307,12 @@ func NewPolicy(configDirectory string, blockPunycode bool, pinResponseDomain boo
 		suffixSearchAllow:    suffixSearchAllow,
 		exactSearchBlock:     exactSearchBlock,
 		suffixSearchBlock:    suffixSearchBlock,
+		wildcardParentsAllow: wildcardParentsAllow,
+		wildcardParentsBlock: wildcardParentsBlock,
+		wildcardsAllow:       wildcardsAllow,
+		wildcardsBlock:       wildcardsBlock,
+		regexesAllow:         regexesAllow,
+		regexesBlock:         regexesBlock,
 		knownTLDs:            knownTLDs,
 		denyIPv4:             denyIPv4,
 		denyIPv6:             denyIPv6,
@@ -149,158 +322,204 @@ func NewPolicy(configDirectory string, blockPunycode bool, pinResponseDomain boo
 		pinResponseDomain:    pinResponseDomain,
 		pinResponseDomainMap: pinResponseDomainMap,
 		pinA:                 pinA,
+		sources:              sources,
+		importSummaries:      append(allowImports.summaries, blockImports.summaries...),
+		rpzZones:             rpzZones,
+		scheduledAllow:       scheduledAllow,
+		scheduledBlock:       scheduledBlock,
+		clock:                time.Now,
 	}, nil
 }
 
 func readKnownTLDs(configDirectory string, policy Policy) (map[string]struct{}, error) {
-	tldList, err := readConfig(configDirectory, configFilenameKnownTLDs)
+	filename := configFilenameKnownTLDs
+	tldList, err := readConfig(configDirectory, filename)
 	if err != nil {
 		return nil, err
 	}
 
+	errs := make([]error, 0)
 	knownTLDs := make(map[string]struct{})
-	for _, tld := range tldList {
+	for _, line := range tldList {
+		tld := line.text
 		if strings.TrimSpace(tld) != tld {
-			return nil, fmt.Errorf("%s '%s' has leading or trailing whitespace", configFilenameKnownTLDs, tld)
+			errs = append(errs, newConfigError(filename, line.number, "'%s' has leading or trailing whitespace", tld))
+			continue
 		}
 
 		expectedPrefix := "."
 		if !strings.HasPrefix(tld, expectedPrefix) {
-			return nil, fmt.Errorf("%s '%s' needs to start with a '.'", configFilenameKnownTLDs, tld)
+			errs = append(errs, newConfigError(filename, line.number, "'%s' needs to start with a '.'", tld))
+			continue
 		}
 
 		tldWithoutPrefix := strings.TrimPrefix(tld, expectedPrefix)
 		err := policy.labelHasCorrectFormat(tldWithoutPrefix)
 		if err != nil {
-			return nil, fmt.Errorf("%s '%s': %s", configFilenameKnownTLDs, tld, err.Error())
+			errs = append(errs, newConfigError(filename, line.number, "'%s': %s", tld, err.Error()))
+			continue
 		}
 
 		knownTLDs[tldWithoutPrefix] = struct{}{}
 	}
 
-	return knownTLDs, nil
+	return knownTLDs, errors.Join(errs...)
 }
 
-func readAndValidateTLDs(configDirectory string, filename string, knownTLDs map[string]struct{}, policy Policy) ([]string, error) {
-	TLDs, err := readConfig(configDirectory, filename)
+func readAndValidateTLDs(configDirectory string, filename string, knownTLDs map[string]struct{}, policy Policy, sources ruleSources) ([]string, error) {
+	lines, err := readConfig(configDirectory, filename)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, TLD := range TLDs {
+	errs := make([]error, 0)
+	TLDs := make([]string, 0)
+	for _, line := range lines {
+		TLD, scheduleName := cutSchedule(line.text)
 		if strings.TrimSpace(TLD) != TLD {
-			return nil, fmt.Errorf("%s '%s' has leading or trailing whitespace", filename, TLD)
+			errs = append(errs, newConfigError(filename, line.number, "'%s' has leading or trailing whitespace", TLD))
+			continue
 		}
 
 		expectedPrefix := "."
 		if !strings.HasPrefix(TLD, expectedPrefix) {
-			return nil, fmt.Errorf("%s '%s' needs to start with at '.'", filename, TLD)
+			errs = append(errs, newConfigError(filename, line.number, "'%s' needs to start with at '.'", TLD))
+			continue
 		}
 
 		tldWithoutPrefix := strings.TrimPrefix(TLD, expectedPrefix)
 		err := policy.labelHasCorrectFormat(tldWithoutPrefix)
 		if err != nil {
-			return nil, fmt.Errorf("%s '%s': %s", filename, TLD, err.Error())
+			errs = append(errs, newConfigError(filename, line.number, "'%s': %s", TLD, err.Error()))
+			continue
 		}
 
 		_, found := knownTLDs[tldWithoutPrefix]
 		if !found {
-			return nil, fmt.Errorf("%s '%s' not present in known.tld", filename, TLD)
+			errs = append(errs, newConfigError(filename, line.number, "'%s' not present in known.tld", TLD))
+			continue
 		}
+
+		TLDs = append(TLDs, TLD)
+		sources.addScheduled(filename, TLD, line.number, scheduleName)
 	}
 
-	return TLDs, nil
+	return TLDs, errors.Join(errs...)
 }
 
-func readAndValidateSuffixes(configDirectory string, filename string, policy Policy) ([]string, error) {
-	suffixes, err := readConfig(configDirectory, filename)
+func readAndValidateSuffixes(configDirectory string, filename string, policy Policy, sources ruleSources) ([]string, error) {
+	lines, err := readConfig(configDirectory, filename)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, suffix := range suffixes {
+	errs := make([]error, 0)
+	suffixes := make([]string, 0)
+	for _, line := range lines {
+		suffix, scheduleName := cutSchedule(line.text)
 		if strings.TrimSpace(suffix) != suffix {
-			return nil, fmt.Errorf("%s '%s' has leading or trailing whitespace", filename, suffix)
+			errs = append(errs, newConfigError(filename, line.number, "'%s' has leading or trailing whitespace", suffix))
+			continue
 		}
 
 		if !strings.HasPrefix(suffix, ".") {
-			return nil, fmt.Errorf("%s '%s' must start with a '.'", filename, suffix)
+			errs = append(errs, newConfigError(filename, line.number, "'%s' must start with a '.'", suffix))
+			continue
 		}
 		domain := strings.TrimPrefix(suffix, ".")
 
 		err := policy.domainHasCorrectFormat(domain)
 		if err != nil {
-			return nil, fmt.Errorf("%s '%s': %s", filename, domain, err.Error())
+			errs = append(errs, newConfigError(filename, line.number, "'%s': %s", domain, err.Error()))
+			continue
 		}
+
+		suffixes = append(suffixes, suffix)
+		sources.addScheduled(filename, suffix, line.number, scheduleName)
 	}
 
-	return suffixes, nil
+	return suffixes, errors.Join(errs...)
 }
 
-func readAndValidateExact(configDirectory string, filename string, policy Policy) ([]string, error) {
-	domains, err := readConfig(configDirectory, filename)
+func readAndValidateExact(configDirectory string, filename string, policy Policy, sources ruleSources) ([]string, error) {
+	lines, err := readConfig(configDirectory, filename)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, domain := range domains {
+	errs := make([]error, 0)
+	domains := make([]string, 0)
+	for _, line := range lines {
+		domain, scheduleName := cutSchedule(line.text)
 		if strings.TrimSpace(domain) != domain {
-			return nil, fmt.Errorf("%s '%s' has leading or trailing whitespace", filename, domain)
+			errs = append(errs, newConfigError(filename, line.number, "'%s' has leading or trailing whitespace", domain))
+			continue
 		}
 
 		err := policy.domainHasCorrectFormat(domain)
 		if err != nil {
-			return nil, fmt.Errorf("%s '%s': %s", filename, domain, err.Error())
+			errs = append(errs, newConfigError(filename, line.number, "'%s': %s", domain, err.Error()))
+			continue
 		}
+
+		domains = append(domains, domain)
+		sources.addScheduled(filename, domain, line.number, scheduleName)
 	}
 
-	return domains, nil
+	return domains, errors.Join(errs...)
 }
 
-func readAndValidateIP(configDirectory string, filename string, ipVersion ipversion) ([]netip.Prefix, error) {
+func readAndValidateIP(configDirectory string, filename string, ipVersion ipversion, sources ruleSources) ([]netip.Prefix, error) {
 	ipListRaw, err := readConfig(configDirectory, filename)
 	if err != nil {
 		return nil, err
 	}
 
+	errs := make([]error, 0)
 	result := make([]netip.Prefix, 0)
-	for _, ip := range ipListRaw {
-		p, err := netip.ParsePrefix(ip)
+	for _, line := range ipListRaw {
+		p, err := netip.ParsePrefix(line.text)
 		if err != nil {
-			return nil, fmt.Errorf("%s: %s", filename, err.Error())
+			errs = append(errs, newConfigError(filename, line.number, "%s", err.Error()))
+			continue
 		}
 
 		switch ipVersion {
 		case IPv4:
 			if !p.Addr().Is4() {
-				return nil, fmt.Errorf("%s '%s': need to be IPv4", filename, p.String())
+				errs = append(errs, newConfigError(filename, line.number, "'%s': need to be IPv4", p.String()))
+				continue
 			}
 		case IPv6:
 			if !p.Addr().Is6() {
-				return nil, fmt.Errorf("%s '%s': need to be IPv6", filename, p.String())
+				errs = append(errs, newConfigError(filename, line.number, "'%s': need to be IPv6", p.String()))
+				continue
 			}
 		default:
-			return nil, fmt.Errorf("%s unexpected IP version %d", filename, ipVersion)
+			return nil, newConfigError(filename, 0, "unexpected IP version %d", ipVersion)
 		}
 
 		result = append(result, p)
+		sources.add(filename, p.String(), line.number)
 	}
 
-	return result, nil
+	return result, errors.Join(errs...)
 }
 
-func readAndValidatePinResponseDomain(configDirectory string, policy Policy) (map[string]map[string]struct{}, error) {
-	configFilename := configFilenamePinResponseDomain
+func readAndValidatePinResponseDomain(configDirectory string, configFilename string, policy Policy, sources ruleSources) (map[string]map[string]struct{}, error) {
 	pinResponseDomainRaw, err := readConfig(configDirectory, configFilename)
 	if err != nil {
 		return nil, err
 	}
 
+	errs := make([]error, 0)
 	pinResponseDomainMap := make(map[string]map[string]struct{})
-	for _, d := range pinResponseDomainRaw {
+	for _, line := range pinResponseDomainRaw {
+		d := line.text
 		parts := strings.Split(d, ":")
 		if len(parts) != 2 {
-			return nil, fmt.Errorf("%s expected '<domain>:<domain>', got '%s'", configFilename, d)
+			errs = append(errs, newConfigError(configFilename, line.number, "expected '<domain>:<domain>', got '%s'", d))
+			continue
 		}
 
 		sourceDomain := parts[0]
@@ -308,12 +527,14 @@ func readAndValidatePinResponseDomain(configDirectory string, policy Policy) (ma
 
 		err = policy.domainHasCorrectFormat(sourceDomain)
 		if err != nil {
-			return nil, fmt.Errorf("%s source domain '%s': %s", configFilename, sourceDomain, err.Error())
+			errs = append(errs, newConfigError(configFilename, line.number, "source domain '%s': %s", sourceDomain, err.Error()))
+			continue
 		}
 
 		err = policy.domainHasCorrectFormat(destinationDomain)
 		if err != nil {
-			return nil, fmt.Errorf("%s destionation domain '%s': %s", configFilename, destinationDomain, err.Error())
+			errs = append(errs, newConfigError(configFilename, line.number, "destination domain '%s': %s", destinationDomain, err.Error()))
+			continue
 		}
 
 		source, found := pinResponseDomainMap[sourceDomain]
@@ -323,34 +544,39 @@ func readAndValidatePinResponseDomain(configDirectory string, policy Policy) (ma
 
 		source[destinationDomain] = struct{}{}
 		pinResponseDomainMap[sourceDomain] = source
+		sources.add(configFilename, d, line.number)
 	}
 
-	return pinResponseDomainMap, nil
+	return pinResponseDomainMap, errors.Join(errs...)
 }
 
-func readAndValidatePinA(configDirectory string, policy Policy) (map[string]net.IP, error) {
-	configFilename := configFilenamePinA
+func readAndValidatePinA(configDirectory string, configFilename string, policy Policy, sources ruleSources) (map[string]net.IP, error) {
 	pinARaw, err := readConfig(configDirectory, configFilename)
 	if err != nil {
 		return nil, err
 	}
 
+	errs := make([]error, 0)
 	pinA := make(map[string]net.IP)
-	for _, r := range pinARaw {
+	for _, line := range pinARaw {
+		r := line.text
 		parts := strings.Split(r, ":")
 		if len(parts) != 2 {
-			return nil, fmt.Errorf("%s expected '<domain>:<ip>', got %s", configFilename, r)
+			errs = append(errs, newConfigError(configFilename, line.number, "expected '<domain>:<ip>', got %s", r))
+			continue
 		}
 
 		domain := parts[0]
 		err := policy.domainHasCorrectFormat(domain)
 		if err != nil {
-			return nil, fmt.Errorf("%s domain '%s': %s", configFilename, domain, err.Error())
+			errs = append(errs, newConfigError(configFilename, line.number, "domain '%s': %s", domain, err.Error()))
+			continue
 		}
 
 		netIP, err := netip.ParseAddr(parts[1])
 		if err != nil || !netIP.Is4() {
-			return nil, fmt.Errorf("%s invalid ip '%s' for domain '%s'", configFilename, parts[1], domain)
+			errs = append(errs, newConfigError(configFilename, line.number, "invalid ip '%s' for domain '%s'", parts[1], domain))
+			continue
 		}
 
 		data := netIP.As4()
@@ -359,12 +585,13 @@ func readAndValidatePinA(configDirectory string, policy Policy) (map[string]net.
 		_, found := pinA[domain]
 		if !found {
 			pinA[domain] = ip
+			sources.add(configFilename, domain, line.number)
 		} else {
-			return nil, fmt.Errorf("%s duplicate domain '%s'", configFilename, domain)
+			errs = append(errs, newConfigError(configFilename, line.number, "duplicate domain '%s'", domain))
 		}
 	}
 
-	return pinA, nil
+	return pinA, errors.Join(errs...)
 }
 
 func buildSuffixesSearch(TLDs []string, subdomains []string) (*suffixtrie.Node, error) {
@@ -394,20 +621,17 @@ func (p *Policy) queryIsAllowed(question Question) (bool, []FilterReason) {
 	reasons := make([]FilterReason, 0)
 
 	if !supportedInRequests(question.Type) {
-		reason := fmt.Sprintf("deny request type: %d", question.Type)
-		reasons = append(reasons, FilterReason(reason))
+		reasons = append(reasons, FilterReason{Code: FilterCodeRequestType, Value: strconv.Itoa(int(question.Type))})
 		return false, reasons
 	}
 
 	if question.Type == RecordTypeA && len(p.allowIPv4) == 0 {
-		reason := fmt.Sprintf("deny request type: %d, no allowed IPv4", question.Type)
-		reasons = append(reasons, FilterReason(reason))
+		reasons = append(reasons, FilterReason{Code: FilterCodeNoAllowedIPv4, Value: strconv.Itoa(int(question.Type))})
 		return false, reasons
 	}
 
 	if question.Type == RecordTypeAAAA && len(p.allowIPv6) == 0 {
-		reason := fmt.Sprintf("deny request type: %d, no allowed IPv6", question.Type)
-		reasons = append(reasons, FilterReason(reason))
+		reasons = append(reasons, FilterReason{Code: FilterCodeNoAllowedIPv6, Value: strconv.Itoa(int(question.Type))})
 		return false, reasons
 	}
 
@@ -416,13 +640,11 @@ func (p *Policy) queryIsAllowed(question Question) (bool, []FilterReason) {
 	allowed, domainReason := p.domainIsAllowed(domain)
 	reasons = append(reasons, domainReason)
 	if !allowed {
-		reason := fmt.Sprintf("deny query")
-		reasons = append(reasons, FilterReason(reason))
+		reasons = append(reasons, FilterReason{Code: FilterCodeDenyQuery})
 		return false, reasons
 	}
 
-	reason := fmt.Sprintf("allow query")
-	reasons = append(reasons, FilterReason(reason))
+	reasons = append(reasons, FilterReason{Code: FilterCodeAllowQuery})
 	return true, reasons
 }
 
@@ -435,13 +657,11 @@ func (p *Policy) responseIsAllowed(questionName string, requestType RecordType,
 	reasons := make([]FilterReason, 0)
 	if len(response.Answers) == 0 {
 		if response.Flags.RCODE == ResponseCodeNoError || response.Flags.RCODE == ResponseCodeNXDomain {
-			reason := fmt.Sprintf("allow response")
-			reasons = append(reasons, FilterReason(reason))
+			reasons = append(reasons, FilterReason{Code: FilterCodeAllowResponse})
 			return true, reasons
 		}
 
-		reason := fmt.Sprintf("deny response due to unexpected error code %s", response.Flags.RCODE.Name())
-		reasons = append(reasons, FilterReason(reason))
+		reasons = append(reasons, FilterReason{Code: FilterCodeResponseCode, Value: response.Flags.RCODE.Name()})
 		return false, reasons
 	}
 
@@ -454,15 +674,13 @@ func (p *Policy) responseIsAllowed(questionName string, requestType RecordType,
 
 	for _, answer := range response.Answers {
 		if !supportedInResponses(answer.Type) {
-			reason := fmt.Sprintf("deny due to response type: %d", answer.Type)
-			reasons = append(reasons, FilterReason(reason))
+			reasons = append(reasons, FilterReason{Code: FilterCodeResponseType, Value: strconv.Itoa(int(answer.Type))})
 			return false, reasons
 		}
 
 		if answer.Type == RecordTypeA {
 			if requestType != RecordTypeA {
-				reason := fmt.Sprintf("deny due to A response not matching request type 1: %d", answer.Type)
-				reasons = append(reasons, FilterReason(reason))
+				reasons = append(reasons, typeMismatchReason(answer.Type, "request type 1"))
 				return false, reasons
 			}
 
@@ -472,15 +690,13 @@ func (p *Policy) responseIsAllowed(questionName string, requestType RecordType,
 
 		if answer.Type == RecordTypeCNAME {
 			if !(requestType == RecordTypeA || requestType == RecordTypeAAAA || requestType == RecordTypeHTTPS) {
-				reason := fmt.Sprintf("deny due to CNAME response not matching request type A, AAAA or HTTPS: %d", answer.Type)
-				reasons = append(reasons, FilterReason(reason))
+				reasons = append(reasons, typeMismatchReason(answer.Type, "request type A, AAAA or HTTPS"))
 				return false, reasons
 			}
 
 			_, found := cnames[answer.Name]
 			if found {
-				reason := fmt.Sprintf("deny due to duplicate CNAME records")
-				reasons = append(reasons, FilterReason(reason))
+				reasons = append(reasons, FilterReason{Code: FilterCodeDuplicateCNAME})
 				return false, reasons
 			}
 			cnames[answer.Name] = answer.CNAME
@@ -493,8 +709,7 @@ func (p *Policy) responseIsAllowed(questionName string, requestType RecordType,
 
 		if answer.Type == RecordTypeAAAA {
 			if requestType != RecordTypeAAAA {
-				reason := fmt.Sprintf("deny due to AAAA response not matching request type 28: %d", answer.Type)
-				reasons = append(reasons, FilterReason(reason))
+				reasons = append(reasons, typeMismatchReason(answer.Type, "request type 28"))
 				return false, reasons
 			}
 
@@ -504,8 +719,7 @@ func (p *Policy) responseIsAllowed(questionName string, requestType RecordType,
 
 		if answer.Type == RecordTypeHTTPS {
 			if requestType != RecordTypeHTTPS {
-				reason := fmt.Sprintf("deny due to HTTPS response not matching request type 65: %d", answer.Type)
-				reasons = append(reasons, FilterReason(reason))
+				reasons = append(reasons, typeMismatchReason(answer.Type, "request type 65"))
 				return false, reasons
 			}
 
@@ -537,14 +751,12 @@ func (p *Policy) responseIsAllowed(questionName string, requestType RecordType,
 	}
 
 	if len(ipDomains) > 1 {
-		reason := fmt.Sprintf("deny due to more than one domain with IPs")
-		reasons = append(reasons, FilterReason(reason))
+		reasons = append(reasons, FilterReason{Code: FilterCodeMultipleIPNames})
 		return false, reasons
 	}
 
 	if len(httpsDomains) > 1 {
-		reason := fmt.Sprintf("deny due to more than one domain with HTTPS records")
-		reasons = append(reasons, FilterReason(reason))
+		reasons = append(reasons, FilterReason{Code: FilterCodeMultipleHTTPSNames})
 		return false, reasons
 	}
 
@@ -552,15 +764,13 @@ func (p *Policy) responseIsAllowed(questionName string, requestType RecordType,
 		if requestType == RecordTypeHTTPS {
 			err := correctCNAMEChain(cnames, questionName, httpsDomains)
 			if err != nil {
-				reason := FilterReason(err.Error())
-				reasons = append(reasons, reason)
+				reasons = append(reasons, FilterReason{Code: err.code})
 				return false, reasons
 			}
 		} else {
 			err := correctCNAMEChain(cnames, questionName, ipDomains)
 			if err != nil {
-				reason := FilterReason(err.Error())
-				reasons = append(reasons, reason)
+				reasons = append(reasons, FilterReason{Code: err.code})
 				return false, reasons
 			}
 		}
@@ -605,10 +815,23 @@ func (p *Policy) responseIsAllowed(questionName string, requestType RecordType,
 			}
 
 			if !domainAllowed {
-				reason := fmt.Sprintf("deny due to response domain: %s:%s", sourceDomain, destinationDomain)
-				reasons = append(reasons, FilterReason(reason))
+				breakGlassReason, found := p.breakGlassAllows(sourceDomain + ":" + destinationDomain)
+				if found {
+					reasons = append(reasons, breakGlassReason)
+					continue
+				}
+
+				reasons = append(reasons, FilterReason{Code: FilterCodePinMismatch, Value: sourceDomain + ":" + destinationDomain})
 				return false, reasons
 			}
+
+			pin := sourceDomain + ":" + destinationDomain
+			reasons = append(reasons, FilterReason{
+				Code:   FilterCodeAllowPin,
+				Value:  pin,
+				Rule:   pin,
+				Source: p.sources.source(pin, configFilenamePinResponseDomain),
+			})
 		}
 	}
 
@@ -617,8 +840,7 @@ func (p *Policy) responseIsAllowed(questionName string, requestType RecordType,
 		reasons = append(reasons, ipv4Reason)
 
 		if !ipv4Allowed {
-			reason := fmt.Sprintf("deny due to response IPv4: %s", ipv4)
-			reasons = append(reasons, FilterReason(reason))
+			reasons = append(reasons, FilterReason{Code: FilterCodeDenyResponseIPv4, Value: ipv4})
 			return false, reasons
 		}
 	}
@@ -628,20 +850,27 @@ func (p *Policy) responseIsAllowed(questionName string, requestType RecordType,
 		reasons = append(reasons, ipv6Reason)
 
 		if !ipv6Allowed {
-			reason := fmt.Sprintf("deny due to response IPv6: %s", ipv6)
-			reasons = append(reasons, FilterReason(reason))
+			reasons = append(reasons, FilterReason{Code: FilterCodeDenyResponseIPv6, Value: ipv6})
 			return false, reasons
 		}
 	}
 
-	reason := fmt.Sprintf("allow response")
-	reasons = append(reasons, FilterReason(reason))
+	reasons = append(reasons, FilterReason{Code: FilterCodeAllowResponse})
 	return true, reasons
 }
 
-func correctCNAMEChain(cnames map[string]string, start string, end map[string]struct{}) error {
+// typeMismatchReason is the reason for an answer of a type that was not asked for.
+func typeMismatchReason(answerType RecordType, expected string) FilterReason {
+	return FilterReason{
+		Code:   FilterCodeTypeMismatch,
+		Value:  strconv.Itoa(int(answerType)),
+		Detail: fmt.Sprintf("%s response not matching %s", answerType.Name(), expected),
+	}
+}
+
+func correctCNAMEChain(cnames map[string]string, start string, end map[string]struct{}) *cnameChainError {
 	if len(cnames) > maxNumberOfCnameRecords {
-		return fmt.Errorf("too many CNAME records")
+		return &cnameChainError{code: FilterCodeCNAMEChainTooLong}
 	}
 
 	currentDomain := start
@@ -649,13 +878,13 @@ func correctCNAMEChain(cnames map[string]string, start string, end map[string]st
 	for i := 0; i < len(cnames); i++ {
 		_, alreadyVisited := visited[currentDomain]
 		if alreadyVisited {
-			return fmt.Errorf("loop in CNAME chain")
+			return &cnameChainError{code: FilterCodeCNAMEChainLoop}
 		}
 		visited[currentDomain] = struct{}{}
 
 		entry, found := cnames[currentDomain]
 		if !found {
-			return fmt.Errorf("incomplete CNAME chain")
+			return &cnameChainError{code: FilterCodeCNAMEChainIncomplete}
 		}
 
 		currentDomain = entry
@@ -664,7 +893,7 @@ func correctCNAMEChain(cnames map[string]string, start string, end map[string]st
 	if len(end) == 1 {
 		_, found := end[currentDomain]
 		if !found {
-			return fmt.Errorf("incomplete CNAME chain, end does not match")
+			return &cnameChainError{code: FilterCodeCNAMEChainEnd}
 		}
 	}
 
@@ -708,51 +937,147 @@ func (p *Policy) domainIsAllowed(domain string) (bool, FilterReason) {
 	domain = strings.TrimSuffix(domain, ".")
 
 	if p.domainMatchesBlockExactly(domain) {
-		reason := fmt.Sprintf("deny due to exact denylist: %s", domain)
-		return false, FilterReason(reason)
+		return false, FilterReason{
+			Code:   FilterCodeDenyExact,
+			Value:  domain,
+			Rule:   domain,
+			Source: p.sources.source(domain, configFilenameDenyExact),
+		}
+	}
+
+	suffix, found := p.domainMatchesBlockSuffix(domain)
+	if found {
+		return false, FilterReason{
+			Code:   FilterCodeDenySuffix,
+			Value:  domain,
+			Rule:   suffix,
+			Source: p.sources.source(suffix, configFilenameDenySuffixes, configFilenameDenyTLDs),
+		}
+	}
+
+	pattern, found := matchWildcards(p.wildcardParentsBlock, p.wildcardsBlock, domain)
+	if found {
+		return false, FilterReason{
+			Code:   FilterCodeDenyWildcard,
+			Value:  domain,
+			Rule:   pattern,
+			Source: p.sources.source(pattern, configFilenameDenyWildcards),
+		}
+	}
+
+	pattern, found = matchPatterns(p.regexesBlock, domain)
+	if found {
+		return false, FilterReason{
+			Code:   FilterCodeDenyRegex,
+			Value:  domain,
+			Rule:   pattern,
+			Source: p.sources.source(pattern, configFilenameDenyRegexes),
+		}
 	}
 
-	if p.domainMatchesBlockSuffix(domain) {
-		reason := fmt.Sprintf("deny due to suffix denylist: %s", domain)
-		return false, FilterReason(reason)
+	now := p.now()
+	scheduled, found := matchScheduledRules(p.scheduledBlock, domain, now)
+	if found {
+		return false, p.scheduledReason(scheduled, domain, false)
 	}
 
 	// all deny rules done, move to explicit allow
 
 	if p.domainMatchesAllowExactly(domain) {
-		reason := fmt.Sprintf("allow due to exact allowlist: %s", domain)
-		return true, FilterReason(reason)
+		return true, FilterReason{
+			Code:   FilterCodeAllowExact,
+			Value:  domain,
+			Rule:   domain,
+			Source: p.sources.source(domain, configFilenameAllowExact),
+		}
+	}
+
+	suffix, found = p.domainMatchesAllowSuffix(domain)
+	if found {
+		return true, FilterReason{
+			Code:   FilterCodeAllowSuffix,
+			Value:  domain,
+			Rule:   suffix,
+			Source: p.sources.source(suffix, configFilenameAllowSuffixes, configFilenameAllowTLDs),
+		}
+	}
+
+	pattern, found = matchWildcards(p.wildcardParentsAllow, p.wildcardsAllow, domain)
+	if found {
+		return true, FilterReason{
+			Code:   FilterCodeAllowWildcard,
+			Value:  domain,
+			Rule:   pattern,
+			Source: p.sources.source(pattern, configFilenameAllowWildcards),
+		}
+	}
+
+	pattern, found = matchPatterns(p.regexesAllow, domain)
+	if found {
+		return true, FilterReason{
+			Code:   FilterCodeAllowRegex,
+			Value:  domain,
+			Rule:   pattern,
+			Source: p.sources.source(pattern, configFilenameAllowRegexes),
+		}
+	}
+
+	scheduled, found = matchScheduledRules(p.scheduledAllow, domain, now)
+	if found {
+		return true, p.scheduledReason(scheduled, domain, true)
+	}
+
+	breakGlassReason, found := p.breakGlassAllows(domain)
+	if found {
+		return true, breakGlassReason
 	}
 
-	if p.domainMatchesAllowSuffix(domain) {
-		reason := fmt.Sprintf("allow due to suffix allowlist: %s", domain)
-		return true, FilterReason(reason)
+	return false, FilterReason{Code: FilterCodeNoAllowRule, Value: domain}
+}
+
+// scheduledReason returns the reason for a scheduled rule that matched domain, with the code of its kind of rule.
+func (p *Policy) scheduledReason(scheduled *scheduledRule, domain string, allowed bool) FilterReason {
+	codes := map[string]FilterCode{
+		"exact":    FilterCodeDenyExact,
+		"suffix":   FilterCodeDenySuffix,
+		"wildcard": FilterCodeDenyWildcard,
+		"regex":    FilterCodeDenyRegex,
+	}
+	if allowed {
+		codes = map[string]FilterCode{
+			"exact":    FilterCodeAllowExact,
+			"suffix":   FilterCodeAllowSuffix,
+			"wildcard": FilterCodeAllowWildcard,
+			"regex":    FilterCodeAllowRegex,
+		}
 	}
 
-	reason := fmt.Sprintf("deny because no allow rule matched: %s", domain)
-	return false, FilterReason(reason)
+	return FilterReason{
+		Code:     codes[scheduled.kind],
+		Value:    domain,
+		Rule:     scheduled.rule,
+		Source:   p.sources.source(scheduled.rule, scheduled.ruleFilenames...),
+		Schedule: scheduled.schedule.name,
+	}
 }
 
 func (p *Policy) domainHasCorrectFormatWithTrailingDot(domain string) (bool, FilterReason) {
 	// https://www.ietf.org/rfc/rfc1035.txt
 	if len(domain) > 254 {
-		reason := fmt.Sprintf("deny due to domain being too long: %d", len(domain))
-		return false, FilterReason(reason)
+		return false, FilterReason{Code: FilterCodeNameTooLong, Value: domain, Detail: strconv.Itoa(len(domain))}
 	}
 
 	if !strings.HasSuffix(domain, ".") {
-		return false, "deny due to missing trailing '.'"
+		return false, FilterReason{Code: FilterCodeNoTrailingDot, Value: domain}
 	}
 
 	domain = strings.TrimSuffix(domain, ".")
 	err := p.domainHasCorrectFormat(domain)
 	if err != nil {
-		reason := fmt.Sprintf("deny: %s", err.Error())
-		return false, FilterReason(reason)
+		return false, FilterReason{Code: FilterCodeNameFormat, Value: domain, Detail: err.Error()}
 	}
 
-	reason := fmt.Sprintf("allow due to correct format: %s", domain)
-	return true, FilterReason(reason)
+	return true, FilterReason{Code: FilterCodeAllowFormat, Value: domain}
 }
 
 func (p *Policy) domainHasCorrectFormat(domain string) error {
@@ -814,78 +1139,90 @@ func (p *Policy) domainMatchesAllowExactly(domain string) bool {
 	return p.exactSearchAllow.MatchExact([]byte(domain))
 }
 
-func (p *Policy) domainMatchesAllowSuffix(domain string) bool {
-	return p.suffixSearchAllow.MatchSuffix([]byte(domain))
+func (p *Policy) domainMatchesAllowSuffix(domain string) (string, bool) {
+	i, found := p.suffixSearchAllow.FindSuffix([]byte(domain))
+	return domain[i:], found
 }
 
 func (p *Policy) domainMatchesBlockExactly(domain string) bool {
 	return p.exactSearchBlock.MatchExact([]byte(domain))
 }
 
-func (p *Policy) domainMatchesBlockSuffix(domain string) bool {
-	return p.suffixSearchBlock.MatchSuffix([]byte(domain))
+func (p *Policy) domainMatchesBlockSuffix(domain string) (string, bool) {
+	i, found := p.suffixSearchBlock.FindSuffix([]byte(domain))
+	return domain[i:], found
 }
 
 func (p *Policy) ipv4IsAllowed(ipString string) (bool, FilterReason) {
 	ip, err := netip.ParseAddr(ipString)
 	if err != nil {
-		reason := fmt.Sprintf("deny failed to parse IPv4: %s", ipString)
-		return false, FilterReason(reason)
+		return false, FilterReason{Code: FilterCodeInvalidIPv4, Value: ipString}
 	}
 
 	if !ip.Is4() {
-		reason := fmt.Sprintf("deny not IPv4: %s", ipString)
-		return false, FilterReason(reason)
+		return false, FilterReason{Code: FilterCodeNotIPv4, Value: ipString}
 	}
 
 	// TODO make more efficient
 	for _, prefix := range p.denyIPv4 {
 		if prefix.Contains(ip) {
-			reason := fmt.Sprintf("deny due to IPv4 denylist: %s", ipString)
-			return false, FilterReason(reason)
+			return false, FilterReason{
+				Code:   FilterCodeDenyIPv4Range,
+				Value:  ipString,
+				Rule:   prefix.String(),
+				Source: p.sources.source(prefix.String(), configFilenameIPv4Deny),
+			}
 		}
 	}
 
 	for _, prefix := range p.allowIPv4 {
 		if prefix.Contains(ip) {
-			reason := fmt.Sprintf("allow due to IPv4 allowlist: %s", ipString)
-			return true, FilterReason(reason)
+			return true, FilterReason{
+				Code:   FilterCodeAllowIPv4Range,
+				Value:  ipString,
+				Rule:   prefix.String(),
+				Source: p.sources.source(prefix.String(), configFilenameIPv4Allow),
+			}
 		}
 	}
 
-	reason := fmt.Sprintf("deny because no IPv4 rule matched: %s", ip)
-	return false, FilterReason(reason)
+	return false, FilterReason{Code: FilterCodeNoIPv4Rule, Value: ip.String()}
 }
 
 func (p *Policy) ipv6IsAllowed(ipString string) (bool, FilterReason) {
 	ip, err := netip.ParseAddr(ipString)
 	if err != nil {
-		reason := fmt.Sprintf("deny failed to parse IPv6: %s", ipString)
-		return false, FilterReason(reason)
+		return false, FilterReason{Code: FilterCodeInvalidIPv6, Value: ipString}
 	}
 
 	if !ip.Is6() {
-		reason := fmt.Sprintf("deny not IPv6: %s", ipString)
-		return false, FilterReason(reason)
+		return false, FilterReason{Code: FilterCodeNotIPv6, Value: ipString}
 	}
 
 	// TODO make more efficient
 	for _, prefix := range p.denyIPv6 {
 		if prefix.Contains(ip) {
-			reason := fmt.Sprintf("deny due to IPv6 denylist: %s", ipString)
-			return false, FilterReason(reason)
+			return false, FilterReason{
+				Code:   FilterCodeDenyIPv6Range,
+				Value:  ipString,
+				Rule:   prefix.String(),
+				Source: p.sources.source(prefix.String(), configFilenameIPv6Deny),
+			}
 		}
 	}
 
 	for _, prefix := range p.allowIPv6 {
 		if prefix.Contains(ip) {
-			reason := fmt.Sprintf("allow due to IPv6 allowlist: %s", ipString)
-			return true, FilterReason(reason)
+			return true, FilterReason{
+				Code:   FilterCodeAllowIPv6Range,
+				Value:  ipString,
+				Rule:   prefix.String(),
+				Source: p.sources.source(prefix.String(), configFilenameIPv6Allow),
+			}
 		}
 	}
 
-	reason := fmt.Sprintf("deny because no IPv6 rule matched: %s", ip)
-	return false, FilterReason(reason)
+	return false, FilterReason{Code: FilterCodeNoIPv6Rule, Value: ip.String()}
 }
 
 func generateAResponse(question *Question, ip net.IP) *Response {
@@ -0,0 +1,289 @@
+package dns
+
+import (
+	"fmt"
+)
+
+// FilterCode is a stable code for why a query or response was allowed or denied, for metrics and log analytics that
+// should not depend on the text of a reason.
+type FilterCode string
+
+const (
+	// queries
+	FilterCodeRequestType   FilterCode = "DENY_REQUEST_TYPE"
+	FilterCodeNoAllowedIPv4 FilterCode = "DENY_NO_ALLOWED_IPV4"
+	FilterCodeNoAllowedIPv6 FilterCode = "DENY_NO_ALLOWED_IPV6"
+	FilterCodeDenyQuery     FilterCode = "DENY_QUERY"
+	FilterCodeAllowQuery    FilterCode = "ALLOW_QUERY"
+
+	// names
+	FilterCodeNameTooLong   FilterCode = "NAME_TOO_LONG"
+	FilterCodeNoTrailingDot FilterCode = "NAME_NO_TRAILING_DOT"
+	FilterCodeNameFormat    FilterCode = "NAME_FORMAT"
+	FilterCodeAllowFormat   FilterCode = "ALLOW_FORMAT"
+	FilterCodeDenyExact     FilterCode = "DENY_EXACT"
+	FilterCodeDenySuffix    FilterCode = "DENY_SUFFIX"
+	FilterCodeDenyWildcard  FilterCode = "DENY_WILDCARD"
+	FilterCodeDenyRegex     FilterCode = "DENY_REGEX"
+	FilterCodeAllowExact    FilterCode = "ALLOW_EXACT"
+	FilterCodeAllowSuffix   FilterCode = "ALLOW_SUFFIX"
+	FilterCodeAllowWildcard FilterCode = "ALLOW_WILDCARD"
+	FilterCodeAllowRegex    FilterCode = "ALLOW_REGEX"
+	FilterCodeNoAllowRule   FilterCode = "DENY_NO_ALLOW_RULE"
+	FilterCodeBreakGlass    FilterCode = "ALLOW_BREAK_GLASS"
+
+	// responses
+	FilterCodeAllowResponse        FilterCode = "ALLOW_RESPONSE"
+	FilterCodeResponseCode         FilterCode = "DENY_RESPONSE_CODE"
+	FilterCodeResponseType         FilterCode = "DENY_RESPONSE_TYPE"
+	FilterCodeTypeMismatch         FilterCode = "TYPE_MISMATCH"
+	FilterCodeDuplicateCNAME       FilterCode = "DUPLICATE_CNAME"
+	FilterCodeMultipleIPNames      FilterCode = "MULTIPLE_IP_NAMES"
+	FilterCodeMultipleHTTPSNames   FilterCode = "MULTIPLE_HTTPS_NAMES"
+	FilterCodeCNAMEChainTooLong    FilterCode = "CNAME_CHAIN_TOO_LONG"
+	FilterCodeCNAMEChainLoop       FilterCode = "CNAME_CHAIN_LOOP"
+	FilterCodeCNAMEChainIncomplete FilterCode = "CNAME_CHAIN_INCOMPLETE"
+	FilterCodeCNAMEChainEnd        FilterCode = "CNAME_CHAIN_END_MISMATCH"
+	FilterCodePinMismatch          FilterCode = "PIN_MISMATCH"
+	FilterCodeAllowPin             FilterCode = "ALLOW_PIN"
+	FilterCodeDenyResponseIPv4     FilterCode = "DENY_RESPONSE_IPV4"
+	FilterCodeDenyResponseIPv6     FilterCode = "DENY_RESPONSE_IPV6"
+
+	// addresses
+	FilterCodeInvalidIPv4    FilterCode = "INVALID_IPV4"
+	FilterCodeNotIPv4        FilterCode = "NOT_IPV4"
+	FilterCodeDenyIPv4Range  FilterCode = "DENY_IPV4_RANGE"
+	FilterCodeAllowIPv4Range FilterCode = "ALLOW_IPV4_RANGE"
+	FilterCodeNoIPv4Rule     FilterCode = "DENY_NO_IPV4_RULE"
+	FilterCodeInvalidIPv6    FilterCode = "INVALID_IPV6"
+	FilterCodeNotIPv6        FilterCode = "NOT_IPV6"
+	FilterCodeDenyIPv6Range  FilterCode = "DENY_IPV6_RANGE"
+	FilterCodeAllowIPv6Range FilterCode = "ALLOW_IPV6_RANGE"
+	FilterCodeNoIPv6Rule     FilterCode = "DENY_NO_IPV6_RULE"
+
+	// response policy zones
+	FilterCodeRPZQName      FilterCode = "RPZ_QNAME"
+	FilterCodeRPZResponseIP FilterCode = "RPZ_RESPONSE_IP"
+)
+
+// filterCodes are the codes above.
+var filterCodes = map[FilterCode]struct{}{
+	// queries
+	FilterCodeRequestType:   {},
+	FilterCodeNoAllowedIPv4: {},
+	FilterCodeNoAllowedIPv6: {},
+	FilterCodeDenyQuery:     {},
+	FilterCodeAllowQuery:    {},
+
+	// names
+	FilterCodeNameTooLong:   {},
+	FilterCodeNoTrailingDot: {},
+	FilterCodeNameFormat:    {},
+	FilterCodeAllowFormat:   {},
+	FilterCodeDenyExact:     {},
+	FilterCodeDenySuffix:    {},
+	FilterCodeDenyWildcard:  {},
+	FilterCodeDenyRegex:     {},
+	FilterCodeAllowExact:    {},
+	FilterCodeAllowSuffix:   {},
+	FilterCodeAllowWildcard: {},
+	FilterCodeAllowRegex:    {},
+	FilterCodeNoAllowRule:   {},
+	FilterCodeBreakGlass:    {},
+
+	// responses
+	FilterCodeAllowResponse:        {},
+	FilterCodeResponseCode:         {},
+	FilterCodeResponseType:         {},
+	FilterCodeTypeMismatch:         {},
+	FilterCodeDuplicateCNAME:       {},
+	FilterCodeMultipleIPNames:      {},
+	FilterCodeMultipleHTTPSNames:   {},
+	FilterCodeCNAMEChainTooLong:    {},
+	FilterCodeCNAMEChainLoop:       {},
+	FilterCodeCNAMEChainIncomplete: {},
+	FilterCodeCNAMEChainEnd:        {},
+	FilterCodePinMismatch:          {},
+	FilterCodeAllowPin:             {},
+	FilterCodeDenyResponseIPv4:     {},
+	FilterCodeDenyResponseIPv6:     {},
+
+	// addresses
+	FilterCodeInvalidIPv4:    {},
+	FilterCodeNotIPv4:        {},
+	FilterCodeDenyIPv4Range:  {},
+	FilterCodeAllowIPv4Range: {},
+	FilterCodeNoIPv4Rule:     {},
+	FilterCodeInvalidIPv6:    {},
+	FilterCodeNotIPv6:        {},
+	FilterCodeDenyIPv6Range:  {},
+	FilterCodeAllowIPv6Range: {},
+	FilterCodeNoIPv6Rule:     {},
+
+	// response policy zones
+	FilterCodeRPZQName:      {},
+	FilterCodeRPZResponseIP: {},
+}
+
+// known reports whether c is one of the codes above.
+func (c FilterCode) known() bool {
+	_, found := filterCodes[c]
+	return found
+}
+
+// FilterReason is one step of filtering a query or response: what was decided, the name, address or record type
+// that was checked, and the rule that matched it with where the rule was read from.
+type FilterReason struct {
+	Code FilterCode
+	// name, address, source:destination pair or record type that was checked
+	Value string
+	// rule that matched, e.g. a name, suffix, pattern, prefix or RPZ trigger
+	Rule string
+	// <file>:<line> of the rule, when known
+	Source string
+	// schedule of a rule that only applies at times
+	Schedule string
+	// e.g. why a name is not valid, until when break-glass is active or the action of an RPZ rule
+	Detail string
+}
+
+// String returns the reason as written to logs and shown by explain.
+func (r FilterReason) String() string {
+	switch r.Code {
+	case FilterCodeRequestType:
+		return fmt.Sprintf("deny request type: %s", r.Value)
+	case FilterCodeNoAllowedIPv4:
+		return fmt.Sprintf("deny request type: %s, no allowed IPv4", r.Value)
+	case FilterCodeNoAllowedIPv6:
+		return fmt.Sprintf("deny request type: %s, no allowed IPv6", r.Value)
+	case FilterCodeDenyQuery:
+		return "deny query"
+	case FilterCodeAllowQuery:
+		return "allow query"
+	case FilterCodeNameTooLong:
+		return fmt.Sprintf("deny due to domain being too long: %s", r.Detail)
+	case FilterCodeNoTrailingDot:
+		return "deny due to missing trailing '.'"
+	case FilterCodeNameFormat:
+		return fmt.Sprintf("deny: %s", r.Detail)
+	case FilterCodeAllowFormat:
+		return fmt.Sprintf("allow due to correct format: %s", r.Value)
+	case FilterCodeDenyExact:
+		return fmt.Sprintf("deny due to exact denylist: %s, rule %s", r.Value, r.rule())
+	case FilterCodeDenySuffix:
+		return fmt.Sprintf("deny due to suffix denylist: %s, rule %s", r.Value, r.rule())
+	case FilterCodeDenyWildcard:
+		return fmt.Sprintf("deny due to wildcard denylist: %s, rule %s", r.Value, r.rule())
+	case FilterCodeDenyRegex:
+		return fmt.Sprintf("deny due to regex denylist: %s, rule %s", r.Value, r.rule())
+	case FilterCodeAllowExact:
+		return fmt.Sprintf("allow due to exact allowlist: %s, rule %s", r.Value, r.rule())
+	case FilterCodeAllowSuffix:
+		return fmt.Sprintf("allow due to suffix allowlist: %s, rule %s", r.Value, r.rule())
+	case FilterCodeAllowWildcard:
+		return fmt.Sprintf("allow due to wildcard allowlist: %s, rule %s", r.Value, r.rule())
+	case FilterCodeAllowRegex:
+		return fmt.Sprintf("allow due to regex allowlist: %s, rule %s", r.Value, r.rule())
+	case FilterCodeNoAllowRule:
+		return fmt.Sprintf("deny because no allow rule matched: %s", r.Value)
+	case FilterCodeBreakGlass:
+		return fmt.Sprintf("%s until %s: %s", breakGlassReason, r.Detail, r.Value)
+	case FilterCodeAllowResponse:
+		return "allow response"
+	case FilterCodeResponseCode:
+		return fmt.Sprintf("deny response due to unexpected error code %s", r.Value)
+	case FilterCodeResponseType:
+		return fmt.Sprintf("deny due to response type: %s", r.Value)
+	case FilterCodeTypeMismatch:
+		return fmt.Sprintf("deny due to %s: %s", r.Detail, r.Value)
+	case FilterCodeDuplicateCNAME:
+		return "deny due to duplicate CNAME records"
+	case FilterCodeMultipleIPNames:
+		return "deny due to more than one domain with IPs"
+	case FilterCodeMultipleHTTPSNames:
+		return "deny due to more than one domain with HTTPS records"
+	case FilterCodeCNAMEChainTooLong:
+		return "too many CNAME records"
+	case FilterCodeCNAMEChainLoop:
+		return "loop in CNAME chain"
+	case FilterCodeCNAMEChainIncomplete:
+		return "incomplete CNAME chain"
+	case FilterCodeCNAMEChainEnd:
+		return "incomplete CNAME chain, end does not match"
+	case FilterCodePinMismatch:
+		return fmt.Sprintf("deny due to response domain: %s", r.Value)
+	case FilterCodeAllowPin:
+		return fmt.Sprintf("allow due to response domain: %s, rule %s", r.Value, r.rule())
+	case FilterCodeDenyResponseIPv4:
+		return fmt.Sprintf("deny due to response IPv4: %s", r.Value)
+	case FilterCodeDenyResponseIPv6:
+		return fmt.Sprintf("deny due to response IPv6: %s", r.Value)
+	case FilterCodeInvalidIPv4:
+		return fmt.Sprintf("deny failed to parse IPv4: %s", r.Value)
+	case FilterCodeNotIPv4:
+		return fmt.Sprintf("deny not IPv4: %s", r.Value)
+	case FilterCodeDenyIPv4Range:
+		return fmt.Sprintf("deny due to IPv4 denylist: %s, rule %s", r.Value, r.rule())
+	case FilterCodeAllowIPv4Range:
+		return fmt.Sprintf("allow due to IPv4 allowlist: %s, rule %s", r.Value, r.rule())
+	case FilterCodeNoIPv4Rule:
+		return fmt.Sprintf("deny because no IPv4 rule matched: %s", r.Value)
+	case FilterCodeInvalidIPv6:
+		return fmt.Sprintf("deny failed to parse IPv6: %s", r.Value)
+	case FilterCodeNotIPv6:
+		return fmt.Sprintf("deny not IPv6: %s", r.Value)
+	case FilterCodeDenyIPv6Range:
+		return fmt.Sprintf("deny due to IPv6 denylist: %s, rule %s", r.Value, r.rule())
+	case FilterCodeAllowIPv6Range:
+		return fmt.Sprintf("allow due to IPv6 allowlist: %s, rule %s", r.Value, r.rule())
+	case FilterCodeNoIPv6Rule:
+		return fmt.Sprintf("deny because no IPv6 rule matched: %s", r.Value)
+	case FilterCodeRPZQName:
+		return fmt.Sprintf("rpz %s due to QNAME trigger: %s, rule %s", r.Detail, r.Value, r.rule())
+	case FilterCodeRPZResponseIP:
+		return fmt.Sprintf("rpz %s due to response IP trigger: %s, rule %s", r.Detail, r.Value, r.rule())
+	}
+
+	return string(r.Code)
+}
+
+// rule returns '<rule>' <file>:<line>, followed by the schedule of a scheduled rule.
+func (r FilterReason) rule() string {
+	rule := fmt.Sprintf("'%s'", r.Rule)
+	if r.Source != "" {
+		rule += " " + r.Source
+	}
+
+	if r.Schedule != "" {
+		rule += ", schedule " + r.Schedule
+	}
+
+	return rule
+}
+
+// cnameChainError is why the CNAME records of a response do not form a chain.
+type cnameChainError struct {
+	code FilterCode
+}
+
+func (e cnameChainError) Error() string {
+	return FilterReason{Code: e.code}.String()
+}
+
+func reasonStrings(reasons []FilterReason) []string {
+	result := make([]string, 0, len(reasons))
+	for _, reason := range reasons {
+		result = append(result, reason.String())
+	}
+
+	return result
+}
+
+func reasonCodes(reasons []FilterReason) []string {
+	result := make([]string, 0, len(reasons))
+	for _, reason := range reasons {
+		result = append(result, string(reason.Code))
+	}
+
+	return result
+}
@@ -0,0 +1,65 @@
+package dns
+
+import (
+	"testing"
+)
+
+func TestFilterReasonString(t *testing.T) {
+	tests := []struct {
+		reason   FilterReason
+		expected string
+	}{
+		{FilterReason{Code: FilterCodeDenyExact, Value: "bad.example.com", Rule: "bad.example.com", Source: "deny.exact:7"}, "deny due to exact denylist: bad.example.com, rule 'bad.example.com' deny.exact:7"},
+		{FilterReason{Code: FilterCodeAllowSuffix, Value: "a.streaming.com", Rule: ".streaming.com", Source: "allow.suffix:2", Schedule: "evening"}, "allow due to suffix allowlist: a.streaming.com, rule '.streaming.com' allow.suffix:2, schedule evening"},
+		{FilterReason{Code: FilterCodeDenyWildcard, Value: "www.example.com", Rule: "*.example.com"}, "deny due to wildcard denylist: www.example.com, rule '*.example.com'"},
+		{FilterReason{Code: FilterCodeRequestType, Value: "255"}, "deny request type: 255"},
+		{FilterReason{Code: FilterCodeNameFormat, Value: "xn--a.com", Detail: "punycode present"}, "deny: punycode present"},
+		{FilterReason{Code: FilterCodePinMismatch, Value: "a.com:b.com"}, "deny due to response domain: a.com:b.com"},
+		{FilterReason{Code: FilterCodeCNAMEChainLoop}, "loop in CNAME chain"},
+		{FilterReason{Code: FilterCodeDenyIPv4Range, Value: "10.1.2.3", Rule: "10.0.0.0/8", Source: "deny.ipv4:2"}, "deny due to IPv4 denylist: 10.1.2.3, rule '10.0.0.0/8' deny.ipv4:2"},
+		{FilterReason{Code: FilterCodeRPZQName, Value: "local.example.com", Rule: "local.example.com", Source: "rpz.d/feed.rpz:10", Detail: "local-data"}, "rpz local-data due to QNAME trigger: local.example.com, rule 'local.example.com' rpz.d/feed.rpz:10"},
+	}
+
+	for _, test := range tests {
+		actual := test.reason.String()
+		if actual != test.expected {
+			t.Errorf("%s: expected '%s', got '%s'", test.reason.Code, test.expected, actual)
+		}
+	}
+}
+
+func TestFilterCodeKnown(t *testing.T) {
+	for code := range filterCodes {
+		if !code.known() || (FilterReason{Code: code}).String() == string(code) {
+			t.Errorf("%s: expected a known code with a text", code)
+		}
+	}
+
+	if FilterCode("DENY_SOMETHING").known() || FilterCode("").known() {
+		t.Errorf("expected an undefined code not to be known")
+	}
+}
+
+func TestResponseReasonCodes(t *testing.T) {
+	policy := newExplainTestPolicy(t)
+
+	response := &Response{
+		Flags: Flags{RCODE: ResponseCodeNoError},
+		Answers: []Answer{
+			{Name: "www.example.com.", Type: RecordTypeCNAME, TTL: 60, CNAME: "cdn.example.com."},
+			{Name: "other.example.com.", Type: RecordTypeCNAME, TTL: 60, CNAME: "www.example.com."},
+		},
+	}
+
+	allowed, reasons := policy.responseIsAllowed("www.example.com.", RecordTypeA, response)
+	if allowed || len(reasons) != 1 || reasons[0].Code != FilterCodeCNAMEChainIncomplete {
+		t.Errorf("expected an incomplete CNAME chain, got %v", reasons)
+	}
+
+	response.Answers = []Answer{{Name: "www.example.com.", Type: RecordTypeAAAA, TTL: 60}}
+	allowed, reasons = policy.responseIsAllowed("www.example.com.", RecordTypeA, response)
+	expected := "deny due to AAAA response not matching request type 28: 28"
+	if allowed || len(reasons) != 1 || reasons[0].Code != FilterCodeTypeMismatch || reasons[0].String() != expected {
+		t.Errorf("expected a type mismatch, got %v", reasons)
+	}
+}
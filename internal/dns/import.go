@@ -0,0 +1,283 @@
+package dns
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	configDirectoryAllowImports = "allow.d"
+	configDirectoryDenyImports  = "deny.d"
+
+	maxImportWarnings = 10
+)
+
+type ImportFormat string
+
+const (
+	ImportFormatDomains ImportFormat = "domains"
+	ImportFormatHosts   ImportFormat = "hosts"
+	ImportFormatAdBlock ImportFormat = "adblock"
+)
+
+// ImportSummary describes what was loaded from one imported list. Entries that are not valid domains are
+// skipped rather than failing the whole policy, and the first few are kept as warnings.
+type ImportSummary struct {
+	Filename string
+	Format   ImportFormat
+	Exact    int
+	Suffixes int
+	Skipped  int
+	Warnings []*ConfigError
+}
+
+func (s *ImportSummary) warn(line int, format string, a ...any) {
+	s.Skipped++
+	if len(s.Warnings) < maxImportWarnings {
+		s.Warnings = append(s.Warnings, newConfigError(s.Filename, line, format, a...))
+	}
+}
+
+type importedRules struct {
+	exact     []string
+	suffixes  []string
+	summaries []ImportSummary
+}
+
+// readImports loads every list in an optional import directory, e.g. deny.d. Imported entries are added
+// as exact and suffix rules, recorded as coming from exactFilename and suffixFilename.
+func readImports(configDirectory string, directory string, exactFilename string, suffixFilename string, policy Policy, sources ruleSources) (*importedRules, error) {
+	result := &importedRules{
+		exact:     make([]string, 0),
+		suffixes:  make([]string, 0),
+		summaries: make([]ImportSummary, 0),
+	}
+
+	entries, err := os.ReadDir(filepath.Join(configDirectory, directory))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return result, nil
+		}
+
+		return nil, &ConfigError{Filename: directory, Err: err}
+	}
+
+	errs := make([]error, 0)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		filename := filepath.Join(directory, entry.Name())
+		if entry.IsDir() {
+			errs = append(errs, newConfigError(filename, 0, "unexpected directory"))
+			continue
+		}
+
+		summary, err := readImport(configDirectory, filename, policy, func(domain string, suffix bool, line int) {
+			if suffix {
+				result.suffixes = append(result.suffixes, "."+domain)
+				sources.addFrom(suffixFilename, filename, "."+domain, line)
+			}
+
+			result.exact = append(result.exact, domain)
+			sources.addFrom(exactFilename, filename, domain, line)
+		})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		result.summaries = append(result.summaries, *summary)
+	}
+
+	return result, errors.Join(errs...)
+}
+
+func readImport(configDirectory string, filename string, policy Policy, add func(domain string, suffix bool, line int)) (*ImportSummary, error) {
+	file, err := os.Open(filepath.Join(configDirectory, filename))
+	if err != nil {
+		return nil, &ConfigError{Filename: filename, Err: err}
+	}
+
+	summary := &ImportSummary{
+		Filename: filename,
+		Format:   importFormatFromExtension(filename),
+	}
+
+	lineNumber := 0
+	sc := bufio.NewScanner(file)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		lineNumber++
+
+		if summary.Format == "" {
+			if line == "" {
+				continue
+			}
+
+			summary.Format = importFormatFromHeader(line)
+			if summary.Format == "" {
+				_ = file.Close()
+				return nil, newConfigError(filename, lineNumber, "unknown format, use the extension .hosts, .adblock or .domains, or a '# format: <hosts|adblock|domains>' header")
+			}
+		}
+
+		var domains []string
+		suffix := false
+		switch summary.Format {
+		case ImportFormatHosts:
+			domains, err = parseHostsLine(line)
+		case ImportFormatAdBlock:
+			domains, err = parseAdBlockLine(line)
+			suffix = true
+		default:
+			domains, err = parseDomainsLine(line)
+		}
+
+		if err != nil {
+			summary.warn(lineNumber, "%s", err.Error())
+			continue
+		}
+
+		for _, domain := range domains {
+			domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+
+			err := policy.domainHasCorrectFormat(domain)
+			if err != nil {
+				summary.warn(lineNumber, "'%s': %s", escapeNonStandard(domain), err.Error())
+				continue
+			}
+
+			add(domain, suffix, lineNumber)
+			summary.Exact++
+			if suffix {
+				summary.Suffixes++
+			}
+		}
+	}
+
+	err = sc.Err()
+	closeErr := file.Close()
+	if err != nil || closeErr != nil {
+		return nil, &ConfigError{Filename: filename, Err: errors.Join(err, closeErr)}
+	}
+
+	return summary, nil
+}
+
+func importFormatFromExtension(filename string) ImportFormat {
+	switch filepath.Ext(filename) {
+	case ".hosts":
+		return ImportFormatHosts
+	case ".adblock", ".abp":
+		return ImportFormatAdBlock
+	case ".domains", ".list":
+		return ImportFormatDomains
+	default:
+		return ""
+	}
+}
+
+func importFormatFromHeader(line string) ImportFormat {
+	if strings.HasPrefix(line, "[Adblock") {
+		return ImportFormatAdBlock
+	}
+
+	header, found := strings.CutPrefix(line, "#")
+	if !found {
+		return ""
+	}
+
+	format, found := strings.CutPrefix(strings.TrimSpace(header), "format:")
+	if !found {
+		return ""
+	}
+
+	switch ImportFormat(strings.TrimSpace(format)) {
+	case ImportFormatHosts:
+		return ImportFormatHosts
+	case ImportFormatAdBlock:
+		return ImportFormatAdBlock
+	case ImportFormatDomains:
+		return ImportFormatDomains
+	default:
+		return ""
+	}
+}
+
+func stripComment(line string) string {
+	before, _, _ := strings.Cut(line, "#")
+	return strings.TrimSpace(before)
+}
+
+// parseHostsLine parses '<ip> <domain> [<domain> ...]', e.g. '0.0.0.0 bad.example'.
+func parseHostsLine(line string) ([]string, error) {
+	line = stripComment(line)
+	if line == "" {
+		return nil, nil
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("expected '<ip> <domain>'")
+	}
+
+	_, err := netip.ParseAddr(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ip '%s'", escapeNonStandard(fields[0]))
+	}
+
+	return fields[1:], nil
+}
+
+// parseAdBlockLine parses '||<domain>^', which matches the domain and all subdomains.
+func parseAdBlockLine(line string) ([]string, error) {
+	if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(line, "@@") {
+		return nil, fmt.Errorf("exception rules are not supported")
+	}
+
+	domain, found := strings.CutPrefix(line, "||")
+	if !found {
+		return nil, fmt.Errorf("only '||<domain>^' rules are supported")
+	}
+
+	domain, found = strings.CutSuffix(domain, "^")
+	if !found {
+		return nil, fmt.Errorf("only '||<domain>^' rules are supported, without modifiers")
+	}
+
+	return []string{domain}, nil
+}
+
+func parseDomainsLine(line string) ([]string, error) {
+	line = stripComment(line)
+	if line == "" {
+		return nil, nil
+	}
+
+	if strings.ContainsAny(line, " \t") {
+		return nil, fmt.Errorf("expected one domain per line")
+	}
+
+	return []string{line}, nil
+}
+
+func (p *Policy) ImportSummaries() []ImportSummary {
+	result := slices.Clone(p.importSummaries)
+	for _, clientPolicy := range p.clientPolicies {
+		result = append(result, clientPolicy.policy.importSummaries...)
+	}
+
+	return result
+}
@@ -0,0 +1,122 @@
+package dns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadImports(t *testing.T) {
+	configDirectory := t.TempDir()
+	directory := filepath.Join(configDirectory, configDirectoryDenyImports)
+	err := os.Mkdir(directory, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"ads.hosts":   "# hosts\n0.0.0.0 ads.example.com tracker.example.com\n127.0.0.1 localhost\n::1 BAD.example.com # comment\n",
+		"list.txt":    "[Adblock Plus 2.0]\n! comment\n||track.example.com^\n||x.example.com^$third-party\n",
+		"plain":       "# format: domains\nexample.com\nexample.org\n",
+		".hidden.swp": "garbage",
+	}
+
+	for filename, content := range files {
+		err := os.WriteFile(filepath.Join(directory, filename), []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	policy := Policy{
+		knownTLDs: map[string]struct{}{
+			"com": {},
+		},
+	}
+
+	sources := make(ruleSources)
+	imported, err := readImports(configDirectory, configDirectoryDenyImports, configFilenameDenyExact, configFilenameDenySuffixes, policy, sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedExact := []string{"ads.example.com", "tracker.example.com", "bad.example.com", "track.example.com", "example.com"}
+	if len(imported.exact) != len(expectedExact) {
+		t.Fatalf("expected %v, got %v", expectedExact, imported.exact)
+	}
+
+	for i := range expectedExact {
+		if imported.exact[i] != expectedExact[i] {
+			t.Errorf("expected '%s', got '%s'", expectedExact[i], imported.exact[i])
+		}
+	}
+
+	if len(imported.suffixes) != 1 || imported.suffixes[0] != ".track.example.com" {
+		t.Errorf("expected [.track.example.com], got %v", imported.suffixes)
+	}
+
+	if len(imported.summaries) != 3 {
+		t.Fatalf("expected 3 summaries, got %d", len(imported.summaries))
+	}
+
+	hosts := imported.summaries[0]
+	if hosts.Format != ImportFormatHosts || hosts.Exact != 3 || hosts.Skipped != 1 {
+		t.Errorf("unexpected summary %+v", hosts)
+	}
+
+	expectedWarning := "deny.d/ads.hosts:3: 'localhost': domain is not at least two parts"
+	if len(hosts.Warnings) != 1 || hosts.Warnings[0].Error() != expectedWarning {
+		t.Errorf("expected warning '%s', got %v", expectedWarning, hosts.Warnings)
+	}
+
+	adblock := imported.summaries[1]
+	if adblock.Format != ImportFormatAdBlock || adblock.Suffixes != 1 || adblock.Skipped != 1 {
+		t.Errorf("unexpected summary %+v", adblock)
+	}
+
+	domains := imported.summaries[2]
+	if domains.Format != ImportFormatDomains || domains.Exact != 1 || domains.Skipped != 1 {
+		t.Errorf("unexpected summary %+v", domains)
+	}
+
+	source := sources.source(".track.example.com", configFilenameDenySuffixes)
+	expectedSource := "deny.d/list.txt:3"
+	if source != expectedSource {
+		t.Errorf("expected '%s', got '%s'", expectedSource, source)
+	}
+}
+
+func TestReadImportsUnknownFormat(t *testing.T) {
+	configDirectory := t.TempDir()
+	directory := filepath.Join(configDirectory, configDirectoryAllowImports)
+	err := os.Mkdir(directory, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(directory, "list"), []byte("\nexample.com\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = readImports(configDirectory, configDirectoryAllowImports, configFilenameAllowExact, configFilenameAllowSuffixes, Policy{}, nil)
+	if err == nil {
+		t.Fatalf("should fail")
+	}
+
+	configErrors := ConfigErrors(err)
+	if len(configErrors) != 1 || configErrors[0].Filename != "allow.d/list" || configErrors[0].Line != 2 {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestReadImportsMissingDirectory(t *testing.T) {
+	imported, err := readImports(t.TempDir(), configDirectoryDenyImports, configFilenameDenyExact, configFilenameDenySuffixes, Policy{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(imported.exact) != 0 || len(imported.summaries) != 0 {
+		t.Errorf("expected nothing to be imported")
+	}
+}
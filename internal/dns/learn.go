@@ -0,0 +1,357 @@
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	defaultLearnMinCount       = 1
+	defaultLearnSuffixMinNames = 3
+)
+
+// the text of the reasons read from logs, up to the name or pair
+var (
+	learnReasonNoAllowRule    = FilterReason{Code: FilterCodeNoAllowRule}.String()
+	learnReasonResponseDomain = FilterReason{Code: FilterCodePinMismatch}.String()
+)
+
+// QueryLog collects denied names and CNAME pairs from netfoil query logs.
+type QueryLog struct {
+	denied map[string]int
+	pairs  map[string]int
+
+	// names counted for the current log record, so a name in both the record and its reasons is counted once
+	record    map[string]struct{}
+	lastCNAME string
+	// inside a block of recent queries written on SIGUSR1, which were logged already
+	inRecent bool
+}
+
+func NewQueryLog() *QueryLog {
+	return &QueryLog{
+		denied: make(map[string]int),
+		pairs:  make(map[string]int),
+		record: make(map[string]struct{}),
+	}
+}
+
+// Read reads log lines as written by netfoil, optionally prefixed by journald (journalctl -o short).
+//
+//   - deny|<name>|<type> and audit-deny|<name>|<type>|<reasons> count the name as denied
+//   - "deny because no allow rule matched: <name>" in audit reasons or debug output counts a denied response name
+//   - "deny due to response domain: <source>:<destination>" and the name/CNAME lines of debug output are CNAME pairs
+//
+// Query records of LogFormat=json are read the same way, from their verdict, reasons and answers.
+func (l *QueryLog) Read(reader io.Reader) error {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		l.readLine(scanner.Text())
+	}
+
+	return scanner.Err()
+}
+
+func (l *QueryLog) readLine(line string) {
+	trimmed := strings.TrimSpace(line)
+
+	// drop any journald prefix in front of a JSON record
+	if i := strings.Index(trimmed, "{\""); i >= 0 {
+		l.readJSONRecord(trimmed[i:])
+		return
+	}
+
+	record := line
+	if i := strings.Index(record, "|"); i >= 0 {
+		prefix := record[:i]
+		l.inRecent = strings.HasPrefix(prefix, "recent ") || strings.Contains(prefix, ": recent ")
+		if l.inRecent {
+			return
+		}
+
+		// drop any journald prefix in front of the verdict
+		j := strings.LastIndex(prefix, " ")
+		record = record[j+1:]
+	}
+
+	if l.inRecent {
+		// the debug block of a query ends with its time
+		l.inRecent = !strings.HasPrefix(trimmed, "time: ")
+		return
+	}
+
+	fields := strings.Split(record, "|")
+	switch {
+	case len(fields) == 3 && fields[0] == "allow":
+		clear(l.record)
+	case len(fields) == 3 && fields[0] == "deny":
+		clear(l.record)
+		l.addDenied(fields[1])
+	case len(fields) == 4 && fields[0] == "audit-deny":
+		clear(l.record)
+		l.addDenied(fields[1])
+		for _, reason := range strings.Split(fields[3], "; ") {
+			l.readReason(reason)
+		}
+	case strings.HasPrefix(trimmed, "name: "):
+		l.lastCNAME = strings.TrimSuffix(strings.TrimPrefix(trimmed, "name: "), ".")
+	case strings.HasPrefix(trimmed, "CNAME: ") && l.lastCNAME != "":
+		destination := strings.TrimSuffix(strings.TrimPrefix(trimmed, "CNAME: "), ".")
+		l.addPair(l.lastCNAME + ":" + destination)
+	default:
+		l.readReason(trimmed)
+	}
+}
+
+func (l *QueryLog) readJSONRecord(line string) {
+	record := struct {
+		Msg          string      `json:"msg"`
+		Name         string      `json:"name"`
+		Verdict      string      `json:"verdict"`
+		Reasons      []string    `json:"reasons"`
+		AuditReasons []string    `json:"audit_reasons"`
+		Answers      []logAnswer `json:"answers"`
+	}{}
+
+	err := json.Unmarshal([]byte(line), &record)
+	if err != nil || record.Msg != logMessageQuery {
+		return
+	}
+
+	clear(l.record)
+	if record.Verdict == verdictDeny || record.Verdict == verdictAuditDeny {
+		l.addDenied(record.Name)
+	}
+
+	for _, reason := range slices.Concat(record.Reasons, record.AuditReasons) {
+		l.readReason(reason)
+	}
+
+	for _, answer := range record.Answers {
+		if answer.Type == RecordTypeCNAME.Name() {
+			l.addPair(strings.TrimSuffix(answer.Name, ".") + ":" + strings.TrimSuffix(answer.Data, "."))
+		}
+	}
+}
+
+func (l *QueryLog) readReason(reason string) {
+	if name, found := strings.CutPrefix(reason, learnReasonNoAllowRule); found {
+		l.addDenied(name)
+	} else if pair, found := strings.CutPrefix(reason, learnReasonResponseDomain); found {
+		l.addPair(pair)
+	}
+}
+
+func (l *QueryLog) addDenied(name string) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return
+	}
+
+	_, counted := l.record[name]
+	if counted {
+		return
+	}
+
+	l.record[name] = struct{}{}
+	l.denied[name]++
+}
+
+func (l *QueryLog) addPair(pair string) {
+	pair = strings.ToLower(pair)
+	_, counted := l.record[pair]
+	if counted {
+		return
+	}
+
+	l.record[pair] = struct{}{}
+	l.pairs[pair]++
+}
+
+type LearnOptions struct {
+	// MinCount is the number of times a name or pair must be seen to be proposed
+	MinCount int
+	// SuffixMinNames is the number of distinct names below a registrable domain that proposes a suffix instead
+	SuffixMinNames int
+	// PublicSuffixes finds registrable domains, the last label is the public suffix when nil
+	PublicSuffixes *PublicSuffixList
+}
+
+func DefaultLearnOptions() LearnOptions {
+	return LearnOptions{
+		MinCount:       defaultLearnMinCount,
+		SuffixMinNames: defaultLearnSuffixMinNames,
+	}
+}
+
+type Proposal struct {
+	Entry   string
+	Comment string
+}
+
+type Proposals struct {
+	AllowExact         []Proposal
+	AllowSuffix        []Proposal
+	PinResponseDomains []Proposal
+}
+
+func (p Proposals) Empty() bool {
+	return len(p.AllowExact) == 0 && len(p.AllowSuffix) == 0 && len(p.PinResponseDomains) == 0
+}
+
+type learnGroup struct {
+	names   []string
+	queries int
+}
+
+// Propose returns the allowlist entries that would allow the denied names and CNAME pairs in the log. Names denied
+// by an explicit deny rule, or because they are malformed, are never proposed.
+func (p *Policy) Propose(log *QueryLog, options LearnOptions) Proposals {
+	groups := make(map[string]*learnGroup)
+	for name, count := range log.denied {
+		allowed, reason := p.domainIsAllowed(name + ".")
+		if allowed || reason.Code != FilterCodeNoAllowRule {
+			continue
+		}
+
+		registrable := options.PublicSuffixes.RegistrableDomain(name)
+		group, found := groups[registrable]
+		if !found {
+			group = &learnGroup{}
+			groups[registrable] = group
+		}
+
+		group.names = append(group.names, name)
+		group.queries += count
+	}
+
+	proposals := Proposals{}
+	for _, registrable := range slices.Sorted(maps.Keys(groups)) {
+		group := groups[registrable]
+		slices.Sort(group.names)
+
+		// a suffix is only proposed below a registrable domain, never for a public suffix
+		isPublicSuffix := options.PublicSuffixes.RegistrableDomain("x."+registrable) == "x."+registrable
+		if len(group.names) >= options.SuffixMinNames && !isPublicSuffix {
+			proposals.AllowSuffix = append(proposals.AllowSuffix, Proposal{
+				Entry:   "." + registrable,
+				Comment: fmt.Sprintf("netfoil learn: %d names, %d queries", len(group.names), group.queries),
+			})
+
+			// the suffix does not match the registrable domain itself
+			if slices.Contains(group.names, registrable) && log.denied[registrable] >= options.MinCount {
+				proposals.AllowExact = append(proposals.AllowExact, Proposal{
+					Entry:   registrable,
+					Comment: fmt.Sprintf("netfoil learn: %d queries", log.denied[registrable]),
+				})
+			}
+
+			continue
+		}
+
+		for _, name := range group.names {
+			if log.denied[name] < options.MinCount {
+				continue
+			}
+
+			proposals.AllowExact = append(proposals.AllowExact, Proposal{
+				Entry:   name,
+				Comment: fmt.Sprintf("netfoil learn: %d queries", log.denied[name]),
+			})
+		}
+	}
+
+	for _, pair := range slices.Sorted(maps.Keys(log.pairs)) {
+		count := log.pairs[pair]
+		if count < options.MinCount {
+			continue
+		}
+
+		source, destination, found := strings.Cut(pair, ":")
+		if !found || p.domainHasCorrectFormat(source) != nil || p.domainHasCorrectFormat(destination) != nil {
+			continue
+		}
+
+		_, pinned := p.pinResponseDomainMap[source][destination]
+		if pinned {
+			continue
+		}
+
+		proposals.PinResponseDomains = append(proposals.PinResponseDomains, Proposal{
+			Entry:   pair,
+			Comment: fmt.Sprintf("netfoil learn: %d responses", count),
+		})
+	}
+
+	return proposals
+}
+
+// Diff returns the proposals as a unified diff against the files in configDirectory, to apply with
+// patch -p1 -d <config directory>.
+func (p Proposals) Diff(configDirectory string) (string, error) {
+	files := []struct {
+		filename  string
+		proposals []Proposal
+	}{
+		{configFilenameAllowExact, p.AllowExact},
+		{configFilenameAllowSuffixes, p.AllowSuffix},
+		{configFilenamePinResponseDomain, p.PinResponseDomains},
+	}
+
+	sb := strings.Builder{}
+	for _, file := range files {
+		if len(file.proposals) == 0 {
+			continue
+		}
+
+		content, err := os.ReadFile(filepath.Join(configDirectory, file.filename))
+		if err != nil {
+			return "", err
+		}
+
+		added := make([]string, 0)
+		for _, proposal := range file.proposals {
+			added = append(added, "# "+proposal.Comment, proposal.Entry)
+		}
+
+		writeAppendDiff(&sb, file.filename, content, added)
+	}
+
+	return sb.String(), nil
+}
+
+func writeAppendDiff(sb *strings.Builder, filename string, content []byte, added []string) {
+	lines := bytes.Count(content, []byte("\n"))
+	missingNewline := len(content) > 0 && content[len(content)-1] != '\n'
+	if missingNewline {
+		lines++
+	}
+
+	fmt.Fprintf(sb, "--- a/%s\n", filename)
+	fmt.Fprintf(sb, "+++ b/%s\n", filename)
+
+	if missingNewline {
+		// the last line changes as it gets a newline
+		last := content[bytes.LastIndexByte(content, '\n')+1:]
+		fmt.Fprintf(sb, "@@ -%d +%d,%d @@\n", lines, lines, len(added)+1)
+		fmt.Fprintf(sb, "-%s\n", last)
+		sb.WriteString("\\ No newline at end of file\n")
+		fmt.Fprintf(sb, "+%s\n", last)
+	} else if lines == 0 {
+		fmt.Fprintf(sb, "@@ -0,0 +1,%d @@\n", len(added))
+	} else {
+		fmt.Fprintf(sb, "@@ -%d,0 +%d,%d @@\n", lines, lines+1, len(added))
+	}
+
+	for _, line := range added {
+		fmt.Fprintf(sb, "+%s\n", line)
+	}
+}
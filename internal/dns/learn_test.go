@@ -0,0 +1,129 @@
+package dns
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRegistrableDomain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "public_suffix_list.dat")
+	err := os.WriteFile(path, []byte("// comment\ncom\nuk\nco.uk\n*.ck\n!www.ck\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := ReadPublicSuffixList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		list     *PublicSuffixList
+		domain   string
+		expected string
+	}{
+		{list, "www.example.com", "example.com"},
+		{list, "example.com", "example.com"},
+		{list, "com", "com"},
+		{list, "a.b.example.co.uk", "example.co.uk"},
+		{list, "co.uk", "co.uk"},
+		{list, "a.example.ck", "a.example.ck"},
+		{list, "a.www.ck", "www.ck"},
+		{list, "www.example.org", "example.org"},
+		{nil, "a.b.example.co.uk", "co.uk"},
+	}
+
+	for _, test := range tests {
+		registrable := test.list.RegistrableDomain(test.domain)
+		if registrable != test.expected {
+			t.Errorf("%s: expected '%s', got '%s'", test.domain, test.expected, registrable)
+		}
+	}
+}
+
+func TestLearn(t *testing.T) {
+	configDirectory := t.TempDir()
+	writeRuleFiles(t, configDirectory, map[string]string{
+		configFilenameKnownTLDs:         ".com\n.net\n",
+		configFilenameAllowExact:        "allowed.com",
+		configFilenameDenyExact:         "ads.example.com\n",
+		configFilenamePinResponseDomain: "allowed.com:cdn.allowed.com\n",
+		configFilenameSchedules:         "",
+	})
+
+	policy, err := NewPolicy(configDirectory, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := `Oct 19 10:00:00 host netfoil[1]: deny|www.example.com|A
+Oct 19 10:00:01 host netfoil[1]: deny|api.example.com|A
+deny|example.com|AAAA
+deny|ads.example.com|A
+allow|allowed.com|A
+deny|other.net|A
+deny|other.net|AAAA
+deny|once.net|A
+audit-deny|video.com|A|deny because no allow rule matched: video.com; deny because no allow rule matched: edge.cdn.net; deny due to response domain: video.com:edge.cdn.net
+result
+  response [NoError]
+    name: allowed.com.
+      type: 5
+      CNAME: cdn.allowed.com.
+`
+
+	queryLog := NewQueryLog()
+	err = queryLog.Read(strings.NewReader(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := DefaultLearnOptions()
+	options.MinCount = 1
+	proposals := policy.Propose(queryLog, options)
+
+	expected := `--- a/allow.exact
++++ b/allow.exact
+@@ -1 +1,11 @@
+-allowed.com
+\ No newline at end of file
++allowed.com
++# netfoil learn: 1 queries
++edge.cdn.net
++# netfoil learn: 1 queries
++example.com
++# netfoil learn: 1 queries
++once.net
++# netfoil learn: 2 queries
++other.net
++# netfoil learn: 1 queries
++video.com
+--- a/allow.suffix
++++ b/allow.suffix
+@@ -0,0 +1,2 @@
++# netfoil learn: 3 names, 3 queries
++.example.com
+--- a/pin.response-domain
++++ b/pin.response-domain
+@@ -1,0 +2,2 @@
++# netfoil learn: 1 responses
++video.com:edge.cdn.net
+`
+
+	diff, err := proposals.Diff(configDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, diff)
+	}
+
+	options.MinCount = 2
+	proposals = policy.Propose(queryLog, options)
+	if len(proposals.AllowExact) != 1 || proposals.AllowExact[0].Entry != "other.net" {
+		t.Errorf("expected [other.net], got %v", proposals.AllowExact)
+	}
+}
@@ -0,0 +1,307 @@
+package dns
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Repeated query records for the same client, name, type and verdict are collapsed into one record with a count, and
+// all records are capped at a rate, so a client retrying a denied name cannot flood the log. Warnings, errors and
+// break-glass queries need attention and are always written.
+
+const (
+	logMessageRepeated   = "query repeated"
+	logMessageSuppressed = "log lines suppressed"
+
+	// queries tracked for repeats at once, others are logged as they are
+	logRepeatMaxKeys   = 4096
+	logLimitFlushEvery = time.Second
+)
+
+type logRepeatKey struct {
+	client     string
+	name       string
+	recordType string
+	verdict    string
+}
+
+type logRepeat struct {
+	since time.Time
+	level slog.Level
+	count int64
+}
+
+type logLimiter struct {
+	window time.Duration
+	rate   float64
+
+	mutex      sync.Mutex
+	repeats    map[logRepeatKey]*logRepeat
+	tokens     float64
+	last       time.Time
+	suppressed int64
+	flushed    time.Time
+}
+
+// limitingHandler collapses repeated query records and drops records over the rate before handing them on.
+type limitingHandler struct {
+	next    slog.Handler
+	limiter *logLimiter
+}
+
+// newLimitingHandler returns a handler where window 0 keeps repeats and rate 0 has no cap on the lines per second.
+func newLimitingHandler(next slog.Handler, window time.Duration, rate uint32) *limitingHandler {
+	return &limitingHandler{
+		next: next,
+		limiter: &logLimiter{
+			window:  window,
+			rate:    float64(rate),
+			repeats: make(map[logRepeatKey]*logRepeat),
+			tokens:  float64(rate),
+		},
+	}
+}
+
+// start writes the records for repeats that ended and lines that were suppressed, also when nothing else is logged.
+func (h *limitingHandler) start() {
+	go func() {
+		ticker := time.NewTicker(logLimitFlushEvery)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			_ = h.flush(context.Background(), now)
+		}
+	}()
+}
+
+func (h *limitingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *limitingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &limitingHandler{next: h.next.WithAttrs(attrs), limiter: h.limiter}
+}
+
+func (h *limitingHandler) WithGroup(name string) slog.Handler {
+	return &limitingHandler{next: h.next.WithGroup(name), limiter: h.limiter}
+}
+
+func (h *limitingHandler) Handle(ctx context.Context, record slog.Record) error {
+	now := record.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	err := h.flush(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	if exemptFromLimits(record) {
+		return h.next.Handle(ctx, record)
+	}
+
+	if record.Message == logMessageQuery && h.limiter.repeated(record, now) {
+		return nil
+	}
+
+	return h.handleLimited(ctx, record, now)
+}
+
+// exemptFromLimits reports whether a record is neither collapsed nor capped.
+func exemptFromLimits(record slog.Record) bool {
+	if record.Level >= slog.LevelWarn {
+		return true
+	}
+
+	// written on demand, and bounded by RecentQueries=
+	if record.Message == logMessageRecent {
+		return true
+	}
+
+	breakGlass := false
+	record.Attrs(func(attr slog.Attr) bool {
+		if attr.Key == "verdict" {
+			breakGlass = attr.Value.String() == verdictBreakGlass
+			return false
+		}
+		return true
+	})
+
+	return breakGlass
+}
+
+func (h *limitingHandler) handleLimited(ctx context.Context, record slog.Record, now time.Time) error {
+	if !h.limiter.allow(now) {
+		return nil
+	}
+
+	return h.next.Handle(ctx, record)
+}
+
+// FlushLogHandler writes the repeats and the notice of suppressed lines that handler holds back, e.g. before exiting.
+func FlushLogHandler(handler slog.Handler) error {
+	limiting, ok := handler.(*limitingHandler)
+	if !ok {
+		return nil
+	}
+
+	return limiting.flushAll(context.Background(), time.Now())
+}
+
+// flush writes a record for each repeat whose window ended, and a notice when lines were suppressed and the rate
+// allows lines again.
+func (h *limitingHandler) flush(ctx context.Context, now time.Time) error {
+	records, suppressed := h.limiter.expired(now, false)
+	return h.write(ctx, now, records, suppressed, true)
+}
+
+// flushAll writes a record for each repeat, whether its window ended or not, and a notice for suppressed lines,
+// whatever the rate.
+func (h *limitingHandler) flushAll(ctx context.Context, now time.Time) error {
+	records, suppressed := h.limiter.expired(now, true)
+	return h.write(ctx, now, records, suppressed, false)
+}
+
+// write writes the notice of suppressed lines and then records, which take a token each when limited.
+func (h *limitingHandler) write(ctx context.Context, now time.Time, records []slog.Record, suppressed int64, limited bool) error {
+	if suppressed > 0 {
+		notice := slog.NewRecord(now, slog.LevelWarn, logMessageSuppressed, 0)
+		notice.AddAttrs(slog.Int64("count", suppressed))
+		err := h.next.Handle(ctx, notice)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, record := range records {
+		var err error
+		if limited {
+			err = h.handleLimited(ctx, record, now)
+		} else {
+			err = h.next.Handle(ctx, record)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// repeated reports whether a query record repeats one logged within the window, and counts it.
+func (l *logLimiter) repeated(record slog.Record, now time.Time) bool {
+	if l.window == 0 {
+		return false
+	}
+
+	key := logRepeatKey{}
+	record.Attrs(func(attr slog.Attr) bool {
+		switch attr.Key {
+		case "client":
+			key.client = logRepeatClient(attr.Value.String())
+		case "name":
+			key.name = attr.Value.String()
+		case "type":
+			key.recordType = attr.Value.String()
+		case "verdict":
+			key.verdict = attr.Value.String()
+		}
+		return true
+	})
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	repeat, found := l.repeats[key]
+	if found {
+		repeat.count++
+		return true
+	}
+
+	if len(l.repeats) < logRepeatMaxKeys {
+		l.repeats[key] = &logRepeat{since: now, level: record.Level}
+	}
+
+	return false
+}
+
+// logRepeatClient returns the address of a client without its port, as retries come from another port each time, or
+// the client as it is logged when it is not an address and port, e.g. when redacted.
+func logRepeatClient(client string) string {
+	addrPort, err := netip.ParseAddrPort(client)
+	if err != nil {
+		return client
+	}
+
+	return addrPort.Addr().String()
+}
+
+// allow takes a token for a line.
+func (l *logLimiter) allow(now time.Time) bool {
+	if l.rate == 0 {
+		return true
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.After(l.last) {
+		l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+		l.last = now
+	}
+
+	if l.tokens < 1 {
+		l.suppressed++
+		return false
+	}
+
+	l.tokens--
+	return true
+}
+
+// expired removes the repeats whose window ended and returns a record for those that were repeated, and the lines
+// suppressed so far once there is a token again. With all, every repeat and the suppressed lines are returned.
+func (l *logLimiter) expired(now time.Time, all bool) ([]slog.Record, int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	records := make([]slog.Record, 0)
+	if now.Sub(l.flushed) < logLimitFlushEvery && !all {
+		return records, 0
+	}
+	l.flushed = now
+
+	for key, repeat := range l.repeats {
+		if now.Sub(repeat.since) < l.window && !all {
+			continue
+		}
+
+		delete(l.repeats, key)
+		if repeat.count == 0 {
+			continue
+		}
+
+		record := slog.NewRecord(now, repeat.level, logMessageRepeated, 0)
+		record.AddAttrs(
+			slog.String("client", key.client),
+			slog.String("name", key.name),
+			slog.String("type", key.recordType),
+			slog.String("verdict", key.verdict),
+			slog.Int64("count", repeat.count),
+			slog.Float64("window", l.window.Seconds()),
+		)
+		records = append(records, record)
+	}
+
+	suppressed := int64(0)
+	if l.suppressed > 0 && (all || l.tokens+now.Sub(l.last).Seconds()*l.rate >= 1) {
+		suppressed = l.suppressed
+		l.suppressed = 0
+	}
+
+	return records, suppressed
+}
@@ -0,0 +1,197 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newLimitTestRecord(now time.Time, client string, name string) slog.Record {
+	record := slog.NewRecord(now, slog.LevelInfo, logMessageQuery, 0)
+	record.AddAttrs(
+		slog.String("client", client),
+		slog.String("name", name),
+		slog.String("type", "A"),
+		slog.String("verdict", verdictDeny),
+	)
+	return record
+}
+
+func limitTestRecords(t *testing.T, buffer *bytes.Buffer) []map[string]any {
+	records := make([]map[string]any, 0)
+	for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		if line == "" {
+			continue
+		}
+
+		record := make(map[string]any)
+		err := json.Unmarshal([]byte(line), &record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+
+	buffer.Reset()
+	return records
+}
+
+func TestLogRepeats(t *testing.T) {
+	buffer := bytes.Buffer{}
+	handler := newLimitingHandler(NewLogHandler(&buffer, LogFormatJSON, slog.LevelInfo), 10*time.Second, 0)
+	ctx := context.Background()
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+
+	// a client retries from another port each time
+	for i := range 50 {
+		err := handler.Handle(ctx, newLimitTestRecord(now.Add(time.Duration(i)*100*time.Millisecond), fmt.Sprintf("192.0.2.10:%d", 5300+i), "ads.example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// another client is logged on its own
+	err := handler.Handle(ctx, newLimitTestRecord(now.Add(5*time.Second), "192.0.2.11:5300", "ads.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := limitTestRecords(t, &buffer)
+	if len(records) != 2 || records[0]["client"] != "192.0.2.10:5300" || records[1]["client"] != "192.0.2.11:5300" {
+		t.Fatalf("expected one record per client, got %v", records)
+	}
+
+	err = handler.flush(ctx, now.Add(10*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records = limitTestRecords(t, &buffer)
+	if len(records) != 1 || records[0]["msg"] != logMessageRepeated || records[0]["client"] != "192.0.2.10" || records[0]["name"] != "ads.example.com" || records[0]["count"] != float64(49) || records[0]["window"] != float64(10) {
+		t.Fatalf("expected a summary of the repeats, got %v", records)
+	}
+
+	// a new window starts with a record of its own
+	err = handler.Handle(ctx, newLimitTestRecord(now.Add(11*time.Second), "192.0.2.10:5400", "ads.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records = limitTestRecords(t, &buffer)
+	if len(records) != 1 || records[0]["msg"] != logMessageQuery {
+		t.Errorf("expected the query to be logged again, got %v", records)
+	}
+}
+
+func TestLogRateLimit(t *testing.T) {
+	buffer := bytes.Buffer{}
+	handler := newLimitingHandler(NewLogHandler(&buffer, LogFormatJSON, slog.LevelInfo), 0, 2)
+	ctx := context.Background()
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+
+	for i := range 5 {
+		err := handler.Handle(ctx, newLimitTestRecord(now, "192.0.2.10:5300", strings.Repeat("a", i+1)+".example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// recent queries are written on demand and not limited
+	err := handler.Handle(ctx, slog.NewRecord(now, slog.LevelInfo, logMessageRecent, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := limitTestRecords(t, &buffer)
+	if len(records) != 3 || records[2]["msg"] != logMessageRecent {
+		t.Fatalf("expected 2 queries and the recent query, got %v", records)
+	}
+
+	err = handler.Handle(ctx, newLimitTestRecord(now.Add(time.Second), "192.0.2.10:5300", "b.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records = limitTestRecords(t, &buffer)
+	if len(records) != 2 || records[0]["msg"] != logMessageSuppressed || records[0]["level"] != "WARN" || records[0]["count"] != float64(3) || records[1]["name"] != "b.example.com" {
+		t.Errorf("expected a notice for the suppressed lines, got %v", records)
+	}
+}
+
+func TestLogLimitExempt(t *testing.T) {
+	buffer := bytes.Buffer{}
+	handler := newLimitingHandler(NewLogHandler(&buffer, LogFormatJSON, slog.LevelInfo), 10*time.Second, 1)
+	ctx := context.Background()
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+
+	for range 3 {
+		breakGlass := slog.NewRecord(now, slog.LevelInfo, logMessageQuery, 0)
+		breakGlass.AddAttrs(
+			slog.String("client", "192.0.2.10:5300"),
+			slog.String("name", "other.net"),
+			slog.String("type", "A"),
+			slog.String("verdict", verdictBreakGlass),
+		)
+		err := handler.Handle(ctx, breakGlass)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		warning := slog.NewRecord(now, slog.LevelWarn, "upstream failed", 0)
+		err = handler.Handle(ctx, warning)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records := limitTestRecords(t, &buffer)
+	if len(records) != 6 || records[0]["verdict"] != verdictBreakGlass || records[1]["level"] != "WARN" {
+		t.Fatalf("expected every break-glass query and warning, got %v", records)
+	}
+
+	// the exempt records took no token
+	err := handler.Handle(ctx, newLimitTestRecord(now, "192.0.2.10:5300", "ads.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records = limitTestRecords(t, &buffer)
+	if len(records) != 1 || records[0]["name"] != "ads.example.com" {
+		t.Errorf("expected the query to be logged, got %v", records)
+	}
+}
+
+func TestFlushLogHandler(t *testing.T) {
+	buffer := bytes.Buffer{}
+	handler := newLimitingHandler(NewLogHandler(&buffer, LogFormatJSON, slog.LevelInfo), 10*time.Second, 1)
+	ctx := context.Background()
+	now := time.Now()
+
+	for range 3 {
+		err := handler.Handle(ctx, newLimitTestRecord(now, "192.0.2.10:5300", "ads.example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := handler.Handle(ctx, newLimitTestRecord(now, "192.0.2.11:5300", "ads.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	limitTestRecords(t, &buffer)
+
+	// before the window ends, and without a token
+	err = FlushLogHandler(handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := limitTestRecords(t, &buffer)
+	if len(records) != 2 || records[0]["msg"] != logMessageSuppressed || records[1]["msg"] != logMessageRepeated || records[1]["count"] != float64(2) {
+		t.Errorf("expected the suppressed lines and the repeats, got %v", records)
+	}
+}
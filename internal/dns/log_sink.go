@@ -0,0 +1,360 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log sinks other than stdout: the journald native protocol (https://systemd.io/JOURNAL_NATIVE_PROTOCOL/) and RFC 5424
+// syslog, both over a local datagram socket. Query records keep the pipe format as their message, and every
+// attribute becomes a field, e.g. NETFOIL_VERDICT=deny in the journal.
+
+type LogSink string
+
+const (
+	LogSinkStdout   LogSink = "stdout"
+	LogSinkJournald LogSink = "journald"
+	LogSinkSyslog   LogSink = "syslog"
+)
+
+const (
+	journaldSocket      = "/run/systemd/journal/socket"
+	defaultSyslogSocket = "/dev/log"
+	logIdentifier       = "netfoil"
+
+	// RFC 5424: facility daemon, and the example enterprise number of RFC 5612 for the structured data ID
+	syslogFacilityDaemon = 3
+	syslogSDID           = "netfoil@32473"
+	syslogTimeFormat     = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// NewConfiguredLogHandler returns the handler for the LogSink=, LogFormat= and LogLevel= of config, where stdout is
+// used for LogSink=stdout and when a socket cannot be written to. Records are limited by LogRepeatWindow= and
+// LogRateLimit=, and redacted by redactor.
+func NewConfiguredLogHandler(config *Config, stdout io.Writer, redactor *Redactor) (slog.Handler, error) {
+	handler, err := newSinkHandler(config, stdout)
+	if err != nil {
+		return nil, err
+	}
+
+	if redactor.enabled() {
+		handler = &redactingHandler{next: handler, redactor: redactor}
+	}
+
+	if config.LogRepeatWindow > 0 || config.LogRateLimit > 0 {
+		limiting := newLimitingHandler(handler, config.LogRepeatWindow, config.LogRateLimit)
+		limiting.start()
+		handler = limiting
+	}
+
+	return handler, nil
+}
+
+func newSinkHandler(config *Config, stdout io.Writer) (slog.Handler, error) {
+	switch config.LogSink {
+	case LogSinkJournald:
+		socket, err := newDatagramSocket(journaldSocket, stdout)
+		if err != nil {
+			return nil, err
+		}
+
+		return &sinkHandler{level: config.LogLevel, sink: &journaldSink{socket: socket}}, nil
+	case LogSinkSyslog:
+		path := config.SyslogSocket
+		if path == "" {
+			path = defaultSyslogSocket
+		}
+
+		socket, err := newDatagramSocket(path, stdout)
+		if err != nil {
+			return nil, err
+		}
+
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "-"
+		}
+
+		return &sinkHandler{level: config.LogLevel, sink: &syslogSink{socket: socket, hostname: hostname, pid: os.Getpid()}}, nil
+	}
+
+	return NewLogHandler(stdout, config.LogFormat, config.LogLevel), nil
+}
+
+type logField struct {
+	key   string
+	value string
+}
+
+type logSinkWriter interface {
+	write(r slog.Record, message string, fields []logField) error
+}
+
+// sinkHandler turns records into a message and a flat list of fields for a sink.
+type sinkHandler struct {
+	level  slog.Level
+	sink   logSinkWriter
+	fields []logField
+	prefix string
+}
+
+func (h *sinkHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *sinkHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	fields := slices.Clone(h.fields)
+	for _, attr := range attrs {
+		fields = appendLogFields(fields, h.prefix, attr)
+	}
+
+	return &sinkHandler{level: h.level, sink: h.sink, fields: fields, prefix: h.prefix}
+}
+
+func (h *sinkHandler) WithGroup(name string) slog.Handler {
+	return &sinkHandler{level: h.level, sink: h.sink, fields: h.fields, prefix: h.prefix + name + "_"}
+}
+
+func (h *sinkHandler) Handle(_ context.Context, r slog.Record) error {
+	fields := slices.Clone(h.fields)
+	r.Attrs(func(attr slog.Attr) bool {
+		fields = appendLogFields(fields, h.prefix, attr)
+		return true
+	})
+
+	message := r.Message
+	if r.Message == logMessageQuery || r.Message == logMessageRecent {
+		message = queryRecordLine(fields)
+	}
+
+	return h.sink.write(r, message, fields)
+}
+
+func appendLogFields(fields []logField, prefix string, attr slog.Attr) []logField {
+	value := attr.Value.Resolve()
+	if value.Kind() == slog.KindGroup {
+		for _, groupAttr := range value.Group() {
+			fields = appendLogFields(fields, prefix+attr.Key+"_", groupAttr)
+		}
+		return fields
+	}
+
+	if attr.Key == "" {
+		return fields
+	}
+
+	text := ""
+	switch v := value.Any().(type) {
+	case []string:
+		text = strings.Join(v, "; ")
+	case []logAnswer:
+		b, err := json.Marshal(v)
+		if err == nil {
+			text = string(b)
+		}
+	case time.Time:
+		text = v.Format(time.RFC3339Nano)
+	default:
+		text = value.String()
+	}
+
+	return append(fields, logField{key: prefix + attr.Key, value: text})
+}
+
+// queryRecordLine returns the pipe format of a query record, the same line LogFormat=text writes.
+func queryRecordLine(fields []logField) string {
+	values := make(map[string]string)
+	for _, field := range fields {
+		values[field.key] = field.value
+	}
+
+	auditReasons := make([]string, 0)
+	if values["audit_reasons"] != "" {
+		auditReasons = strings.Split(values["audit_reasons"], "; ")
+	}
+
+	return queryLogLine(values["verdict"], values["name"], values["type"], auditReasons)
+}
+
+func syslogSeverity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	}
+
+	return 7
+}
+
+// journaldSink writes entries in the journald native protocol.
+type journaldSink struct {
+	socket *datagramSocket
+}
+
+func (s *journaldSink) write(r slog.Record, message string, fields []logField) error {
+	b := make([]byte, 0, 512)
+	b = appendJournalField(b, "MESSAGE", message)
+	b = appendJournalField(b, "PRIORITY", fmt.Sprintf("%d", syslogSeverity(r.Level)))
+	b = appendJournalField(b, "SYSLOG_IDENTIFIER", logIdentifier)
+	for _, field := range fields {
+		b = appendJournalField(b, journalFieldName(field.key), field.value)
+	}
+
+	return s.socket.write(b, message)
+}
+
+// journalFieldName returns NETFOIL_ and the key in upper case, with the question as QNAME and QTYPE.
+func journalFieldName(key string) string {
+	switch key {
+	case "name":
+		key = "qname"
+	case "type":
+		key = "qtype"
+	}
+
+	sb := strings.Builder{}
+	sb.WriteString("NETFOIL_")
+	for _, c := range strings.ToUpper(key) {
+		if (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			sb.WriteRune(c)
+		} else {
+			sb.WriteByte('_')
+		}
+	}
+
+	// at most 64 characters
+	name := sb.String()
+	if len(name) > 64 {
+		name = name[:64]
+	}
+
+	return name
+}
+
+func appendJournalField(b []byte, name string, value string) []byte {
+	if !strings.Contains(value, "\n") {
+		b = append(b, name...)
+		b = append(b, '=')
+		b = append(b, value...)
+		return append(b, '\n')
+	}
+
+	// a value with a newline is written with its length
+	b = append(b, name...)
+	b = append(b, '\n')
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(value)))
+	b = append(b, value...)
+	return append(b, '\n')
+}
+
+// syslogSink writes RFC 5424 messages, with the fields as structured data.
+type syslogSink struct {
+	socket   *datagramSocket
+	hostname string
+	pid      int
+}
+
+func (s *syslogSink) write(r slog.Record, message string, fields []logField) error {
+	msgID := "-"
+	if r.Message == logMessageQuery {
+		msgID = logMessageQuery
+	}
+
+	structuredData := "-"
+	if len(fields) > 0 {
+		sb := strings.Builder{}
+		sb.WriteString("[" + syslogSDID)
+		for _, field := range fields {
+			fmt.Fprintf(&sb, " %s=\"%s\"", syslogParamName(field.key), syslogEscape(field.value))
+		}
+		sb.WriteString("]")
+		structuredData = sb.String()
+	}
+
+	timestamp := r.Time
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	priority := syslogFacilityDaemon*8 + syslogSeverity(r.Level)
+	line := fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s", priority, timestamp.Format(syslogTimeFormat), s.hostname, logIdentifier, s.pid, msgID, structuredData, message)
+
+	return s.socket.write([]byte(line), message)
+}
+
+// syslogParamName returns key as an SD-NAME, at most 32 printable characters without '=', ' ', ']' and '"'.
+func syslogParamName(key string) string {
+	sb := strings.Builder{}
+	for _, c := range key {
+		if c <= ' ' || c > '~' || c == '=' || c == ']' || c == '"' {
+			c = '_'
+		}
+		sb.WriteRune(c)
+	}
+
+	name := sb.String()
+	if len(name) > 32 {
+		name = name[:32]
+	}
+
+	return name
+}
+
+func syslogEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+// datagramSocket writes to a local datagram socket, and reconnects once when a write fails, e.g. after journald or
+// the syslog daemon restarted. A message that cannot be written goes to fallback.
+type datagramSocket struct {
+	path     string
+	fallback io.Writer
+
+	mutex sync.Mutex
+	conn  *net.UnixConn
+}
+
+func newDatagramSocket(path string, fallback io.Writer) (*datagramSocket, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("log socket %s: %w", path, err)
+	}
+
+	return &datagramSocket{path: path, fallback: fallback, conn: conn}, nil
+}
+
+func (s *datagramSocket) write(b []byte, message string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.conn.Write(b)
+	if err == nil {
+		return nil
+	}
+
+	conn, dialErr := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: s.path, Net: "unixgram"})
+	if dialErr == nil {
+		_ = s.conn.Close()
+		s.conn = conn
+		_, err = s.conn.Write(b)
+		if err == nil {
+			return nil
+		}
+	}
+
+	_, fallbackErr := fmt.Fprintf(s.fallback, "%s (log socket %s: %s)\n", message, s.path, err.Error())
+	return fallbackErr
+}
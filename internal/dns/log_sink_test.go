@@ -0,0 +1,102 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func listenLogSocket(t *testing.T) (*net.UnixConn, string) {
+	path := filepath.Join(t.TempDir(), "log")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	return conn, path
+}
+
+func readLogDatagram(t *testing.T, conn *net.UnixConn) []byte {
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 4096)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b[:n]
+}
+
+func newSinkTestLogger(t *testing.T, sink LogSink) (*slog.Logger, *net.UnixConn) {
+	conn, path := listenLogSocket(t)
+	socket, err := newDatagramSocket(path, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	switch sink {
+	case LogSinkJournald:
+		return slog.New(&sinkHandler{level: slog.LevelInfo, sink: &journaldSink{socket: socket}}), conn
+	default:
+		return slog.New(&sinkHandler{level: slog.LevelInfo, sink: &syslogSink{socket: socket, hostname: "host", pid: 42}}), conn
+	}
+}
+
+func TestJournaldSink(t *testing.T) {
+	logger, conn := newSinkTestLogger(t, LogSinkJournald)
+
+	logger.Info(logMessageQuery, "client", "192.0.2.10:5300", "name", "ads.example.com", "type", "A", "verdict", "deny",
+		"reasons", []string{"deny due to exact denylist: ads.example.com"}, "cache_hit", false)
+
+	expected := "MESSAGE=deny|ads.example.com|A\n" +
+		"PRIORITY=6\n" +
+		"SYSLOG_IDENTIFIER=netfoil\n" +
+		"NETFOIL_CLIENT=192.0.2.10:5300\n" +
+		"NETFOIL_QNAME=ads.example.com\n" +
+		"NETFOIL_QTYPE=A\n" +
+		"NETFOIL_VERDICT=deny\n" +
+		"NETFOIL_REASONS=deny due to exact denylist: ads.example.com\n" +
+		"NETFOIL_CACHE_HIT=false\n"
+	actual := string(readLogDatagram(t, conn))
+	if actual != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, actual)
+	}
+
+	logger.With("component", "control").Warn("two\nlines", "error", "failed")
+	expectedBytes := []byte("MESSAGE\n")
+	expectedBytes = binary.LittleEndian.AppendUint64(expectedBytes, 9)
+	expectedBytes = append(expectedBytes, "two\nlines\nPRIORITY=4\nSYSLOG_IDENTIFIER=netfoil\nNETFOIL_COMPONENT=control\nNETFOIL_ERROR=failed\n"...)
+	actualBytes := readLogDatagram(t, conn)
+	if !bytes.Equal(actualBytes, expectedBytes) {
+		t.Errorf("expected\n%q\ngot\n%q", expectedBytes, actualBytes)
+	}
+}
+
+func TestSyslogSink(t *testing.T) {
+	logger, conn := newSinkTestLogger(t, LogSinkSyslog)
+
+	logger.Info(logMessageQuery, "name", "ads.example.com", "type", "A", "verdict", "audit-deny",
+		"audit_reasons", []string{`deny due to regex denylist: ^ads\.`})
+
+	expected := regexp.MustCompile(`^<30>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}(Z|[+-]\d\d:\d\d) host netfoil 42 query ` +
+		regexp.QuoteMeta(`[netfoil@32473 name="ads.example.com" type="A" verdict="audit-deny" audit_reasons="deny due to regex denylist: ^ads\\."] audit-deny|ads.example.com|A|deny due to regex denylist: ^ads\.`) + `$`)
+	actual := string(readLogDatagram(t, conn))
+	if !expected.MatchString(actual) {
+		t.Errorf("unexpected message '%s'", actual)
+	}
+
+	logger.Error("failed to serve request")
+	expected = regexp.MustCompile(`^<27>1 \S+ host netfoil 42 - - failed to serve request$`)
+	actual = string(readLogDatagram(t, conn))
+	if !expected.MatchString(actual) {
+		t.Errorf("unexpected message '%s'", actual)
+	}
+}
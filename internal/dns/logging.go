@@ -1,12 +1,16 @@
 package dns
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"log/slog"
 	"strings"
+	"sync"
+	"time"
 )
 
 type LogEvent string
-type FilterReason string
 
 type FormatError struct {
 	Domain string
@@ -29,3 +33,341 @@ func escapeNonStandard(domain string) string {
 
 	return sb.String()
 }
+
+// All logging goes through slog. With LogFormat=text, query records are written in the pipe format, e.g.
+// allow|example.com|A, followed by a multi-line block at debug level. With LogFormat=json, every record is a JSON
+// object, and a query is a single record with the message "query".
+
+type LogFormat string
+
+const (
+	LogFormatText LogFormat = "text"
+	LogFormatJSON LogFormat = "json"
+)
+
+const (
+	logMessageQuery  = "query"
+	logMessageRecent = "recent query"
+
+	verdictAllow      = "allow"
+	verdictDeny       = "deny"
+	verdictAuditDeny  = "audit-deny"
+	verdictBreakGlass = "break-glass"
+	verdictError      = "error"
+)
+
+type logAnswer struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	TTL  uint32 `json:"ttl"`
+	Data string `json:"data,omitempty"`
+}
+
+// NewLogHandler returns the handler for all logging in the given format.
+func NewLogHandler(w io.Writer, format LogFormat, level slog.Level) slog.Handler {
+	opts := &slog.HandlerOptions{
+		Level: level,
+	}
+
+	if format == LogFormatJSON {
+		return slog.NewJSONHandler(w, opts)
+	}
+
+	return &textHandler{
+		w:     w,
+		level: level,
+		mutex: &sync.Mutex{},
+		other: slog.NewTextHandler(w, opts),
+	}
+}
+
+func (r *workerResult) verdict() string {
+	if r.err != nil {
+		return verdictError
+	} else if r.audited {
+		return verdictAuditDeny
+	} else if r.breakGlass {
+		return verdictBreakGlass
+	} else if r.allowed {
+		return verdictAllow
+	}
+
+	return verdictDeny
+}
+
+func logResult(config *Config, result workerResult) {
+	verdict := result.verdict()
+
+	logged := false
+	switch verdict {
+	case verdictAuditDeny, verdictDeny:
+		logged = config.LogDenied
+	case verdictBreakGlass:
+		// always logged, whatever LogAllowed is set to
+		logged = true
+	case verdictAllow:
+		logged = config.LogAllowed
+	}
+
+	level := slog.LevelInfo
+	if !logged {
+		if config.LogLevel > slog.LevelDebug {
+			return
+		}
+		level = slog.LevelDebug
+	}
+
+	attrs := queryAttrs(result, config.LogLevel <= slog.LevelDebug)
+	slog.LogAttrs(context.Background(), level, logMessageQuery, attrs...)
+}
+
+// queryAttrs returns the attributes of a query record, with the events of the query when events is set.
+func queryAttrs(result workerResult, events bool) []slog.Attr {
+	verdict := result.verdict()
+	attrs := []slog.Attr{
+		slog.String("client", result.client),
+		slog.String("name", strings.TrimSuffix(result.question.Name, ".")),
+		slog.String("type", result.question.Type.Name()),
+		slog.String("verdict", verdict),
+		slog.Any("reasons", reasonStrings(result.filterReasons)),
+		slog.Any("reason_codes", reasonCodes(result.filterReasons)),
+	}
+
+	if result.audited {
+		attrs = append(attrs,
+			slog.Any("audit_reasons", reasonStrings(result.auditReasons)),
+			slog.Any("audit_reason_codes", reasonCodes(result.auditReasons)),
+		)
+	}
+
+	attrs = append(attrs,
+		slog.Bool("cache_hit", result.cacheHit),
+		slog.Bool("external_request", result.externalRequest),
+		slog.Bool("pinned", result.pinned),
+	)
+
+	if result.response != nil {
+		answers := make([]logAnswer, 0, len(result.response.Answers))
+		for _, answer := range result.response.Answers {
+			answers = append(answers, logAnswer{
+				Name: answer.Name,
+				Type: answer.Type.Name(),
+				TTL:  answer.TTL,
+				Data: answerData(answer),
+			})
+		}
+
+		attrs = append(attrs,
+			slog.String("rcode", result.response.Flags.RCODE.Name()),
+			slog.Any("answers", answers),
+		)
+	}
+
+	attrs = append(attrs, slog.Float64("duration", result.time.Seconds()))
+
+	if result.err != nil {
+		attrs = append(attrs, slog.String("error", result.err.Error()))
+	}
+
+	if events {
+		eventStrings := make([]string, 0, len(result.logEvents))
+		for _, event := range result.logEvents {
+			eventStrings = append(eventStrings, string(event))
+		}
+		attrs = append(attrs, slog.Any("events", eventStrings))
+	}
+
+	return attrs
+}
+
+func logError(result workerResult) {
+	attrs := []slog.Attr{
+		slog.String("error", result.err.Error()),
+	}
+
+	if result.client != "" {
+		attrs = append(attrs, slog.String("client", result.client))
+	}
+
+	if result.question != nil {
+		attrs = append(attrs,
+			slog.String("name", strings.TrimSuffix(result.question.Name, ".")),
+			slog.String("type", result.question.Type.Name()),
+		)
+	}
+
+	slog.LogAttrs(context.Background(), slog.LevelError, "failed to serve request", attrs...)
+}
+
+// queryLogLine returns the pipe format of a query, where reasons are only written for audit-deny.
+func queryLogLine(verdict string, name string, recordType string, reasons []string) string {
+	if verdict == verdictAuditDeny {
+		return fmt.Sprintf("%s|%s|%s|%s", verdict, name, recordType, strings.Join(reasons, "; "))
+	}
+
+	return fmt.Sprintf("%s|%s|%s", verdict, name, recordType)
+}
+
+// answerData returns the data of an answer in a presentation format, empty for unsupported types.
+func answerData(answer Answer) string {
+	switch answer.Type {
+	case RecordTypeA:
+		return answer.IPv4.String()
+	case RecordTypeCNAME:
+		return answer.CNAME
+	case RecordTypeAAAA:
+		return answer.IPv6.String()
+	case RecordTypeHTTPS:
+		name := "."
+		if answer.HTTPSRecord.TargetName != "" {
+			name = answer.HTTPSRecord.TargetName
+		}
+
+		alpn := ""
+		if len(answer.HTTPSRecord.ALPN) > 0 {
+			alpn = fmt.Sprintf(" alpn=\"%s\"", strings.Join(answer.HTTPSRecord.ALPN, ","))
+		}
+
+		ipv4Hints := ""
+		if len(answer.HTTPSRecord.IPv4Hint) > 0 {
+			hints := make([]string, 0, len(answer.HTTPSRecord.IPv4Hint))
+			for _, h := range answer.HTTPSRecord.IPv4Hint {
+				hints = append(hints, h.String())
+			}
+
+			ipv4Hints = fmt.Sprintf(" ipv4hint=%s", strings.Join(hints, ","))
+		}
+
+		ipv6Hints := ""
+		if len(answer.HTTPSRecord.IPv6Hint) > 0 {
+			hints := make([]string, 0, len(answer.HTTPSRecord.IPv6Hint))
+			for _, h := range answer.HTTPSRecord.IPv6Hint {
+				hints = append(hints, h.String())
+			}
+
+			ipv6Hints = fmt.Sprintf(" ipv6hint=%s", strings.Join(hints, ","))
+		}
+
+		ech := ""
+		if answer.HTTPSRecord.ECH != nil {
+			publicNames := make([]string, 0, len(answer.HTTPSRecord.ECH))
+			for _, e := range answer.HTTPSRecord.ECH {
+				publicNames = append(publicNames, e.PublicName)
+			}
+
+			ech = fmt.Sprintf(" ech=%s", strings.Join(publicNames, ","))
+		}
+
+		return fmt.Sprintf("%d %s%s%s%s%s", answer.HTTPSRecord.Priority, name, alpn, ipv4Hints, ipv6Hints, ech)
+	}
+
+	return ""
+}
+
+// textHandler writes query records in the pipe format and hands all other records to a slog.TextHandler.
+type textHandler struct {
+	w     io.Writer
+	level slog.Level
+	mutex *sync.Mutex
+	other slog.Handler
+}
+
+func (h *textHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.other.Enabled(ctx, level)
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &textHandler{w: h.w, level: h.level, mutex: h.mutex, other: h.other.WithAttrs(attrs)}
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	return &textHandler{w: h.w, level: h.level, mutex: h.mutex, other: h.other.WithGroup(name)}
+}
+
+func (h *textHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Message != logMessageQuery && r.Message != logMessageRecent {
+		return h.other.Handle(ctx, r)
+	}
+
+	values := make(map[string]slog.Value)
+	r.Attrs(func(a slog.Attr) bool {
+		values[a.Key] = a.Value.Resolve()
+		return true
+	})
+
+	verdict := values["verdict"].String()
+	auditReasons, _ := values["audit_reasons"].Any().([]string)
+	line := queryLogLine(verdict, values["name"].String(), values["type"].String(), auditReasons)
+	sb := strings.Builder{}
+
+	if r.Message == logMessageRecent {
+		// always with the debug block, which is what the recent queries are kept for
+		fmt.Fprintf(&sb, "recent %s", r.Time.Format(time.RFC3339Nano))
+		client, found := values["client"]
+		if found {
+			fmt.Fprintf(&sb, " %s", client.String())
+		}
+		fmt.Fprintf(&sb, " %s\n", line)
+		writeDebugBlock(&sb, verdict, values)
+	} else {
+		// debug records are only written as part of the debug block
+		if r.Level >= slog.LevelInfo {
+			sb.WriteString(line)
+			sb.WriteString("\n")
+		}
+
+		if h.level <= slog.LevelDebug {
+			writeDebugBlock(&sb, verdict, values)
+		}
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	_, err := io.WriteString(h.w, sb.String())
+	return err
+}
+
+func writeDebugBlock(sb *strings.Builder, verdict string, values map[string]slog.Value) {
+	sb.WriteString("result\n")
+
+	events, _ := values["events"].Any().([]string)
+	for _, event := range events {
+		fmt.Fprintf(sb, "  %s\n", event)
+	}
+
+	reasons, _ := values["reasons"].Any().([]string)
+	if len(reasons) > 0 {
+		sb.WriteString("  filter\n")
+	}
+	for _, reason := range reasons {
+		fmt.Fprintf(sb, "    %s\n", reason)
+	}
+
+	fmt.Fprintf(sb, "  cache hit: %t, external request: %t, pinned: %t, audited: %t, break-glass: %t\n",
+		values["cache_hit"].Bool(), values["external_request"].Bool(), values["pinned"].Bool(),
+		verdict == verdictAuditDeny, verdict == verdictBreakGlass)
+
+	if rcode, found := values["rcode"]; found {
+		fmt.Fprintf(sb, "  response [%s]\n", rcode.String())
+
+		answers, _ := values["answers"].Any().([]logAnswer)
+		for _, answer := range answers {
+			fmt.Fprintf(sb, "    name: %s\n", answer.Name)
+			fmt.Fprintf(sb, "      type: %s\n", answer.Type)
+			fmt.Fprintf(sb, "      TTL: %d\n", answer.TTL)
+
+			labels := map[string]string{"A": "IPv4", "AAAA": "IPv6", "CNAME": "CNAME", "HTTPS": "HTTPS"}
+			label, found := labels[answer.Type]
+			if found && answer.Data != "" {
+				fmt.Fprintf(sb, "      %s: %s\n", label, answer.Data)
+			}
+		}
+	}
+
+	if err, found := values["error"]; found {
+		fmt.Fprintf(sb, "  error: %s\n", err.String())
+	}
+
+	fmt.Fprintf(sb, "  time: %f\n", values["duration"].Float64())
+}
@@ -1,7 +1,14 @@
 package dns
 
 import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestEscapeNonStandard(t *testing.T) {
@@ -26,3 +33,152 @@ func TestEscapeNonStandard(t *testing.T) {
 		t.Errorf("expected %s, got %s", expected, r3)
 	}
 }
+
+func logTestResult(t *testing.T, config *Config, result workerResult) string {
+	buffer := bytes.Buffer{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(NewLogHandler(&buffer, config.LogFormat, config.LogLevel)))
+	t.Cleanup(func() {
+		slog.SetDefault(previous)
+	})
+
+	logResult(config, result)
+	return buffer.String()
+}
+
+// newTestResult returns a result for an A query of name from a UDP client, which the tests of the result consumers
+// adjust as needed.
+func newTestResult(name string, reasons ...FilterReason) workerResult {
+	return workerResult{
+		client:        "192.0.2.10:5300",
+		question:      &Question{Name: name + ".", Type: RecordTypeA},
+		filterReasons: reasons,
+	}
+}
+
+// newLogTestResult returns an allowed result with the events and answers that are logged at debug level.
+func newLogTestResult() workerResult {
+	result := newTestResult("www.example.com", FilterReason{Code: FilterCodeAllowExact, Value: "www.example.com", Rule: "www.example.com"})
+	result.allowed = true
+	result.cacheHit = true
+	result.logEvents = []LogEvent{"query from: 192.0.2.10:5300 [UDP]"}
+	result.response = &Response{
+		Answers: []Answer{
+			{Name: "www.example.com.", Type: RecordTypeCNAME, TTL: 60, CNAME: "cdn.example.com."},
+			{Name: "cdn.example.com.", Type: RecordTypeA, TTL: 60, IPv4: net.IPv4(192, 0, 2, 1)},
+		},
+	}
+	result.time = 20 * time.Millisecond
+	return result
+}
+
+func TestLogText(t *testing.T) {
+	config := &Config{LogAllowed: true, LogDenied: true, LogLevel: slog.LevelInfo, LogFormat: LogFormatText}
+
+	output := logTestResult(t, config, newLogTestResult())
+	if output != "allow|www.example.com|A\n" {
+		t.Errorf("unexpected output '%s'", output)
+	}
+
+	audited := newLogTestResult()
+	audited.audited = true
+	audited.auditReasons = []FilterReason{FilterReason{Code: FilterCodeDenyExact, Value: "www.example.com", Rule: "www.example.com"}}
+	output = logTestResult(t, config, audited)
+	if output != "audit-deny|www.example.com|A|deny due to exact denylist: www.example.com, rule 'www.example.com'\n" {
+		t.Errorf("unexpected output '%s'", output)
+	}
+
+	config.LogAllowed = false
+	output = logTestResult(t, config, newLogTestResult())
+	if output != "" {
+		t.Errorf("expected no output, got '%s'", output)
+	}
+
+	// the debug block is written for every query
+	config.LogLevel = slog.LevelDebug
+	output = logTestResult(t, config, newLogTestResult())
+	expected := `result
+  query from: 192.0.2.10:5300 [UDP]
+  filter
+    allow due to exact allowlist: www.example.com, rule 'www.example.com'
+  cache hit: true, external request: false, pinned: false, audited: false, break-glass: false
+  response [NoError]
+    name: www.example.com.
+      type: CNAME
+      TTL: 60
+      CNAME: cdn.example.com.
+    name: cdn.example.com.
+      type: A
+      TTL: 60
+      IPv4: 192.0.2.1
+  time: 0.020000
+`
+	if output != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, output)
+	}
+
+	queryLog := NewQueryLog()
+	err := queryLog.Read(strings.NewReader(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if queryLog.pairs["www.example.com:cdn.example.com"] != 1 {
+		t.Errorf("expected the CNAME pair to be read back, got %v", queryLog.pairs)
+	}
+}
+
+func TestLogJSON(t *testing.T) {
+	config := &Config{LogAllowed: true, LogDenied: true, LogLevel: slog.LevelInfo, LogFormat: LogFormatJSON}
+
+	denied := newLogTestResult()
+	denied.allowed = false
+	denied.filterReasons = []FilterReason{{Code: FilterCodeNoAllowRule, Value: "www.example.com"}}
+	output := logTestResult(t, config, denied)
+
+	record := struct {
+		Level    string      `json:"level"`
+		Msg      string      `json:"msg"`
+		Client   string      `json:"client"`
+		Name     string      `json:"name"`
+		Type     string      `json:"type"`
+		Verdict  string      `json:"verdict"`
+		Reasons  []string    `json:"reasons"`
+		Codes    []string    `json:"reason_codes"`
+		CacheHit bool        `json:"cache_hit"`
+		Pinned   bool        `json:"pinned"`
+		Answers  []logAnswer `json:"answers"`
+		Duration float64     `json:"duration"`
+	}{}
+
+	if strings.Count(output, "\n") != 1 {
+		t.Fatalf("expected a single record, got '%s'", output)
+	}
+
+	err := json.Unmarshal([]byte(output), &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if record.Level != "INFO" || record.Msg != "query" || record.Client != "192.0.2.10:5300" || record.Name != "www.example.com" || record.Type != "A" || record.Verdict != "deny" {
+		t.Errorf("unexpected record %+v", record)
+	}
+
+	if len(record.Reasons) != 1 || !slices.Equal(record.Codes, []string{"DENY_NO_ALLOW_RULE"}) || !record.CacheHit || record.Pinned || record.Duration != 0.02 {
+		t.Errorf("unexpected record %+v", record)
+	}
+
+	if len(record.Answers) != 2 || record.Answers[1] != (logAnswer{Name: "cdn.example.com.", Type: "A", TTL: 60, Data: "192.0.2.1"}) {
+		t.Errorf("unexpected answers %+v", record.Answers)
+	}
+
+	queryLog := NewQueryLog()
+	err = queryLog.Read(strings.NewReader("Oct 19 10:00:00 host netfoil[1]: " + output))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if queryLog.denied["www.example.com"] != 1 || queryLog.pairs["www.example.com:cdn.example.com"] != 1 {
+		t.Errorf("expected the record to be read back, got %v %v", queryLog.denied, queryLog.pairs)
+	}
+}
@@ -0,0 +1,391 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinfoil-factory/netfoil/internal/lru"
+)
+
+// Metrics are served in the Prometheus text format (https://prometheus.io/docs/instrumenting/exposition_formats/).
+
+const (
+	metricsReadTimeout = 5 * time.Second
+	metricsPath        = "/metrics"
+)
+
+// upstream request durations in seconds, the last bucket is the DoH timeout
+var upstreamBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, timeout.Seconds()}
+
+type queryLabels struct {
+	verdict   string
+	queryType string
+	transport string
+}
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bound := range upstreamBuckets {
+		if value <= bound {
+			h.buckets[i]++
+		}
+	}
+
+	h.count++
+	h.sum += value
+}
+
+type queueGauge struct {
+	name     string
+	length   func() int
+	capacity int
+}
+
+type metrics struct {
+	queries          atomic.Uint64
+	allowed          atomic.Uint64
+	denied           atomic.Uint64
+	audited          atomic.Uint64
+	cacheHits        atomic.Uint64
+	externalRequests atomic.Uint64
+	errors           atomic.Uint64
+	shedUDP          atomic.Uint64
+	shedTCP          atomic.Uint64
+
+	mutex            sync.Mutex
+	queriesByLabels  map[queryLabels]uint64
+	denials          map[string]uint64
+	upstreamDuration map[string]*histogram
+	upstreamErrors   map[string]uint64
+
+	// set by Server
+	cache           *lru.Cache[timedResponse]
+	queues          []queueGauge
+	dnstap          *Dnstap
+	notifier        *Notifier
+	clientLimiter   *rateLimiter
+	responseLimiter *rateLimiter
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		queriesByLabels:  make(map[queryLabels]uint64),
+		denials:          make(map[string]uint64),
+		upstreamDuration: make(map[string]*histogram),
+		upstreamErrors:   make(map[string]uint64),
+	}
+}
+
+func (m *metrics) add(result workerResult) {
+	if result.err != nil {
+		m.errors.Add(1)
+	}
+
+	if result.shed {
+		m.shedUDP.Add(1)
+		return
+	}
+
+	if result.question == nil {
+		return
+	}
+
+	m.queries.Add(1)
+	if result.allowed {
+		m.allowed.Add(1)
+	} else {
+		m.denied.Add(1)
+	}
+
+	if result.audited {
+		m.audited.Add(1)
+	}
+
+	// a stale cache entry is refreshed by an external request
+	if result.cacheHit && !result.externalRequest {
+		m.cacheHits.Add(1)
+	}
+
+	if result.externalRequest {
+		m.externalRequests.Add(1)
+	}
+
+	verdict := result.verdict()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	labels := queryLabels{
+		verdict:   verdict,
+		queryType: metricsQueryType(result.question.Type),
+		transport: strings.ToLower(string(result.connectionType)),
+	}
+	m.queriesByLabels[labels]++
+
+	if verdict == verdictDeny {
+		m.denials[denyCategory(result.filterReasons)]++
+	}
+}
+
+// metricsQueryType returns the label of a record type, where all types netfoil does not know share one, so clients
+// cannot create a series for each of the 65536 types.
+func metricsQueryType(recordType RecordType) string {
+	switch recordType {
+	case RecordTypeA, RecordTypeCNAME, RecordTypeAAAA, RecordTypeHTTPS:
+		return recordType.Name()
+	default:
+		return "other"
+	}
+}
+
+// observeUpstream records a DoH request to ip, which is empty when no connection was made.
+func (m *metrics) observeUpstream(ip string, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	if ip == "" {
+		ip = "none"
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err != nil {
+		m.upstreamErrors[ip]++
+		return
+	}
+
+	h, found := m.upstreamDuration[ip]
+	if !found {
+		h = &histogram{buckets: make([]uint64, len(upstreamBuckets))}
+		m.upstreamDuration[ip] = h
+	}
+
+	h.observe(duration.Seconds())
+}
+
+// denyCategories maps the codes of deny reasons to a short category, where the codes that sum up the reasons before
+// them, e.g. DENY_QUERY, are left out.
+var denyCategories = map[FilterCode]string{
+	FilterCodeDenyExact:            "exact",
+	FilterCodeDenySuffix:           "suffix",
+	FilterCodeDenyWildcard:         "wildcard",
+	FilterCodeDenyRegex:            "regex",
+	FilterCodeNoAllowRule:          "no-allow-rule",
+	FilterCodeRequestType:          "request-type",
+	FilterCodeNoAllowedIPv4:        "request-type",
+	FilterCodeNoAllowedIPv6:        "request-type",
+	FilterCodeNameTooLong:          "format",
+	FilterCodeNoTrailingDot:        "format",
+	FilterCodeNameFormat:           "format",
+	FilterCodePinMismatch:          "response-domain",
+	FilterCodeDenyIPv4Range:        "ipv4",
+	FilterCodeNoIPv4Rule:           "ipv4",
+	FilterCodeDenyIPv6Range:        "ipv6",
+	FilterCodeNoIPv6Rule:           "ipv6",
+	FilterCodeResponseCode:         "response-code",
+	FilterCodeResponseType:         "response-format",
+	FilterCodeTypeMismatch:         "response-format",
+	FilterCodeDuplicateCNAME:       "response-format",
+	FilterCodeMultipleIPNames:      "response-format",
+	FilterCodeMultipleHTTPSNames:   "response-format",
+	FilterCodeCNAMEChainTooLong:    "response-format",
+	FilterCodeCNAMEChainLoop:       "response-format",
+	FilterCodeCNAMEChainIncomplete: "response-format",
+	FilterCodeCNAMEChainEnd:        "response-format",
+	FilterCodeInvalidIPv4:          "response-format",
+	FilterCodeNotIPv4:              "response-format",
+	FilterCodeInvalidIPv6:          "response-format",
+	FilterCodeNotIPv6:              "response-format",
+	FilterCodeRPZQName:             "rpz",
+	FilterCodeRPZResponseIP:        "rpz",
+}
+
+// denyCategory returns a short category for the first deny reason, which is the most specific one.
+func denyCategory(reasons []FilterReason) string {
+	for _, reason := range reasons {
+		category, found := denyCategories[reason.Code]
+		if !found {
+			continue
+		}
+
+		if reason.Schedule != "" {
+			return "schedule"
+		}
+
+		return category
+	}
+
+	return "other"
+}
+
+func (m *metrics) write(w io.Writer) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	sb := strings.Builder{}
+
+	writeMetricHeader(&sb, "netfoil_queries_total", "counter", "Queries by verdict, record type and transport.")
+	for _, labels := range slices.SortedFunc(maps.Keys(m.queriesByLabels), compareQueryLabels) {
+		fmt.Fprintf(&sb, "netfoil_queries_total{verdict=%q,type=%q,transport=%q} %d\n", labels.verdict, labels.queryType, labels.transport, m.queriesByLabels[labels])
+	}
+
+	writeMetricHeader(&sb, "netfoil_denials_total", "counter", "Denied queries by reason category.")
+	for _, category := range slices.Sorted(maps.Keys(m.denials)) {
+		fmt.Fprintf(&sb, "netfoil_denials_total{reason=%q} %d\n", category, m.denials[category])
+	}
+
+	writeMetricHeader(&sb, "netfoil_errors_total", "counter", "Errors while serving queries.")
+	fmt.Fprintf(&sb, "netfoil_errors_total %d\n", m.errors.Load())
+
+	hits := m.cacheHits.Load()
+	misses := m.externalRequests.Load()
+	writeMetricHeader(&sb, "netfoil_cache_hits_total", "counter", "Answers served from the cache.")
+	fmt.Fprintf(&sb, "netfoil_cache_hits_total %d\n", hits)
+	writeMetricHeader(&sb, "netfoil_cache_misses_total", "counter", "Answers requested upstream.")
+	fmt.Fprintf(&sb, "netfoil_cache_misses_total %d\n", misses)
+
+	ratio := 0.0
+	if hits+misses > 0 {
+		ratio = float64(hits) / float64(hits+misses)
+	}
+	writeMetricHeader(&sb, "netfoil_cache_hit_ratio", "gauge", "Cache hits divided by cache lookups since start.")
+	fmt.Fprintf(&sb, "netfoil_cache_hit_ratio %g\n", ratio)
+
+	if m.cache != nil {
+		writeMetricHeader(&sb, "netfoil_cache_entries", "gauge", "Entries in the cache.")
+		fmt.Fprintf(&sb, "netfoil_cache_entries %d\n", m.cache.Size())
+		writeMetricHeader(&sb, "netfoil_cache_capacity", "gauge", "Maximum entries in the cache.")
+		fmt.Fprintf(&sb, "netfoil_cache_capacity %d\n", m.cache.Capacity())
+	}
+
+	writeMetricHeader(&sb, "netfoil_upstream_request_duration_seconds", "histogram", "Duration of successful DoH requests by upstream IP.")
+	for _, ip := range slices.Sorted(maps.Keys(m.upstreamDuration)) {
+		h := m.upstreamDuration[ip]
+		for i, bound := range upstreamBuckets {
+			fmt.Fprintf(&sb, "netfoil_upstream_request_duration_seconds_bucket{ip=%q,le=\"%g\"} %d\n", ip, bound, h.buckets[i])
+		}
+		fmt.Fprintf(&sb, "netfoil_upstream_request_duration_seconds_bucket{ip=%q,le=\"+Inf\"} %d\n", ip, h.count)
+		fmt.Fprintf(&sb, "netfoil_upstream_request_duration_seconds_sum{ip=%q} %g\n", ip, h.sum)
+		fmt.Fprintf(&sb, "netfoil_upstream_request_duration_seconds_count{ip=%q} %d\n", ip, h.count)
+	}
+
+	writeMetricHeader(&sb, "netfoil_upstream_errors_total", "counter", "Failed DoH requests by upstream IP, 'none' when no connection was made.")
+	for _, ip := range slices.Sorted(maps.Keys(m.upstreamErrors)) {
+		fmt.Fprintf(&sb, "netfoil_upstream_errors_total{ip=%q} %d\n", ip, m.upstreamErrors[ip])
+	}
+
+	writeMetricHeader(&sb, "netfoil_queue_depth", "gauge", "Items waiting in the internal queues.")
+	for _, queue := range m.queues {
+		fmt.Fprintf(&sb, "netfoil_queue_depth{queue=%q} %d\n", queue.name, queue.length())
+	}
+
+	writeMetricHeader(&sb, "netfoil_queue_capacity", "gauge", "Items the internal queues hold before queries are shed.")
+	for _, queue := range m.queues {
+		fmt.Fprintf(&sb, "netfoil_queue_capacity{queue=%q} %d\n", queue.name, queue.capacity)
+	}
+
+	writeMetricHeader(&sb, "netfoil_queries_shed_total", "counter", "Queries shed because all workers were busy and the queue was full, by transport.")
+	fmt.Fprintf(&sb, "netfoil_queries_shed_total{transport=\"udp\"} %d\n", m.shedUDP.Load())
+	fmt.Fprintf(&sb, "netfoil_queries_shed_total{transport=\"tcp\"} %d\n", m.shedTCP.Load())
+
+	if m.dnstap != nil {
+		writeMetricHeader(&sb, "netfoil_dnstap_dropped_total", "counter", "dnstap messages dropped because the collector did not keep up or was unavailable.")
+		fmt.Fprintf(&sb, "netfoil_dnstap_dropped_total %d\n", m.dnstap.Dropped())
+	}
+
+	if m.notifier != nil {
+		writeMetricHeader(&sb, "netfoil_notifications_dropped_total", "counter", "Notifications dropped by the rate limit or because the hook did not keep up.")
+		fmt.Fprintf(&sb, "netfoil_notifications_dropped_total %d\n", m.notifier.Dropped())
+	}
+
+	if m.clientLimiter != nil || m.responseLimiter != nil {
+		writeMetricHeader(&sb, "netfoil_rate_limited_total", "counter", "Queries dropped or answered truncated by ClientRateLimit= or ResponseRateLimit=.")
+		if m.clientLimiter != nil {
+			fmt.Fprintf(&sb, "netfoil_rate_limited_total{limit=%q} %d\n", rateLimitClient, m.clientLimiter.Limited())
+		}
+		if m.responseLimiter != nil {
+			fmt.Fprintf(&sb, "netfoil_rate_limited_total{limit=%q} %d\n", rateLimitResponse, m.responseLimiter.Limited())
+		}
+	}
+
+	if m.responseLimiter != nil {
+		writeMetricHeader(&sb, "netfoil_rate_limit_slipped_total", "counter", "Rate limited responses sent truncated, so the client retries over TCP.")
+		fmt.Fprintf(&sb, "netfoil_rate_limit_slipped_total %d\n", m.responseLimiter.Slipped())
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func writeMetricHeader(sb *strings.Builder, name string, metricType string, help string) {
+	fmt.Fprintf(sb, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(sb, "# TYPE %s %s\n", name, metricType)
+}
+
+func compareQueryLabels(a queryLabels, b queryLabels) int {
+	return strings.Compare(a.verdict+"|"+a.queryType+"|"+a.transport, b.verdict+"|"+b.queryType+"|"+b.transport)
+}
+
+// ListenMetrics listens on a loopback address and port, or on a Unix socket when address is an absolute path.
+func ListenMetrics(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "/") {
+		return listenUnixSocket(address, 0117)
+	}
+
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metrics address '%s': expected <ip>:<port> or an absolute path", address)
+	}
+
+	if !addrPort.Addr().IsLoopback() {
+		return nil, fmt.Errorf("invalid metrics address '%s': only loopback addresses are allowed", address)
+	}
+
+	return net.Listen("tcp", addrPort.String())
+}
+
+func (m *metrics) serve(listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = m.write(w)
+	})
+
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: metricsReadTimeout,
+		ReadTimeout:       metricsReadTimeout,
+		WriteTimeout:      metricsReadTimeout,
+		MaxHeaderBytes:    4096,
+	}
+
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("metrics: server stopped", "error", err.Error())
+		}
+	}()
+}
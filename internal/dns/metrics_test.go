@@ -0,0 +1,100 @@
+package dns
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinfoil-factory/netfoil/internal/lru"
+)
+
+func TestDenyCategory(t *testing.T) {
+	tests := []struct {
+		reasons  []FilterReason
+		expected string
+	}{
+		{[]FilterReason{{Code: FilterCodeDenyExact}}, "exact"},
+		{[]FilterReason{{Code: FilterCodeDenySuffix}}, "suffix"},
+		{[]FilterReason{{Code: FilterCodeNoAllowRule}, {Code: FilterCodeDenyQuery}}, "no-allow-rule"},
+		{[]FilterReason{{Code: FilterCodeRequestType}}, "request-type"},
+		{[]FilterReason{{Code: FilterCodeAllowExact}, {Code: FilterCodeDenyIPv4Range}, {Code: FilterCodeDenyResponseIPv4}}, "ipv4"},
+		{[]FilterReason{{Code: FilterCodeDenyExact, Schedule: "work"}}, "schedule"},
+		{[]FilterReason{{Code: FilterCodeCNAMEChainLoop}}, "response-format"},
+		{[]FilterReason{{Code: FilterCodeAllowExact, Schedule: "work"}}, "other"},
+	}
+
+	for _, test := range tests {
+		actual := denyCategory(test.reasons)
+		if actual != test.expected {
+			t.Errorf("%v: expected '%s', got '%s'", test.reasons, test.expected, actual)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := newMetrics()
+	m.cache = lru.NewCache[timedResponse](16)
+	m.queues = []queueGauge{{name: "tasks", length: func() int { return 3 }, capacity: 50}}
+
+	m.add(workerResult{question: &Question{Name: "example.com.", Type: RecordTypeA}, connectionType: ConnectionTypeUDP, allowed: true, cacheHit: true})
+	m.add(workerResult{question: &Question{Name: "example.com.", Type: RecordTypeA}, connectionType: ConnectionTypeUDP, allowed: true, externalRequest: true})
+	m.add(workerResult{question: &Question{Name: "bad.example.com.", Type: RecordTypeAAAA}, connectionType: ConnectionTypeTCP, filterReasons: []FilterReason{{Code: FilterCodeDenyExact}}})
+	m.add(workerResult{question: &Question{Name: "example.org.", Type: RecordTypeA}, connectionType: ConnectionTypeUDP, shed: true})
+	m.add(workerResult{question: &Question{Name: "example.com.", Type: RecordType(16)}, connectionType: ConnectionTypeUDP, filterReasons: []FilterReason{{Code: FilterCodeDenyQuery}}})
+	m.add(workerResult{question: &Question{Name: "example.com.", Type: RecordType(4711)}, connectionType: ConnectionTypeUDP, filterReasons: []FilterReason{{Code: FilterCodeDenyQuery}}})
+	m.observeUpstream("192.0.2.1", 30*time.Millisecond, nil)
+	m.observeUpstream("", 0, context.DeadlineExceeded)
+
+	sb := strings.Builder{}
+	err := m.write(&sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`netfoil_queries_total{verdict="allow",type="A",transport="udp"} 2`,
+		`netfoil_queries_total{verdict="deny",type="AAAA",transport="tcp"} 1`,
+		`netfoil_queries_total{verdict="deny",type="other",transport="udp"} 2`,
+		`netfoil_denials_total{reason="exact"} 1`,
+		`netfoil_cache_hits_total 1`,
+		`netfoil_cache_misses_total 1`,
+		`netfoil_cache_hit_ratio 0.5`,
+		`netfoil_cache_capacity 16`,
+		`netfoil_upstream_request_duration_seconds_bucket{ip="192.0.2.1",le="0.025"} 0`,
+		`netfoil_upstream_request_duration_seconds_bucket{ip="192.0.2.1",le="0.05"} 1`,
+		`netfoil_upstream_request_duration_seconds_bucket{ip="192.0.2.1",le="+Inf"} 1`,
+		`netfoil_upstream_request_duration_seconds_count{ip="192.0.2.1"} 1`,
+		`netfoil_upstream_errors_total{ip="none"} 1`,
+		`netfoil_queue_depth{queue="tasks"} 3`,
+		`netfoil_queue_capacity{queue="tasks"} 50`,
+		`netfoil_queries_shed_total{transport="udp"} 1`,
+		`netfoil_queries_shed_total{transport="tcp"} 0`,
+	}
+
+	lines := strings.Split(sb.String(), "\n")
+	for _, e := range expected {
+		if !slices.Contains(lines, e) {
+			t.Errorf("expected '%s' in\n%s", e, sb.String())
+		}
+	}
+}
+
+func TestListenMetrics(t *testing.T) {
+	_, err := ListenMetrics("192.0.2.1:9153")
+	if err == nil {
+		t.Errorf("expected an error for a non-loopback address")
+	}
+
+	_, err = ListenMetrics("localhost:9153")
+	if err == nil {
+		t.Errorf("expected an error for a host name")
+	}
+
+	listener, err := ListenMetrics("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = listener.Close()
+}
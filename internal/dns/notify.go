@@ -0,0 +1,258 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Notifications run a command or POST to a local HTTP endpoint for queries matching NotifyOn= or NotifyNames=, e.g. to
+// alert on a honeypot name right away. They are rate limited and queued, and dropped when the queue is full, so a slow
+// hook never delays a response.
+
+const (
+	notifyQueueSize = 64
+)
+
+// notifyEvent is the JSON written to the stdin of NotifyCommand= and POSTed to NotifyURL=.
+type notifyEvent struct {
+	Time string `json:"time"`
+	// verdict, reason code or NotifyNames= entry that matched
+	Trigger     string   `json:"trigger"`
+	Client      string   `json:"client,omitempty"`
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Verdict     string   `json:"verdict"`
+	Reasons     []string `json:"reasons"`
+	ReasonCodes []string `json:"reason_codes"`
+	// notifications dropped since the one before this one
+	Dropped uint64 `json:"dropped"`
+}
+
+type Notifier struct {
+	on       map[string]struct{}
+	names    []string
+	command  string
+	url      *url.URL
+	timeout  time.Duration
+	redactor *Redactor
+	client   *http.Client
+
+	events chan notifyEvent
+
+	mutex      sync.Mutex
+	rate       float64
+	tokens     float64
+	last       time.Time
+	dropped    atomic.Uint64
+	unreported atomic.Uint64
+}
+
+// NewNotifier returns the notifier of config with events redacted by redactor, or nil when notifications are off.
+func NewNotifier(config *Config, redactor *Redactor) *Notifier {
+	if config.NotifyCommand == "" && config.NotifyURL == nil {
+		return nil
+	}
+
+	on := make(map[string]struct{})
+	for _, class := range config.NotifyOn {
+		on[class] = struct{}{}
+	}
+
+	return &Notifier{
+		on:       on,
+		names:    config.NotifyNames,
+		command:  config.NotifyCommand,
+		url:      config.NotifyURL,
+		timeout:  config.NotifyTimeout,
+		redactor: redactor,
+		client: &http.Client{
+			// no proxy from the environment, the endpoint is local
+			Transport: &http.Transport{},
+			Timeout:   config.NotifyTimeout,
+		},
+		events: make(chan notifyEvent, notifyQueueSize),
+		rate:   float64(config.NotifyRateLimit),
+		tokens: float64(config.NotifyRateLimit),
+	}
+}
+
+// Start runs the hooks for queued notifications one at a time.
+func (n *Notifier) Start() {
+	if n == nil {
+		return
+	}
+
+	go func() {
+		for event := range n.events {
+			n.send(event)
+		}
+	}()
+}
+
+// Dropped returns the number of notifications dropped by NotifyRateLimit= or because the queue was full.
+func (n *Notifier) Dropped() uint64 {
+	return n.dropped.Load()
+}
+
+// notify queues a notification when result matches, without blocking.
+func (n *Notifier) notify(now time.Time, result workerResult) {
+	if n == nil || result.question == nil {
+		return
+	}
+
+	trigger, found := n.trigger(result)
+	if !found {
+		return
+	}
+
+	if !n.allow(now) {
+		n.drop()
+		return
+	}
+
+	reasons := result.filterReasons
+	if result.audited {
+		reasons = result.auditReasons
+	}
+
+	event := notifyEvent{
+		Time:        now.UTC().Format(time.RFC3339Nano),
+		Trigger:     trigger,
+		Client:      n.redactor.client(result.client),
+		Name:        n.redactor.name(strings.TrimSuffix(result.question.Name, ".")),
+		Type:        result.question.Type.Name(),
+		Verdict:     result.verdict(),
+		Reasons:     n.redactor.reasons(reasonStrings(reasons)),
+		ReasonCodes: reasonCodes(reasons),
+		Dropped:     n.unreported.Swap(0),
+	}
+
+	select {
+	case n.events <- event:
+	default:
+		n.unreported.Add(event.Dropped)
+		n.drop()
+	}
+}
+
+func (n *Notifier) drop() {
+	n.dropped.Add(1)
+	n.unreported.Add(1)
+}
+
+// trigger returns the NotifyOn= or NotifyNames= entry that result matches.
+func (n *Notifier) trigger(result workerResult) (string, bool) {
+	name := strings.ToLower(strings.TrimSuffix(result.question.Name, "."))
+	for _, entry := range n.names {
+		if name == entry || (strings.HasPrefix(entry, ".") && strings.HasSuffix(name, entry)) {
+			return entry, true
+		}
+	}
+
+	verdict := result.verdict()
+	_, found := n.on[verdict]
+	if found {
+		return verdict, true
+	}
+
+	reasons := result.filterReasons
+	if result.audited {
+		reasons = result.auditReasons
+	}
+
+	for _, reason := range reasons {
+		_, found = n.on[string(reason.Code)]
+		if found {
+			return string(reason.Code), true
+		}
+	}
+
+	return "", false
+}
+
+// allow takes a token, where the bucket holds NotifyRateLimit= tokens and is refilled over a minute.
+func (n *Notifier) allow(now time.Time) bool {
+	if n.rate == 0 {
+		return true
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if now.After(n.last) {
+		n.tokens = min(n.rate, n.tokens+now.Sub(n.last).Minutes()*n.rate)
+		n.last = now
+	}
+
+	if n.tokens < 1 {
+		return false
+	}
+
+	n.tokens--
+	return true
+}
+
+func (n *Notifier) send(event notifyEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("failed to marshal notification", "error", err.Error())
+		return
+	}
+
+	if n.command != "" {
+		err = n.run(body)
+		if err != nil {
+			slog.Warn("notification command failed", "command", n.command, "error", err.Error())
+		}
+	}
+
+	if n.url != nil {
+		err = n.post(body)
+		if err != nil {
+			slog.Warn("notification request failed", "url", n.url.String(), "error", err.Error())
+		}
+	}
+}
+
+// run runs NotifyCommand= without arguments and the event on stdin.
+func (n *Notifier) run(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), n.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, n.command)
+	cmd.Stdin = bytes.NewReader(body)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		output = bytes.TrimSpace(output)
+		if len(output) > 0 {
+			return fmt.Errorf("%w: %s", err, output)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (n *Notifier) post(body []byte) error {
+	response, err := n.client.Post(n.url.String(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+
+	return nil
+}
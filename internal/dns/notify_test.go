@@ -0,0 +1,153 @@
+package dns
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNotifierTrigger(t *testing.T) {
+	config := &Config{
+		NotifyOn:      []string{verdictBreakGlass, string(FilterCodeDenyExact)},
+		NotifyNames:   []string{"canary.example.com", ".honeypot.example.net"},
+		NotifyCommand: "/bin/true",
+	}
+	notifier := NewNotifier(config, nil)
+
+	tests := []struct {
+		result   workerResult
+		expected string
+	}{
+		{newTestResult("bad.example.com", FilterReason{Code: FilterCodeDenyExact}, FilterReason{Code: FilterCodeDenyQuery}), "DENY_EXACT"},
+		{newTestResult("other.example.com", FilterReason{Code: FilterCodeNoAllowRule}), ""},
+		{newTestResult("Canary.Example.com", FilterReason{Code: FilterCodeAllowExact}), "canary.example.com"},
+		{newTestResult("www.honeypot.example.net"), ".honeypot.example.net"},
+		{newTestResult("honeypot.example.net"), ""},
+	}
+
+	breakGlass := newTestResult("other.net", FilterReason{Code: FilterCodeBreakGlass})
+	breakGlass.allowed = true
+	breakGlass.breakGlass = true
+	tests = append(tests, struct {
+		result   workerResult
+		expected string
+	}{breakGlass, verdictBreakGlass})
+
+	audited := newTestResult("bad.example.com", FilterReason{Code: FilterCodeAllowSuffix})
+	audited.allowed = true
+	audited.audited = true
+	audited.auditReasons = []FilterReason{{Code: FilterCodeDenyExact}}
+	tests = append(tests, struct {
+		result   workerResult
+		expected string
+	}{audited, "DENY_EXACT"})
+
+	for _, test := range tests {
+		trigger, _ := notifier.trigger(test.result)
+		if trigger != test.expected {
+			t.Errorf("%s: expected '%s', got '%s'", test.result.question.Name, test.expected, trigger)
+		}
+	}
+}
+
+func TestNotifierRateLimit(t *testing.T) {
+	config := &Config{
+		NotifyOn:        []string{verdictDeny},
+		NotifyCommand:   "/bin/true",
+		NotifyRateLimit: 2,
+	}
+	notifier := NewNotifier(config, nil)
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+
+	for range 5 {
+		notifier.notify(now, newTestResult("bad.example.com", FilterReason{Code: FilterCodeDenyExact}))
+	}
+
+	if len(notifier.events) != 2 || notifier.Dropped() != 3 {
+		t.Fatalf("expected 2 queued and 3 dropped, got %d and %d", len(notifier.events), notifier.Dropped())
+	}
+
+	<-notifier.events
+	<-notifier.events
+
+	// a token is back after half a minute
+	notifier.notify(now.Add(30*time.Second), newTestResult("bad.example.com", FilterReason{Code: FilterCodeDenyExact}))
+	event := <-notifier.events
+	if event.Dropped != 3 || event.Trigger != verdictDeny || event.Name != "bad.example.com" {
+		t.Errorf("expected the dropped notifications to be reported, got %+v", event)
+	}
+}
+
+func TestNotifierPost(t *testing.T) {
+	events := make(chan notifyEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := notifyEvent{}
+		err := json.NewDecoder(r.Body).Decode(&event)
+		if err != nil || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		events <- event
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{
+		NotifyOn:      []string{string(FilterCodeDenyExact)},
+		NotifyURL:     u,
+		NotifyTimeout: 5 * time.Second,
+	}
+	notifier := NewNotifier(config, nil)
+	notifier.Start()
+
+	notifier.notify(time.Now(), newTestResult("bad.example.com", FilterReason{Code: FilterCodeDenyExact, Value: "bad.example.com", Rule: "bad.example.com"}))
+
+	select {
+	case event := <-events:
+		if event.Client != "192.0.2.10:5300" || event.Verdict != verdictDeny || len(event.ReasonCodes) != 1 || event.ReasonCodes[0] != "DENY_EXACT" || event.Reasons[0] != "deny due to exact denylist: bad.example.com, rule 'bad.example.com'" {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no notification")
+	}
+}
+
+func TestNotifierCommand(t *testing.T) {
+	directory := t.TempDir()
+	output := filepath.Join(directory, "event.json")
+	command := filepath.Join(directory, "notify")
+	err := os.WriteFile(command, []byte("#!/bin/sh\ncat > "+output+"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notifier := NewNotifier(&Config{NotifyCommand: command, NotifyTimeout: 5 * time.Second}, nil)
+	err = notifier.run([]byte(`{"name":"bad.example.com"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(output)
+	if err != nil || string(content) != `{"name":"bad.example.com"}` {
+		t.Errorf("expected the event on stdin, got '%s' %v", content, err)
+	}
+
+	err = os.WriteFile(command, []byte("#!/bin/sh\necho broken >&2\nexit 1\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = notifier.run(nil)
+	if err == nil || err.Error() != "exit status 1: broken" {
+		t.Errorf("expected the output of the failed command, got %v", err)
+	}
+}
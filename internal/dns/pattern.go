@@ -0,0 +1,198 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/tinfoil-factory/netfoil/internal/suffixtrie"
+)
+
+const maxPatternLength = 512
+
+// domainPattern is a wildcard or regular expression rule. Patterns are compiled with regexp, which uses RE2
+// and guarantees matching in time linear in the length of the domain.
+type domainPattern struct {
+	rule  string
+	regex *regexp.Regexp
+}
+
+func matchPatterns(patterns []domainPattern, domain string) (string, bool) {
+	for _, pattern := range patterns {
+		if pattern.regex.MatchString(domain) {
+			return pattern.rule, true
+		}
+	}
+
+	return "", false
+}
+
+// splitWildcards returns the parent domains of the wildcards with a '*' label only in front, e.g. 'example.com' for
+// '*.example.com', which are looked up in a trie instead of matched one by one, and the other wildcards.
+func splitWildcards(wildcards []domainPattern) ([]string, []domainPattern) {
+	parents := make([]string, 0)
+	patterns := make([]domainPattern, 0)
+	for _, wildcard := range wildcards {
+		parent, found := strings.CutPrefix(wildcard.rule, "*.")
+		if found && !strings.Contains(parent, "*") {
+			parents = append(parents, parent)
+		} else {
+			patterns = append(patterns, wildcard)
+		}
+	}
+
+	return parents, patterns
+}
+
+// matchWildcards returns the wildcard rule that matches domain, looking up the parent domain of its first label in
+// parents before matching patterns.
+func matchWildcards(parents *suffixtrie.Node, patterns []domainPattern, domain string) (string, bool) {
+	if parents != nil {
+		label, parent, found := strings.Cut(domain, ".")
+		if found && isWildcardLabel(label) && parents.MatchExact([]byte(parent)) {
+			return "*." + parent, true
+		}
+	}
+
+	return matchPatterns(patterns, domain)
+}
+
+// isWildcardLabel reports whether label is matched by a '*' label, as in compileWildcard.
+func isWildcardLabel(label string) bool {
+	if label == "" {
+		return false
+	}
+
+	for _, c := range []byte(label) {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '_' && c != '-' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// compileWildcard turns a wildcard rule into a regular expression. A '*' label matches exactly one label,
+// e.g. '*.s3.*.amazonaws.com' matches 'bucket.s3.eu-west-1.amazonaws.com'.
+func (p *Policy) compileWildcard(wildcard string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(wildcard, ".") {
+		return nil, fmt.Errorf("unexpected leading '.'")
+	}
+
+	if strings.HasSuffix(wildcard, ".") {
+		return nil, fmt.Errorf("unexpected trailing '.'")
+	}
+
+	if len(wildcard) > 253 {
+		return nil, fmt.Errorf("wildcard is too long: %d", len(wildcard))
+	}
+
+	labels := strings.Split(wildcard, ".")
+	if len(labels) < 2 {
+		return nil, fmt.Errorf("wildcard is not at least two parts")
+	}
+
+	hasWildcard := false
+	hasLabel := false
+	expression := make([]string, 0)
+	for _, label := range labels {
+		if label == "*" {
+			hasWildcard = true
+			expression = append(expression, "[a-z0-9_-]+")
+			continue
+		}
+
+		err := p.labelHasCorrectFormat(label)
+		if err != nil {
+			return nil, err
+		}
+
+		hasLabel = true
+		expression = append(expression, regexp.QuoteMeta(label))
+	}
+
+	if !hasWildcard {
+		return nil, fmt.Errorf("no '*' label, use exact instead")
+	}
+
+	if !hasLabel {
+		return nil, fmt.Errorf("only '*' labels")
+	}
+
+	tld := labels[len(labels)-1]
+	if tld != "*" {
+		_, found := p.knownTLDs[tld]
+		if !found {
+			return nil, fmt.Errorf("not a valid TLD")
+		}
+	}
+
+	return regexp.Compile("^" + strings.Join(expression, `\.`) + "$")
+}
+
+func readAndValidateWildcards(configDirectory string, filename string, policy Policy, sources ruleSources) ([]domainPattern, error) {
+	lines, err := readOptionalConfig(configDirectory, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, 0)
+	patterns := make([]domainPattern, 0)
+	for _, line := range lines {
+		wildcard, scheduleName := cutSchedule(line.text)
+		if strings.TrimSpace(wildcard) != wildcard {
+			errs = append(errs, newConfigError(filename, line.number, "'%s' has leading or trailing whitespace", wildcard))
+			continue
+		}
+
+		regex, err := policy.compileWildcard(wildcard)
+		if err != nil {
+			errs = append(errs, newConfigError(filename, line.number, "'%s': %s", wildcard, err.Error()))
+			continue
+		}
+
+		patterns = append(patterns, domainPattern{rule: wildcard, regex: regex})
+		sources.addScheduled(filename, wildcard, line.number, scheduleName)
+	}
+
+	return patterns, errors.Join(errs...)
+}
+
+func readAndValidateRegexes(configDirectory string, filename string, sources ruleSources) ([]domainPattern, error) {
+	lines, err := readOptionalConfig(configDirectory, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, 0)
+	patterns := make([]domainPattern, 0)
+	for _, line := range lines {
+		expression, scheduleName := cutSchedule(line.text)
+		if strings.TrimSpace(expression) != expression {
+			errs = append(errs, newConfigError(filename, line.number, "'%s' has leading or trailing whitespace", expression))
+			continue
+		}
+
+		if len(expression) > maxPatternLength {
+			errs = append(errs, newConfigError(filename, line.number, "'%s': expression is too long: %d", expression, len(expression)))
+			continue
+		}
+
+		regex, err := regexp.Compile(expression)
+		if err != nil {
+			errs = append(errs, newConfigError(filename, line.number, "'%s': %s", expression, err.Error()))
+			continue
+		}
+
+		if regex.MatchString("") {
+			errs = append(errs, newConfigError(filename, line.number, "'%s': matches the empty string", expression))
+			continue
+		}
+
+		patterns = append(patterns, domainPattern{rule: expression, regex: regex})
+		sources.addScheduled(filename, expression, line.number, scheduleName)
+	}
+
+	return patterns, errors.Join(errs...)
+}
@@ -0,0 +1,161 @@
+package dns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompileWildcard(t *testing.T) {
+	policy := Policy{
+		knownTLDs: map[string]struct{}{
+			"com": {},
+		},
+	}
+
+	regex, err := policy.compileWildcard("*.s3.*.amazonaws.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !regex.MatchString("bucket.s3.eu-west-1.amazonaws.com") {
+		t.Errorf("should match")
+	}
+
+	if regex.MatchString("a.bucket.s3.eu-west-1.amazonaws.com") {
+		t.Errorf("should not match, '*' is a single label")
+	}
+
+	if regex.MatchString("bucket.s3.amazonaws.com") {
+		t.Errorf("should not match")
+	}
+
+	if regex.MatchString("bucket.s3xeu-west-1.amazonaws.com") {
+		t.Errorf("should not match, '.' is literal")
+	}
+
+	_, err = policy.compileWildcard("example.com")
+	expectedErr := "no '*' label, use exact instead"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatalf("expected '%s', got '%v'", expectedErr, err)
+	}
+
+	_, err = policy.compileWildcard("*.*")
+	expectedErr = "only '*' labels"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatalf("expected '%s', got '%v'", expectedErr, err)
+	}
+
+	_, err = policy.compileWildcard("*.example.org")
+	expectedErr = "not a valid TLD"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatalf("expected '%s', got '%v'", expectedErr, err)
+	}
+
+	_, err = policy.compileWildcard("a*.example.com")
+	expectedErr = "illegal characters in label"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatalf("expected '%s', got '%v'", expectedErr, err)
+	}
+}
+
+func TestPatternDenyTakesPrecedence(t *testing.T) {
+	policy := newExplainTestPolicy(t)
+
+	deny, err := policy.compileWildcard("*.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.wildcardsBlock = []domainPattern{{rule: "*.example.com", regex: deny}}
+
+	allow, err := policy.compileWildcard("*.example.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.wildcardsAllow = []domainPattern{{rule: "*.example.net", regex: allow}}
+
+	allowed, reason := policy.domainIsAllowed("www.example.com.")
+	if allowed {
+		t.Errorf("should be denied: %s", reason)
+	}
+
+	expected := "deny due to wildcard denylist: www.example.com, rule '*.example.com'"
+	if reason.String() != expected {
+		t.Errorf("expected '%s', got '%s'", expected, reason)
+	}
+
+	allowed, reason = policy.domainIsAllowed("cdn.example.net.")
+	if !allowed {
+		t.Errorf("should be allowed: %s", reason)
+	}
+}
+
+func TestMissingPatternFiles(t *testing.T) {
+	// a config directory from before wildcards and regexes
+	configDirectory := t.TempDir()
+	writeRuleFiles(t, configDirectory, map[string]string{
+		configFilenameKnownTLDs:  ".com\n",
+		configFilenameSchedules:  "",
+		configFilenameAllowExact: "example.com\n",
+	})
+
+	for _, filename := range []string{configFilenameAllowWildcards, configFilenameDenyWildcards, configFilenameAllowRegexes, configFilenameDenyRegexes} {
+		err := os.Remove(filepath.Join(configDirectory, filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	policy, err := NewPolicy(configDirectory, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed, _ := policy.domainIsAllowed("example.com.")
+	if !allowed {
+		t.Errorf("expected example.com to be allowed")
+	}
+}
+
+func TestWildcardParents(t *testing.T) {
+	configDirectory := t.TempDir()
+	writeRuleFiles(t, configDirectory, map[string]string{
+		configFilenameKnownTLDs:      ".com\n",
+		configFilenameSchedules:      "",
+		configFilenameAllowWildcards: "*.example.com\n*.s3.*.amazonaws.com\n",
+		configFilenameDenyWildcards:  "*.ads.example.com\n",
+	})
+
+	policy, err := NewPolicy(configDirectory, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only true patterns are matched one by one
+	if len(policy.wildcardsAllow) != 1 || len(policy.wildcardsBlock) != 0 {
+		t.Fatalf("expected one allow pattern and no deny pattern, got %d and %d", len(policy.wildcardsAllow), len(policy.wildcardsBlock))
+	}
+
+	tests := []struct {
+		domain   string
+		allowed  bool
+		expected string
+	}{
+		{"www.example.com.", true, "allow due to wildcard allowlist: www.example.com, rule '*.example.com' allow.wildcard:1"},
+		{"bucket.s3.eu-west-1.amazonaws.com.", true, "allow due to wildcard allowlist: bucket.s3.eu-west-1.amazonaws.com, rule '*.s3.*.amazonaws.com' allow.wildcard:2"},
+		{"tracker.ads.example.com.", false, "deny due to wildcard denylist: tracker.ads.example.com, rule '*.ads.example.com' deny.wildcard:1"},
+		{"a.www.example.com.", false, ""},
+		{"example.com.", false, ""},
+	}
+
+	for _, test := range tests {
+		allowed, reason := policy.domainIsAllowed(test.domain)
+		if allowed != test.allowed {
+			t.Errorf("%s: expected %t, got %t: %s", test.domain, test.allowed, allowed, reason)
+		}
+
+		if test.expected != "" && reason.String() != test.expected {
+			t.Errorf("expected '%s', got '%s'", test.expected, reason)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"golang.org/x/sys/unix"
+)
+
+// Client policies bound to a listen address need the destination address of each UDP query, which is only known from
+// the socket address when the socket is bound to a single address.
+
+func enablePacketInfo(conn *net.UDPConn) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var ipv4Err, ipv6Err error
+	err = rawConn.Control(func(fd uintptr) {
+		ipv4Err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_PKTINFO, 1)
+		ipv6Err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_RECVPKTINFO, 1)
+	})
+	if err != nil {
+		return err
+	}
+
+	// only one of them applies to an IPv4 socket
+	if ipv4Err != nil && ipv6Err != nil {
+		return fmt.Errorf("error enabling packet info: %w %w", ipv4Err, ipv6Err)
+	}
+
+	return nil
+}
+
+// packetInfoDestination returns the address a query was sent to from the control messages of a UDP read.
+func packetInfoDestination(oob []byte) (netip.Addr, bool) {
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	for _, message := range messages {
+		if message.Header.Level == unix.IPPROTO_IP && message.Header.Type == unix.IP_PKTINFO && len(message.Data) >= unix.SizeofInet4Pktinfo {
+			// struct in_pktinfo: ifindex, spec_dst, addr
+			addr, _ := netip.AddrFromSlice(message.Data[8:12])
+			return addr, true
+		}
+
+		if message.Header.Level == unix.IPPROTO_IPV6 && message.Header.Type == unix.IPV6_PKTINFO && len(message.Data) >= unix.SizeofInet6Pktinfo {
+			// struct in6_pktinfo: addr, ifindex
+			addr, _ := netip.AddrFromSlice(message.Data[0:16])
+			return addr.Unmap(), true
+		}
+	}
+
+	return netip.Addr{}, false
+}
+
+// packetInfoSource returns the control message that sends a response from the address the query was sent to.
+func packetInfoSource(addr netip.Addr) []byte {
+	if addr.Is4() {
+		return unix.PktInfo4(&unix.Inet4Pktinfo{Spec_dst: addr.As4()})
+	}
+
+	return unix.PktInfo6(&unix.Inet6Pktinfo{Addr: addr.As16()})
+}
+
+func addrFromNetAddr(addr net.Addr) netip.Addr {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.AddrPort().Addr().Unmap()
+	case *net.TCPAddr:
+		return a.AddrPort().Addr().Unmap()
+	}
+
+	return netip.Addr{}
+}
+
+func portFromNetAddr(addr net.Addr) uint16 {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.AddrPort().Port()
+	case *net.TCPAddr:
+		return a.AddrPort().Port()
+	}
+
+	return 0
+}
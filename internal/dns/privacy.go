@@ -0,0 +1,341 @@
+package dns
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinfoil-factory/netfoil/internal/lru"
+)
+
+// Log redaction applies to every log record, whatever the sink, and to the control socket tail, so a query name or
+// client address is only written in full when configured to. dnstap carries DNS messages as they are.
+
+type LogPrivacy string
+
+const (
+	LogPrivacyFull         LogPrivacy = "full"
+	LogPrivacyPseudonymous LogPrivacy = "pseudonymous"
+	LogPrivacyMinimal      LogPrivacy = "minimal"
+)
+
+type LogNames string
+
+const (
+	LogNamesFull        LogNames = "full"
+	LogNamesRegistrable LogNames = "registrable"
+	LogNamesHMAC        LogNames = "hmac"
+)
+
+const (
+	// names counted for LogAllowedLimit, the least recently logged are forgotten first
+	logAllowedLimitNames = 4096
+	logAllowedLimitReset = 24 * time.Hour
+	logNameHMACLength    = 16
+	minLogNameKeyLength  = 32
+)
+
+// defaults of the other privacy settings for each LogPrivacy= level
+var logPrivacyDefaults = map[LogPrivacy]struct {
+	names      LogNames
+	ipv4Prefix uint32
+	ipv6Prefix uint32
+}{
+	LogPrivacyFull:         {LogNamesFull, 32, 128},
+	LogPrivacyPseudonymous: {LogNamesRegistrable, 24, 48},
+	LogPrivacyMinimal:      {LogNamesRegistrable, 0, 0},
+}
+
+type Redactor struct {
+	privacy        LogPrivacy
+	names          LogNames
+	key            []byte
+	publicSuffixes *PublicSuffixList
+	ipv4Prefix     int
+	ipv6Prefix     int
+	allowedLimit   uint32
+
+	mutex         sync.Mutex
+	allowedCounts *lru.Cache[uint32]
+	countsSince   time.Time
+}
+
+// NewRedactor reads the HMAC key and public suffix list of config, so it must be called before system calls are
+// filtered.
+func NewRedactor(config *Config) (*Redactor, error) {
+	redactor := &Redactor{
+		privacy:       config.LogPrivacy,
+		names:         config.LogNames,
+		ipv4Prefix:    int(config.LogClientPrefixIPv4),
+		ipv6Prefix:    int(config.LogClientPrefixIPv6),
+		allowedLimit:  config.LogAllowedLimit,
+		allowedCounts: lru.NewCache[uint32](logAllowedLimitNames),
+		countsSince:   time.Now(),
+	}
+
+	if config.LogNames == LogNamesHMAC {
+		content, err := os.ReadFile(config.LogNameKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", keyLogNameKeyFile, err)
+		}
+
+		key := []byte(strings.TrimSpace(string(content)))
+		if len(key) < minLogNameKeyLength {
+			return nil, fmt.Errorf("%s: key must be at least %d bytes", keyLogNameKeyFile, minLogNameKeyLength)
+		}
+		redactor.key = key
+	}
+
+	if config.PublicSuffixList != "" {
+		publicSuffixes, err := ReadPublicSuffixList(config.PublicSuffixList)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", keyPublicSuffixList, err)
+		}
+		redactor.publicSuffixes = publicSuffixes
+	}
+
+	return redactor, nil
+}
+
+// enabled is false when records are logged as they are.
+func (r *Redactor) enabled() bool {
+	if r == nil {
+		return false
+	}
+
+	return r.privacy != LogPrivacyFull || r.names != LogNamesFull || r.ipv4Prefix < 32 || r.ipv6Prefix < 128 || r.allowedLimit > 0
+}
+
+// keepsNames is false when names are logged hashed or as their registrable domain, whatever LogPrivacy= is.
+func (r *Redactor) keepsNames() bool {
+	return r.privacy == LogPrivacyFull && r.names == LogNamesFull
+}
+
+// keepsClients is false when client addresses are truncated.
+func (r *Redactor) keepsClients() bool {
+	return r.privacy == LogPrivacyFull && r.ipv4Prefix == 32 && r.ipv6Prefix == 128
+}
+
+func (r *Redactor) name(name string) string {
+	if r == nil || name == "" {
+		return name
+	}
+
+	switch r.names {
+	case LogNamesRegistrable:
+		trailingDot := strings.HasSuffix(name, ".")
+		registrable := r.publicSuffixes.RegistrableDomain(strings.ToLower(strings.TrimSuffix(name, ".")))
+		if trailingDot {
+			registrable += "."
+		}
+		return registrable
+	case LogNamesHMAC:
+		mac := hmac.New(sha256.New, r.key)
+		mac.Write([]byte(strings.ToLower(strings.TrimSuffix(name, "."))))
+		return hex.EncodeToString(mac.Sum(nil)[:logNameHMACLength])
+	}
+
+	return name
+}
+
+// client returns the client address or prefix truncated to the configured prefix, without the port unless it is kept
+// in full. It returns an empty string when the client is not logged at all.
+func (r *Redactor) client(client string) string {
+	if r == nil || client == "" || (r.ipv4Prefix == 32 && r.ipv6Prefix == 128) {
+		return client
+	}
+
+	maxBits := 128
+	addr, err := netip.ParseAddr(client)
+	if err != nil {
+		addrPort, err := netip.ParseAddrPort(client)
+		if err == nil {
+			addr = addrPort.Addr()
+		} else {
+			prefix, err := netip.ParsePrefix(client)
+			if err != nil {
+				return ""
+			}
+			addr = prefix.Addr()
+			maxBits = prefix.Bits()
+		}
+	}
+
+	addr = addr.Unmap()
+	bits := r.ipv6Prefix
+	if addr.Is4() {
+		bits = r.ipv4Prefix
+	}
+	bits = min(bits, maxBits)
+
+	if bits == 0 {
+		return ""
+	}
+
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ""
+	}
+
+	return prefix.String()
+}
+
+// reasons drops what follows the first ': ' of each reason, which is the rule or name that matched.
+func (r *Redactor) reasons(reasons []string) []string {
+	if r == nil || r.keepsNames() {
+		return reasons
+	}
+
+	result := make([]string, 0, len(reasons))
+	for _, reason := range reasons {
+		before, _, _ := strings.Cut(reason, ": ")
+		result = append(result, before)
+	}
+
+	return result
+}
+
+func (r *Redactor) answers(answers []logAnswer) []logAnswer {
+	if r == nil || (r.keepsNames() && r.keepsClients()) {
+		return answers
+	}
+
+	// the type, TTL and the redacted names, and addresses only when clients are logged in full
+	result := make([]logAnswer, 0, len(answers))
+	for _, answer := range answers {
+		data := ""
+		if answer.Type == RecordTypeCNAME.Name() {
+			data = r.name(answer.Data)
+		} else if r.keepsClients() && (answer.Type == RecordTypeA.Name() || answer.Type == RecordTypeAAAA.Name()) {
+			data = answer.Data
+		}
+
+		result = append(result, logAnswer{
+			Name: r.name(answer.Name),
+			Type: answer.Type,
+			TTL:  answer.TTL,
+			Data: data,
+		})
+	}
+
+	return result
+}
+
+// logAllowed reports whether an allowed query for the redacted name is logged.
+func (r *Redactor) logAllowed(name string, now time.Time) bool {
+	if r == nil {
+		return true
+	}
+
+	if r.privacy == LogPrivacyMinimal {
+		return false
+	}
+
+	if r.allowedLimit == 0 {
+		return true
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if now.Sub(r.countsSince) >= logAllowedLimitReset {
+		r.allowedCounts.DeleteFunc(func(string) bool { return true })
+		r.countsSince = now
+	}
+
+	count := uint32(0)
+	previous, found := r.allowedCounts.Get(name)
+	if found {
+		count = *previous
+	}
+
+	if count >= r.allowedLimit {
+		return false
+	}
+
+	count++
+	r.allowedCounts.Set(name, &count)
+	return true
+}
+
+// redactingHandler redacts the attributes of records before handing them to the sink.
+type redactingHandler struct {
+	next     slog.Handler
+	redactor *Redactor
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &redactingHandler{next: h.next.WithAttrs(attrs), redactor: h.redactor}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{next: h.next.WithGroup(name), redactor: h.redactor}
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+
+	verdict := ""
+	name := ""
+	record.Attrs(func(attr slog.Attr) bool {
+		value := attr.Value.Resolve()
+		switch attr.Key {
+		case "client":
+			client := h.redactor.client(value.String())
+			if client == "" {
+				return true
+			}
+			attr = slog.String(attr.Key, client)
+		case "name":
+			name = h.redactor.name(value.String())
+			attr = slog.String(attr.Key, name)
+		case "verdict":
+			verdict = value.String()
+		case "reasons", "audit_reasons":
+			reasons, ok := value.Any().([]string)
+			if ok {
+				attr = slog.Any(attr.Key, h.redactor.reasons(reasons))
+			}
+		case "answers":
+			answers, ok := value.Any().([]logAnswer)
+			if ok {
+				attr = slog.Any(attr.Key, h.redactor.answers(answers))
+			}
+		case "events":
+			// free text with client addresses and names
+			if !h.redactor.keepsNames() || !h.redactor.keepsClients() {
+				return true
+			}
+		}
+
+		redacted.AddAttrs(attr)
+		return true
+	})
+
+	now := record.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	if record.Message == logMessageQuery && verdict == verdictAllow && !h.redactor.logAllowed(name, now) {
+		return nil
+	}
+
+	if record.Message == logMessageRecent && verdict == verdictAllow && h.redactor.privacy == LogPrivacyMinimal {
+		return nil
+	}
+
+	return h.next.Handle(ctx, redacted)
+}
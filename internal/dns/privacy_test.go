@@ -0,0 +1,263 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedactorName(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	err := os.WriteFile(keyFile, []byte(strings.Repeat("k", 32)+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registrable, err := NewRedactor(&Config{LogPrivacy: LogPrivacyFull, LogNames: LogNamesRegistrable, LogClientPrefixIPv4: 32, LogClientPrefixIPv6: 128})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if registrable.name("a.b.Example.com.") != "example.com." || registrable.name("example.com") != "example.com" {
+		t.Errorf("unexpected registrable domain '%s'", registrable.name("a.b.Example.com."))
+	}
+
+	hmacRedactor, err := NewRedactor(&Config{LogPrivacy: LogPrivacyFull, LogNames: LogNamesHMAC, LogNameKeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := hmacRedactor.name("www.example.com.")
+	if len(name) != 2*logNameHMACLength || strings.Contains(name, "example") {
+		t.Errorf("unexpected HMAC '%s'", name)
+	}
+
+	if hmacRedactor.name("WWW.example.com") != name || hmacRedactor.name("example.com") == name {
+		t.Errorf("expected the same HMAC for the same name only")
+	}
+
+	err = os.WriteFile(keyFile, []byte("short"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewRedactor(&Config{LogNames: LogNamesHMAC, LogNameKeyFile: keyFile})
+	if err == nil {
+		t.Errorf("expected an error for a short key")
+	}
+}
+
+func TestRedactorClient(t *testing.T) {
+	redactor := &Redactor{ipv4Prefix: 24, ipv6Prefix: 48}
+
+	tests := []struct {
+		client   string
+		expected string
+	}{
+		{"192.0.2.10:5300", "192.0.2.0/24"},
+		{"192.0.2.10", "192.0.2.0/24"},
+		{"[::ffff:192.0.2.10]:53", "192.0.2.0/24"},
+		{"[2001:db8:1:2::1]:5300", "2001:db8:1::/48"},
+		{"192.0.2.0/28", "192.0.2.0/24"},
+		{"2001:db8::/32", "2001:db8::/32"},
+		{"invalid", ""},
+	}
+
+	for _, test := range tests {
+		client := redactor.client(test.client)
+		if client != test.expected {
+			t.Errorf("expected '%s' for '%s', got '%s'", test.expected, test.client, client)
+		}
+	}
+
+	redactor.ipv4Prefix = 0
+	if redactor.client("192.0.2.10:5300") != "" {
+		t.Errorf("expected the client to be dropped")
+	}
+
+	full := &Redactor{ipv4Prefix: 32, ipv6Prefix: 128}
+	if full.client("192.0.2.10:5300") != "192.0.2.10:5300" {
+		t.Errorf("expected the client in full")
+	}
+}
+
+func TestRedactorLogAllowed(t *testing.T) {
+	redactor, err := NewRedactor(&Config{LogPrivacy: LogPrivacyFull, LogNames: LogNamesFull, LogClientPrefixIPv4: 32, LogClientPrefixIPv6: 128, LogAllowedLimit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if !redactor.logAllowed("example.com", now) || !redactor.logAllowed("example.com", now) {
+		t.Errorf("expected the first two queries to be logged")
+	}
+
+	if redactor.logAllowed("example.com", now) {
+		t.Errorf("expected the third query to be dropped")
+	}
+
+	if !redactor.logAllowed("example.org", now) {
+		t.Errorf("expected other names to be counted on their own")
+	}
+
+	if !redactor.logAllowed("example.com", now.Add(logAllowedLimitReset)) {
+		t.Errorf("expected the count to be reset")
+	}
+
+	redactor.privacy = LogPrivacyMinimal
+	if redactor.logAllowed("example.net", now) {
+		t.Errorf("expected no allowed queries to be logged at minimal")
+	}
+}
+
+func TestRedactingHandler(t *testing.T) {
+	config := &Config{
+		LogAllowed:          true,
+		LogDenied:           true,
+		LogLevel:            slog.LevelDebug,
+		LogFormat:           LogFormatJSON,
+		LogPrivacy:          LogPrivacyPseudonymous,
+		LogNames:            LogNamesRegistrable,
+		LogClientPrefixIPv4: 24,
+		LogClientPrefixIPv6: 48,
+	}
+
+	redactor, err := NewRedactor(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := bytes.Buffer{}
+	handler, err := NewConfiguredLogHandler(config, &buffer, redactor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := slog.Default()
+	slog.SetDefault(slog.New(handler))
+	t.Cleanup(func() {
+		slog.SetDefault(previous)
+	})
+
+	logResult(config, newLogTestResult())
+
+	record := struct {
+		Client  string      `json:"client"`
+		Name    string      `json:"name"`
+		Reasons []string    `json:"reasons"`
+		Answers []logAnswer `json:"answers"`
+		Events  []string    `json:"events"`
+	}{}
+
+	err = json.Unmarshal(buffer.Bytes(), &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if record.Client != "192.0.2.0/24" || record.Name != "example.com" || len(record.Events) != 0 {
+		t.Errorf("unexpected record %+v", record)
+	}
+
+	if len(record.Reasons) != 1 || record.Reasons[0] != "allow due to exact allowlist" {
+		t.Errorf("unexpected reasons %v", record.Reasons)
+	}
+
+	if len(record.Answers) != 2 || record.Answers[0] != (logAnswer{Name: "example.com.", Type: "CNAME", TTL: 60, Data: "example.com."}) || record.Answers[1].Data != "" {
+		t.Errorf("unexpected answers %+v", record.Answers)
+	}
+
+	if strings.Contains(buffer.String(), "www.example.com") || strings.Contains(buffer.String(), "192.0.2.1") {
+		t.Errorf("expected no names or addresses in full, got '%s'", buffer.String())
+	}
+
+	buffer.Reset()
+	redactor.privacy = LogPrivacyMinimal
+	logResult(config, newLogTestResult())
+	if buffer.Len() != 0 {
+		t.Errorf("expected no allowed queries at minimal, got '%s'", buffer.String())
+	}
+}
+
+func TestRedactingHandlerHashedNames(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	err := os.WriteFile(keyFile, []byte(strings.Repeat("k", 32)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// names are hashed, while the level and client prefixes keep everything else
+	config := &Config{
+		LogAllowed:          true,
+		LogDenied:           true,
+		LogLevel:            slog.LevelDebug,
+		LogFormat:           LogFormatJSON,
+		LogPrivacy:          LogPrivacyFull,
+		LogNames:            LogNamesHMAC,
+		LogNameKeyFile:      keyFile,
+		LogClientPrefixIPv4: 32,
+		LogClientPrefixIPv6: 128,
+	}
+
+	redactor, err := NewRedactor(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := bytes.Buffer{}
+	handler, err := NewConfiguredLogHandler(config, &buffer, redactor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := slog.Default()
+	slog.SetDefault(slog.New(handler))
+	t.Cleanup(func() {
+		slog.SetDefault(previous)
+	})
+
+	result := newLogTestResult()
+	result.audited = true
+	result.auditReasons = []FilterReason{{Code: FilterCodeDenySuffix, Value: "www.example.com", Rule: "example.com"}}
+	logResult(config, result)
+
+	record := struct {
+		Client       string      `json:"client"`
+		Name         string      `json:"name"`
+		Reasons      []string    `json:"reasons"`
+		AuditReasons []string    `json:"audit_reasons"`
+		Answers      []logAnswer `json:"answers"`
+		Events       []string    `json:"events"`
+	}{}
+
+	err = json.Unmarshal(buffer.Bytes(), &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if record.Client != "192.0.2.10:5300" || record.Name != redactor.name("www.example.com") || len(record.Events) != 0 {
+		t.Errorf("unexpected record %+v", record)
+	}
+
+	if len(record.Reasons) != 1 || record.Reasons[0] != "allow due to exact allowlist" || len(record.AuditReasons) != 1 || record.AuditReasons[0] != "deny due to suffix denylist" {
+		t.Errorf("unexpected reasons %v and %v", record.Reasons, record.AuditReasons)
+	}
+
+	if len(record.Answers) != 2 || record.Answers[0].Data != redactor.name("cdn.example.com.") || record.Answers[1].Data != "192.0.2.1" {
+		t.Errorf("unexpected answers %+v", record.Answers)
+	}
+
+	if strings.Contains(buffer.String(), "example.com") {
+		t.Errorf("expected no names in full, got '%s'", buffer.String())
+	}
+
+	// the audit log and notifications redact reasons the same way
+	reasons := redactor.reasons(reasonStrings(result.auditReasons))
+	if len(reasons) != 1 || strings.Contains(reasons[0], "example.com") {
+		t.Errorf("unexpected reasons %v", reasons)
+	}
+}
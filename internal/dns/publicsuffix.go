@@ -0,0 +1,96 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// PublicSuffixList is the Mozilla Public Suffix List (https://publicsuffix.org/list/public_suffix_list.dat), used to
+// find the registrable domain of a name, e.g. example.co.uk for www.example.co.uk.
+type PublicSuffixList struct {
+	rules      map[string]struct{}
+	wildcards  map[string]struct{}
+	exceptions map[string]struct{}
+}
+
+func ReadPublicSuffixList(path string) (*PublicSuffixList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	list := &PublicSuffixList{
+		rules:      make(map[string]struct{}),
+		wildcards:  make(map[string]struct{}),
+		exceptions: make(map[string]struct{}),
+	}
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		// rules end at the first whitespace
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+			continue
+		}
+
+		rule := strings.ToLower(fields[0])
+		if strings.ContainsFunc(rule, func(r rune) bool { return r > 127 }) {
+			// the punycode form of internationalized rules is not part of the list
+			continue
+		}
+
+		if strings.HasPrefix(rule, "!") {
+			list.exceptions[strings.TrimPrefix(rule, "!")] = struct{}{}
+		} else if strings.HasPrefix(rule, "*.") {
+			list.wildcards[strings.TrimPrefix(rule, "*.")] = struct{}{}
+		} else if strings.Contains(rule, "*") {
+			return nil, fmt.Errorf("%s:%d: unsupported rule '%s'", path, lineNumber, rule)
+		} else {
+			list.rules[rule] = struct{}{}
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// RegistrableDomain returns the public suffix of domain plus one label, or domain when it is a public suffix. Without
+// a list, the public suffix is the last label. The domain is expected without a trailing dot.
+func (l *PublicSuffixList) RegistrableDomain(domain string) string {
+	labels := strings.Split(domain, ".")
+
+	suffixLength := 1
+	if l != nil {
+		for i := range labels {
+			candidate := strings.Join(labels[i:], ".")
+			_, exception := l.exceptions[candidate]
+			if exception {
+				suffixLength = len(labels) - i - 1
+				break
+			}
+
+			_, rule := l.rules[candidate]
+			_, wildcard := l.wildcards[strings.Join(labels[min(i+1, len(labels)):], ".")]
+			if rule || (wildcard && i+1 < len(labels)) {
+				suffixLength = len(labels) - i
+				break
+			}
+		}
+	}
+
+	if suffixLength >= len(labels) {
+		return domain
+	}
+
+	return strings.Join(labels[len(labels)-suffixLength-1:], ".")
+}
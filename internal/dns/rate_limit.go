@@ -0,0 +1,268 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Queries are limited per client prefix with ClientRateLimit=, before they reach a worker, and identical UDP
+// responses to a client prefix with ResponseRateLimit=, so netfoil cannot be used to flood a spoofed address. A
+// limited query is dropped, except every ResponseRateSlip=th limited response, which is sent truncated so a real
+// client retries over TCP.
+
+const (
+	rateLimitClient   = "client"
+	rateLimitResponse = "response"
+
+	logMessageRateLimited = "queries rate limited"
+
+	// buckets tracked at once per limit, queries of other clients share one more bucket
+	rateLimitMaxKeys    = 16384
+	rateLimitFlushEvery = 10 * time.Second
+)
+
+type rateLimitKey struct {
+	client     netip.Prefix
+	name       string
+	recordType RecordType
+	rcode      ResponseCode
+}
+
+// rateLimitOverflow is the key of the bucket shared by all keys once rateLimitMaxKeys are tracked, so filling the
+// buckets with spoofed prefixes or random names does not lift the limit.
+var rateLimitOverflow = rateLimitKey{}
+
+type tokenBucket struct {
+	tokens  float64
+	last    time.Time
+	limited int64
+	slipped int64
+}
+
+type rateLimiter struct {
+	limit      string
+	rate       float64
+	burst      float64
+	ipv4Prefix int
+	ipv6Prefix int
+	slip       uint32
+
+	mutex   sync.Mutex
+	buckets map[rateLimitKey]*tokenBucket
+
+	limited atomic.Uint64
+	slipped atomic.Uint64
+}
+
+// newClientRateLimiter returns the limit on queries per client prefix of config, or nil when there is none.
+func newClientRateLimiter(config *Config) *rateLimiter {
+	if config.ClientRateLimit == 0 {
+		return nil
+	}
+
+	return newRateLimiter(rateLimitClient, config.ClientRateLimit, config.ClientRateBurst, config, 0)
+}
+
+// newResponseRateLimiter returns the limit on identical responses per client prefix of config, or nil when there is
+// none.
+func newResponseRateLimiter(config *Config) *rateLimiter {
+	if config.ResponseRateLimit == 0 {
+		return nil
+	}
+
+	return newRateLimiter(rateLimitResponse, config.ResponseRateLimit, config.ResponseRateLimit, config, config.ResponseRateSlip)
+}
+
+func newRateLimiter(limit string, rate uint32, burst uint32, config *Config, slip uint32) *rateLimiter {
+	return &rateLimiter{
+		limit:      limit,
+		rate:       float64(rate),
+		burst:      float64(burst),
+		ipv4Prefix: int(config.ClientRatePrefixIPv4),
+		ipv6Prefix: int(config.ClientRatePrefixIPv6),
+		slip:       slip,
+		buckets:    make(map[rateLimitKey]*tokenBucket),
+	}
+}
+
+// start logs the queries that were limited and forgets the buckets that are full again.
+func (l *rateLimiter) start() {
+	if l == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(rateLimitFlushEvery)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			for _, attrs := range l.flush(now) {
+				slog.LogAttrs(context.Background(), slog.LevelWarn, logMessageRateLimited, attrs...)
+			}
+		}
+	}()
+}
+
+// Limited returns the number of queries dropped or truncated by the limit.
+func (l *rateLimiter) Limited() uint64 {
+	return l.limited.Load()
+}
+
+// Slipped returns the number of limited responses that were sent truncated.
+func (l *rateLimiter) Slipped() uint64 {
+	return l.slipped.Load()
+}
+
+// allowClient takes a token for a query from client.
+func (l *rateLimiter) allowClient(now time.Time, client netip.Addr) bool {
+	if l == nil {
+		return true
+	}
+
+	allowed, _ := l.take(now, rateLimitKey{client: l.prefix(client)})
+	return allowed
+}
+
+// limitResponse returns the UDP response to send for result: as it is, truncated when a limited response slips, or
+// nil when it is dropped.
+func (l *rateLimiter) limitResponse(now time.Time, result workerResult) []byte {
+	response := result.marshalledResponse
+	if l == nil || len(response) < headerLength {
+		return response
+	}
+
+	key := rateLimitKey{
+		client: l.prefix(addrFromNetAddr(result.remote)),
+		rcode:  UnmarshalFlags(binary.BigEndian.Uint16(response[2:4])).RCODE,
+	}
+	if result.question != nil {
+		key.name = strings.ToLower(result.question.Name)
+		key.recordType = result.question.Type
+	}
+
+	allowed, slip := l.take(now, key)
+	if allowed {
+		return response
+	}
+
+	if !slip || result.question == nil {
+		return nil
+	}
+
+	truncated, err := marshalTruncated(response, *result.question)
+	if err != nil {
+		slog.Error("failed to marshal truncated response", "error", err.Error())
+		return nil
+	}
+
+	return truncated
+}
+
+// prefix returns the prefix of client that shares a bucket.
+func (l *rateLimiter) prefix(client netip.Addr) netip.Prefix {
+	bits := l.ipv6Prefix
+	if client.Is4() {
+		bits = l.ipv4Prefix
+	}
+
+	prefix, err := client.Prefix(bits)
+	if err != nil {
+		return netip.Prefix{}
+	}
+
+	return prefix
+}
+
+// take takes a token from the bucket of key, where a bucket holds the burst and is refilled at the rate per second. A
+// limited query slips every slip times.
+func (l *rateLimiter) take(now time.Time, key rateLimitKey) (allowed bool, slip bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	bucket, found := l.buckets[key]
+	if !found && len(l.buckets) >= rateLimitMaxKeys {
+		key = rateLimitOverflow
+		bucket, found = l.buckets[key]
+	}
+	if !found {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+
+	if now.After(bucket.last) {
+		bucket.tokens = min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+		bucket.last = now
+	}
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, false
+	}
+
+	bucket.limited++
+	l.limited.Add(1)
+
+	if l.slip > 0 && bucket.limited%int64(l.slip) == 0 {
+		bucket.slipped++
+		l.slipped.Add(1)
+		return false, true
+	}
+
+	return false, false
+}
+
+// flush returns the attributes of a record for each bucket with limited queries since the last flush, and removes the
+// buckets that are full again.
+func (l *rateLimiter) flush(now time.Time) [][]slog.Attr {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	records := make([][]slog.Attr, 0)
+	for key, bucket := range l.buckets {
+		if bucket.limited > 0 {
+			attrs := []slog.Attr{
+				slog.String("limit", l.limit),
+				slog.String("client", rateLimitClientString(key.client)),
+			}
+			if l.limit == rateLimitResponse {
+				attrs = append(attrs,
+					slog.String("name", strings.TrimSuffix(key.name, ".")),
+					slog.String("type", key.recordType.Name()),
+					slog.String("rcode", key.rcode.Name()),
+					slog.Int64("slipped", bucket.slipped),
+				)
+			}
+			attrs = append(attrs, slog.Int64("count", bucket.limited))
+			records = append(records, attrs)
+
+			bucket.limited = 0
+			bucket.slipped = 0
+		}
+
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+
+	return records
+}
+
+// rateLimitClientString returns a single address without the prefix length, so it is redacted like any client, and
+// "other" for the bucket shared once the buckets are full.
+func rateLimitClientString(prefix netip.Prefix) string {
+	if !prefix.IsValid() {
+		return "other"
+	}
+
+	if prefix.IsSingleIP() {
+		return prefix.Addr().String()
+	}
+
+	return prefix.String()
+}
@@ -0,0 +1,172 @@
+package dns
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestClientRateLimit(t *testing.T) {
+	config := &Config{
+		ClientRateLimit:      2,
+		ClientRateBurst:      3,
+		ClientRatePrefixIPv4: 24,
+		ClientRatePrefixIPv6: 64,
+	}
+	limiter := newClientRateLimiter(config)
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+
+	allowed := 0
+	for i := range 5 {
+		// same /24, so one bucket
+		client := netip.AddrFrom4([4]byte{192, 0, 2, byte(10 + i)})
+		if limiter.allowClient(now, client) {
+			allowed++
+		}
+	}
+
+	if allowed != 3 || limiter.Limited() != 2 {
+		t.Fatalf("expected the burst of 3 allowed and 2 limited, got %d and %d", allowed, limiter.Limited())
+	}
+
+	if !limiter.allowClient(now, netip.MustParseAddr("198.51.100.1")) {
+		t.Errorf("expected another prefix to have its own bucket")
+	}
+
+	// refilled at 2 per second
+	now = now.Add(time.Second)
+	if !limiter.allowClient(now, netip.MustParseAddr("192.0.2.10")) || !limiter.allowClient(now, netip.MustParseAddr("192.0.2.10")) {
+		t.Errorf("expected two tokens after a second")
+	}
+
+	if limiter.allowClient(now, netip.MustParseAddr("192.0.2.10")) {
+		t.Errorf("expected the bucket to be empty")
+	}
+
+	if !newClientRateLimiter(&Config{}).allowClient(now, netip.MustParseAddr("192.0.2.10")) {
+		t.Errorf("expected no limit without ClientRateLimit=")
+	}
+}
+
+func TestClientRateLimitFull(t *testing.T) {
+	config := &Config{
+		ClientRateLimit:      1,
+		ClientRateBurst:      2,
+		ClientRatePrefixIPv4: 32,
+		ClientRatePrefixIPv6: 128,
+	}
+	limiter := newClientRateLimiter(config)
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+
+	// e.g. spoofed source addresses
+	for i := range rateLimitMaxKeys {
+		client := netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, 14: byte(i >> 8), 15: byte(i)})
+		if !limiter.allowClient(now, client) {
+			t.Fatalf("expected the first query of %s to be allowed", client)
+		}
+	}
+
+	allowed := 0
+	for i := range 5 {
+		client := netip.AddrFrom4([4]byte{198, 51, 100, byte(i)})
+		if limiter.allowClient(now, client) {
+			allowed++
+		}
+	}
+
+	if allowed != 2 {
+		t.Errorf("expected new clients to share the burst of 2 once the buckets are full, got %d allowed", allowed)
+	}
+}
+
+func TestResponseRateLimitSlip(t *testing.T) {
+	config := &Config{
+		ResponseRateLimit:    1,
+		ResponseRateSlip:     2,
+		ClientRatePrefixIPv4: 32,
+		ClientRatePrefixIPv6: 64,
+	}
+	limiter := newResponseRateLimiter(config)
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+
+	question := Question{Name: "example.com.", Type: RecordTypeA}
+	response, err := MarshalServerFailure(&Request{TransactionID: 4711, Question: question})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := workerResult{
+		remote:             &net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 5300},
+		question:           &question,
+		marshalledResponse: response,
+	}
+
+	sent := make([][]byte, 0)
+	for range 5 {
+		sent = append(sent, limiter.limitResponse(now, result))
+	}
+
+	if len(sent[0]) != len(response) {
+		t.Fatalf("expected the first response as it is")
+	}
+
+	// limited responses alternate between dropped and truncated
+	if sent[1] != nil || sent[2] == nil || sent[3] != nil || sent[4] == nil {
+		t.Fatalf("expected every second limited response to slip, got %v", sent)
+	}
+
+	if limiter.Limited() != 4 || limiter.Slipped() != 2 {
+		t.Errorf("expected 4 limited and 2 slipped, got %d and %d", limiter.Limited(), limiter.Slipped())
+	}
+
+	truncated := sent[2]
+	flags := UnmarshalFlags(binary.BigEndian.Uint16(truncated[2:4]))
+	if binary.BigEndian.Uint16(truncated[0:2]) != 4711 || !flags.TC || flags.RCODE != ResponseCodeServFail {
+		t.Errorf("expected a truncated response with the same ID and code, got %+v", flags)
+	}
+
+	// another name is another response
+	other := Question{Name: "example.net.", Type: RecordTypeA}
+	result.question = &other
+	if limiter.limitResponse(now, result) == nil {
+		t.Errorf("expected a response for another name")
+	}
+}
+
+func TestRateLimitFlush(t *testing.T) {
+	config := &Config{
+		ClientRateLimit:      1,
+		ClientRateBurst:      1,
+		ClientRatePrefixIPv4: 32,
+		ClientRatePrefixIPv6: 64,
+	}
+	limiter := newClientRateLimiter(config)
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+
+	for range 3 {
+		limiter.allowClient(now, netip.MustParseAddr("192.0.2.10"))
+	}
+	limiter.allowClient(now, netip.MustParseAddr("192.0.2.11"))
+
+	records := limiter.flush(now)
+	if len(records) != 1 {
+		t.Fatalf("expected one record, got %d", len(records))
+	}
+
+	attrs := make(map[string]string)
+	for _, attr := range records[0] {
+		attrs[attr.Key] = attr.Value.String()
+	}
+
+	if attrs["limit"] != rateLimitClient || attrs["client"] != "192.0.2.10" || attrs["count"] != "2" {
+		t.Errorf("unexpected record %v", attrs)
+	}
+
+	// full again after a second, and forgotten
+	records = limiter.flush(now.Add(time.Second))
+	if len(records) != 0 || len(limiter.buckets) != 0 {
+		t.Errorf("expected no records and no buckets, got %d and %d", len(records), len(limiter.buckets))
+	}
+}
@@ -0,0 +1,178 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecentQueries keeps the last queries with their events, filter reasons and answers whatever the log level, to look
+// at after a problem is reported without running at LogLevel=debug.
+type RecentQueries struct {
+	mutex   sync.Mutex
+	entries []recentQuery
+	next    int
+	full    bool
+}
+
+type recentQuery struct {
+	time   time.Time
+	result workerResult
+}
+
+// RecentQueryFilter selects recent queries, where empty fields match every query.
+type RecentQueryFilter struct {
+	// client address, or a prefix like 192.0.2.0/24
+	Client string
+	// name and the names below it
+	Name    string
+	Verdict string
+}
+
+// NewRecentQueries returns a buffer of the last size queries, or nil when size is 0.
+func NewRecentQueries(size uint32) *RecentQueries {
+	if size == 0 {
+		return nil
+	}
+
+	return &RecentQueries{
+		entries: make([]recentQuery, size),
+	}
+}
+
+func (r *RecentQueries) add(now time.Time, result workerResult) {
+	if r == nil || result.question == nil {
+		return
+	}
+
+	// only what is needed to show the query
+	result.remote = nil
+	result.marshalledResponse = nil
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.entries[r.next] = recentQuery{time: now, result: result}
+	r.next++
+	if r.next == len(r.entries) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// find returns the queries matching filter, the oldest first.
+func (r *RecentQueries) find(filter RecentQueryFilter) ([]recentQuery, error) {
+	if r == nil {
+		return nil, fmt.Errorf("recent queries are not kept, RecentQueries=0")
+	}
+
+	var prefix netip.Prefix
+	if filter.Client != "" {
+		var err error
+		prefix, err = parseClientPrefix(filter.Client)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client '%s'", filter.Client)
+		}
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(filter.Name, "."))
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	start := 0
+	count := r.next
+	if r.full {
+		start = r.next
+		count = len(r.entries)
+	}
+
+	result := make([]recentQuery, 0)
+	for i := range count {
+		entry := r.entries[(start+i)%len(r.entries)]
+
+		if prefix.IsValid() && !prefix.Contains(clientAddr(entry.result.client)) {
+			continue
+		}
+
+		if name != "" {
+			queryName := strings.ToLower(strings.TrimSuffix(entry.result.question.Name, "."))
+			if queryName != name && !strings.HasSuffix(queryName, "."+name) {
+				continue
+			}
+		}
+
+		if filter.Verdict != "" && entry.result.verdict() != filter.Verdict {
+			continue
+		}
+
+		result = append(result, entry)
+	}
+
+	return result, nil
+}
+
+// Dump writes every recent query to handler as a record at info level.
+func (r *RecentQueries) Dump(handler slog.Handler) error {
+	entries, err := r.find(RecentQueryFilter{})
+	if err != nil {
+		return err
+	}
+
+	return writeRecentQueries(handler, entries)
+}
+
+func writeRecentQueries(handler slog.Handler, entries []recentQuery) error {
+	for _, entry := range entries {
+		record := slog.NewRecord(entry.time, slog.LevelInfo, logMessageRecent, 0)
+		record.AddAttrs(queryAttrs(entry.result, true)...)
+
+		err := handler.Handle(context.Background(), record)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recentQueryLines returns the recent queries matching filter in the text log format, redacted by redactor.
+func (r *RecentQueries) recentQueryLines(filter RecentQueryFilter, redactor *Redactor) ([]string, error) {
+	entries, err := r.find(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := bytes.Buffer{}
+	var handler slog.Handler = NewLogHandler(&buffer, LogFormatText, slog.LevelDebug)
+	if redactor.enabled() {
+		handler = &redactingHandler{next: handler, redactor: redactor}
+	}
+
+	err = writeRecentQueries(handler, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	if buffer.Len() == 0 {
+		return nil, nil
+	}
+
+	return strings.Split(strings.TrimSuffix(buffer.String(), "\n"), "\n"), nil
+}
+
+// clientAddr returns the address of a client, which is an address and port.
+func clientAddr(client string) netip.Addr {
+	addrPort, err := netip.ParseAddrPort(client)
+	if err != nil {
+		addr, _ := netip.ParseAddr(client)
+		return addr.Unmap()
+	}
+
+	return addrPort.Addr().Unmap()
+}
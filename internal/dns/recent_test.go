@@ -0,0 +1,138 @@
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecentQueries(t *testing.T) {
+	recent := NewRecentQueries(3)
+	now := time.Now()
+
+	for i := range 5 {
+		result := newTestResult(fmt.Sprintf("%d.example.com", i))
+		result.client = fmt.Sprintf("192.0.2.%d:5300", i)
+		result.allowed = i%2 == 0
+		result.marshalledResponse = []byte("response")
+		recent.add(now.Add(time.Duration(i)*time.Second), result)
+	}
+
+	// a result without a question, e.g. an invalid request
+	recent.add(now, workerResult{err: errors.New("invalid request")})
+
+	entries, err := recent.find(RecentQueryFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 3 || entries[0].result.question.Name != "2.example.com." || entries[2].result.question.Name != "4.example.com." {
+		t.Fatalf("expected the last 3 queries, the oldest first, got %v", entries)
+	}
+
+	if entries[0].result.marshalledResponse != nil {
+		t.Errorf("expected the marshalled response to be dropped")
+	}
+
+	tests := []struct {
+		filter   RecentQueryFilter
+		expected int
+	}{
+		{RecentQueryFilter{Client: "192.0.2.3"}, 1},
+		{RecentQueryFilter{Client: "192.0.2.0/24"}, 3},
+		{RecentQueryFilter{Client: "2001:db8::/32"}, 0},
+		{RecentQueryFilter{Name: "example.com"}, 3},
+		{RecentQueryFilter{Name: "4.Example.com."}, 1},
+		{RecentQueryFilter{Name: "xample.com"}, 0},
+		{RecentQueryFilter{Verdict: verdictDeny}, 1},
+		{RecentQueryFilter{Verdict: verdictAllow, Client: "192.0.2.4"}, 1},
+	}
+
+	for _, test := range tests {
+		entries, err = recent.find(test.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(entries) != test.expected {
+			t.Errorf("expected %d queries for %+v, got %d", test.expected, test.filter, len(entries))
+		}
+	}
+
+	_, err = recent.find(RecentQueryFilter{Client: "192.0.2.1/24"})
+	if err == nil {
+		t.Errorf("expected an error for an invalid client")
+	}
+
+	var disabled *RecentQueries
+	disabled.add(now, newTestResult("example.com"))
+	_, err = disabled.find(RecentQueryFilter{})
+	if err == nil {
+		t.Errorf("expected an error when recent queries are not kept")
+	}
+}
+
+func TestRecentQueriesDump(t *testing.T) {
+	recent := NewRecentQueries(10)
+	queryTime := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+
+	failed := newLogTestResult()
+	failed.allowed = false
+	failed.err = errors.New("upstream timeout")
+	recent.add(queryTime, failed)
+
+	// at info level, recent queries are still written with the debug block
+	buffer := bytes.Buffer{}
+	err := recent.Dump(NewLogHandler(&buffer, LogFormatText, slog.LevelInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `recent 2026-10-19T10:00:00Z 192.0.2.10:5300 error|www.example.com|A
+result
+  query from: 192.0.2.10:5300 [UDP]
+  filter
+    allow due to exact allowlist: www.example.com, rule 'www.example.com'
+  cache hit: true, external request: false, pinned: false, audited: false, break-glass: false
+  response [NoError]
+    name: www.example.com.
+      type: CNAME
+      TTL: 60
+      CNAME: cdn.example.com.
+    name: cdn.example.com.
+      type: A
+      TTL: 60
+      IPv4: 192.0.2.1
+  error: upstream timeout
+  time: 0.020000
+`
+	if buffer.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, buffer.String())
+	}
+
+	// already logged when they were answered, so not read again by netfoil learn
+	queryLog := NewQueryLog()
+	err = queryLog.Read(strings.NewReader("Oct 19 10:00:00 host netfoil[1]: " + strings.ReplaceAll(buffer.String(), "error|", "deny|") + "deny|other.example.com|A\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(queryLog.denied) != 1 || queryLog.denied["other.example.com"] != 1 || len(queryLog.pairs) != 0 {
+		t.Errorf("expected only the query after the recent queries, got %v %v", queryLog.denied, queryLog.pairs)
+	}
+
+	redactor := &Redactor{privacy: LogPrivacyPseudonymous, names: LogNamesRegistrable, ipv4Prefix: 24, ipv6Prefix: 48}
+	lines, err := recent.recentQueryLines(RecentQueryFilter{Verdict: verdictError}, redactor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := strings.Join(lines, "\n")
+	if !strings.HasPrefix(output, "recent 2026-10-19T10:00:00Z 192.0.2.0/24 error|example.com|A\nresult\n  filter\n") || strings.Contains(output, "www.example.com") {
+		t.Errorf("expected redacted queries, got\n%s", output)
+	}
+}
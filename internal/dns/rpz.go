@@ -0,0 +1,512 @@
+package dns
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Response Policy Zones https://datatracker.ietf.org/doc/html/draft-vixie-dnsop-dns-rpz
+
+const configDirectoryRPZ = "rpz.d"
+
+type rpzAction int
+
+const (
+	rpzActionNXDomain rpzAction = iota
+	rpzActionNoData
+	rpzActionPassthru
+	rpzActionDrop
+	rpzActionLocalData
+)
+
+func (a rpzAction) Name() string {
+	switch a {
+	case rpzActionNXDomain:
+		return "NXDOMAIN"
+	case rpzActionNoData:
+		return "NODATA"
+	case rpzActionPassthru:
+		return "PASSTHRU"
+	case rpzActionDrop:
+		return "DROP"
+	case rpzActionLocalData:
+		return "local-data"
+	default:
+		return strconv.Itoa(int(a))
+	}
+}
+
+type rpzRule struct {
+	trigger   string
+	action    rpzAction
+	localData []Answer
+	source    ruleSource
+}
+
+type rpzIPRule struct {
+	prefix netip.Prefix
+	rule   *rpzRule
+}
+
+type rpzZone struct {
+	qnames      map[string]*rpzRule
+	wildcards   map[string]*rpzRule
+	responseIPs []rpzIPRule
+}
+
+// rpzVerdict is what an RPZ trigger does to a query. The response is nil when the action is DROP or PASSTHRU.
+type rpzVerdict struct {
+	action   rpzAction
+	response *Response
+	reason   FilterReason
+}
+
+func (p *Policy) rpzQuery(question *Question) (*rpzVerdict, bool) {
+	domain := strings.TrimSuffix(question.Name, ".")
+
+	for _, zone := range p.rpzZones {
+		rule, found := zone.qnames[domain]
+		if !found {
+			labels := strings.Split(domain, ".")
+			for i := 1; i < len(labels) && !found; i++ {
+				rule, found = zone.wildcards[strings.Join(labels[i:], ".")]
+			}
+		}
+
+		if found {
+			return rule.verdict(question, rule.reason(FilterCodeRPZQName, domain)), true
+		}
+	}
+
+	return nil, false
+}
+
+func (p *Policy) rpzResponse(question *Question, response *Response) (*rpzVerdict, bool) {
+	ips := make([]net.IP, 0)
+	for _, answer := range response.Answers {
+		switch answer.Type {
+		case RecordTypeA:
+			ips = append(ips, answer.IPv4)
+		case RecordTypeAAAA:
+			ips = append(ips, answer.IPv6)
+		case RecordTypeHTTPS:
+			ips = append(ips, answer.HTTPSRecord.IPv4Hint...)
+			ips = append(ips, answer.HTTPSRecord.IPv6Hint...)
+		}
+	}
+
+	for _, zone := range p.rpzZones {
+		for _, ip := range ips {
+			addr, ok := netip.AddrFromSlice(ip)
+			if !ok {
+				continue
+			}
+			addr = addr.Unmap()
+
+			for _, ipRule := range zone.responseIPs {
+				if ipRule.prefix.Contains(addr) {
+					rule := ipRule.rule
+					return rule.verdict(question, rule.reason(FilterCodeRPZResponseIP, addr.String())), true
+				}
+			}
+		}
+	}
+
+	return nil, false
+}
+
+func (r *rpzRule) reason(code FilterCode, value string) FilterReason {
+	return FilterReason{
+		Code:   code,
+		Value:  value,
+		Rule:   r.trigger,
+		Source: fmt.Sprintf("%s:%d", r.source.filename, r.source.line),
+		Detail: r.action.Name(),
+	}
+}
+
+func (r *rpzRule) verdict(question *Question, reason FilterReason) *rpzVerdict {
+	verdict := &rpzVerdict{
+		action: r.action,
+		reason: reason,
+	}
+
+	switch r.action {
+	case rpzActionNXDomain:
+		verdict.response = generateBlockResponse()
+	case rpzActionNoData:
+		verdict.response = generateNoDataResponse()
+	case rpzActionLocalData:
+		response := generateNoDataResponse()
+		for _, answer := range r.localData {
+			if answer.Type == question.Type {
+				answer.Name = question.Name
+				response.Answers = append(response.Answers, answer)
+			}
+		}
+		verdict.response = response
+	}
+
+	return verdict
+}
+
+func readRPZZones(configDirectory string, directory string, policy Policy) ([]*rpzZone, error) {
+	entries, err := os.ReadDir(filepath.Join(configDirectory, directory))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, &ConfigError{Filename: directory, Err: err}
+	}
+
+	errs := make([]error, 0)
+	zones := make([]*rpzZone, 0)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		filename := filepath.Join(directory, entry.Name())
+		if entry.IsDir() {
+			errs = append(errs, newConfigError(filename, 0, "unexpected directory"))
+			continue
+		}
+
+		zone, err := readRPZZone(configDirectory, filename, policy)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		zones = append(zones, zone)
+	}
+
+	return zones, errors.Join(errs...)
+}
+
+type rpzRecord struct {
+	line       int
+	owner      string
+	recordType string
+	data       []string
+}
+
+func readRPZZone(configDirectory string, filename string, policy Policy) (*rpzZone, error) {
+	records, err := readZoneFile(configDirectory, filename)
+	if records == nil {
+		return nil, err
+	}
+
+	zone := &rpzZone{
+		qnames:      make(map[string]*rpzRule),
+		wildcards:   make(map[string]*rpzRule),
+		responseIPs: make([]rpzIPRule, 0),
+	}
+
+	errs := []error{err}
+	rules := make(map[string]*rpzRule)
+	for _, record := range records {
+		if record.owner == "" || record.recordType == "SOA" || record.recordType == "NS" {
+			continue
+		}
+
+		rule, found := rules[record.owner]
+		if !found {
+			rule = &rpzRule{
+				trigger: record.owner,
+				action:  rpzActionLocalData,
+				source:  ruleSource{filename: filename, line: record.line},
+			}
+		}
+
+		err := rule.addRecord(record)
+		if err != nil {
+			errs = append(errs, newConfigError(filename, record.line, "'%s': %s", record.owner, err.Error()))
+			continue
+		}
+
+		if found {
+			continue
+		}
+		rules[record.owner] = rule
+
+		err = zone.addTrigger(record.owner, rule, policy)
+		if err != nil {
+			errs = append(errs, newConfigError(filename, record.line, "'%s': %s", record.owner, err.Error()))
+		}
+	}
+
+	return zone, errors.Join(errs...)
+}
+
+func (r *rpzRule) addRecord(record rpzRecord) error {
+	if r.action != rpzActionLocalData || (record.recordType == "CNAME" && len(r.localData) > 0) {
+		return fmt.Errorf("conflicting records for the same trigger")
+	}
+
+	switch record.recordType {
+	case "CNAME":
+		if len(record.data) != 1 {
+			return fmt.Errorf("expected 'CNAME <target>'")
+		}
+
+		switch record.data[0] {
+		case ".":
+			r.action = rpzActionNXDomain
+		case "*.":
+			r.action = rpzActionNoData
+		case "rpz-passthru.":
+			r.action = rpzActionPassthru
+		case "rpz-drop.":
+			r.action = rpzActionDrop
+		default:
+			return fmt.Errorf("unsupported CNAME target '%s', only ., *., rpz-passthru. and rpz-drop. are supported", record.data[0])
+		}
+	case "A":
+		ip := net.ParseIP(strings.Join(record.data, "")).To4()
+		if len(record.data) != 1 || ip == nil {
+			return fmt.Errorf("invalid A record")
+		}
+
+		r.localData = append(r.localData, Answer{Type: RecordTypeA, Class: ClassTypeIN, TTL: defaultTTL, IPv4: ip})
+	case "AAAA":
+		ip := net.ParseIP(strings.Join(record.data, ""))
+		if len(record.data) != 1 || ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid AAAA record")
+		}
+
+		r.localData = append(r.localData, Answer{Type: RecordTypeAAAA, Class: ClassTypeIN, TTL: defaultTTL, IPv6: ip})
+	default:
+		return fmt.Errorf("unsupported record type '%s'", record.recordType)
+	}
+
+	return nil
+}
+
+func (z *rpzZone) addTrigger(trigger string, rule *rpzRule, policy Policy) error {
+	for _, unsupported := range []string{".rpz-nsdname", ".rpz-nsip", ".rpz-client-ip"} {
+		if strings.HasSuffix(trigger, unsupported) {
+			return fmt.Errorf("%s triggers are not supported", strings.TrimPrefix(unsupported, "."))
+		}
+	}
+
+	ipTrigger, found := strings.CutSuffix(trigger, ".rpz-ip")
+	if found {
+		if rule.action == rpzActionLocalData {
+			return fmt.Errorf("local-data is not supported for response IP triggers")
+		}
+
+		prefix, err := parseRPZIPTrigger(ipTrigger)
+		if err != nil {
+			return err
+		}
+
+		z.responseIPs = append(z.responseIPs, rpzIPRule{prefix: prefix, rule: rule})
+		return nil
+	}
+
+	wildcard, found := strings.CutPrefix(trigger, "*.")
+	if found {
+		err := policy.domainHasCorrectFormat(wildcard)
+		if err != nil {
+			return err
+		}
+
+		z.wildcards[wildcard] = rule
+		return nil
+	}
+
+	err := policy.domainHasCorrectFormat(trigger)
+	if err != nil {
+		return err
+	}
+
+	z.qnames[trigger] = rule
+	return nil
+}
+
+// parseRPZIPTrigger parses '<prefix length>.<reversed address>', e.g. '24.0.2.0.192' for 192.0.2.0/24 and
+// '48.zz.db8.2001' for 2001:db8::/48.
+func parseRPZIPTrigger(trigger string) (netip.Prefix, error) {
+	labels := strings.Split(trigger, ".")
+	if len(labels) < 2 {
+		return netip.Prefix{}, fmt.Errorf("invalid response IP trigger")
+	}
+
+	bits, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid response IP trigger prefix length '%s'", labels[0])
+	}
+
+	address := labels[1:]
+	slices.Reverse(address)
+
+	var addr netip.Addr
+	if len(address) == 4 && !slices.Contains(address, "zz") {
+		addr, err = netip.ParseAddr(strings.Join(address, "."))
+	} else {
+		expanded := strings.Replace(strings.Join(address, ":"), "zz", "", 1)
+		if expanded == "" {
+			expanded = "::"
+		} else if strings.HasPrefix(expanded, ":") {
+			expanded = ":" + expanded
+		} else if strings.HasSuffix(expanded, ":") {
+			expanded = expanded + ":"
+		}
+		addr, err = netip.ParseAddr(expanded)
+		if err == nil && !addr.Is6() {
+			err = fmt.Errorf("not IPv6")
+		}
+	}
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid response IP trigger address '%s'", strings.Join(labels[1:], "."))
+	}
+
+	prefix, err := addr.Prefix(bits)
+	if err != nil || prefix.Addr() != addr {
+		return netip.Prefix{}, fmt.Errorf("invalid response IP trigger prefix length %d", bits)
+	}
+
+	return prefix, nil
+}
+
+// readZoneFile reads the subset of the master file format (RFC 1035 section 5) used by RPZ: $ORIGIN and $TTL,
+// comments, parentheses, and owners relative to the origin or omitted to reuse the previous one.
+func readZoneFile(configDirectory string, filename string) ([]rpzRecord, error) {
+	file, err := os.Open(filepath.Join(configDirectory, filename))
+	if err != nil {
+		return nil, &ConfigError{Filename: filename, Err: err}
+	}
+
+	errs := make([]error, 0)
+	records := make([]rpzRecord, 0)
+	origin := ""
+	owner := ""
+	pending := ""
+	pendingLine := 0
+
+	lineNumber := 0
+	sc := bufio.NewScanner(file)
+	for sc.Scan() {
+		lineNumber++
+		line, _, _ := strings.Cut(sc.Text(), ";")
+
+		if pending != "" || strings.Contains(line, "(") {
+			if pending == "" {
+				pendingLine = lineNumber
+			}
+			pending += " " + line
+			if !strings.Contains(line, ")") {
+				continue
+			}
+
+			line = strings.NewReplacer("(", " ", ")", " ").Replace(pending)
+			pending = ""
+		} else {
+			pendingLine = lineNumber
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "$ORIGIN":
+			if len(fields) != 2 || !strings.HasSuffix(fields[1], ".") {
+				errs = append(errs, newConfigError(filename, pendingLine, "expected '$ORIGIN <absolute name>'"))
+				continue
+			}
+			origin = strings.ToLower(fields[1])
+			continue
+		case "$TTL":
+			continue
+		}
+
+		if strings.HasPrefix(fields[0], "$") {
+			errs = append(errs, newConfigError(filename, pendingLine, "unsupported directive '%s'", fields[0]))
+			continue
+		}
+
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+			name, err := relativeToOrigin(strings.ToLower(fields[0]), origin)
+			if err != nil {
+				errs = append(errs, newConfigError(filename, pendingLine, "'%s': %s", fields[0], err.Error()))
+				owner = ""
+				continue
+			}
+
+			owner = name
+			fields = fields[1:]
+		}
+
+		// skip the optional TTL and class
+		for len(fields) > 0 && (fields[0] == "IN" || isZoneTTL(fields[0])) {
+			fields = fields[1:]
+		}
+
+		if len(fields) == 0 {
+			errs = append(errs, newConfigError(filename, pendingLine, "missing record type"))
+			continue
+		}
+
+		records = append(records, rpzRecord{
+			line:       pendingLine,
+			owner:      owner,
+			recordType: strings.ToUpper(fields[0]),
+			data:       fields[1:],
+		})
+	}
+
+	err = sc.Err()
+	closeErr := file.Close()
+	if err != nil || closeErr != nil {
+		return nil, &ConfigError{Filename: filename, Err: errors.Join(err, closeErr)}
+	}
+
+	if pending != "" {
+		errs = append(errs, newConfigError(filename, pendingLine, "unbalanced parentheses"))
+	}
+
+	return records, errors.Join(errs...)
+}
+
+func relativeToOrigin(name string, origin string) (string, error) {
+	if name == "@" {
+		return "", nil
+	}
+
+	if !strings.HasSuffix(name, ".") {
+		return name, nil
+	}
+
+	if origin == "" {
+		return "", fmt.Errorf("absolute name without $ORIGIN")
+	}
+
+	if name == origin {
+		return "", nil
+	}
+
+	relative, found := strings.CutSuffix(name, "."+origin)
+	if !found {
+		return "", fmt.Errorf("not in zone '%s'", origin)
+	}
+
+	return relative, nil
+}
+
+func isZoneTTL(s string) bool {
+	s = strings.TrimRight(strings.ToLower(s), "smhdw")
+	_, err := strconv.ParseUint(s, 10, 32)
+	return err == nil
+}
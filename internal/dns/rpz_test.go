@@ -0,0 +1,164 @@
+package dns
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRPZIPTrigger(t *testing.T) {
+	tests := map[string]string{
+		"32.1.2.0.192":        "192.0.2.1/32",
+		"24.0.2.0.192":        "192.0.2.0/24",
+		"48.zz.db8.2001":      "2001:db8::/48",
+		"128.1.zz.db8.2001":   "2001:db8::1/128",
+		"64.zz.1.zz.db8.2001": "",
+		"128.zz":              "::/128",
+		"24.1.2.0.192":        "",
+		"33.1.2.0.192":        "",
+		"x.1.2.0.192":         "",
+	}
+
+	for trigger, expected := range tests {
+		prefix, err := parseRPZIPTrigger(trigger)
+		if expected == "" {
+			if err == nil {
+				t.Errorf("'%s' should fail, got %s", trigger, prefix)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("'%s': %s", trigger, err)
+			continue
+		}
+
+		if prefix.String() != expected {
+			t.Errorf("'%s': expected %s, got %s", trigger, expected, prefix)
+		}
+	}
+}
+
+func writeRPZZone(t *testing.T, content string) string {
+	configDirectory := t.TempDir()
+	err := os.Mkdir(filepath.Join(configDirectory, configDirectoryRPZ), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(configDirectory, configDirectoryRPZ, "feed.rpz"), []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return configDirectory
+}
+
+func TestRPZ(t *testing.T) {
+	configDirectory := writeRPZZone(t, `$TTL 60
+$ORIGIN rpz.example.
+@ SOA localhost. root.localhost. (
+      1 3600 600 86400 60 )
+  NS localhost.
+bad.example.com      CNAME .        ; NXDOMAIN
+*.bad.example.com    CNAME .
+nodata.example.com   CNAME *.
+drop.example.com.rpz.example. 300 IN CNAME rpz-drop.
+local.example.com    A 192.0.2.10
+                     AAAA 2001:db8::10
+24.0.2.0.192.rpz-ip  CNAME *.
+`)
+
+	policy := Policy{
+		knownTLDs: map[string]struct{}{
+			"com": {},
+		},
+	}
+
+	zones, err := readRPZZones(configDirectory, configDirectoryRPZ, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.rpzZones = zones
+
+	tests := map[string]rpzAction{
+		"bad.example.com.":     rpzActionNXDomain,
+		"a.b.bad.example.com.": rpzActionNXDomain,
+		"nodata.example.com.":  rpzActionNoData,
+		"drop.example.com.":    rpzActionDrop,
+		"local.example.com.":   rpzActionLocalData,
+	}
+
+	for name, expected := range tests {
+		verdict, triggered := policy.rpzQuery(&Question{Name: name, Type: RecordTypeAAAA})
+		if !triggered {
+			t.Errorf("'%s' should trigger", name)
+			continue
+		}
+
+		if verdict.action != expected {
+			t.Errorf("'%s': expected %s, got %s", name, expected.Name(), verdict.action.Name())
+		}
+	}
+
+	_, triggered := policy.rpzQuery(&Question{Name: "example.com.", Type: RecordTypeA})
+	if triggered {
+		t.Errorf("should not trigger")
+	}
+
+	verdict, _ := policy.rpzQuery(&Question{Name: "local.example.com.", Type: RecordTypeAAAA})
+	if len(verdict.response.Answers) != 1 || verdict.response.Answers[0].IPv6.String() != "2001:db8::10" || verdict.response.Answers[0].Name != "local.example.com." {
+		t.Errorf("unexpected local-data %+v", verdict.response.Answers)
+	}
+
+	expectedReason := "rpz local-data due to QNAME trigger: local.example.com, rule 'local.example.com' rpz.d/feed.rpz:10"
+	if verdict.reason.String() != expectedReason {
+		t.Errorf("expected '%s', got '%s'", expectedReason, verdict.reason)
+	}
+
+	response := &Response{
+		Answers: []Answer{
+			{Name: "www.example.com.", Type: RecordTypeA, IPv4: net.IP{192, 0, 2, 1}},
+		},
+	}
+
+	verdict, triggered = policy.rpzResponse(&Question{Name: "www.example.com.", Type: RecordTypeA}, response)
+	if !triggered || verdict.action != rpzActionNoData {
+		t.Errorf("response IP should trigger NODATA")
+	}
+}
+
+func TestRPZErrors(t *testing.T) {
+	configDirectory := writeRPZZone(t, `bad.example.com CNAME other.example.com.
+ns.example.com.rpz-nsdname CNAME .
+conflict.example.com CNAME .
+conflict.example.com A 192.0.2.1
+absolute.example.com. CNAME .
+32.1.2.0.192.rpz-ip A 192.0.2.1
+$INCLUDE other
+`)
+
+	policy := Policy{
+		knownTLDs: map[string]struct{}{
+			"com": {},
+		},
+	}
+
+	_, err := readRPZZones(configDirectory, configDirectoryRPZ, policy)
+	if err == nil {
+		t.Fatalf("should fail")
+	}
+
+	expectedLines := []int{5, 7, 1, 2, 4, 6}
+	configErrors := ConfigErrors(err)
+	if len(configErrors) != len(expectedLines) {
+		t.Fatalf("expected %d errors, got %v", len(expectedLines), err)
+	}
+
+	for i, configError := range configErrors {
+		if configError.Line != expectedLines[i] {
+			t.Errorf("expected line %d, got '%s'", expectedLines[i], configError.Error())
+		}
+	}
+}
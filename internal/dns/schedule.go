@@ -0,0 +1,509 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+const configFilenameSchedules = "schedules"
+
+var scheduleNameRegex = regexp.MustCompile("^[a-z0-9][a-z0-9_-]*$")
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// schedule is a named set of time windows in the local time zone, used to make rules active only part of the time.
+type schedule struct {
+	name    string
+	windows []scheduleWindow
+}
+
+// scheduleWindow is either a weekly window, from start to end minutes on the given days, or an absolute window.
+// A weekly window with end before start ends on the next day.
+type scheduleWindow struct {
+	absolute bool
+	days     [7]bool
+	start    int
+	end      int
+	from     time.Time
+	to       time.Time
+}
+
+type scheduleSet struct {
+	byName map[string]*schedule
+	// rule file -> schedule name, for rule files where all rules are scheduled
+	files map[string]string
+}
+
+// scheduledRule is a rule kept out of the suffix tries and pattern lists, since it only applies while its schedule
+// is active.
+type scheduledRule struct {
+	kind          string
+	rule          string
+	regex         *regexp.Regexp
+	ruleFilenames []string
+	schedule      *schedule
+}
+
+// cutSchedule splits '<rule> @<schedule>' in a rule file.
+func cutSchedule(text string) (string, string) {
+	i := strings.LastIndex(text, " @")
+	if i < 0 {
+		return text, ""
+	}
+
+	return text[:i], text[i+2:]
+}
+
+func readSchedules(configDirectory string) (*scheduleSet, error) {
+	filename := configFilenameSchedules
+	lines, err := readOptionalConfig(configDirectory, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// load the time zone now rather than on first use, which can be after the system call filter is applied
+	_ = time.Local.String()
+
+	result := &scheduleSet{
+		byName: make(map[string]*schedule),
+		files:  make(map[string]string),
+	}
+
+	errs := make([]error, 0)
+	fileLines := make(map[string]int)
+	for _, line := range lines {
+		fields := strings.Fields(line.text)
+		if len(fields) < 2 {
+			errs = append(errs, newConfigError(filename, line.number, "expected '<name> [<days>] <HH:MM>-<HH:MM>', '<name> <start>/<end>' or 'file <rule file> <name>', got '%s'", line.text))
+			continue
+		}
+
+		if fields[0] == "file" {
+			if len(fields) != 3 {
+				errs = append(errs, newConfigError(filename, line.number, "expected 'file <rule file> <name>', got '%s'", line.text))
+				continue
+			}
+
+			ruleFilename := filepath.Clean(fields[1])
+			err := checkScheduledFile(configDirectory, ruleFilename)
+			if err != nil {
+				errs = append(errs, newConfigError(filename, line.number, "'%s': %s", fields[1], err.Error()))
+				continue
+			}
+
+			_, found := result.files[ruleFilename]
+			if found {
+				errs = append(errs, newConfigError(filename, line.number, "'%s' already has a schedule", fields[1]))
+				continue
+			}
+
+			result.files[ruleFilename] = fields[2]
+			fileLines[ruleFilename] = line.number
+			continue
+		}
+
+		name := fields[0]
+		if !scheduleNameRegex.MatchString(name) {
+			errs = append(errs, newConfigError(filename, line.number, "invalid schedule name '%s'", name))
+			continue
+		}
+
+		window, err := parseScheduleWindow(fields[1:])
+		if err != nil {
+			errs = append(errs, newConfigError(filename, line.number, "'%s': %s", strings.Join(fields[1:], " "), err.Error()))
+			continue
+		}
+
+		s, found := result.byName[name]
+		if !found {
+			s = &schedule{name: name}
+			result.byName[name] = s
+		}
+		s.windows = append(s.windows, window)
+	}
+
+	for ruleFilename, name := range result.files {
+		_, found := result.byName[name]
+		if !found {
+			errs = append(errs, newConfigError(filename, fileLines[ruleFilename], "unknown schedule '%s'", name))
+		}
+	}
+
+	return result, errors.Join(errs...)
+}
+
+// checkScheduledFile only accepts domain rule files, including imported lists and the rule files of client policies.
+func checkScheduledFile(configDirectory string, ruleFilename string) error {
+	ruleFilenames := []string{
+		configFilenameAllowExact, configFilenameDenyExact, configFilenameAllowTLDs, configFilenameDenyTLDs,
+		configFilenameAllowSuffixes, configFilenameDenySuffixes, configFilenameAllowWildcards,
+		configFilenameDenyWildcards, configFilenameAllowRegexes, configFilenameDenyRegexes,
+	}
+
+	directory := filepath.Base(filepath.Dir(ruleFilename))
+	if !slices.Contains(ruleFilenames, filepath.Base(ruleFilename)) && directory != configDirectoryAllowImports && directory != configDirectoryDenyImports {
+		return fmt.Errorf("not a domain rule file")
+	}
+
+	info, err := os.Stat(filepath.Join(configDirectory, ruleFilename))
+	if err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("not a regular file")
+	}
+
+	return nil
+}
+
+// parseScheduleWindow parses '[<days>] <HH:MM>-<HH:MM>', where days is e.g. 'mon-fri' or 'sat,sun' and defaults to
+// every day, or '<YYYY-MM-DDTHH:MM>/<YYYY-MM-DDTHH:MM>'.
+func parseScheduleWindow(fields []string) (scheduleWindow, error) {
+	if len(fields) == 1 && strings.Contains(fields[0], "/") {
+		fromString, toString, _ := strings.Cut(fields[0], "/")
+		from, err := time.ParseInLocation("2006-01-02T15:04", fromString, time.Local)
+		if err != nil {
+			return scheduleWindow{}, fmt.Errorf("invalid start '%s'", fromString)
+		}
+
+		to, err := time.ParseInLocation("2006-01-02T15:04", toString, time.Local)
+		if err != nil {
+			return scheduleWindow{}, fmt.Errorf("invalid end '%s'", toString)
+		}
+
+		if !from.Before(to) {
+			return scheduleWindow{}, fmt.Errorf("start is not before end")
+		}
+
+		return scheduleWindow{absolute: true, from: from, to: to}, nil
+	}
+
+	if len(fields) > 2 {
+		return scheduleWindow{}, fmt.Errorf("too many fields")
+	}
+
+	window := scheduleWindow{}
+	for i := range window.days {
+		window.days[i] = true
+	}
+
+	if len(fields) == 2 {
+		days, err := parseWeekdays(fields[0])
+		if err != nil {
+			return scheduleWindow{}, err
+		}
+		window.days = days
+	}
+
+	startString, endString, found := strings.Cut(fields[len(fields)-1], "-")
+	if !found {
+		return scheduleWindow{}, fmt.Errorf("expected '<HH:MM>-<HH:MM>'")
+	}
+
+	var err error
+	window.start, err = parseMinuteOfDay(startString)
+	if err != nil {
+		return scheduleWindow{}, err
+	}
+
+	window.end, err = parseMinuteOfDay(endString)
+	if err != nil {
+		return scheduleWindow{}, err
+	}
+
+	if window.start == window.end || window.start == 24*60 {
+		return scheduleWindow{}, fmt.Errorf("empty window")
+	}
+
+	return window, nil
+}
+
+func parseWeekdays(s string) ([7]bool, error) {
+	var days [7]bool
+	for _, part := range strings.Split(s, ",") {
+		firstString, lastString, isRange := strings.Cut(part, "-")
+		if !isRange {
+			lastString = firstString
+		}
+
+		first := slices.Index(weekdays, firstString)
+		if first < 0 {
+			return days, fmt.Errorf("invalid day '%s'", firstString)
+		}
+
+		last := slices.Index(weekdays, lastString)
+		if last < 0 {
+			return days, fmt.Errorf("invalid day '%s'", lastString)
+		}
+
+		// ranges can wrap around the end of the week, e.g. 'fri-mon'
+		for i := first; ; i = (i + 1) % 7 {
+			days[i] = true
+			if i == last {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+// parseMinuteOfDay parses HH:MM, where 24:00 is the end of the day.
+func parseMinuteOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err == nil {
+		return t.Hour()*60 + t.Minute(), nil
+	}
+
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+
+	return 0, fmt.Errorf("invalid time '%s'", s)
+}
+
+func (s *schedule) active(now time.Time) bool {
+	for _, window := range s.windows {
+		if window.active(now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nextChange returns the first time after now where the schedule can become active or inactive.
+func (s *schedule) nextChange(now time.Time) (time.Time, bool) {
+	var next time.Time
+	found := false
+	for _, window := range s.windows {
+		change, ok := window.nextChange(now)
+		if ok && (!found || change.Before(next)) {
+			next = change
+			found = true
+		}
+	}
+
+	return next, found
+}
+
+func (w *scheduleWindow) active(now time.Time) bool {
+	if w.absolute {
+		return !now.Before(w.from) && now.Before(w.to)
+	}
+
+	t := now.In(time.Local)
+	minute := t.Hour()*60 + t.Minute()
+	weekday := int(t.Weekday())
+	if w.start < w.end {
+		return w.days[weekday] && minute >= w.start && minute < w.end
+	}
+
+	return (w.days[weekday] && minute >= w.start) || (w.days[(weekday+6)%7] && minute < w.end)
+}
+
+func (w *scheduleWindow) nextChange(now time.Time) (time.Time, bool) {
+	if w.absolute {
+		if now.Before(w.from) {
+			return w.from, true
+		}
+
+		if now.Before(w.to) {
+			return w.to, true
+		}
+
+		return time.Time{}, false
+	}
+
+	t := now.In(time.Local)
+	var next time.Time
+	found := false
+	for i := -1; i <= 7; i++ {
+		day := time.Date(t.Year(), t.Month(), t.Day()+i, 0, 0, 0, 0, time.Local)
+		if !w.days[day.Weekday()] {
+			continue
+		}
+
+		endDay := t.Day() + i
+		if w.end < w.start {
+			endDay++
+		}
+
+		start := time.Date(t.Year(), t.Month(), t.Day()+i, w.start/60, w.start%60, 0, 0, time.Local)
+		end := time.Date(t.Year(), t.Month(), endDay, w.end/60, w.end%60, 0, 0, time.Local)
+		for _, change := range []time.Time{start, end} {
+			if change.After(now) && (!found || change.Before(next)) {
+				next = change
+				found = true
+			}
+		}
+	}
+
+	return next, found
+}
+
+// applyFileSchedules schedules every rule read from a rule file with a schedule, unless the rule has its own.
+func (s *scheduleSet) applyFileSchedules(sources ruleSources) {
+	for _, rules := range sources {
+		for rule, source := range rules {
+			name, found := s.files[source.filename]
+			if found && source.schedule == "" {
+				source.schedule = name
+				rules[rule] = source
+			}
+		}
+	}
+}
+
+// partitionDomains splits exact rules or suffixes into the rules that always apply and the scheduled rules.
+func (s *scheduleSet) partitionDomains(rules []string, kind string, ruleFilename string, sources ruleSources) ([]string, []scheduledRule, error) {
+	unscheduled := make([]string, 0)
+	scheduled := make([]scheduledRule, 0)
+	errs := make([]error, 0)
+	for _, rule := range rules {
+		source := sources[filepath.Base(ruleFilename)][rule]
+		if source.schedule == "" {
+			unscheduled = append(unscheduled, rule)
+			continue
+		}
+
+		sch, found := s.byName[source.schedule]
+		if !found {
+			errs = append(errs, newConfigError(source.filename, source.line, "unknown schedule '%s'", source.schedule))
+			continue
+		}
+
+		scheduled = append(scheduled, scheduledRule{
+			kind:          kind,
+			rule:          rule,
+			ruleFilenames: []string{ruleFilename},
+			schedule:      sch,
+		})
+	}
+
+	return unscheduled, scheduled, errors.Join(errs...)
+}
+
+// partitionPatterns splits wildcards or regular expressions into the rules that always apply and the scheduled rules.
+func (s *scheduleSet) partitionPatterns(patterns []domainPattern, kind string, ruleFilename string, sources ruleSources) ([]domainPattern, []scheduledRule, error) {
+	unscheduled := make([]domainPattern, 0)
+	scheduled := make([]scheduledRule, 0)
+	errs := make([]error, 0)
+	for _, pattern := range patterns {
+		source := sources[filepath.Base(ruleFilename)][pattern.rule]
+		if source.schedule == "" {
+			unscheduled = append(unscheduled, pattern)
+			continue
+		}
+
+		sch, found := s.byName[source.schedule]
+		if !found {
+			errs = append(errs, newConfigError(source.filename, source.line, "unknown schedule '%s'", source.schedule))
+			continue
+		}
+
+		scheduled = append(scheduled, scheduledRule{
+			kind:          kind,
+			rule:          pattern.rule,
+			regex:         pattern.regex,
+			ruleFilenames: []string{ruleFilename},
+			schedule:      sch,
+		})
+	}
+
+	return unscheduled, scheduled, errors.Join(errs...)
+}
+
+func (r *scheduledRule) matches(domain string) bool {
+	switch r.kind {
+	case "exact":
+		return domain == r.rule
+	case "suffix":
+		return strings.HasSuffix(domain, r.rule)
+	default:
+		return r.regex.MatchString(domain)
+	}
+}
+
+func matchScheduledRules(rules []scheduledRule, domain string, now time.Time) (*scheduledRule, bool) {
+	for i := range rules {
+		if rules[i].matches(domain) && rules[i].schedule.active(now) {
+			return &rules[i], true
+		}
+	}
+
+	return nil, false
+}
+
+// SetClock replaces the clock used to evaluate schedules, for the policy and its client policies.
+func (p *Policy) SetClock(clock func() time.Time) {
+	p.clock = clock
+	for _, clientPolicy := range p.clientPolicies {
+		clientPolicy.policy.clock = clock
+	}
+}
+
+func (p *Policy) now() time.Time {
+	if p.clock == nil {
+		return time.Now()
+	}
+
+	return p.clock()
+}
+
+// scheduleTTL returns the largest TTL that does not let a response be cached past the next change of a schedule of a
+// rule matching one of the names in the question or response.
+func (p *Policy) scheduleTTL(question *Question, response *Response) (uint32, bool) {
+	names := []string{question.Name}
+	if response != nil {
+		for _, answer := range response.Answers {
+			names = append(names, answer.Name)
+			if answer.Type == RecordTypeCNAME {
+				names = append(names, answer.CNAME)
+			}
+		}
+	}
+
+	now := p.now()
+	var next time.Time
+	found := false
+	for _, rules := range [][]scheduledRule{p.scheduledBlock, p.scheduledAllow} {
+		for i := range rules {
+			matched := false
+			for _, name := range names {
+				if rules[i].matches(strings.TrimSuffix(name, ".")) {
+					matched = true
+					break
+				}
+			}
+
+			if !matched {
+				continue
+			}
+
+			change, ok := rules[i].schedule.nextChange(now)
+			if ok && (!found || change.Before(next)) {
+				next = change
+				found = true
+			}
+		}
+	}
+
+	if !found {
+		return 0, false
+	}
+
+	seconds := math.Ceil(next.Sub(now).Seconds())
+	if seconds > math.MaxUint32 {
+		return math.MaxUint32, true
+	}
+
+	return uint32(seconds), true
+}
@@ -0,0 +1,207 @@
+package dns
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleWindow(t *testing.T) {
+	// 2026-10-19 is a Monday
+	monday := func(hour int, minute int) time.Time {
+		return time.Date(2026, 10, 19, hour, minute, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		expression string
+		now        time.Time
+		active     bool
+		next       time.Time
+	}{
+		{"mon-fri 18:00-23:00", monday(17, 59), false, monday(18, 0)},
+		{"mon-fri 18:00-23:00", monday(18, 0), true, monday(23, 0)},
+		{"mon-fri 18:00-23:00", monday(23, 0), false, monday(42, 0)},
+		{"sat,sun 18:00-23:00", monday(19, 0), false, monday(5*24+18, 0)},
+		{"22:00-06:00", monday(23, 0), true, monday(30, 0)},
+		{"22:00-06:00", monday(5, 0), true, monday(6, 0)},
+		{"sun 22:00-06:00", monday(5, 0), true, monday(6, 0)},
+		{"mon 22:00-06:00", monday(5, 0), false, monday(22, 0)},
+		{"fri-mon 00:00-24:00", monday(12, 0), true, monday(24, 0)},
+		{"2026-10-19T10:00/2026-10-19T12:30", monday(11, 0), true, monday(12, 30)},
+		{"2026-10-19T10:00/2026-10-19T12:30", monday(9, 0), false, monday(10, 0)},
+	}
+
+	for _, test := range tests {
+		window, err := parseScheduleWindow(strings.Fields(test.expression))
+		if err != nil {
+			t.Fatalf("%s: %s", test.expression, err.Error())
+		}
+
+		if window.active(test.now) != test.active {
+			t.Errorf("%s at %s: expected active %t", test.expression, test.now, test.active)
+		}
+
+		next, found := window.nextChange(test.now)
+		if !found || !next.Equal(test.next) {
+			t.Errorf("%s at %s: expected next change %s, got %s", test.expression, test.now, test.next, next)
+		}
+	}
+
+	window, err := parseScheduleWindow(strings.Fields("2026-10-19T10:00/2026-10-19T12:30"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, found := window.nextChange(monday(13, 0))
+	if found {
+		t.Errorf("expected no change after the end of an absolute window")
+	}
+
+	invalid := []string{"mon-fri", "18:00-18:00", "24:00-06:00", "mon-xyz 18:00-23:00", "18:00-25:00", "2026-10-19T12:00/2026-10-19T10:00", "mon 1 18:00-23:00"}
+	for _, expression := range invalid {
+		_, err := parseScheduleWindow(strings.Fields(expression))
+		if err == nil {
+			t.Errorf("%s: should fail", expression)
+		}
+	}
+}
+
+func TestScheduledRules(t *testing.T) {
+	configDirectory := t.TempDir()
+	writeRuleFiles(t, configDirectory, map[string]string{
+		configFilenameKnownTLDs:     ".com\n",
+		configFilenameAllowSuffixes: ".example.com\n.streaming.com @evening\n",
+		configFilenameDenyExact:     "www.example.com @maintenance\n",
+		configFilenameSchedules:     "evening mon-fri 18:00-23:00\nmaintenance 2026-10-20T22:00/2026-10-21T02:00\nfile allow.d/video.hosts evening\n",
+	})
+
+	err := os.Mkdir(filepath.Join(configDirectory, configDirectoryAllowImports), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(configDirectory, configDirectoryAllowImports, "video.hosts"), []byte("0.0.0.0 video.com\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := NewPolicy(configDirectory, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		now      time.Time
+		domain   string
+		expected bool
+	}{
+		{time.Date(2026, 10, 19, 12, 0, 0, 0, time.Local), "a.streaming.com.", false},
+		{time.Date(2026, 10, 19, 12, 0, 0, 0, time.Local), "video.com.", false},
+		{time.Date(2026, 10, 19, 12, 0, 0, 0, time.Local), "www.example.com.", true},
+		{time.Date(2026, 10, 19, 19, 0, 0, 0, time.Local), "a.streaming.com.", true},
+		{time.Date(2026, 10, 19, 19, 0, 0, 0, time.Local), "video.com.", true},
+		{time.Date(2026, 10, 20, 23, 0, 0, 0, time.Local), "www.example.com.", false},
+		{time.Date(2026, 10, 20, 23, 0, 0, 0, time.Local), "mail.example.com.", true},
+	}
+
+	for _, test := range tests {
+		policy.clock = func() time.Time {
+			return test.now
+		}
+
+		allowed, reason := policy.domainIsAllowed(test.domain)
+		if allowed != test.expected {
+			t.Errorf("%s at %s: expected %t, got %t: %s", test.domain, test.now, test.expected, allowed, reason)
+		}
+	}
+
+	policy.clock = func() time.Time {
+		return time.Date(2026, 10, 19, 19, 0, 0, 0, time.Local)
+	}
+
+	_, reason := policy.domainIsAllowed("a.streaming.com.")
+	expectedReason := "allow due to suffix allowlist: a.streaming.com, rule '.streaming.com' allow.suffix:2, schedule evening"
+	if reason.String() != expectedReason {
+		t.Errorf("expected '%s', got '%s'", expectedReason, reason)
+	}
+
+	question := &Question{Name: "a.streaming.com.", Type: RecordTypeA, Class: ClassTypeIN}
+	ttl, scheduled := policy.scheduleTTL(question, nil)
+	if !scheduled || ttl != 4*3600 {
+		t.Errorf("expected TTL %d, got %d", 4*3600, ttl)
+	}
+
+	question = &Question{Name: "cdn.example.com.", Type: RecordTypeA, Class: ClassTypeIN}
+	response := &Response{
+		Answers: []Answer{
+			{Name: "cdn.example.com.", Type: RecordTypeCNAME, CNAME: "www.example.com."},
+		},
+	}
+	policy.clock = func() time.Time {
+		return time.Date(2026, 10, 20, 21, 0, 0, 0, time.Local)
+	}
+
+	ttl, scheduled = policy.scheduleTTL(question, response)
+	if !scheduled || ttl != 3600 {
+		t.Errorf("expected TTL %d, got %d", 3600, ttl)
+	}
+
+	_, scheduled = policy.scheduleTTL(question, nil)
+	if scheduled {
+		t.Errorf("expected no schedule for %s", question.Name)
+	}
+}
+
+func TestScheduleErrors(t *testing.T) {
+	configDirectory := t.TempDir()
+	writeRuleFiles(t, configDirectory, map[string]string{
+		configFilenameKnownTLDs:     ".com\n",
+		configFilenameAllowSuffixes: ".streaming.com @evening\n",
+		configFilenameSchedules:     "night 22:00\nNight 22:00-06:00\nfile allow.ipv4 night\nfile allow.exact evening\n",
+	})
+
+	_, err := NewPolicy(configDirectory, false, false)
+	if err == nil {
+		t.Fatalf("should fail")
+	}
+
+	expected := []string{
+		"schedules:1: '22:00': expected '<HH:MM>-<HH:MM>'",
+		"schedules:2: invalid schedule name 'Night'",
+		"schedules:3: 'allow.ipv4': not a domain rule file",
+		"schedules:4: unknown schedule 'evening'",
+		"allow.suffix:1: unknown schedule 'evening'",
+	}
+
+	configErrors := ConfigErrors(err)
+	if len(configErrors) != len(expected) {
+		t.Fatalf("expected %d errors, got %d: %v", len(expected), len(configErrors), err)
+	}
+
+	for i, e := range expected {
+		if configErrors[i].Error() != e {
+			t.Errorf("expected '%s', got '%s'", e, configErrors[i].Error())
+		}
+	}
+}
+
+func TestMissingSchedules(t *testing.T) {
+	// a config directory from before schedules
+	configDirectory := t.TempDir()
+	writeRuleFiles(t, configDirectory, map[string]string{
+		configFilenameKnownTLDs:     ".com\n",
+		configFilenameAllowSuffixes: ".example.com\n",
+	})
+
+	policy, err := NewPolicy(configDirectory, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed, _ := policy.domainIsAllowed("www.example.com.")
+	if !allowed {
+		t.Errorf("expected www.example.com to be allowed")
+	}
+}
@@ -0,0 +1,171 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// With Type=notify, systemd is told on NOTIFY_SOCKET when netfoil is ready, its status, and with WatchdogSec= that it
+// is not wedged (see man sd_notify). A watchdog ping is only sent while the workers finish queries, or none is in
+// flight or waiting in the queues, so systemd restarts netfoil when the workers or the result loop are stuck. Queries
+// shed or answered from the cache by the UDP reader are not progress.
+
+const (
+	systemdStatusEvery = 10 * time.Second
+)
+
+type SystemdNotify struct {
+	conn     *net.UnixConn
+	watchdog time.Duration
+
+	inFlight    atomic.Int64
+	handled     atomic.Uint64
+	lastHandled uint64
+}
+
+// NewSystemdNotify connects to NOTIFY_SOCKET, or returns nil when netfoil is not started by systemd with Type=notify.
+// The socket is connected before the system call filter is applied, which only allows writing to it.
+func NewSystemdNotify() (*SystemdNotify, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil, nil
+	}
+
+	// an abstract socket starts with @, as in Go
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("systemd notify socket %s: %w", path, err)
+	}
+
+	watchdog, err := systemdWatchdog(os.Getenv("WATCHDOG_USEC"), os.Getenv("WATCHDOG_PID"), os.Getpid())
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return &SystemdNotify{conn: conn, watchdog: watchdog}, nil
+}
+
+// systemdWatchdog returns the watchdog timeout of WatchdogSec=, or 0 when there is none or it is meant for another
+// process.
+func systemdWatchdog(usec string, watchdogPID string, pid int) (time.Duration, error) {
+	if usec == "" {
+		return 0, nil
+	}
+
+	if watchdogPID != "" && watchdogPID != strconv.Itoa(pid) {
+		return 0, nil
+	}
+
+	v, err := strconv.ParseUint(usec, 10, 63)
+	if err != nil || v == 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC '%s'", usec)
+	}
+
+	return time.Duration(v) * time.Microsecond, nil
+}
+
+// start tells systemd that netfoil is ready, and then sends the status and watchdog pings until ctx is done. pending
+// returns the number of tasks and results waiting in the queues.
+func (s *SystemdNotify) start(ctx context.Context, m *metrics, pending func() int) {
+	if s == nil {
+		return
+	}
+
+	err := s.send("READY=1\n" + s.status(m))
+	if err != nil {
+		slog.Warn("failed to notify systemd", "error", err.Error())
+	}
+
+	every := systemdStatusEvery
+	if s.watchdog > 0 {
+		// as recommended by man sd_watchdog_enabled
+		every = min(every, s.watchdog/2)
+	}
+
+	go func() {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := s.tick(m, pending())
+				if err != nil {
+					slog.Warn("failed to notify systemd", "error", err.Error())
+				}
+			}
+		}
+	}()
+}
+
+// stopping tells systemd that netfoil is shutting down, before the queries in flight are finished.
+func (s *SystemdNotify) stopping() {
+	if s == nil {
+		return
+	}
+
+	err := s.send("STOPPING=1\nSTATUS=shutting down")
+	if err != nil {
+		slog.Warn("failed to notify systemd", "error", err.Error())
+	}
+}
+
+// begin counts a query a worker started to process.
+func (s *SystemdNotify) begin() {
+	if s == nil {
+		return
+	}
+
+	s.inFlight.Add(1)
+}
+
+// finish counts a query a worker finished to process.
+func (s *SystemdNotify) finish() {
+	if s == nil {
+		return
+	}
+
+	s.inFlight.Add(-1)
+	s.handled.Add(1)
+}
+
+// tick sends the status, with a watchdog ping when the workers finished queries since the last tick, or no query is
+// in flight or pending.
+func (s *SystemdNotify) tick(m *metrics, pending int) error {
+	handled := s.handled.Load()
+	progressing := handled != s.lastHandled || (s.inFlight.Load() == 0 && pending == 0)
+	s.lastHandled = handled
+
+	state := s.status(m)
+	if s.watchdog > 0 && progressing {
+		state = "WATCHDOG=1\n" + state
+	}
+
+	return s.send(state)
+}
+
+// status returns the STATUS= line shown by systemctl status.
+func (s *SystemdNotify) status(m *metrics) string {
+	return fmt.Sprintf("STATUS=%d queries, %d denied, %d cache hits, %d upstream, %d shed, %d errors",
+		m.queries.Load(),
+		m.denied.Load(),
+		m.cacheHits.Load(),
+		m.externalRequests.Load(),
+		m.shedUDP.Load()+m.shedTCP.Load(),
+		m.errors.Load(),
+	)
+}
+
+func (s *SystemdNotify) send(state string) error {
+	_, err := s.conn.Write([]byte(state))
+	return err
+}
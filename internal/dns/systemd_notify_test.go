@@ -0,0 +1,124 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSystemdWatchdog(t *testing.T) {
+	watchdog, err := systemdWatchdog("30000000", "", 4711)
+	if err != nil || watchdog != 30*time.Second {
+		t.Errorf("expected 30s, got %s %v", watchdog, err)
+	}
+
+	watchdog, err = systemdWatchdog("30000000", "1", 4711)
+	if err != nil || watchdog != 0 {
+		t.Errorf("expected no watchdog for another process, got %s %v", watchdog, err)
+	}
+
+	watchdog, err = systemdWatchdog("", "", 4711)
+	if err != nil || watchdog != 0 {
+		t.Errorf("expected no watchdog, got %s %v", watchdog, err)
+	}
+
+	_, err = systemdWatchdog("soon", "", 4711)
+	if err == nil {
+		t.Errorf("expected an error for an invalid WATCHDOG_USEC")
+	}
+}
+
+func TestSystemdNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	t.Setenv("WATCHDOG_USEC", "2000000")
+	t.Setenv("WATCHDOG_PID", "")
+
+	systemd, err := NewSystemdNotify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receive := func() string {
+		err := listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 1024)
+		n, err := listener.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return string(buf[:n])
+	}
+
+	m := newMetrics()
+	m.queries.Store(12)
+	m.denied.Store(3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	systemd.start(ctx, m, func() int { return 0 })
+
+	expected := "READY=1\nSTATUS=12 queries, 3 denied, 0 cache hits, 0 upstream, 0 shed, 0 errors"
+	state := receive()
+	if state != expected {
+		t.Errorf("expected '%s', got '%s'", expected, state)
+	}
+
+	// idle, so the pipeline is not stuck
+	state = receive()
+	if !strings.HasPrefix(state, "WATCHDOG=1\nSTATUS=") {
+		t.Errorf("expected a watchdog ping, got '%s'", state)
+	}
+
+	cancel()
+	systemd.stopping()
+	for !strings.HasPrefix(state, "STOPPING=1") {
+		state = receive()
+	}
+
+	// tasks wait, but no worker finished a query since the last tick
+	err = systemd.tick(m, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state = receive()
+	if strings.Contains(state, "WATCHDOG=1") {
+		t.Errorf("expected no watchdog ping while stuck, got '%s'", state)
+	}
+
+	// the queues are empty, but a worker hangs on its query
+	systemd.begin()
+	err = systemd.tick(m, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state = receive()
+	if strings.Contains(state, "WATCHDOG=1") {
+		t.Errorf("expected no watchdog ping while a query hangs, got '%s'", state)
+	}
+
+	systemd.finish()
+	err = systemd.tick(m, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state = receive()
+	if !strings.HasPrefix(state, "WATCHDOG=1\n") {
+		t.Errorf("expected a watchdog ping after progress, got '%s'", state)
+	}
+}
@@ -81,3 +81,22 @@ func (c *Cache[T]) Size() int64 {
 func (c *Cache[T]) Capacity() int64 {
 	return c.capacity.Load()
 }
+
+// DeleteFunc removes all entries with a key for which del returns true, and returns the number of removed entries.
+func (c *Cache[T]) DeleteFunc(del func(key string) bool) int {
+	c.mutex.Lock()
+
+	deleted := 0
+	for key, e := range c.m {
+		if del(key) {
+			delete(c.m, key)
+			c.list.Remove(e)
+			c.size.Add(-1)
+			deleted++
+		}
+	}
+
+	c.mutex.Unlock()
+
+	return deleted
+}
@@ -84,3 +84,42 @@ func TestLRU(t *testing.T) {
 		t.Errorf("expected 4, got %s", *v3)
 	}
 }
+
+func TestDeleteFunc(t *testing.T) {
+	lru := NewCache[string](4)
+
+	for _, key := range []string{"a:1", "a:28", "b:1"} {
+		value := key
+		lru.Set(key, &value)
+	}
+
+	deleted := lru.DeleteFunc(func(key string) bool {
+		return key[0] == 'a'
+	})
+
+	if deleted != 2 {
+		t.Errorf("expected 2 deleted, got %d", deleted)
+	}
+
+	if lru.Size() != 1 {
+		t.Errorf("LRU size should be 1, got %d", lru.Size())
+	}
+
+	_, ok := lru.Get("a:1")
+	if ok {
+		t.Error("LRU should not contain a:1")
+	}
+
+	_, ok = lru.Get("b:1")
+	if !ok {
+		t.Error("LRU should contain b:1")
+	}
+
+	lru.Set("c:1", nil)
+	lru.Set("d:1", nil)
+	lru.Set("e:1", nil)
+	lru.Set("f:1", nil)
+	if lru.Size() != 4 {
+		t.Errorf("LRU size should be 4, got %d", lru.Size())
+	}
+}
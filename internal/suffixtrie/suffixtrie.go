@@ -64,26 +64,32 @@ func (st *Node) MatchExact(word []byte) bool {
 }
 
 func (st *Node) MatchSuffix(word []byte) bool {
+	_, found := st.FindSuffix(word)
+	return found
+}
+
+// FindSuffix returns the index in word where the shortest matching suffix starts.
+func (st *Node) FindSuffix(word []byte) (int, bool) {
 	if len(word) == 0 {
-		return false
+		return 0, false
 	}
 
 	current := st
 	for i := len(word) - 1; i > 0; i-- {
 		c := word[i]
 		if c > 127 {
-			return false
+			return 0, false
 		}
 
 		if current.next[c] == nil {
-			return false
+			return 0, false
 		}
 		current = current.next[c]
 
 		if current.match {
-			return true
+			return i, true
 		}
 	}
 
-	return false
+	return 0, false
 }
@@ -111,3 +111,37 @@ func TestSuffix(t *testing.T) {
 		t.Errorf("should not match")
 	}
 }
+
+func TestFindSuffix(t *testing.T) {
+	s := Node{}
+
+	err := s.InsertMultiple([]string{".com", ".example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	word := []byte("www.example.org")
+	i, found := s.FindSuffix(word)
+	if !found {
+		t.Fatalf("should match")
+	}
+
+	if string(word[i:]) != ".example.org" {
+		t.Errorf("expected '.example.org', got '%s'", word[i:])
+	}
+
+	word = []byte("a.b.com")
+	i, found = s.FindSuffix(word)
+	if !found {
+		t.Fatalf("should match")
+	}
+
+	if string(word[i:]) != ".com" {
+		t.Errorf("expected '.com', got '%s'", word[i:])
+	}
+
+	_, found = s.FindSuffix([]byte("example.org"))
+	if found {
+		t.Errorf("should not match")
+	}
+}